@@ -0,0 +1,112 @@
+package blockpage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	// leafValidity is lifetime of issued certificates. They are reissued
+	// once less than leafRenewBefore is left.
+	leafValidity    = 7 * 24 * time.Hour
+	leafRenewBefore = 24 * time.Hour
+	// leafCacheSize limits number of cached certificates.
+	leafCacheSize = 1024
+)
+
+// CA issues certificates for blocked domains, so clients trusting it see
+// block page over HTTPS instead of connection error.
+type CA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// leafKey is shared by all issued certificates.
+	leafKey *ecdsa.PrivateKey
+
+	mux   sync.Mutex
+	cache map[string]*tls.Certificate
+}
+
+// LoadCA reads PEM-encoded CA certificate and its private key.
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't load CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("can't parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key type")
+	}
+	return newCA(cert, key)
+}
+
+func newCA(cert *x509.Certificate, key crypto.Signer) (*CA, error) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't generate certificate key: %w", err)
+	}
+	return &CA{
+		cert:    cert,
+		key:     key,
+		leafKey: leafKey,
+		cache:   make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// certificate returns certificate for domain name, issuing it if needed.
+func (ca *CA) certificate(name string) (*tls.Certificate, error) {
+	now := time.Now()
+	ca.mux.Lock()
+	defer ca.mux.Unlock()
+	if cert, ok := ca.cache[name]; ok && cert.Leaf.NotAfter.Sub(now) > leafRenewBefore {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("can't issue certificate for %s: %w", name, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}
+	if len(ca.cache) >= leafCacheSize {
+		ca.cache = make(map[string]*tls.Certificate)
+	}
+	ca.cache[name] = cert
+	return cert, nil
+}
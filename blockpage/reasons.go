@@ -0,0 +1,82 @@
+// Package blockpage serves pages explaining why domain was blocked to
+// clients connecting to it.
+package blockpage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// reasonTTL is how long reason of block is kept after domain was last
+// blocked.
+const reasonTTL = 24 * time.Hour
+
+type reasonKey struct {
+	client clientkey.Key
+	domain string
+}
+
+type reasonEntry struct {
+	reason string
+	seen   time.Time
+}
+
+// Reasons remembers why domains were blocked for clients. Nil Reasons
+// remembers nothing.
+type Reasons struct {
+	now func() time.Time
+
+	mux       sync.Mutex
+	entries   map[reasonKey]reasonEntry
+	lastPurge time.Time
+}
+
+func NewReasons() *Reasons {
+	return &Reasons{
+		now:     time.Now,
+		entries: make(map[reasonKey]reasonEntry),
+	}
+}
+
+// RecordBlock stores reason of domain block for client.
+func (r *Reasons) RecordBlock(clientKey clientkey.Key, domainName, reason string) {
+	if r == nil {
+		return
+	}
+	now := r.now()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if now.Sub(r.lastPurge) > time.Minute {
+		for key, entry := range r.entries {
+			if now.Sub(entry.seen) > reasonTTL {
+				delete(r.entries, key)
+			}
+		}
+		r.lastPurge = now
+	}
+	r.entries[reasonKey{clientKey, domainName}] = reasonEntry{reason, now}
+}
+
+// Lookup returns reason of domain block for client. It's empty if reason
+// is unknown.
+func (r *Reasons) Lookup(clientKey clientkey.Key, domainName string) string {
+	reason, _ := r.lookup(clientKey, domainName)
+	return reason
+}
+
+// lookup returns reason of domain block for client and whether block was
+// recorded at all.
+func (r *Reasons) lookup(clientKey clientkey.Key, domainName string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	entry, ok := r.entries[reasonKey{clientKey, domainName}]
+	if !ok || r.now().Sub(entry.seen) > reasonTTL {
+		return "", false
+	}
+	return entry.reason, true
+}
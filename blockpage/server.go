@@ -0,0 +1,119 @@
+package blockpage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// serveTimeout bounds time spent on one client connection.
+const serveTimeout = 10 * time.Second
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Blocked: {{.Domain}}</title>
+</head>
+<body>
+<h1>Access to {{.Domain}} is blocked</h1>
+<p>This domain was blocked by DNS policy of your network.</p>
+{{if .Reason}}<p>Reason: <code>{{.Reason}}</code></p>
+{{end}}<p>Contact your network administrator if you think this is a mistake.</p>
+</body>
+</html>
+`))
+
+// Server answers HTTP requests to blocked domains with block page. HTTPS
+// requests are answered only if CA is set, and clients have to trust CA
+// to see the page.
+type Server struct {
+	reasons *Reasons
+	ca      *CA
+}
+
+// New returns Server explaining blocks with reasons. ca may be nil.
+func New(reasons *Reasons, ca *CA) *Server {
+	return &Server{
+		reasons: reasons,
+		ca:      ca,
+	}
+}
+
+// ServeBlocked answers connection of client to blocked domain on given
+// port with block page. Connections to ports other than 80 and 443 are
+// left untouched.
+func (s *Server) ServeBlocked(conn net.Conn, clientKey clientkey.Key, domainName string, port uint16) {
+	switch {
+	case port == 80:
+	case port == 443 && s.ca != nil:
+		tlsConn := tls.Server(conn, &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return s.certificate(hello.ServerName, clientKey, domainName)
+			},
+		})
+		defer tlsConn.Close()
+		conn = tlsConn
+	default:
+		return
+	}
+	conn.SetDeadline(time.Now().Add(serveTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("block page: can't read request: %v", err)
+		}
+		return
+	}
+	req.Body.Close()
+	if err := s.page(clientKey, domainName).Write(conn); err != nil {
+		log.Printf("block page: can't write response: %v", err)
+	}
+}
+
+// certificate issues certificate for name client asked for. Only the
+// domain sinkholed address belongs to is certified, and only once its
+// block was recorded for client, so clients can't get trusted
+// certificates for arbitrary names.
+func (s *Server) certificate(name string, clientKey clientkey.Key, domainName string) (*tls.Certificate, error) {
+	if name == "" {
+		name = domainName
+	}
+	if name = strings.TrimSuffix(strings.ToLower(name), "."); name != domainName {
+		return nil, fmt.Errorf("certificate for %q refused: connection is to blocked domain %q", name, domainName)
+	}
+	if _, blocked := s.reasons.lookup(clientKey, domainName); !blocked {
+		return nil, fmt.Errorf("certificate for %q refused: no block of it is recorded for client", name)
+	}
+	return s.ca.certificate(name)
+}
+
+func (s *Server) page(clientKey clientkey.Key, domainName string) *http.Response {
+	var body bytes.Buffer
+	pageTemplate.Execute(&body, struct {
+		Domain string
+		Reason string
+	}{domainName, s.reasons.Lookup(clientKey, domainName)})
+	header := make(http.Header)
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	return &http.Response{
+		StatusCode:    http.StatusForbidden,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+	}
+}
@@ -0,0 +1,181 @@
+package blockpage
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+func testCA(t *testing.T) *CA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns44 test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("can't create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("can't parse CA certificate: %v", err)
+	}
+	ca, err := newCA(cert, key)
+	if err != nil {
+		t.Fatalf("newCA failed: %v", err)
+	}
+	return ca
+}
+
+// fetch serves block page on accepted connection and requests it over
+// client connection wrapped by wrap.
+func fetch(t *testing.T, s *Server, port uint16, wrap func(net.Conn) net.Conn) (*http.Response, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+	defer ln.Close()
+	key := clientkey.FromAddr(netip.MustParseAddr("10.0.0.1"))
+	go func() {
+		server, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		s.ServeBlocked(server, key, "ads.example", port)
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect: %v", err)
+	}
+	conn := wrap(client)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: ads.example\r\n\r\n"); err != nil {
+		t.Fatalf("can't send request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("can't read response: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("can't read body: %v", err)
+	}
+	return resp, string(body)
+}
+
+func TestServeBlocked(t *testing.T) {
+	reasons := NewReasons()
+	key := clientkey.FromAddr(netip.MustParseAddr("10.0.0.1"))
+	reasons.RecordBlock(key, "ads.example", `line 1: block suffix(name, "ads.example")`)
+	ca := testCA(t)
+	s := New(reasons, ca)
+
+	resp, body := fetch(t, s, 80, func(c net.Conn) net.Conn { return c })
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d, expected 403", resp.StatusCode)
+	}
+	for _, want := range []string{"ads.example", "line 1: block suffix(name, &#34;ads.example&#34;)"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page doesn't contain %q:\n%s", want, body)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	resp, body = fetch(t, s, 443, func(c net.Conn) net.Conn {
+		return tls.Client(c, &tls.Config{ServerName: "ads.example", RootCAs: roots})
+	})
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "ads.example") {
+		t.Errorf("unexpected HTTPS response %d:\n%s", resp.StatusCode, body)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		New(reasons, nil).ServeBlocked(server, key, "ads.example", 443)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("HTTPS connection without CA isn't left at once")
+	}
+}
+
+func TestCertificateNames(t *testing.T) {
+	reasons := NewReasons()
+	key := clientkey.FromAddr(netip.MustParseAddr("10.0.0.1"))
+	other := clientkey.FromAddr(netip.MustParseAddr("10.0.0.2"))
+	reasons.RecordBlock(key, "ads.example", "policy service")
+	s := New(reasons, testCA(t))
+
+	for _, name := range []string{"ads.example", "ADS.example.", ""} {
+		cert, err := s.certificate(name, key, "ads.example")
+		if err != nil {
+			t.Errorf("certificate(%q) failed: %v", name, err)
+			continue
+		}
+		if names := cert.Leaf.DNSNames; len(names) != 1 || names[0] != "ads.example" {
+			t.Errorf("certificate(%q) is issued for %v", name, names)
+		}
+	}
+	if _, err := s.certificate("bank.example", key, "ads.example"); err == nil {
+		t.Error("certificate issued for name other than blocked domain")
+	}
+	if _, err := s.certificate("ads.example", other, "ads.example"); err == nil {
+		t.Error("certificate issued for client without recorded block")
+	}
+	if _, err := New(nil, s.ca).certificate("ads.example", key, "ads.example"); err == nil {
+		t.Error("certificate issued without block reasons")
+	}
+}
+
+func TestReasonsExpire(t *testing.T) {
+	now := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	r := NewReasons()
+	r.now = func() time.Time { return now }
+	key := clientkey.FromAddr(netip.MustParseAddr("10.0.0.1"))
+	r.RecordBlock(key, "ads.example", "policy service")
+	if reason := r.Lookup(key, "ads.example"); reason != "policy service" {
+		t.Errorf("Lookup() = %q", reason)
+	}
+	if reason := r.Lookup(clientkey.FromAddr(netip.MustParseAddr("10.0.0.2")), "ads.example"); reason != "" {
+		t.Errorf("reason of other client is returned: %q", reason)
+	}
+	now = now.Add(reasonTTL + time.Second)
+	if reason := r.Lookup(key, "ads.example"); reason != "" {
+		t.Errorf("expired reason is returned: %q", reason)
+	}
+	var nilReasons *Reasons
+	nilReasons.RecordBlock(key, "ads.example", "x")
+	if reason := nilReasons.Lookup(key, "ads.example"); reason != "" {
+		t.Errorf("nil Reasons returned %q", reason)
+	}
+}
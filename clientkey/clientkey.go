@@ -0,0 +1,71 @@
+// Package clientkey derives keys which identify clients in mapping storage.
+package clientkey
+
+import (
+	"net/netip"
+)
+
+// Key identifies client in mapping storage. Keys are only made by
+// constructors of this package, which normalize address representation,
+// so keys of the same client are always equal.
+type Key struct {
+	s string
+}
+
+// FromAddr returns key of client with address addr.
+func FromAddr(addr netip.Addr) Key {
+	return Key{addr.Unmap().String()}
+}
+
+// FromPrefix returns key shared by clients within prefix.
+func FromPrefix(prefix netip.Prefix) Key {
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	if bits < 0 || bits >= addr.BitLen() {
+		return FromAddr(addr)
+	}
+	masked, err := addr.Prefix(bits)
+	if err != nil {
+		return FromAddr(addr)
+	}
+	return Key{masked.String()}
+}
+
+// Named returns key of client identified by means other than its address,
+// e.g. by name passed by embedder.
+func Named(name string) Key {
+	return Key{name}
+}
+
+// String returns key as it's stored in mapping storage.
+func (k Key) String() string {
+	return k.s
+}
+
+// Masker derives client key from client address, masking it to a prefix
+// length, so hosts using several addresses within one network segment share
+// mappings. Zero value keeps addresses intact.
+type Masker struct {
+	// Bits4 is a prefix length applied to IPv4 addresses. Zero disables
+	// masking.
+	Bits4 int
+
+	// Bits6 is a prefix length applied to IPv6 addresses. Zero disables
+	// masking.
+	Bits6 int
+}
+
+// Key returns client key for address addr.
+func (m Masker) Key(addr netip.Addr) Key {
+	addr = addr.Unmap()
+	bits := m.Bits6
+	if addr.Is4() {
+		bits = m.Bits4
+	}
+	if bits <= 0 {
+		return FromAddr(addr)
+	}
+	return FromPrefix(netip.PrefixFrom(addr, bits))
+}
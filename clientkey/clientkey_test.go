@@ -0,0 +1,45 @@
+package clientkey
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestMaskerKey(t *testing.T) {
+	testCases := []struct {
+		masker   Masker
+		addr     string
+		expected string
+	}{
+		{Masker{}, "192.168.1.10", "192.168.1.10"},
+		{Masker{}, "::ffff:192.168.1.10", "192.168.1.10"},
+		{Masker{Bits4: 24}, "192.168.1.10", "192.168.1.0/24"},
+		{Masker{Bits4: 24}, "::ffff:192.168.1.10", "192.168.1.0/24"},
+		{Masker{Bits4: 32}, "192.168.1.10", "192.168.1.10"},
+		{Masker{Bits4: 24}, "2001:db8::1", "2001:db8::1"},
+		{Masker{Bits6: 64}, "2001:db8::1", "2001:db8::/64"},
+	}
+	for _, tc := range testCases {
+		if got := tc.masker.Key(netip.MustParseAddr(tc.addr)).String(); got != tc.expected {
+			t.Errorf("%+v.Key(%s) = %q, expected %q", tc.masker, tc.addr, got, tc.expected)
+		}
+	}
+}
+
+func TestKeyNormalization(t *testing.T) {
+	testCases := []struct {
+		key      Key
+		expected Key
+	}{
+		{FromAddr(netip.MustParseAddr("::ffff:192.168.1.10")), FromAddr(netip.MustParseAddr("192.168.1.10"))},
+		{FromPrefix(netip.MustParsePrefix("192.168.1.10/32")), FromAddr(netip.MustParseAddr("192.168.1.10"))},
+		{FromPrefix(netip.MustParsePrefix("::ffff:192.168.1.10/120")), FromPrefix(netip.MustParsePrefix("192.168.1.0/24"))},
+		{FromPrefix(netip.MustParsePrefix("192.168.1.10/24")), FromPrefix(netip.MustParsePrefix("192.168.1.0/24"))},
+		{FromPrefix(netip.MustParsePrefix("2001:db8::1/64")), Named("2001:db8::/64")},
+	}
+	for _, tc := range testCases {
+		if tc.key != tc.expected {
+			t.Errorf("key %q != %q", tc.key, tc.expected)
+		}
+	}
+}
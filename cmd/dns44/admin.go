@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/dnsproxy"
+	"github.com/Snawoot/dns44/logstream"
+	"github.com/Snawoot/dns44/mapping"
+	"github.com/Snawoot/dns44/tproxy"
+
+	"github.com/miekg/dns"
+)
+
+// pinner makes mappings permanent.
+type pinner interface {
+	Pin(clientKey clientkey.Key, addr netip.Addr) (mapping.Mapping, bool, error)
+	Unpin(clientKey clientkey.Key, addr netip.Addr) (mapping.Mapping, bool, error)
+	WalkPinned(fn func(mapping.Mapping)) error
+}
+
+// startAdmin starts admin HTTP API on -admin-bind-address, if it's set.
+// pins holds mappings of tenants by their names.
+func startAdmin(mon monitoring, pins map[string]pinner, reload *reloader) (*http.Server, error) {
+	if !adminAddress.value.IsValid() {
+		return nil, nil
+	}
+	var token []byte
+	if *adminTokenFile != "" {
+		var err error
+		token, err = readSecret(*adminTokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(token) == 0 && !adminAddress.value.Addr().Unmap().IsLoopback() {
+		return nil, errors.New("admin API on non-loopback address requires -admin-token-file")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/logs", logstream.Handler(mon.stream))
+	mux.Handle("/pins", pinHandler(pins))
+	mux.Handle("/reload", reloadHandler(reload))
+	listener, err := net.Listen("tcp", adminAddress.value.String())
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Handler:           requireToken(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("admin server stopped: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+// requireToken rejects requests without token, given as bearer token or
+// token query parameter, as browsers can't set headers of WebSocket
+// requests. Empty token allows all requests.
+func requireToken(token []byte, next http.Handler) http.Handler {
+	if len(token) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.URL.Query().Get("token")
+		if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			given = auth
+		}
+		if subtle.ConstantTimeCompare([]byte(given), token) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pinEntry is mapping as reported by admin API.
+type pinEntry struct {
+	Tenant string     `json:"tenant,omitempty"`
+	Client string     `json:"client"`
+	Domain string     `json:"domain"`
+	Addr   netip.Addr `json:"addr"`
+	Pinned bool       `json:"pinned"`
+}
+
+// pinRequest holds parameters of admin API request to pins.
+type pinRequest struct {
+	Tenant string `json:"tenant"`
+	Client string `json:"client"`
+	Addr   string `json:"addr"`
+}
+
+// pinParams returns parameters of request to pins. Changes are taken from
+// JSON body, or from form values only along with bearer token: any web page
+// can submit form to admin API, but can't send JSON or set headers of
+// cross-site request without CORS approval.
+func pinParams(r *http.Request) (pinRequest, error) {
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		return pinRequest{Tenant: q.Get("tenant")}, nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var req pinRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+			return req, fmt.Errorf("bad request body: %w", err)
+		}
+		return req, nil
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return pinRequest{}, errors.New("changes require JSON body or bearer token")
+	}
+	return pinRequest{
+		Tenant: r.FormValue("tenant"),
+		Client: r.FormValue("client"),
+		Addr:   r.FormValue("addr"),
+	}, nil
+}
+
+// reloadHandler reloads settings on POST, like SIGHUP does, and reports
+// settings applied. Like changes of pins, it requires JSON body or bearer
+// token.
+func reloadHandler(reload *reloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" && !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			http.Error(w, "changes require JSON body or bearer token", http.StatusBadRequest)
+			return
+		}
+		s, err := reload.reloadLogged("via admin API")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	})
+}
+
+// pinHandler lists pinned mappings on GET, pins mapping on POST and unpins
+// it on DELETE. Mapping is given by client and addr parameters, tenant
+// parameter selects namespace.
+func pinHandler(pins map[string]pinner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodPost, http.MethodDelete:
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params, err := pinParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tenant := params.Tenant
+		m, ok := pins[tenant]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown tenant %q", tenant), http.StatusNotFound)
+			return
+		}
+		entry := func(item mapping.Mapping) pinEntry {
+			return pinEntry{
+				Tenant: tenant,
+				Client: item.ClientKey,
+				Domain: item.DomainName,
+				Addr:   item.Addr,
+				Pinned: item.Pinned,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			entries := []pinEntry{}
+			if err := m.WalkPinned(func(item mapping.Mapping) {
+				entries = append(entries, entry(item))
+			}); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(entries)
+		case http.MethodPost, http.MethodDelete:
+			clientKey, err := parseClientKey(params.Client)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			addr, err := netip.ParseAddr(params.Addr)
+			if err != nil {
+				http.Error(w, "addr has to be mapped address", http.StatusBadRequest)
+				return
+			}
+			setPinned := m.Pin
+			if r.Method == http.MethodDelete {
+				setPinned = m.Unpin
+			}
+			item, ok, err := setPinned(clientKey, addr)
+			switch {
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			case !ok:
+				http.Error(w, fmt.Sprintf("no mapping of %s for client %s", addr, clientKey), http.StatusNotFound)
+			default:
+				action := "unpinned"
+				if item.Pinned {
+					action = "pinned"
+				}
+				log.Printf("mapping of %s for client %s %s via admin API", item.Addr, item.ClientKey, action)
+				json.NewEncoder(w).Encode(entry(item))
+			}
+		}
+	})
+}
+
+// queryStream feeds events of answered DNS queries to live log stream.
+type queryStream struct {
+	hub *logstream.Hub
+}
+
+func (s queryStream) ObserveQuery(ev *dnsproxy.QueryEvent) {
+	if !s.hub.Active() {
+		return
+	}
+	s.hub.Publish(logstream.Event{
+		Kind:     logstream.KindDNS,
+		Client:   ev.Client,
+		Device:   ev.Device,
+		Domain:   ev.Name,
+		Type:     dns.TypeToString[ev.Type],
+		Result:   ev.Result,
+		Decision: ev.Decision,
+		Rule:     ev.Reason,
+	})
+}
+
+// publishConn feeds proxied connection event to live log stream.
+func (mon monitoring) publishConn(kind string, info *tproxy.ConnInfo, sent, received int64) {
+	if !mon.stream.Active() {
+		return
+	}
+	device, _ := mon.names.ClientName(info.ClientKey)
+	host := info.Host
+	if _, err := netip.ParseAddr(host); err != nil && mon.redact != nil {
+		host = mon.redact(host)
+	}
+	mon.stream.Publish(logstream.Event{
+		Kind:        kind,
+		Client:      info.Source,
+		Device:      device,
+		Domain:      host,
+		Network:     info.Network,
+		Destination: info.Destination.String(),
+		Sent:        sent,
+		Received:    received,
+	})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/dns44/mapping"
+)
+
+// backupFormat is the version of backup archive layout. Restore refuses
+// archives of newer formats.
+const backupFormat = 1
+
+// backupManifestName is the first member of backup archive.
+const backupManifestName = "manifest.json"
+
+// backupManifest describes backup archive. Members under db/ are files of
+// mapping storage, restored into database directory. Other members are
+// restored to their original paths.
+type backupManifest struct {
+	Format  int          `json:"format"`
+	Version string       `json:"version"`
+	Created time.Time    `json:"created"`
+	Backend string       `json:"backend"`
+	DBPath  string       `json:"db_path"`
+	Files   []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+}
+
+// runBackup bundles mapping storage, config file and rule lists given by
+// options into archive named by the only argument, "-" meaning stdout.
+func runBackup(args []string) int {
+	flag.CommandLine.Init("backup", flag.ExitOnError)
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dns44 backup [options] ARCHIVE")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	if flag.NArg() != 1 {
+		flag.Usage()
+		return 2
+	}
+	if err := loadConfig(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := writeBackup(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func writeBackup(archive string) error {
+	manifest := backupManifest{
+		Format:  backupFormat,
+		Version: version,
+		Created: time.Now().UTC(),
+		Backend: *mappingBackend,
+		DBPath:  *dbPath,
+	}
+	sources := make(map[string]string)
+	if *dbPath != mapping.InMemory {
+		dbDir, cleanup, err := backupDBDir()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		entries, err := os.ReadDir(dbDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				name := "db/" + entry.Name()
+				manifest.Files = append(manifest.Files, backupFile{Name: name})
+				sources[name] = filepath.Join(dbDir, entry.Name())
+			}
+		}
+	}
+	for i, file := range backupRuleFiles() {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		name := "files/" + strconv.Itoa(i) + "/" + filepath.Base(abs)
+		manifest.Files = append(manifest.Files, backupFile{Name: name, Path: abs})
+		sources[name] = abs
+	}
+
+	out := io.Writer(os.Stdout)
+	var tmp *os.File
+	if archive != "-" {
+		var err error
+		tmp, err = os.CreateTemp(filepath.Dir(archive), "."+filepath.Base(archive)+".*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		out = tmp
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarMember(tw, backupManifestName, 0644, manifest.Created, data); err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		if err := addTarFile(tw, file.Name, sources[file.Name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if tmp == nil {
+		return nil
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), archive); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d files saved to %s\n", len(manifest.Files), archive)
+	return nil
+}
+
+// backupDBDir returns directory holding consistent copy of mapping storage
+// files. SQLite database is copied, as it may be in use, while memory
+// backend files are read in place: their torn tail is skipped on load.
+func backupDBDir() (dir string, cleanup func(), err error) {
+	noop := func() {}
+	switch *mappingBackend {
+	case "sqlite":
+		tmp, err := os.MkdirTemp("", "dns44-backup")
+		if err != nil {
+			return "", noop, err
+		}
+		cleanup := func() { os.RemoveAll(tmp) }
+		if err := backupSQLite(*dbPath, tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+			cleanup()
+			return "", noop, err
+		}
+		return tmp, cleanup, nil
+	case "memory":
+		return *dbPath, noop, nil
+	default:
+		return "", noop, fmt.Errorf("unknown mapping backend %q", *mappingBackend)
+	}
+}
+
+// backupRuleFiles lists config file and local rule lists given by options.
+// Secrets, such as key files, are left out, so they don't end up in the
+// same archive with state they protect.
+func backupRuleFiles() []string {
+	var files []string
+	if *configFile != "" {
+		files = append(files, *configFile)
+	}
+	if *policyScript != "" {
+		files = append(files, *policyScript)
+	}
+	if *mapRulesFile != "" {
+		files = append(files, *mapRulesFile)
+	}
+	if *preallocFile != "" {
+		files = append(files, *preallocFile)
+	}
+	for _, src := range rpzSources {
+		if !strings.HasPrefix(src, "axfr://") {
+			files = append(files, src)
+		}
+	}
+	for _, spec := range threatFeeds {
+		if name, src, ok := strings.Cut(spec, "="); ok && !strings.Contains(name, "/") {
+			spec = src
+		}
+		if !strings.HasPrefix(spec, "http://") && !strings.HasPrefix(spec, "https://") {
+			files = append(files, spec)
+		}
+	}
+	return files
+}
+
+func writeTarMember(tw *tar.Writer, name string, mode int64, modTime time.Time, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func addTarFile(tw *tar.Writer, name, src string) error {
+	// Files are read whole, as journal of memory backend may grow while
+	// it's archived.
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return writeTarMember(tw, name, int64(info.Mode().Perm()), info.ModTime(), data)
+}
+
+// runRestore puts files of backup archive back in place. dns44 has to be
+// stopped while state is restored.
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbDir := fs.String("db-path", "", "database directory mapping storage is restored to. Defaults to the one archive was made from")
+	force := fs.Bool("force", false, "overwrite existing files, replacing current mapping storage")
+	yes := fs.Bool("yes", false, "restore files without asking for confirmation of their paths")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dns44 restore [options] ARCHIVE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	confirm := confirmRestore
+	if *yes {
+		confirm = nil
+	}
+	if err := restoreBackup(fs.Arg(0), *dbDir, *force, confirm); err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// confirmRestore lists paths files are restored to and asks user whether
+// to proceed, as archive may name any path.
+func confirmRestore(targets []string) error {
+	fmt.Fprintln(os.Stderr, "Files to restore:")
+	for _, target := range targets {
+		fmt.Fprintf(os.Stderr, "  %s\n", target)
+	}
+	p := &prompter{
+		in:  bufio.NewReader(os.Stdin),
+		out: os.Stderr,
+	}
+	proceed := false
+	err := p.ask("Restore them (yes/no)", "no", func(answer string) error {
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			proceed = true
+		case "n", "no":
+		default:
+			return errors.New("answer yes or no")
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't confirm restore, use -yes to skip confirmation: %w", err)
+	}
+	if !proceed {
+		return errors.New("restore cancelled")
+	}
+	return nil
+}
+
+// restoreBackup restores files of archive. Mapping storage goes into
+// dbDir, or into directory it was backed up from if dbDir is empty. Unless
+// confirm is nil, it approves paths files are written to beforehand.
+func restoreBackup(archive, dbDir string, force bool, confirm func(targets []string) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("not a backup archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestName {
+		return errors.New("not a backup archive: manifest is missing")
+	}
+	var manifest backupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("bad manifest: %w", err)
+	}
+	if manifest.Format > backupFormat {
+		return fmt.Errorf("archive format %d is newer than supported %d, archive is made by dns44 %s", manifest.Format, backupFormat, manifest.Version)
+	}
+	if dbDir == "" {
+		dbDir = manifest.DBPath
+	}
+
+	targets := make(map[string]string)
+	hasDB := false
+	for _, file := range manifest.Files {
+		if base, ok := strings.CutPrefix(file.Name, "db/"); ok {
+			if base != path.Base(base) || base == "." || base == ".." {
+				return fmt.Errorf("bad member name %q", file.Name)
+			}
+			targets[file.Name] = filepath.Join(dbDir, base)
+			hasDB = true
+			continue
+		}
+		if !filepath.IsAbs(file.Path) {
+			return fmt.Errorf("bad path %q of member %q", file.Path, file.Name)
+		}
+		targets[file.Name] = file.Path
+	}
+
+	var existing []string
+	if hasDB {
+		entries, err := os.ReadDir(dbDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				existing = append(existing, filepath.Join(dbDir, entry.Name()))
+			}
+		}
+	}
+	if !force {
+		for _, file := range manifest.Files {
+			if _, err := os.Stat(targets[file.Name]); err == nil && !strings.HasPrefix(file.Name, "db/") {
+				existing = append(existing, targets[file.Name])
+			}
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("%s already exist, use -force to overwrite", strings.Join(existing, ", "))
+		}
+	}
+	if confirm != nil {
+		list := make([]string, 0, len(manifest.Files))
+		for _, file := range manifest.Files {
+			list = append(list, targets[file.Name])
+		}
+		if err := confirm(list); err != nil {
+			return err
+		}
+	}
+
+	// Stale files, such as SQLite WAL or memory backend journal, would be
+	// applied on top of restored state.
+	for _, file := range existing {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	restored := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive is damaged: %w", err)
+		}
+		target, ok := targets[hdr.Name]
+		if !ok {
+			return fmt.Errorf("member %q is not listed in manifest", hdr.Name)
+		}
+		dirMode, mode := os.FileMode(0755), os.FileMode(hdr.Mode).Perm()
+		if strings.HasPrefix(hdr.Name, "db/") {
+			// Mapping storage holds domains clients visited.
+			dirMode, mode = 0700, 0600
+		}
+		if err := os.MkdirAll(filepath.Dir(target), dirMode); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("can't restore %s: %w", target, err)
+		}
+		restored++
+	}
+	fmt.Fprintf(os.Stderr, "%d files restored from backup made by dns44 %s at %s, mapping backend %s\n",
+		restored, manifest.Version, manifest.Created.Format(time.RFC3339), manifest.Backend)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBackupRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "db")
+	conf := filepath.Join(dir, "dns44.yaml")
+	files := map[string]string{
+		filepath.Join(db, "mapping.snapshot"): "snapshot",
+		filepath.Join(db, "mapping.journal"):  "journal",
+		conf:                                  "ttl: 60\n",
+	}
+	if err := os.Mkdir(db, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(backend, path, config string) {
+		*mappingBackend, *dbPath, *configFile = backend, path, config
+	}(*mappingBackend, *dbPath, *configFile)
+	*mappingBackend, *dbPath, *configFile = "memory", db, conf
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := writeBackup(archive); err != nil {
+		t.Fatalf("writeBackup failed: %v", err)
+	}
+
+	// Existing files are kept without force.
+	if err := restoreBackup(archive, "", false, nil); err == nil {
+		t.Error("restore overwrote existing files without force")
+	}
+	for name := range files {
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Declined restore writes nothing.
+	var listed []string
+	errDeclined := errors.New("declined")
+	err := restoreBackup(archive, "", false, func(targets []string) error {
+		listed = targets
+		return errDeclined
+	})
+	if !errors.Is(err, errDeclined) {
+		t.Errorf("declined restore returned %v", err)
+	}
+	expected := []string{filepath.Join(db, "mapping.journal"), filepath.Join(db, "mapping.snapshot"), conf}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("restore asked to confirm %q, expected %q", listed, expected)
+	}
+	for name := range files {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("declined restore wrote %s", name)
+		}
+	}
+
+	if err := restoreBackup(archive, "", false, func([]string) error { return nil }); err != nil {
+		t.Fatalf("restoreBackup failed: %v", err)
+	}
+	for name, content := range files {
+		restored, err := os.ReadFile(name)
+		if err != nil || string(restored) != content {
+			t.Errorf("%s restored as %q, %v, expected %q", name, restored, err, content)
+		}
+	}
+
+	// Mapping storage follows -db-path of restore.
+	other := filepath.Join(t.TempDir(), "db")
+	if err := restoreBackup(archive, other, true, nil); err != nil {
+		t.Fatalf("restoreBackup failed: %v", err)
+	}
+	if restored, err := os.ReadFile(filepath.Join(other, "mapping.snapshot")); err != nil || string(restored) != "snapshot" {
+		t.Errorf("snapshot restored as %q, %v", restored, err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type benchStats struct {
+	mux     sync.Mutex
+	samples []time.Duration
+	errors  uint64
+	bytes   uint64
+}
+
+func (s *benchStats) add(d time.Duration, n int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.samples = append(s.samples, d)
+	s.bytes += uint64(n)
+}
+
+func (s *benchStats) fail() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.errors++
+}
+
+func (s *benchStats) report(name string, elapsed time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sort.Slice(s.samples, func(i, j int) bool { return s.samples[i] < s.samples[j] })
+	pct := func(p float64) time.Duration {
+		if len(s.samples) == 0 {
+			return 0
+		}
+		return s.samples[int(float64(len(s.samples)-1)*p)]
+	}
+	fmt.Printf("%s: ok=%d errors=%d rate=%.1f/s p50=%v p90=%v p99=%v max=%v",
+		name, len(s.samples), s.errors, float64(len(s.samples))/elapsed.Seconds(),
+		pct(0.5), pct(0.9), pct(0.99), pct(1))
+	if s.bytes > 0 {
+		fmt.Printf(" throughput=%.1fKiB/s", float64(s.bytes)/1024/elapsed.Seconds())
+	}
+	fmt.Println()
+}
+
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	dnsServer := fs.String("dns-server", "127.0.0.1:4453", "address of DNS server under test")
+	duration := fs.Duration("duration", 10*time.Second, "benchmark duration")
+	concurrency := fs.Int("concurrency", 16, "number of concurrent workers per load type")
+	domains := fs.Int("domains", 10000, "number of distinct domain names to query")
+	domainSuffix := fs.String("domain-suffix", "bench.example.com", "suffix for generated domain names")
+	tcpTarget := fs.String("tcp-target", "", "domain:port to open TCP connections to via proxy (empty disables)")
+	udpTarget := fs.String("udp-target", "", "domain:port to send UDP datagrams to via proxy (empty disables)")
+	payload := fs.Int("payload-size", 64, "bytes sent per TCP connection or UDP datagram")
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout for single operation")
+	fs.Parse(args)
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	client := &dns.Client{Timeout: *timeout}
+	resolve := func(name string) (net.IP, time.Duration, error) {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		resp, rtt, err := client.Exchange(req, *dnsServer)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				return a.A, rtt, nil
+			}
+		}
+		return nil, 0, fmt.Errorf("no A record in response for %s", name)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		counter uint64
+	)
+	dnsStats := new(benchStats)
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := atomic.AddUint64(&counter, 1) % uint64(*domains)
+				_, rtt, err := resolve(fmt.Sprintf("d%d.%s", n, *domainSuffix))
+				if err != nil {
+					dnsStats.fail()
+					continue
+				}
+				dnsStats.add(rtt, 0)
+			}
+		}()
+	}
+
+	resolveTarget := func(target string) (string, error) {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return "", err
+		}
+		ip, _, err := resolve(host)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+
+	buf := make([]byte, *payload)
+	connChurn := func(network, target string, stats *benchStats) {
+		addr, err := resolveTarget(target)
+		if err != nil {
+			log.Printf("bench: unable to resolve %s target %q: %v", network, target, err)
+			return
+		}
+		for i := 0; i < *concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				readBuf := make([]byte, 64*1024)
+				for ctx.Err() == nil {
+					started := time.Now()
+					conn, err := net.DialTimeout(network, addr, *timeout)
+					if err != nil {
+						stats.fail()
+						continue
+					}
+					conn.SetDeadline(time.Now().Add(*timeout))
+					n, err := exchange(network, conn, buf, readBuf)
+					conn.Close()
+					if err != nil {
+						stats.fail()
+						continue
+					}
+					stats.add(time.Since(started), n)
+				}
+			}()
+		}
+	}
+
+	tcpStats := new(benchStats)
+	if *tcpTarget != "" {
+		connChurn("tcp", *tcpTarget, tcpStats)
+	}
+	udpStats := new(benchStats)
+	if *udpTarget != "" {
+		connChurn("udp", *udpTarget, udpStats)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	dnsStats.report("dns", elapsed)
+	if *tcpTarget != "" {
+		tcpStats.report("tcp", elapsed)
+	}
+	if *udpTarget != "" {
+		udpStats.report("udp", elapsed)
+	}
+	return 0
+}
+
+// exchange sends payload and reads the response. For TCP whole response
+// until EOF is consumed, for UDP a single datagram is awaited.
+func exchange(network string, conn net.Conn, payload, readBuf []byte) (int, error) {
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			return 0, err
+		}
+	}
+	if network == "udp" {
+		return conn.Read(readBuf)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	total := 0
+	for {
+		n, err := conn.Read(readBuf)
+		total += n
+		if err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			if os.IsTimeout(err) && total > 0 {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupLimits returns CPU quota in CPUs and memory limit in bytes of
+// cgroup dns44 runs in. Zero values mean no limit.
+func cgroupLimits() (cpus float64, memory int64, err error) {
+	return readCgroupLimits(cgroupRoot, "/proc/self/cgroup")
+}
+
+// readCgroupLimits reads limits of cgroups listed in procFile from
+// hierarchies mounted under root.
+func readCgroupLimits(root, procFile string) (cpus float64, memory int64, err error) {
+	paths, err := cgroupPaths(procFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Hybrid hosts have empty v2 hierarchy along with v1 controllers.
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		path := paths[""]
+		if fields := strings.Fields(readCgroupFile(root, path, "cpu.max")); len(fields) == 2 {
+			cpus = cpuQuota(fields[0], fields[1])
+		}
+		memory = memoryLimit(readCgroupFile(root, path, "memory.max"))
+		return cpus, memory, nil
+	}
+	for controllers, path := range paths {
+		for _, controller := range strings.Split(controllers, ",") {
+			switch controller {
+			case "cpu":
+				dir := filepath.Join(root, controllers)
+				cpus = cpuQuota(readCgroupFile(dir, path, "cpu.cfs_quota_us"), readCgroupFile(dir, path, "cpu.cfs_period_us"))
+			case "memory":
+				memory = memoryLimit(readCgroupFile(filepath.Join(root, controllers), path, "memory.limit_in_bytes"))
+			}
+		}
+	}
+	return cpus, memory, nil
+}
+
+// cgroupPaths returns cgroup paths of process listed in procFile keyed by
+// controller list. cgroup v2 hierarchy has empty controller list.
+func cgroupPaths(procFile string) (map[string]string, error) {
+	f, err := os.Open(procFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) == 3 {
+			paths[parts[1]] = parts[2]
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// readCgroupFile reads control file of cgroup. Containers often see their
+// own cgroup as hierarchy root, so root is tried if cgroup path has no file.
+func readCgroupFile(dir, path, name string) string {
+	for _, p := range []string{filepath.Join(dir, path, name), filepath.Join(dir, name)} {
+		if data, err := os.ReadFile(p); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return ""
+}
+
+func cpuQuota(quota, period string) float64 {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return float64(q) / float64(p)
+}
+
+func memoryLimit(s string) int64 {
+	limit, err := strconv.ParseInt(s, 10, 64)
+	// cgroup v1 reports absence of limit as huge page-aligned number.
+	if err != nil || limit <= 0 || limit >= 1<<62 {
+		return 0
+	}
+	return limit
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCPUQuota(t *testing.T) {
+	for _, tc := range []struct {
+		quota, period string
+		cpus          float64
+	}{
+		{"150000", "100000", 1.5},
+		{"50000", "100000", 0.5},
+		{"max", "100000", 0},
+		{"-1", "100000", 0},
+		{"100000", "0", 0},
+		{"", "", 0},
+	} {
+		if cpus := cpuQuota(tc.quota, tc.period); cpus != tc.cpus {
+			t.Errorf("cpuQuota(%q, %q) = %v, expected %v", tc.quota, tc.period, cpus, tc.cpus)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		limit int64
+	}{
+		{"536870912", 536870912},
+		{"max", 0},
+		// cgroup v1 reports no limit as page-aligned maximal value.
+		{"9223372036854771712", 0},
+		{"0", 0},
+		{"", 0},
+	} {
+		if limit := memoryLimit(tc.value); limit != tc.limit {
+			t.Errorf("memoryLimit(%q) = %d, expected %d", tc.value, limit, tc.limit)
+		}
+	}
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadCgroupLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		files  map[string]string
+		cpus   float64
+		memory int64
+	}{
+		{
+			name: "v2",
+			files: map[string]string{
+				"proc":                                     "0::/system.slice/dns44.service",
+				"fs/cgroup.controllers":                    "cpu memory",
+				"fs/system.slice/dns44.service/cpu.max":    "200000 100000",
+				"fs/system.slice/dns44.service/memory.max": "268435456",
+			},
+			cpus:   2,
+			memory: 268435456,
+		},
+		{
+			name: "v2 without limits",
+			files: map[string]string{
+				"proc":                  "0::/",
+				"fs/cgroup.controllers": "cpu memory",
+				"fs/cpu.max":            "max 100000",
+				"fs/memory.max":         "max",
+			},
+		},
+		{
+			// Container sees its own cgroup as hierarchy root.
+			name: "v2 namespaced",
+			files: map[string]string{
+				"proc":                  "0::/docker/abc",
+				"fs/cgroup.controllers": "cpu memory",
+				"fs/cpu.max":            "50000 100000",
+				"fs/memory.max":         "134217728",
+			},
+			cpus:   0.5,
+			memory: 134217728,
+		},
+		{
+			name: "v1",
+			files: map[string]string{
+				"proc": "12:memory:/dns44\n" +
+					"4:cpu,cpuacct:/dns44\n" +
+					"1:name=systemd:/dns44\n" +
+					"0::/dns44",
+				"fs/cpu,cpuacct/dns44/cpu.cfs_quota_us":  "300000",
+				"fs/cpu,cpuacct/dns44/cpu.cfs_period_us": "100000",
+				"fs/memory/dns44/memory.limit_in_bytes":  "1073741824",
+			},
+			cpus:   3,
+			memory: 1073741824,
+		},
+		{
+			name: "v1 without limits",
+			files: map[string]string{
+				"proc": "12:memory:/\n" +
+					"4:cpu,cpuacct:/",
+				"fs/cpu,cpuacct/cpu.cfs_quota_us":  "-1",
+				"fs/cpu,cpuacct/cpu.cfs_period_us": "100000",
+				"fs/memory/memory.limit_in_bytes":  "9223372036854771712",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tc.files)
+			cpus, memory, err := readCgroupLimits(filepath.Join(dir, "fs"), filepath.Join(dir, "proc"))
+			if err != nil {
+				t.Fatalf("readCgroupLimits failed: %v", err)
+			}
+			if cpus != tc.cpus || memory != tc.memory {
+				t.Errorf("got %v CPUs and %d bytes, expected %v CPUs and %d bytes", cpus, memory, tc.cpus, tc.memory)
+			}
+		})
+	}
+
+	cpus, memory, err := readCgroupLimits(t.TempDir(), filepath.Join(t.TempDir(), "missing"))
+	if err != nil || cpus != 0 || memory != 0 {
+		t.Errorf("missing cgroup file: got %v, %d, %v", cpus, memory, err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// cgroupLimits reports no limits: cgroups are Linux feature.
+func cgroupLimits() (cpus float64, memory int64, err error) {
+	return 0, 0, nil
+}
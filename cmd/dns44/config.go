@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the structure of file named by -config, in YAML or, if file
+// name ends with .toml, TOML. Each field tagged with flag sets option of
+// that name unless it's given on command line, so flags override file
+// values. Lists set repeatable options item by item and are joined with
+// commas for others.
+type config struct {
+	DNS      dnsConfig      `yaml:"dns" toml:"dns"`
+	Upstream upstreamConfig `yaml:"upstream" toml:"upstream"`
+	Mapping  mappingConfig  `yaml:"mapping" toml:"mapping"`
+	// Pools set -pool and -pool-rule options.
+	Pools   []poolConfig   `yaml:"pools" toml:"pools"`
+	Rules   rulesConfig    `yaml:"rules" toml:"rules"`
+	Policy  policyConfig   `yaml:"policy" toml:"policy"`
+	Proxy   proxyConfig    `yaml:"proxy" toml:"proxy"`
+	Dialer  dialerConfig   `yaml:"dialer" toml:"dialer"`
+	Tenants []tenantConfig `yaml:"tenants" toml:"tenants" flag:"tenant"`
+	Devices []string       `yaml:"devices" toml:"devices" flag:"device"`
+	Admin   adminConfig    `yaml:"admin" toml:"admin"`
+	Log     logConfig      `yaml:"log" toml:"log"`
+	Notify  notifyConfig   `yaml:"notify" toml:"notify"`
+	MQTT    mqttConfig     `yaml:"mqtt" toml:"mqtt"`
+	IPFIX   ipfixConfig    `yaml:"ipfix" toml:"ipfix"`
+	Runtime runtimeConfig  `yaml:"runtime" toml:"runtime"`
+}
+
+type dnsConfig struct {
+	Listen            *string   `yaml:"listen" toml:"listen" flag:"dns-bind-address"`
+	DoTListen         *string   `yaml:"dot_listen" toml:"dot_listen" flag:"dot-bind-address"`
+	DoHListen         *string   `yaml:"doh_listen" toml:"doh_listen" flag:"doh-bind-address"`
+	DoQListen         *string   `yaml:"doq_listen" toml:"doq_listen" flag:"doq-bind-address"`
+	TLSCert           *string   `yaml:"tls_cert" toml:"tls_cert" flag:"dns-tls-cert"`
+	TLSKey            *string   `yaml:"tls_key" toml:"tls_key" flag:"dns-tls-key"`
+	InterfaceSubnets  []string  `yaml:"interface_subnets" toml:"interface_subnets" flag:"dns-interface-subnets"`
+	SelfCIDR          []string  `yaml:"self_cidr" toml:"self_cidr" flag:"dns-self-cidr"`
+	ClientKeySource   *string   `yaml:"client_key_source" toml:"client_key_source" flag:"dns-client-key-source"`
+	ClientKeyPrefix   *int      `yaml:"client_key_prefix" toml:"client_key_prefix" flag:"client-key-prefix"`
+	ClientKeyPrefix6  *int      `yaml:"client_key_prefix6" toml:"client_key_prefix6" flag:"client-key-prefix6"`
+	TTL               *uint     `yaml:"ttl" toml:"ttl" flag:"ttl"`
+	TTLFromUpstream   *bool     `yaml:"ttl_from_upstream" toml:"ttl_from_upstream" flag:"ttl-from-upstream"`
+	MinTTL            *uint     `yaml:"min_ttl" toml:"min_ttl" flag:"min-ttl"`
+	MaxTTL            *uint     `yaml:"max_ttl" toml:"max_ttl" flag:"max-ttl"`
+	TTLPressure       []string  `yaml:"ttl_pressure" toml:"ttl_pressure" flag:"ttl-pressure"`
+	NegativeTTL       *uint     `yaml:"negative_ttl" toml:"negative_ttl" flag:"dns-negative-ttl"`
+	SOANs             *string   `yaml:"soa_ns" toml:"soa_ns" flag:"dns-soa-ns"`
+	SOAMbox           *string   `yaml:"soa_mbox" toml:"soa_mbox" flag:"dns-soa-mbox"`
+	Compress          *bool     `yaml:"compress" toml:"compress" flag:"dns-compress"`
+	MaxUDPSize        *int      `yaml:"max_udp_size" toml:"max_udp_size" flag:"dns-max-udp-size"`
+	Truncate          *string   `yaml:"truncate" toml:"truncate" flag:"dns-truncate"`
+	StatusName        *string   `yaml:"status_name" toml:"status_name" flag:"status-name"`
+	DebugAnnotations  *bool     `yaml:"debug_annotations" toml:"debug_annotations" flag:"debug-annotations"`
+	ServeReverse      *bool     `yaml:"serve_reverse" toml:"serve_reverse" flag:"serve-reverse"`
+	ReverseAnyClient  *bool     `yaml:"reverse_any_client" toml:"reverse_any_client" flag:"reverse-any-client"`
+	TransferAllow     []string  `yaml:"transfer_allow" toml:"transfer_allow" flag:"transfer-allow"`
+	AddrsPerDomain    *int      `yaml:"addrs_per_domain" toml:"addrs_per_domain" flag:"addrs-per-domain"`
+	NXDomainPass      *bool     `yaml:"nxdomain_passthrough" toml:"nxdomain_passthrough" flag:"nxdomain-passthrough"`
+	SuppressAAAA      *string   `yaml:"suppress_aaaa" toml:"suppress_aaaa" flag:"suppress-aaaa"`
+	SuppressAAAARules []string  `yaml:"suppress_aaaa_rules" toml:"suppress_aaaa_rules" flag:"suppress-aaaa-rules"`
+	RewriteSRVTargets []string  `yaml:"rewrite_srv_targets" toml:"rewrite_srv_targets" flag:"rewrite-srv-targets"`
+	LocalQueries      *string   `yaml:"local_queries" toml:"local_queries" flag:"local-queries"`
+	MDNSTimeout       *duration `yaml:"mdns_timeout" toml:"mdns_timeout" flag:"mdns-timeout"`
+	StaticHosts       []string  `yaml:"static_hosts" toml:"static_hosts" flag:"static-host"`
+	StaticHostDirect  *bool     `yaml:"static_host_direct" toml:"static_host_direct" flag:"static-host-direct"`
+	DHCPLeases        *string   `yaml:"dhcp_leases" toml:"dhcp_leases" flag:"dhcp-leases"`
+	DHCPDomain        *string   `yaml:"dhcp_domain" toml:"dhcp_domain" flag:"dhcp-domain"`
+	Prealloc          *string   `yaml:"prealloc" toml:"prealloc" flag:"prealloc"`
+	PreallocClients   []string  `yaml:"prealloc_clients" toml:"prealloc_clients" flag:"prealloc-clients"`
+	FailOpen          *bool     `yaml:"fail_open" toml:"fail_open" flag:"fail-open"`
+	FailOpenFailures  *int      `yaml:"fail_open_failures" toml:"fail_open_failures" flag:"fail-open-failures"`
+	FailOpenRetry     *duration `yaml:"fail_open_retry" toml:"fail_open_retry" flag:"fail-open-retry"`
+}
+
+type upstreamConfig struct {
+	Servers        []string  `yaml:"servers" toml:"servers" flag:"dns-upstream"`
+	Timeout        *duration `yaml:"timeout" toml:"timeout" flag:"dns-upstream-timeout"`
+	Retries        *int      `yaml:"retries" toml:"retries" flag:"dns-upstream-retries"`
+	RetryBackoff   *duration `yaml:"retry_backoff" toml:"retry_backoff" flag:"dns-upstream-retry-backoff"`
+	HealthInterval *duration `yaml:"health_interval" toml:"health_interval" flag:"dns-health-interval"`
+	HealthFailures *int      `yaml:"health_failures" toml:"health_failures" flag:"dns-health-failures"`
+	HealthProbe    *string   `yaml:"health_probe" toml:"health_probe" flag:"dns-health-probe"`
+}
+
+type mappingConfig struct {
+	Backend          *string   `yaml:"backend" toml:"backend" flag:"mapping-backend"`
+	DBPath           *string   `yaml:"db_path" toml:"db_path" flag:"db-path"`
+	SnapshotInterval *duration `yaml:"snapshot_interval" toml:"snapshot_interval" flag:"snapshot-interval"`
+	PrivacyKeyFile   *string   `yaml:"privacy_key_file" toml:"privacy_key_file" flag:"privacy-key-file"`
+	KeyFile          *string   `yaml:"key_file" toml:"key_file" flag:"mapping-key-file"`
+	IPRange          []string  `yaml:"ip_range" toml:"ip_range" flag:"ip-range"`
+	IP6Prefix        *string   `yaml:"ip6_prefix" toml:"ip6_prefix" flag:"ip6-prefix"`
+	BlockedRange     []string  `yaml:"blocked_range" toml:"blocked_range" flag:"blocked-range"`
+}
+
+// poolConfig is named address pool along with domains mapped to it.
+type poolConfig struct {
+	Name    string   `yaml:"name" toml:"name"`
+	Ranges  []string `yaml:"ranges" toml:"ranges"`
+	Domains []string `yaml:"domains" toml:"domains"`
+}
+
+type rulesConfig struct {
+	NeverMap      []string          `yaml:"never_map" toml:"never_map" flag:"never-map"`
+	MapRules      *string           `yaml:"map_rules" toml:"map_rules" flag:"map-rules"`
+	CIDR          []cidrRuleConfig  `yaml:"cidr" toml:"cidr" flag:"cidr-rule"`
+	InterceptCIDR []string          `yaml:"intercept_cidr" toml:"intercept_cidr" flag:"intercept-cidr"`
+	Ports         []portRuleConfig  `yaml:"ports" toml:"ports" flag:"port-rule"`
+	UDPLoose      []portRuleConfig  `yaml:"udp_loose" toml:"udp_loose" flag:"udp-loose-rule"`
+	Quotas        []quotaRuleConfig `yaml:"quotas" toml:"quotas" flag:"quota"`
+	SafeSearch    []string          `yaml:"safe_search" toml:"safe_search" flag:"safe-search"`
+	RPZ           []string          `yaml:"rpz" toml:"rpz" flag:"rpz"`
+	ThreatFeeds   []string          `yaml:"threat_feeds" toml:"threat_feeds" flag:"threat-feed"`
+}
+
+// cidrRuleConfig sets -cidr-rule PREFIX,ACTION.
+type cidrRuleConfig struct {
+	Prefix string `yaml:"prefix" toml:"prefix"`
+	Action string `yaml:"action" toml:"action"`
+}
+
+func (r cidrRuleConfig) flagValue() string {
+	return r.Prefix + "," + r.Action
+}
+
+// portRuleConfig sets DOMAIN=PORT[,PORT...] rule.
+type portRuleConfig struct {
+	Domain string   `yaml:"domain" toml:"domain"`
+	Ports  []string `yaml:"ports" toml:"ports"`
+}
+
+func (r portRuleConfig) flagValue() string {
+	return r.Domain + "=" + strings.Join(r.Ports, ",")
+}
+
+// quotaRuleConfig sets -quota DOMAIN=SIZE.
+type quotaRuleConfig struct {
+	Domain string `yaml:"domain" toml:"domain"`
+	Limit  string `yaml:"limit" toml:"limit"`
+}
+
+func (r quotaRuleConfig) flagValue() string {
+	return r.Domain + "=" + r.Limit
+}
+
+type policyConfig struct {
+	URL         *string   `yaml:"url" toml:"url" flag:"policy-url"`
+	Script      *string   `yaml:"script" toml:"script" flag:"policy-script"`
+	Timeout     *duration `yaml:"timeout" toml:"timeout" flag:"policy-timeout"`
+	CacheTTL    *duration `yaml:"cache_ttl" toml:"cache_ttl" flag:"policy-cache-ttl"`
+	RPZRefresh  *duration `yaml:"rpz_refresh" toml:"rpz_refresh" flag:"rpz-refresh"`
+	FeedRefresh *duration `yaml:"threat_feed_refresh" toml:"threat_feed_refresh" flag:"threat-feed-refresh"`
+}
+
+type proxyConfig struct {
+	Listen           *string   `yaml:"listen" toml:"listen" flag:"proxy-bind-address"`
+	UDPListen        *string   `yaml:"udp_listen" toml:"udp_listen" flag:"proxy-udp-bind-address"`
+	Mode             *string   `yaml:"mode" toml:"mode" flag:"proxy-mode"`
+	LoopCheck        *string   `yaml:"loop_check" toml:"loop_check" flag:"loop-check"`
+	AnyClient        *bool     `yaml:"any_client_fallback" toml:"any_client_fallback" flag:"any-client-fallback"`
+	UDPTimeout       *duration `yaml:"udp_timeout" toml:"udp_timeout" flag:"udp-timeout"`
+	UDPShortTimeout  *duration `yaml:"udp_short_timeout" toml:"udp_short_timeout" flag:"udp-short-timeout"`
+	UDPLongTimeout   *duration `yaml:"udp_long_timeout" toml:"udp_long_timeout" flag:"udp-long-timeout"`
+	UDPWorkers       *int      `yaml:"udp_workers" toml:"udp_workers" flag:"udp-workers"`
+	TCPBufferSize    *int      `yaml:"tcp_buffer_size" toml:"tcp_buffer_size" flag:"tcp-buffer-size"`
+	TCPMaxPending    *int      `yaml:"tcp_max_pending" toml:"tcp_max_pending" flag:"tcp-max-pending"`
+	TCPMaxAcceptRate *float64  `yaml:"tcp_max_accept_rate" toml:"tcp_max_accept_rate" flag:"tcp-max-accept-rate"`
+	BlockPage        *bool     `yaml:"block_page" toml:"block_page" flag:"block-page"`
+	BlockPageCACert  *string   `yaml:"block_page_ca_cert" toml:"block_page_ca_cert" flag:"block-page-ca-cert"`
+	BlockPageCAKey   *string   `yaml:"block_page_ca_key" toml:"block_page_ca_key" flag:"block-page-ca-key"`
+}
+
+// dialerConfig describes how proxy dials destinations.
+type dialerConfig struct {
+	Timeout          *duration `yaml:"timeout" toml:"timeout" flag:"dial-timeout"`
+	ResolvedCacheTTL *duration `yaml:"resolved_cache_ttl" toml:"resolved_cache_ttl" flag:"resolved-cache-ttl"`
+	ForbidPrivate    *bool     `yaml:"forbid_private" toml:"forbid_private" flag:"forbid-private"`
+	ForbidCIDR       []string  `yaml:"forbid_cidr" toml:"forbid_cidr" flag:"forbid-cidr"`
+}
+
+// tenantConfig sets -tenant NAME,DNS,PROXY[,UDP].
+type tenantConfig struct {
+	Name           string `yaml:"name" toml:"name"`
+	DNSListen      string `yaml:"dns_listen" toml:"dns_listen"`
+	ProxyListen    string `yaml:"proxy_listen" toml:"proxy_listen"`
+	ProxyUDPListen string `yaml:"proxy_udp_listen" toml:"proxy_udp_listen"`
+}
+
+func (t tenantConfig) flagValue() string {
+	value := t.Name + "," + t.DNSListen + "," + t.ProxyListen
+	if t.ProxyUDPListen != "" {
+		value += "," + t.ProxyUDPListen
+	}
+	return value
+}
+
+type adminConfig struct {
+	Listen    *string `yaml:"listen" toml:"listen" flag:"admin-bind-address"`
+	TokenFile *string `yaml:"token_file" toml:"token_file" flag:"admin-token-file"`
+}
+
+type logConfig struct {
+	Backend        *string `yaml:"backend" toml:"backend" flag:"log-backend"`
+	Debug          *bool   `yaml:"debug" toml:"debug" flag:"debug"`
+	Syslog         *string `yaml:"syslog" toml:"syslog" flag:"syslog"`
+	SyslogFacility *string `yaml:"syslog_facility" toml:"syslog_facility" flag:"syslog-facility"`
+	SyslogQueries  *bool   `yaml:"syslog_queries" toml:"syslog_queries" flag:"syslog-queries"`
+}
+
+type notifyConfig struct {
+	Sinks         []string  `yaml:"sinks" toml:"sinks" flag:"notify"`
+	Events        []string  `yaml:"events" toml:"events" flag:"notify-events"`
+	Cooldown      *duration `yaml:"cooldown" toml:"cooldown" flag:"notify-cooldown"`
+	PoolThreshold *float64  `yaml:"pool_threshold" toml:"pool_threshold" flag:"notify-pool-threshold"`
+}
+
+type mqttConfig struct {
+	URL             *string   `yaml:"url" toml:"url" flag:"mqtt"`
+	Interval        *duration `yaml:"interval" toml:"interval" flag:"mqtt-interval"`
+	DiscoveryPrefix *string   `yaml:"discovery_prefix" toml:"discovery_prefix" flag:"mqtt-discovery-prefix"`
+}
+
+type ipfixConfig struct {
+	Collector     *string   `yaml:"collector" toml:"collector" flag:"ipfix-collector"`
+	ActiveTimeout *duration `yaml:"active_timeout" toml:"active_timeout" flag:"ipfix-active-timeout"`
+	DomainID      *uint     `yaml:"domain_id" toml:"domain_id" flag:"ipfix-domain-id"`
+}
+
+type runtimeConfig struct {
+	GOMAXPROCS  *string `yaml:"gomaxprocs" toml:"gomaxprocs" flag:"gomaxprocs"`
+	MemoryLimit *string `yaml:"memory_limit" toml:"memory_limit" flag:"memory-limit"`
+}
+
+// duration is time.Duration given as string like "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+// flagValuer is a structured list item setting repeatable option.
+type flagValuer interface {
+	flagValue() string
+}
+
+// readConfig parses config file, rejecting unknown keys.
+func readConfig(filename string) (*config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read config file: %w", err)
+	}
+	cfg := new(config)
+	if strings.EqualFold(filepath.Ext(filename), ".toml") {
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown key %q", filename, undecoded[0].String())
+		}
+		return cfg, nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// cmdlineOptions are options given on command line, which keep their
+// values when settings are reloaded.
+var cmdlineOptions map[string]bool
+
+// loadConfig sets options of fs which weren't given on command line from
+// file named by -config.
+func loadConfig(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	cmdlineOptions = given
+	if *configFile == "" {
+		return nil
+	}
+	cfg, err := readConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if err := cfg.apply(fs, given); err != nil {
+		return fmt.Errorf("%s: %w", *configFile, err)
+	}
+	return nil
+}
+
+// apply sets options of fs, except given ones, from config. Options fs
+// doesn't define are skipped.
+func (cfg *config) apply(fs *flag.FlagSet, given map[string]bool) error {
+	set := func(name string, values []string) error {
+		f := fs.Lookup(name)
+		if f == nil || given[name] {
+			return nil
+		}
+		if _, builtin := f.Value.(flag.Getter); builtin && len(values) != 1 {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("option %q: %w", name, err)
+			}
+		}
+		return nil
+	}
+	if err := applyFields(reflect.ValueOf(cfg).Elem(), set); err != nil {
+		return err
+	}
+
+	var pools, poolRules []string
+	for _, p := range cfg.Pools {
+		pools = append(pools, p.Name+"="+strings.Join(p.Ranges, ","))
+		for _, domain := range p.Domains {
+			poolRules = append(poolRules, domain+"="+p.Name)
+		}
+	}
+	if len(pools) > 0 {
+		if err := set("pool", pools); err != nil {
+			return err
+		}
+	}
+	if len(poolRules) > 0 {
+		return set("pool-rule", poolRules)
+	}
+	return nil
+}
+
+// applyFields calls set for each field of struct v tagged with flag which
+// has value, descending into nested structs.
+func applyFields(v reflect.Value, set func(name string, values []string) error) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		name := field.Tag.Get("flag")
+		if name == "" {
+			if value.Kind() == reflect.Struct {
+				if err := applyFields(value, set); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		var values []string
+		switch value.Kind() {
+		case reflect.Pointer:
+			if value.IsNil() {
+				continue
+			}
+			values = []string{fmt.Sprint(value.Elem().Interface())}
+		case reflect.Slice:
+			// Empty list clears option, e.g. never-map defaults.
+			if value.IsNil() {
+				continue
+			}
+			values = []string{}
+			for j := 0; j < value.Len(); j++ {
+				item := value.Index(j).Interface()
+				if fv, ok := item.(flagValuer); ok {
+					values = append(values, fv.flagValue())
+				} else {
+					values = append(values, fmt.Sprint(item))
+				}
+			}
+		default:
+			return fmt.Errorf("config field %s has unsupported type %s", field.Name, field.Type)
+		}
+		if err := set(name, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
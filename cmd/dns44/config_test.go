@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name, content string
+	}{
+		{"dns44.yaml", `
+dns:
+  listen: 127.0.0.2:53
+  ttl: 60
+  compress: false
+upstream:
+  servers: [1.1.1.1, 8.8.8.8]
+  timeout: 3s
+pools:
+  - name: video
+    ranges: [172.25.0.0/16]
+    domains: [youtube.com, googlevideo.com]
+rules:
+  never_map: []
+  cidr:
+    - {prefix: 10.0.0.0/8, action: direct}
+  ports:
+    - {domain: ., ports: ["80", "443"]}
+devices: [tv@kids=192.168.1.20]
+`},
+		{"dns44.toml", `
+devices = ["tv@kids=192.168.1.20"]
+
+[dns]
+listen = "127.0.0.2:53"
+ttl = 60
+compress = false
+
+[upstream]
+servers = ["1.1.1.1", "8.8.8.8"]
+timeout = "3s"
+
+[[pools]]
+name = "video"
+ranges = ["172.25.0.0/16"]
+domains = ["youtube.com", "googlevideo.com"]
+
+[rules]
+never_map = []
+cidr = [{prefix = "10.0.0.0/8", action = "direct"}]
+ports = [{domain = ".", ports = ["80", "443"]}]
+`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), tc.name)
+			if err := os.WriteFile(filename, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := readConfig(filename)
+			if err != nil {
+				t.Fatalf("readConfig failed: %v", err)
+			}
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			listen := fs.String("dns-bind-address", "127.0.0.1:4453", "")
+			ttl := fs.Uint("ttl", 900, "")
+			compress := fs.Bool("dns-compress", true, "")
+			upstream := fs.String("dns-upstream", "1.1.1.1", "")
+			timeout := fs.Duration("dns-upstream-timeout", time.Second, "")
+			neverMap := fs.String("never-map", "stun.l.google.com", "")
+			var pools, poolRules, cidrRules, portRules, devices stringList
+			fs.Var(&pools, "pool", "")
+			fs.Var(&poolRules, "pool-rule", "")
+			fs.Var(&cidrRules, "cidr-rule", "")
+			fs.Var(&portRules, "port-rule", "")
+			fs.Var(&devices, "device", "")
+			if err := fs.Parse([]string{"-ttl", "30"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.apply(fs, map[string]bool{"ttl": true}); err != nil {
+				t.Fatalf("apply failed: %v", err)
+			}
+
+			if *listen != "127.0.0.2:53" || *compress || *upstream != "1.1.1.1,8.8.8.8" || *timeout != 3*time.Second || *neverMap != "" {
+				t.Errorf("got options %q, %v, %q, %v, %q", *listen, *compress, *upstream, *timeout, *neverMap)
+			}
+			if *ttl != 30 {
+				t.Errorf("ttl given on command line was overridden with %d", *ttl)
+			}
+			for _, tc := range []struct {
+				name          string
+				got, expected stringList
+			}{
+				{"pool", pools, stringList{"video=172.25.0.0/16"}},
+				{"pool-rule", poolRules, stringList{"youtube.com=video", "googlevideo.com=video"}},
+				{"cidr-rule", cidrRules, stringList{"10.0.0.0/8,direct"}},
+				{"port-rule", portRules, stringList{".=80,443"}},
+				{"device", devices, stringList{"tv@kids=192.168.1.20"}},
+			} {
+				if !reflect.DeepEqual(tc.got, tc.expected) {
+					t.Errorf("-%s got %q, expected %q", tc.name, tc.got, tc.expected)
+				}
+			}
+		})
+	}
+
+	for name, content := range map[string]string{
+		"unknown.yaml":  "dns:\n  bogus: 1\n",
+		"type.yaml":     "dns:\n  ttl: soon\n",
+		"duration.yaml": "upstream:\n  timeout: 3\n",
+		"unknown.toml":  "[dns]\nbogus = 1\n",
+		"syntax.toml":   "[dns\n",
+	} {
+		filename := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfig(filename); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
+
+// TestConfigOptions checks that config fields refer to existing options.
+func TestConfigOptions(t *testing.T) {
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name := field.Tag.Get("flag")
+			if name == "" {
+				if field.Type.Kind() == reflect.Struct {
+					check(field.Type)
+				}
+				continue
+			}
+			if flag.Lookup(name) == nil {
+				t.Errorf("field %s.%s refers to unknown option %q", typ.Name(), field.Name, name)
+			}
+			if strings.Contains(field.Tag.Get("yaml"), "-") {
+				t.Errorf("field %s.%s has dash in YAML key", typ.Name(), field.Name)
+			}
+		}
+	}
+	check(reflect.TypeOf(config{}))
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Snawoot/dns44/mapping"
+)
+
+// Capability numbers from linux/capability.h.
+const (
+	capNetBindService = 10
+	capNetAdmin       = 12
+)
+
+// checkStatus is the outcome of diagnostic check.
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	checkWarn
+	checkFail
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case checkOK:
+		return " OK "
+	case checkWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// finding is the result of diagnostic check along with suggested fix.
+type finding struct {
+	status  checkStatus
+	check   string
+	message string
+	fix     string
+}
+
+// doctor collects findings of diagnostic checks.
+type doctor struct {
+	findings []finding
+}
+
+func (d *doctor) report(status checkStatus, check, fix, format string, args ...interface{}) {
+	d.findings = append(d.findings, finding{
+		status:  status,
+		check:   check,
+		message: fmt.Sprintf(format, args...),
+		fix:     fix,
+	})
+}
+
+func (d *doctor) print() (problems int) {
+	for _, f := range d.findings {
+		fmt.Printf("[%s] %s: %s\n", f.status, f.check, f.message)
+		if f.status != checkOK {
+			problems++
+			if f.fix != "" {
+				fmt.Printf("       fix: %s\n", f.fix)
+			}
+		}
+	}
+	return problems
+}
+
+func (d *doctor) failed() bool {
+	for _, f := range d.findings {
+		if f.status == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+// runCommand runs diagnostic command and returns its output. Missing
+// command is reported with error wrapping exec.ErrNotFound.
+func runCommand(name string, args ...string) (string, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return "", err
+	}
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// checkTransparent checks whether kernel and process privileges allow
+// transparent proxy sockets, and whether TPROXY target is available.
+func (d *doctor) checkTransparent() {
+	err := probeTransparent()
+	switch {
+	case err == nil:
+		d.report(checkOK, "transparent sockets", "", "IP_TRANSPARENT socket option is available")
+	case errors.Is(err, syscall.EPERM):
+		d.report(checkFail, "transparent sockets", "run dns44 as root or grant it CAP_NET_ADMIN, e.g. with \"AmbientCapabilities=CAP_NET_ADMIN CAP_NET_BIND_SERVICE\" in systemd unit",
+			"setting IP_TRANSPARENT socket option is not permitted")
+	default:
+		d.report(checkFail, "transparent sockets", "use Linux kernel built with CONFIG_NETFILTER_XT_TARGET_TPROXY",
+			"can't set IP_TRANSPARENT socket option: %v", err)
+	}
+
+	targets, err := os.ReadFile("/proc/net/ip_tables_targets")
+	if err == nil && containsLine(string(targets), "TPROXY") {
+		d.report(checkOK, "TPROXY target", "", "iptables TPROXY target is loaded")
+		return
+	}
+	modules, err := os.ReadFile("/proc/modules")
+	if err != nil {
+		d.report(checkWarn, "TPROXY target", "", "can't read loaded kernel modules: %v", err)
+		return
+	}
+	for _, module := range []string{"xt_TPROXY", "nft_tproxy"} {
+		if strings.Contains(string(modules), module+" ") {
+			d.report(checkOK, "TPROXY target", "", "kernel module %s is loaded", module)
+			return
+		}
+	}
+	d.report(checkWarn, "TPROXY target", "run \"modprobe xt_TPROXY\" (iptables) or \"modprobe nft_tproxy\" (nftables)",
+		"TPROXY kernel module is not loaded. It's usually loaded on first use, but firewall rules fail if kernel lacks it")
+}
+
+// checkCapabilities checks effective capabilities of this process. They
+// matter only if doctor runs as the same user as the service.
+func (d *doctor) checkCapabilities() {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		d.report(checkWarn, "capabilities", "", "can't read process status: %v", err)
+		return
+	}
+	var caps uint64
+	found := false
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err = strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			found = err == nil
+			break
+		}
+	}
+	if !found {
+		d.report(checkWarn, "capabilities", "", "can't find effective capabilities in process status")
+		return
+	}
+	const fix = "run doctor as the same user as dns44 service; grant service missing capabilities with AmbientCapabilities option of systemd unit or with setcap"
+	if caps&(1<<capNetAdmin) == 0 {
+		d.report(checkFail, "capabilities", fix, "CAP_NET_ADMIN is missing, transparent proxy can't listen")
+	} else {
+		d.report(checkOK, "capabilities", "", "CAP_NET_ADMIN is present")
+	}
+	lowPort := dnsBindAddress.value.Port() < 1024
+	for _, t := range tenants {
+		lowPort = lowPort || t.dnsAddr.Port() < 1024
+	}
+	if lowPort && caps&(1<<capNetBindService) == 0 {
+		d.report(checkFail, "capabilities", fix, "CAP_NET_BIND_SERVICE is missing, DNS server can't listen on port below 1024")
+	}
+}
+
+// checkRoutes checks that mapped addresses are routed locally, so
+// intercepted packets reach proxy socket.
+func (d *doctor) checkRoutes() {
+	for _, prefix := range mappedPrefixes() {
+		addr := prefix.Addr()
+		if addr.Is4() {
+			// Network address isn't routed on some setups, take the next one.
+			addr = addr.Next()
+		}
+		args := []string{"route", "get", addr.String()}
+		if addr.Is6() {
+			args = append([]string{"-6"}, args...)
+		}
+		out, err := runCommand("ip", args...)
+		if errors.Is(err, exec.ErrNotFound) {
+			d.report(checkWarn, "routes", "install iproute2", "\"ip\" command is not found, can't check routes")
+			return
+		}
+		if err == nil && strings.HasPrefix(out, "local ") {
+			d.report(checkOK, "routes", "", "%s is routed locally", prefix)
+			continue
+		}
+		if table, ok := markTable(addr.Is6()); ok {
+			d.report(checkOK, "routes", "", "%s is routed by policy rule for marked packets, via table %s", prefix, table)
+			continue
+		}
+		fix := fmt.Sprintf("ip route add local %s dev lo", prefix)
+		if addr.Is6() {
+			fix = "ip -6 route add local " + prefix.String() + " dev lo"
+		}
+		d.report(checkFail, "routes", fix, "%s is not routed locally, intercepted packets never reach proxy", prefix)
+	}
+}
+
+// markTable finds policy rule for firewall marks whose routing table has
+// local default route. This is the other common way to deliver TPROXY
+// packets.
+func markTable(ipv6 bool) (string, bool) {
+	family := "-4"
+	if ipv6 {
+		family = "-6"
+	}
+	rules, err := runCommand("ip", family, "rule", "show")
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(rules, "\n") {
+		if !strings.Contains(line, "fwmark") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "lookup" && fields[i] != "table" {
+				continue
+			}
+			routes, err := runCommand("ip", family, "route", "show", "table", fields[i+1])
+			if err == nil && strings.Contains(routes, "local ") {
+				return fields[i+1], true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkRPFilter warns about strict reverse path filtering on interfaces
+// serving clients. Loose mode works along with policy routing of TPROXY
+// setups, strict one drops packets unexpectedly.
+func (d *doctor) checkRPFilter() {
+	readValue := func(iface string) (int, error) {
+		content, err := os.ReadFile(filepath.Join("/proc/sys/net/ipv4/conf", iface, "rp_filter"))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(strings.TrimSpace(string(content)))
+	}
+	all, err := readValue("all")
+	if err != nil {
+		d.report(checkWarn, "rp_filter", "", "can't read rp_filter setting: %v", err)
+		return
+	}
+	ifaces := splitList(*dnsIfaceSubnets)
+	if len(ifaces) == 0 {
+		ifaces = []string{"default"}
+	}
+	for _, iface := range ifaces {
+		value, err := readValue(iface)
+		if err != nil {
+			d.report(checkWarn, "rp_filter", "", "can't read rp_filter setting of %s: %v", iface, err)
+			continue
+		}
+		// Kernel applies maximum of "all" and interface value.
+		if all > value {
+			value = all
+		}
+		if value == 1 {
+			d.report(checkWarn, "rp_filter", fmt.Sprintf("sysctl -w net.ipv4.conf.all.rp_filter=2 net.ipv4.conf.%s.rp_filter=2", iface),
+				"strict reverse path filtering is on for %s, it may drop intercepted packets", iface)
+			continue
+		}
+		d.report(checkOK, "rp_filter", "", "reverse path filtering of %s is %d", iface, value)
+	}
+}
+
+// checkFirewall looks for TPROXY rules delivering mapped ranges to proxy
+// ports in iptables and nftables rulesets.
+func (d *doctor) checkFirewall() {
+	ports := map[string]bool{strconv.Itoa(int(proxyBindAddress.value.Port())): true}
+	if proxyUDPAddress.value.IsValid() {
+		ports[strconv.Itoa(int(proxyUDPAddress.value.Port()))] = true
+	}
+	for _, t := range tenants {
+		ports[strconv.Itoa(int(t.proxyAddr.Port()))] = true
+		if t.udpAddr.IsValid() {
+			ports[strconv.Itoa(int(t.udpAddr.Port()))] = true
+		}
+	}
+
+	var rules []string
+	checked := false
+	for _, tool := range [][]string{{"iptables-save", "-t", "mangle"}, {"ip6tables-save", "-t", "mangle"}} {
+		out, err := runCommand(tool[0], tool[1:]...)
+		if err != nil {
+			continue
+		}
+		checked = true
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, "-j TPROXY") {
+				rules = append(rules, line)
+			}
+		}
+	}
+	if out, err := runCommand("nft", "list", "ruleset"); err == nil {
+		checked = true
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, "tproxy ") {
+				rules = append(rules, line)
+			}
+		}
+	}
+	if !checked {
+		d.report(checkWarn, "firewall", "run doctor as root with iptables or nft installed", "can't read firewall rules")
+		return
+	}
+	if len(rules) == 0 {
+		d.report(checkFail, "firewall", "see \"dns44 init\" for rules delivering mapped range to proxy",
+			"there are no TPROXY rules, mapped addresses are not intercepted")
+		return
+	}
+
+	toProxy := false
+	for _, rule := range rules {
+		if rulePort(rule) != "" && ports[rulePort(rule)] {
+			toProxy = true
+		}
+	}
+	if !toProxy {
+		d.report(checkFail, "firewall", "point TPROXY rules to port of -proxy-bind-address",
+			"TPROXY rules don't deliver traffic to proxy port %d", proxyBindAddress.value.Port())
+		return
+	}
+	for _, prefix := range mappedPrefixes() {
+		covered := false
+		for _, rule := range rules {
+			if ruleCovers(rule, prefix) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			d.report(checkOK, "firewall", "", "%s is intercepted by TPROXY rule", prefix)
+		} else {
+			d.report(checkWarn, "firewall", "add TPROXY rules for TCP and UDP traffic to "+prefix.String(),
+				"no TPROXY rule names %s or range covering it, it's not intercepted unless rules match it otherwise", prefix)
+		}
+	}
+}
+
+// rulePort extracts destination port of TPROXY rule in iptables-save or
+// nft format.
+func rulePort(rule string) string {
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "--on-port":
+			return fields[i+1]
+		case "to":
+			// nft: "tproxy ip to 127.0.0.1:4480" or "tproxy to :4480".
+			if _, port, ok := strings.Cut(fields[i+1], ":"); ok {
+				return port
+			}
+		}
+	}
+	return ""
+}
+
+// ruleCovers reports whether TPROXY rule matches destination prefix
+// covering given one.
+func ruleCovers(rule string, prefix netip.Prefix) bool {
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "-d" && fields[i] != "daddr" {
+			continue
+		}
+		for _, spec := range strings.Split(strings.Trim(fields[i+1], "{},"), ",") {
+			ruled, err := netip.ParsePrefix(spec)
+			if err != nil {
+				addr, err := netip.ParseAddr(spec)
+				if err != nil {
+					continue
+				}
+				ruled = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			if ruled.Bits() <= prefix.Bits() && ruled.Contains(prefix.Addr()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkDatabase checks mapping storage without modifying it.
+func (d *doctor) checkDatabase() {
+	if *dbPath == mapping.InMemory {
+		d.report(checkOK, "mapping storage", "", "mappings are kept in memory only and lost on restart")
+		return
+	}
+	if _, err := os.Stat(*dbPath); errors.Is(err, os.ErrNotExist) {
+		d.report(checkOK, "mapping storage", "", "%s doesn't exist yet, it's created on start", *dbPath)
+		return
+	}
+	if err := checkWritable(*dbPath); err != nil {
+		d.report(checkFail, "mapping storage", "make "+*dbPath+" writable by dns44 service user", "%s is not writable: %v", *dbPath, err)
+	}
+	switch *mappingBackend {
+	case "sqlite":
+		err := checkSQLite(*dbPath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			d.report(checkOK, "mapping storage", "", "there is no SQLite database yet, it's created on start")
+		case err != nil:
+			d.report(checkFail, "mapping storage", "stop dns44 and move damaged database aside, dns44 creates new one on start",
+				"SQLite database check failed: %v", err)
+		default:
+			d.report(checkOK, "mapping storage", "", "SQLite database is intact")
+		}
+	case "memory":
+		var secret []byte
+		if *mappingKeyFile != "" {
+			var err error
+			secret, err = readSecret(*mappingKeyFile)
+			if err != nil {
+				d.report(checkFail, "mapping storage", "", "can't read mapping key: %v", err)
+				return
+			}
+		}
+		n, err := mapping.CheckMemory(*dbPath, secret)
+		if err != nil {
+			d.report(checkFail, "mapping storage", "check -mapping-key-file, or stop dns44 and move damaged state aside",
+				"memory backend state can't be read: %v", err)
+			return
+		}
+		d.report(checkOK, "mapping storage", "", "memory backend state holds %d live mappings", n)
+	default:
+		d.report(checkFail, "mapping storage", "use -mapping-backend sqlite or memory", "unknown mapping backend %q", *mappingBackend)
+	}
+}
+
+// checkWritable creates and removes temporary file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// containsLine reports whether text has line equal to s.
+func containsLine(text, s string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runDoctor checks environment for common problems which break
+// interception. It accepts the same options as the service, so checks
+// match its configuration.
+func runDoctor(args []string) int {
+	flag.CommandLine.Init("doctor", flag.ExitOnError)
+	flag.CommandLine.Parse(args)
+	if err := loadConfig(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := checkOverlap(addressRanges()); err != nil {
+		fmt.Fprintf(os.Stderr, "doctor: %v\n", err)
+		return 2
+	}
+
+	d := new(doctor)
+	if *proxyMode == "redirect" {
+		// NAT delivers redirected connections, neither transparent
+		// sockets nor policy routing take part.
+		d.report(checkOK, "proxy mode", "", "redirect mode doesn't need transparent sockets, TPROXY rules and local routes")
+		d.checkCapabilities()
+	} else {
+		d.checkTransparent()
+		d.checkCapabilities()
+		d.checkRoutes()
+		d.checkRPFilter()
+		d.checkFirewall()
+	}
+	d.checkDatabase()
+
+	problems := d.print()
+	if problems == 0 {
+		fmt.Println("No problems found.")
+	} else {
+		fmt.Printf("%d problems found.\n", problems)
+	}
+	if d.failed() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// probeTransparent sets IP_TRANSPARENT option, which proxy listeners need,
+// on a new socket.
+func probeTransparent() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// probeTransparent fails: TPROXY is Linux feature.
+func probeTransparent() error {
+	return errors.New("transparent proxying is supported on Linux only")
+}
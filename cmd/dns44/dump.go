@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/netip"
+	"runtime"
+	"strings"
+
+	"github.com/Snawoot/dns44/dnsproxy"
+	"github.com/Snawoot/dns44/flowexport"
+	"github.com/Snawoot/dns44/tproxy"
+)
+
+// dumpState logs internal state for debugging stuck deployments.
+func dumpState(m mapper, services []io.Closer, flows *flowexport.Table) {
+	log.Printf("state dump: goroutines: %d", runtime.NumGoroutine())
+	if stats, err := m.Stats(); err != nil {
+		log.Printf("state dump: mapping stats unavailable: %v", err)
+	} else {
+		log.Printf("state dump: mappings: %d, addresses in use: %d of %d",
+			stats.Mappings, stats.Addresses, poolSize())
+		log.Printf("state dump: allocations: %d, collisions: %d (%.2f per attempt), failures: %d, average allocation time: %v",
+			stats.Alloc.Allocations, stats.Alloc.Collisions, stats.Alloc.CollisionRate(), stats.Alloc.Failures, stats.Alloc.AvgAllocTime())
+		if stats.DB != nil {
+			log.Printf("state dump: DB: %+v", *stats.DB)
+		}
+	}
+	if flows != nil {
+		var buf strings.Builder
+		flows.WriteConntrack(&buf)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line != "" {
+				log.Printf("state dump: flow: %s", line)
+			}
+		}
+	}
+	for _, s := range services {
+		switch p := s.(type) {
+		case *tproxy.UDPProxy:
+			log.Printf("state dump: UDP proxy %s: %+v", p.Addr(), p.Stats())
+		case *tproxy.TCPProxy:
+			log.Printf("state dump: TCP proxy %s: %+v", p.Addr(), p.Stats())
+		case *dnsproxy.DNSProxy:
+			for _, st := range p.UpstreamStatus() {
+				log.Printf("state dump: upstream %s: healthy: %v, latency: %v, consecutive failures: %d, failed probes: %d of %d, last error: %v",
+					st.Address, st.Healthy, st.Latency, st.Failures, st.Failed, st.Probes, st.LastErr)
+			}
+		}
+	}
+}
+
+// poolUsage returns function reporting addresses in use and pool size.
+func poolUsage(m mapper) func() (uint64, uint64, error) {
+	return func() (uint64, uint64, error) {
+		stats, err := m.Stats()
+		if err != nil {
+			return 0, 0, err
+		}
+		return uint64(stats.Addresses), poolSize(), nil
+	}
+}
+
+// poolSize returns number of addresses in all pools.
+func poolSize() uint64 {
+	var size uint64
+	for _, r := range addressRanges() {
+		for _, rng := range r.ranges {
+			size += rangeSize(rng.Start, rng.End)
+		}
+	}
+	return size
+}
+
+// rangeSize returns number of IPv4 addresses in range.
+func rangeSize(start, end netip.Addr) uint64 {
+	s, e := start.As4(), end.As4()
+	toInt := func(b [4]byte) uint64 {
+		return uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3])
+	}
+	return toInt(e) - toInt(s) + 1
+}
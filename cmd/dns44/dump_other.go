@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// notifyDump does nothing on platforms without SIGUSR1.
+func notifyDump(ctx context.Context, dump func()) {}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// initMarker starts config files written by init, so it never overwrites
+// configuration edited by hand without -force.
+const initMarker = "# Written by dns44 init.\n"
+
+// initConfigPath is EnvironmentFile of deploy/systemd/dns44.service.
+const initConfigPath = "/etc/default/dns44"
+
+// initSetup holds answers given to init wizard.
+type initSetup struct {
+	iface     string
+	dnsBind   netip.AddrPort
+	ipRange   addressRange
+	upstreams []string
+	proxyBind netip.AddrPort
+}
+
+// options returns command line options implementing setup.
+func (s *initSetup) options() []string {
+	opts := []string{
+		"-dns-bind-address=" + s.dnsBind.String(),
+		"-ip-range=" + s.ipRange.String(),
+		"-dns-upstream=" + strings.Join(s.upstreams, ","),
+		"-proxy-bind-address=" + s.proxyBind.String(),
+	}
+	if s.iface != "" {
+		opts = append(opts, "-dns-interface-subnets="+s.iface)
+	}
+	return opts
+}
+
+// config returns EnvironmentFile content for systemd unit.
+func (s *initSetup) config() string {
+	return fmt.Sprintf("%sOPTIONS=%q\n", initMarker, strings.Join(s.options(), " "))
+}
+
+// firewall returns commands routing fake range to transparent proxy.
+func (s *initSetup) firewall() [][]string {
+	port := strconv.Itoa(int(s.proxyBind.Port()))
+	var cmds [][]string
+	for _, prefix := range s.ipRange.prefixes() {
+		cmds = append(cmds, []string{"ip", "route", "add", "local", prefix.String(), "dev", "lo", "src", "127.0.0.1"})
+		for _, proto := range []string{"tcp", "udp"} {
+			cmds = append(cmds, []string{
+				"iptables", "-t", "mangle", "-I", "PREROUTING", "-d", prefix.String(), "-p", proto,
+				"-j", "TPROXY", "--on-port", port, "--on-ip", s.proxyBind.Addr().String(), "--tproxy-mark", "44",
+			})
+		}
+	}
+	return cmds
+}
+
+// prompter asks questions on terminal, offering default answers.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask repeats question until parse accepts the answer. Empty answer
+// selects def.
+func (p *prompter) ask(question, def string, parse func(string) error) error {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		line, err := p.in.ReadString('\n')
+		if err != nil && line == "" {
+			if errors.Is(err, io.EOF) {
+				return errors.New("unexpected end of input")
+			}
+			return err
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if err := parse(answer); err != nil {
+			fmt.Fprintf(p.out, "  %v\n", err)
+			continue
+		}
+		return nil
+	}
+}
+
+// lanInterfaces returns names and first IPv4 addresses of interfaces
+// which are up, excluding loopback.
+func lanInterfaces() ([]string, map[string]netip.Addr) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil
+	}
+	var names []string
+	addrs := make(map[string]netip.Addr)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		names = append(names, iface.Name)
+		ifAddrs, _ := iface.Addrs()
+		for _, a := range ifAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				if addr, ok := netip.AddrFromSlice(ipNet.IP.To4()); ok {
+					addrs[iface.Name] = addr
+					break
+				}
+			}
+		}
+	}
+	return names, addrs
+}
+
+// interview asks for setup values.
+func interview(p *prompter) (*initSetup, error) {
+	s := &initSetup{
+		ipRange:   *ipRange,
+		proxyBind: proxyBindAddress.value,
+	}
+
+	names, addrs := lanInterfaces()
+	var defIface string
+	for _, name := range names {
+		if addrs[name].IsValid() {
+			defIface = name
+			break
+		}
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(p.out, "Network interfaces: %s\n", strings.Join(names, ", "))
+	}
+	err := p.ask("LAN interface serving clients (\"-\" for any)", defIface, func(answer string) error {
+		switch answer {
+		case "":
+			return errors.New("interface name is required")
+		case "-":
+			return nil
+		}
+		if _, err := net.InterfaceByName(answer); err != nil {
+			return err
+		}
+		s.iface = answer
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defDNS := dnsBindAddress.value.String()
+	if addr := addrs[s.iface]; addr.IsValid() {
+		defDNS = netip.AddrPortFrom(addr, 53).String()
+	}
+	err = p.ask("DNS server address for clients", defDNS, func(answer string) error {
+		addr, err := netip.ParseAddrPort(answer)
+		if err != nil {
+			return err
+		}
+		s.dnsBind = addr
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.ask("Fake address range", s.ipRange.String(), func(answer string) error {
+		var r addressRange
+		if err := r.Set(answer); err != nil {
+			return err
+		}
+		s.ipRange = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.ask("Upstream DNS servers (comma-separated)", flag.Lookup("dns-upstream").DefValue, func(answer string) error {
+		s.upstreams = splitList(answer)
+		if len(s.upstreams) == 0 {
+			return errors.New("at least one upstream is required")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.ask("Transparent proxy address", s.proxyBind.String(), func(answer string) error {
+		addr, err := netip.ParseAddrPort(answer)
+		if err != nil {
+			return err
+		}
+		s.proxyBind = addr
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkInitConfig refuses to overwrite existing config not written by
+// init.
+func checkInitConfig(path string) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(content, []byte(initMarker)) {
+		return fmt.Errorf("%s exists and wasn't written by dns44 init, use -force to overwrite it", path)
+	}
+	return nil
+}
+
+// runInit interactively prepares configuration for dns44 service and
+// firewall rules delivering fake range traffic to it.
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	configPath := fs.String("config", initConfigPath, "path of EnvironmentFile with options for systemd unit")
+	apply := fs.Bool("apply", false, "run firewall commands instead of printing them")
+	dryRun := fs.Bool("dry-run", false, "print config instead of writing it, and never run firewall commands")
+	force := fs.Bool("force", false, "overwrite existing config not written by init")
+	fs.Parse(args)
+
+	if !*dryRun && !*force {
+		if err := checkInitConfig(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "init: %v\n", err)
+			return 1
+		}
+	}
+
+	setup, err := interview(&prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init: %v\n", err)
+		return 1
+	}
+	fmt.Println()
+
+	content := setup.config()
+	if *dryRun {
+		fmt.Printf("# %s\n%s\n", *configPath, content)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(*configPath), 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "init: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(*configPath, []byte(content), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "init: %v\n", err)
+			return 1
+		}
+		fmt.Printf("wrote %s\n", *configPath)
+	}
+
+	cmds := setup.firewall()
+	if !*apply || *dryRun {
+		fmt.Println("Firewall rules to deliver fake range traffic to dns44:")
+		for _, cmd := range cmds {
+			fmt.Printf("  %s\n", strings.Join(cmd, " "))
+		}
+		return 0
+	}
+	for _, args := range cmds {
+		fmt.Printf("running %s\n", strings.Join(args, " "))
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "init: %q failed: %v\n", strings.Join(args, " "), err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testSetup(t *testing.T, iface, ranges string) *initSetup {
+	t.Helper()
+	s := &initSetup{
+		iface:     iface,
+		dnsBind:   netip.MustParseAddrPort("192.168.1.1:53"),
+		upstreams: []string{"1.1.1.1", "9.9.9.9"},
+		proxyBind: netip.MustParseAddrPort("127.0.0.1:4480"),
+	}
+	if err := s.ipRange.Set(ranges); err != nil {
+		t.Fatalf("can't parse range %q: %v", ranges, err)
+	}
+	return s
+}
+
+func TestInitSetupConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name, iface, ranges, expected string
+	}{
+		{
+			name:     "any interface",
+			ranges:   "172.24.0.0/16",
+			expected: initMarker + `OPTIONS="-dns-bind-address=192.168.1.1:53 -ip-range=172.24.0.0-172.24.255.255 -dns-upstream=1.1.1.1,9.9.9.9 -proxy-bind-address=127.0.0.1:4480"` + "\n",
+		},
+		{
+			name:     "interface",
+			iface:    "eth1",
+			ranges:   "172.24.0.0/16",
+			expected: initMarker + `OPTIONS="-dns-bind-address=192.168.1.1:53 -ip-range=172.24.0.0-172.24.255.255 -dns-upstream=1.1.1.1,9.9.9.9 -proxy-bind-address=127.0.0.1:4480 -dns-interface-subnets=eth1"` + "\n",
+		},
+		{
+			name:     "several ranges",
+			ranges:   "172.24.0.0/16,172.25.0.0-172.25.0.255",
+			expected: initMarker + `OPTIONS="-dns-bind-address=192.168.1.1:53 -ip-range=172.24.0.0-172.24.255.255,172.25.0.0-172.25.0.255 -dns-upstream=1.1.1.1,9.9.9.9 -proxy-bind-address=127.0.0.1:4480"` + "\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if config := testSetup(t, tc.iface, tc.ranges).config(); config != tc.expected {
+				t.Errorf("unexpected config:\n%s\nexpected:\n%s", config, tc.expected)
+			}
+		})
+	}
+}
+
+func TestInitSetupFirewall(t *testing.T) {
+	tproxyRule := func(prefix, proto string) []string {
+		return []string{
+			"iptables", "-t", "mangle", "-I", "PREROUTING", "-d", prefix, "-p", proto,
+			"-j", "TPROXY", "--on-port", "4480", "--on-ip", "127.0.0.1", "--tproxy-mark", "44",
+		}
+	}
+	for _, tc := range []struct {
+		name, ranges string
+		expected     [][]string
+	}{
+		{
+			name:   "prefix",
+			ranges: "172.24.0.0/16",
+			expected: [][]string{
+				{"ip", "route", "add", "local", "172.24.0.0/16", "dev", "lo", "src", "127.0.0.1"},
+				tproxyRule("172.24.0.0/16", "tcp"),
+				tproxyRule("172.24.0.0/16", "udp"),
+			},
+		},
+		{
+			name:   "range",
+			ranges: "172.24.0.0-172.24.1.255",
+			expected: [][]string{
+				{"ip", "route", "add", "local", "172.24.0.0/23", "dev", "lo", "src", "127.0.0.1"},
+				tproxyRule("172.24.0.0/23", "tcp"),
+				tproxyRule("172.24.0.0/23", "udp"),
+			},
+		},
+		{
+			name:   "unaligned range",
+			ranges: "172.24.0.128-172.24.1.127",
+			expected: [][]string{
+				{"ip", "route", "add", "local", "172.24.0.128/25", "dev", "lo", "src", "127.0.0.1"},
+				tproxyRule("172.24.0.128/25", "tcp"),
+				tproxyRule("172.24.0.128/25", "udp"),
+				{"ip", "route", "add", "local", "172.24.1.0/25", "dev", "lo", "src", "127.0.0.1"},
+				tproxyRule("172.24.1.0/25", "tcp"),
+				tproxyRule("172.24.1.0/25", "udp"),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if cmds := testSetup(t, "", tc.ranges).firewall(); !reflect.DeepEqual(cmds, tc.expected) {
+				t.Errorf("unexpected commands:\n%q\nexpected:\n%q", cmds, tc.expected)
+			}
+		})
+	}
+}
+
+func TestInterview(t *testing.T) {
+	if _, err := net.InterfaceByName("lo"); err != nil {
+		t.Skipf("no loopback interface to answer with: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		input    []string
+		expected *initSetup
+		rejected []string
+	}{
+		{
+			name:  "valid answers",
+			input: []string{"lo", "10.0.0.1:53", "172.30.0.0/16", "8.8.8.8, 8.8.4.4", "127.0.0.1:4490"},
+			expected: &initSetup{
+				iface:     "lo",
+				dnsBind:   netip.MustParseAddrPort("10.0.0.1:53"),
+				upstreams: []string{"8.8.8.8", "8.8.4.4"},
+				proxyBind: netip.MustParseAddrPort("127.0.0.1:4490"),
+			},
+		},
+		{
+			name:  "invalid answers are asked again",
+			input: []string{"no-such-iface0", "-", "10.0.0.1", "10.0.0.1:53", "bogus", "172.30.0.0/16", ",", "8.8.8.8", "4490", "127.0.0.1:4490"},
+			expected: &initSetup{
+				dnsBind:   netip.MustParseAddrPort("10.0.0.1:53"),
+				upstreams: []string{"8.8.8.8"},
+				proxyBind: netip.MustParseAddrPort("127.0.0.1:4490"),
+			},
+			rejected: []string{
+				"no such network interface",
+				"not an ip:port",
+				`range "bogus"`,
+				"at least one upstream is required",
+				"not an ip:port",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out strings.Builder
+			p := &prompter{
+				in:  bufio.NewReader(strings.NewReader(strings.Join(tc.input, "\n") + "\n")),
+				out: &out,
+			}
+			s, err := interview(p)
+			if err != nil {
+				t.Fatalf("interview failed: %v\n%s", err, out.String())
+			}
+			if err := tc.expected.ipRange.Set("172.30.0.0/16"); err != nil {
+				t.Fatalf("can't parse range: %v", err)
+			}
+			if !reflect.DeepEqual(s, tc.expected) {
+				t.Errorf("unexpected setup %+v, expected %+v", s, tc.expected)
+			}
+			// Answers aren't echoed, so rejections follow questions.
+			var rejected []string
+			for _, line := range strings.Split(out.String(), "\n") {
+				if i := strings.Index(line, ":   "); i >= 0 {
+					rejected = append(rejected, line[i+4:])
+				}
+			}
+			if len(rejected) != len(tc.rejected) {
+				t.Fatalf("got rejections %q, expected %q", rejected, tc.rejected)
+			}
+			for i, msg := range tc.rejected {
+				if !strings.Contains(rejected[i], msg) {
+					t.Errorf("rejection %q doesn't mention %q", rejected[i], msg)
+				}
+			}
+		})
+	}
+}
+
+func TestInterviewEOF(t *testing.T) {
+	p := &prompter{
+		in:  bufio.NewReader(strings.NewReader("-\n")),
+		out: new(strings.Builder),
+	}
+	if _, err := interview(p); err == nil {
+		t.Error("interview succeeded on truncated input")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Snawoot/dns44/logsink"
+)
+
+// logBackend picks log destination for "auto" setting: journal when stderr
+// goes there anyway, Event Log for Windows service, stderr otherwise.
+func logBackend() string {
+	if *logBackendName != "auto" {
+		return *logBackendName
+	}
+	switch {
+	case logsink.JournaldConnected():
+		return "journald"
+	case logsink.IsWindowsService():
+		return "eventlog"
+	}
+	return "stderr"
+}
+
+// setupLogging directs log output to configured backend and syslog server,
+// and returns logger for query and connection log lines along with closers
+// of log sinks. Logger is nil if standard one has to be used.
+func setupLogging() (*log.Logger, []io.Closer) {
+	var (
+		out      io.Writer = os.Stderr
+		queryOut io.Writer = os.Stderr
+		closers  []io.Closer
+	)
+	identifier := strings.ToLower(ProgName)
+	switch backend := logBackend(); backend {
+	case "stderr":
+	case "journald":
+		journal, err := logsink.NewJournald(identifier)
+		if err != nil {
+			log.Fatalf("can't log to journal: %v", err)
+		}
+		out, queryOut = journal, journal.WithKind("query")
+		closers = append(closers, journal)
+	case "eventlog":
+		eventLog, err := logsink.NewEventLog(ProgName)
+		if err != nil {
+			log.Fatalf("can't log to Event Log: %v", err)
+		}
+		// Queries would flood Event Log, so they are sent only to syslog,
+		// if requested.
+		out, queryOut = eventLog, io.Discard
+		closers = append(closers, eventLog)
+	default:
+		log.Fatalf("bad -log-backend value %q", backend)
+	}
+
+	if *syslogURL != "" {
+		facility, err := logsink.ParseFacility(*syslogFacility)
+		if err != nil {
+			log.Fatalf("bad -syslog-facility value: %v", err)
+		}
+		sink, err := logsink.NewSyslog(*syslogURL, facility, identifier)
+		if err != nil {
+			log.Fatalf("bad -syslog value: %v", err)
+		}
+		out = io.MultiWriter(out, sink)
+		if *syslogQueries {
+			queryOut = io.MultiWriter(queryOut, sink.WithMsgID("query"))
+		}
+		closers = append(closers, sink)
+	}
+	if len(closers) == 0 {
+		return nil, nil
+	}
+	log.SetOutput(out)
+	return log.New(queryOut, log.Prefix(), log.Flags()), closers
+}
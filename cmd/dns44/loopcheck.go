@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	loopProbeTimeout = 2 * time.Second
+	// loopProbePort is the discard service port, so probe does no harm if
+	// it reaches some host after all.
+	loopProbePort = 9
+)
+
+const loopGuidance = "connection from dns44 process to mapped address %s was intercepted: " +
+	"TPROXY rules catch dns44 own outbound traffic, which causes connection loops. " +
+	"Exclude dns44 from rules, e.g. by matching its user with \"-m owner ! --uid-owner\" " +
+	"or by marking its sockets, and make sure mapped range is intercepted in PREROUTING only"
+
+// checkRedirectLoop dials address in mapped range from dns44 process. It is
+// routable only via TPROXY rules of dns44, so successful connection means
+// dns44 own traffic gets intercepted too.
+func checkRedirectLoop(addr netip.Addr) error {
+	conn, err := net.DialTimeout("tcp", netip.AddrPortFrom(addr, loopProbePort).String(), loopProbeTimeout)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	return fmt.Errorf(loopGuidance, addr)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/netip"
 	"os"
 	"os/signal"
@@ -13,8 +17,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/devices"
 	"github.com/Snawoot/dns44/dnsproxy"
+	"github.com/Snawoot/dns44/flowexport"
+	"github.com/Snawoot/dns44/logstream"
 	"github.com/Snawoot/dns44/mapping"
+	"github.com/Snawoot/dns44/notify"
 	"github.com/Snawoot/dns44/pool"
 	"github.com/Snawoot/dns44/tproxy"
 
@@ -45,33 +54,303 @@ func (a *addrPort) Set(arg string) error {
 	return nil
 }
 
+// addressRange is a set of disjoint address ranges given as comma-separated
+// list of START-END ranges and prefixes. Ranges of repeated options are
+// added up, except for default value, which the first option replaces.
 type addressRange struct {
-	rangeStart netip.Addr
-	rangeEnd   netip.Addr
+	ranges    []pool.Range
+	isDefault bool
 }
 
 func (r *addressRange) String() string {
 	if r == nil {
-		return "<nil>-<nil>"
+		return ""
 	}
-	return fmt.Sprintf("%s-%s", r.rangeStart, r.rangeEnd)
+	parts := make([]string, 0, len(r.ranges))
+	for _, rng := range r.ranges {
+		parts = append(parts, rng.String())
+	}
+	return strings.Join(parts, ",")
 }
 
 func (r *addressRange) Set(arg string) error {
-	parts := strings.SplitN(arg, "-", 2)
+	var ranges []pool.Range
+	for _, spec := range splitList(arg) {
+		rng, err := parseRange(spec)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, rng)
+	}
+	if len(ranges) == 0 {
+		return errors.New("empty address range")
+	}
+	if r.isDefault {
+		r.ranges, r.isDefault = nil, false
+	}
+	r.ranges = append(r.ranges, ranges...)
+	return nil
+}
+
+// isSet reports whether there are any ranges.
+func (r *addressRange) isSet() bool {
+	return len(r.ranges) > 0
+}
+
+// prefixes returns prefixes covering ranges.
+func (r *addressRange) prefixes() []netip.Prefix {
+	var res []netip.Prefix
+	for _, rng := range r.ranges {
+		res = append(res, rng.Prefixes()...)
+	}
+	return res
+}
+
+// parseRange parses START-END range or prefix.
+func parseRange(spec string) (pool.Range, error) {
+	if strings.Contains(spec, "/") {
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return pool.Range{}, fmt.Errorf("unable to parse prefix: %w", err)
+		}
+		return pool.PrefixRange(netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits())), nil
+	}
+	parts := strings.SplitN(spec, "-", 2)
 	if len(parts) < 2 {
-		return fmt.Errorf("bad number of components in range. expected 2, got %d", len(parts))
+		return pool.Range{}, fmt.Errorf("range %q has to be START-END or prefix", spec)
 	}
 	start, err := netip.ParseAddr(parts[0])
 	if err != nil {
-		return fmt.Errorf("unable to parse start address: %w", err)
+		return pool.Range{}, fmt.Errorf("unable to parse start address: %w", err)
 	}
 	end, err := netip.ParseAddr(parts[1])
 	if err != nil {
-		return fmt.Errorf("unable to parse end address: %w", err)
+		return pool.Range{}, fmt.Errorf("unable to parse end address: %w", err)
+	}
+	return pool.Range{Start: start.Unmap(), End: end.Unmap()}, nil
+}
+
+type pairPrefix struct {
+	value *pool.Pair6
+}
+
+func (p *pairPrefix) String() string {
+	if p == nil || p.value == nil {
+		return ""
+	}
+	return p.value.Prefix().String()
+}
+
+func (p *pairPrefix) Set(arg string) error {
+	prefix, err := netip.ParsePrefix(arg)
+	if err != nil {
+		return fmt.Errorf("unable to parse prefix %q: %w", arg, err)
+	}
+	pair6, err := pool.NewPair6(prefix)
+	if err != nil {
+		return err
+	}
+	p.value = pair6
+	return nil
+}
+
+// tenant is a set of listeners bound to its own mapping namespace.
+type tenant struct {
+	name      string
+	dnsAddr   netip.AddrPort
+	proxyAddr netip.AddrPort
+	// udpAddr, if set, is listened by UDP proxy instead of proxyAddr.
+	udpAddr netip.AddrPort
+	// dotAddr, dohAddr and doqAddr, if set, are listened by encrypted DNS
+	// services.
+	dotAddr netip.AddrPort
+	dohAddr netip.AddrPort
+	doqAddr netip.AddrPort
+}
+
+type tenantList []tenant
+
+func (l *tenantList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, t := range *l {
+		part := fmt.Sprintf("%s,%s,%s", t.name, t.dnsAddr, t.proxyAddr)
+		if t.udpAddr.IsValid() {
+			part += "," + t.udpAddr.String()
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *tenantList) Set(arg string) error {
+	parts := strings.Split(arg, ",")
+	if len(parts) != 3 && len(parts) != 4 {
+		return fmt.Errorf("bad number of components in tenant spec. expected 3 or 4, got %d", len(parts))
+	}
+	if parts[0] == "" {
+		return errors.New("tenant name can't be empty")
+	}
+	dnsAddr, err := netip.ParseAddrPort(parts[1])
+	if err != nil {
+		return fmt.Errorf("unable to parse DNS bind address: %w", err)
+	}
+	proxyAddr, err := netip.ParseAddrPort(parts[2])
+	if err != nil {
+		return fmt.Errorf("unable to parse proxy bind address: %w", err)
+	}
+	var udpAddr netip.AddrPort
+	if len(parts) == 4 {
+		udpAddr, err = netip.ParseAddrPort(parts[3])
+		if err != nil {
+			return fmt.Errorf("unable to parse UDP proxy bind address: %w", err)
+		}
+	}
+	*l = append(*l, tenant{
+		name:      parts[0],
+		dnsAddr:   dnsAddr,
+		proxyAddr: proxyAddr,
+		udpAddr:   udpAddr,
+	})
+	return nil
+}
+
+type prefixList []netip.Prefix
+
+func (l *prefixList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, p := range *l {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *prefixList) Set(arg string) error {
+	for _, item := range splitList(arg) {
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return fmt.Errorf("unable to parse prefix %q: %w", item, err)
+		}
+		*l = append(*l, p.Masked())
+	}
+	return nil
+}
+
+type portRuleList []tproxy.PortRule
+
+func (l *portRuleList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, r := range *l {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *portRuleList) Set(arg string) error {
+	rule, err := tproxy.ParsePortRule(arg)
+	if err != nil {
+		return err
 	}
-	r.rangeStart = start
-	r.rangeEnd = end
+	*l = append(*l, rule)
+	return nil
+}
+
+type quotaRuleList []tproxy.QuotaRule
+
+func (l *quotaRuleList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, r := range *l {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *quotaRuleList) Set(arg string) error {
+	rule, err := tproxy.ParseQuotaRule(arg)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, rule)
+	return nil
+}
+
+type cidrRuleList []tproxy.CIDRRule
+
+func (l *cidrRuleList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, r := range *l {
+		parts = append(parts, fmt.Sprintf("%s,%s", r.Prefix, r.Action))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *cidrRuleList) Set(arg string) error {
+	parts := strings.Split(arg, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("bad number of components in CIDR rule. expected 2, got %d", len(parts))
+	}
+	prefix, err := netip.ParsePrefix(parts[0])
+	if err != nil {
+		return fmt.Errorf("unable to parse prefix %q: %w", parts[0], err)
+	}
+	action, err := tproxy.ParseAction(parts[1])
+	if err != nil {
+		return err
+	}
+	*l = append(*l, tproxy.CIDRRule{
+		Prefix: prefix.Masked(),
+		Action: action,
+	})
+	return nil
+}
+
+type safeSearchList []dnsproxy.SafeSearchRule
+
+func (l *safeSearchList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, r := range *l {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *safeSearchList) Set(arg string) error {
+	rule, err := dnsproxy.ParseSafeSearchRule(arg)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, rule)
+	return nil
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(arg string) error {
+	*l = append(*l, arg)
 	return nil
 }
 
@@ -81,36 +360,211 @@ var (
 	version   = "undefined"
 
 	showVersion    = flag.Bool("version", false, "show program version and exit")
+	configFile     = flag.String("config", "", "YAML file, or TOML file with .toml extension, with settings grouped into sections like dns, upstream, pools and rules. Options given on command line override file")
 	dnsBindAddress = &addrPort{
 		value: netip.MustParseAddrPort("127.0.0.1:4453"),
 	}
-	dnsUpstream = flag.String("dns-upstream", "1.1.1.1", "upstream DNS server")
+	dnsUpstream = flag.String("dns-upstream", "1.1.1.1", "comma-separated list of upstream DNS servers. Each may be followed by \"#timeout=DURATION\" overriding -dns-upstream-timeout")
 	ipRange     = &addressRange{
-		rangeStart: netip.MustParseAddr("172.24.0.0"),
-		rangeEnd:   netip.MustParseAddr("172.24.255.255"),
+		ranges:    []pool.Range{pool.PrefixRange(netip.MustParsePrefix("172.24.0.0/16"))},
+		isDefault: true,
 	}
-	dbPath           = flag.String("db-path", defDBPath, "path to database")
+	dbPath           = flag.String("db-path", defDBPath, "path to database. "+mapping.InMemory+" keeps mappings in memory only, without any files")
+	mappingBackend   = flag.String("mapping-backend", defaultMappingBackend, "mapping storage backend: sqlite or memory")
+	snapshotInterval = flag.Duration("snapshot-interval", mapping.DefaultSnapshotInterval, "interval between state snapshots for memory mapping backend")
+	privacyKeyFile   = flag.String("privacy-key-file", "", "file with secret enabling privacy mode: mapping storage and logs get keyed hashes of domain names instead of names themselves. Plain names are kept in memory only")
+	mappingKeyFile   = flag.String("mapping-key-file", "", "file with secret used to encrypt state of memory mapping backend on disk. Existing unencrypted state gets encrypted")
 	ttl              = flag.Uint("ttl", 900, "TTL for responses")
+	upstreamTTL      = flag.Bool("ttl-from-upstream", false, "resolve mapped domains via upstream before mapping them and use TTL of upstream answer, clamped by -min-ttl and -max-ttl, for response and mapping lease. -ttl applies if upstream has no answer records or fails")
+	minTTL           = flag.Uint("min-ttl", 60, "lower bound of TTL taken from upstream with -ttl-from-upstream")
+	maxTTL           = flag.Uint("max-ttl", 3600, "upper bound of TTL taken from upstream with -ttl-from-upstream. Zero means no bound")
+	ttlPressure      = flag.String("ttl-pressure", "", "comma-separated list of PERCENT=TTL entries. While address pool occupancy is at least PERCENT, new mappings are leased and answered with TTL seconds, so addresses are recycled faster. Entry with highest reached PERCENT applies. Empty value disables it")
+	failOpen         = flag.Bool("fail-open", false, "pass queries to upstream without mapping while mapping storage fails or transparent proxy is down, instead of failing them. Clients then connect to destinations directly")
+	failOpenFailures = flag.Int("fail-open-failures", dnsproxy.DefaultFailOpenFailures, "number of consecutive mapping errors which turn on passthrough mode of -fail-open")
+	failOpenRetry    = flag.Duration("fail-open-retry", dnsproxy.DefaultFailOpenRetry, "interval between mapping attempts checking whether mapping storage recovered in passthrough mode of -fail-open")
 	proxyBindAddress = &addrPort{
 		value: netip.MustParseAddrPort("127.0.0.1:4480"),
 	}
-	dialTimeout = flag.Duration("dial-timeout", 10*time.Second, "dial timeout for connection originated by proxy")
-	debug       = flag.Bool("debug", false, "debug logging")
+	proxyUDPAddress  = &addrPort{}
+	adminAddress     = &addrPort{}
+	adminTokenFile   = flag.String("admin-token-file", "", "file with token required by admin API as bearer token or token query parameter. Required unless admin API is bound to loopback address")
+	dotAddress       = &addrPort{}
+	dohAddress       = &addrPort{}
+	doqAddress       = &addrPort{}
+	dnsTLSCert       = flag.String("dns-tls-cert", "", "certificate chain file of DNS-over-TLS, DNS-over-HTTPS and DNS-over-QUIC services. It's loaded again when it changes")
+	dnsTLSKey        = flag.String("dns-tls-key", "", "private key file of -dns-tls-cert")
+	dialTimeout      = flag.Duration("dial-timeout", 10*time.Second, "dial timeout for connection originated by proxy")
+	debug            = flag.Bool("debug", false, "debug logging")
+	maxProcs         = flag.String("gomaxprocs", "auto", "number of OS threads running Go code at once: auto (lowered to cgroup CPU quota, unless GOMAXPROCS environment variable is set), off (Go default, number of CPUs) or number")
+	memLimit         = flag.String("memory-limit", "off", "soft memory limit making garbage collector work harder as memory use approaches it: SIZE with optional K, M or G suffix, auto (90% of cgroup memory limit, unless GOMEMLIMIT environment variable is set) or off")
+	statusName       = flag.String("status-name", dnsproxy.DefaultStatusName, "domain name answered with TXT record holding dns44 version, uptime and address pool occupancy, so clients can check they use dns44. Empty value disables it")
+	debugAnnotations = flag.Bool("debug-annotations", false, "describe in DNS responses which rule matched query and which addresses were assigned, as Extended DNS Error text or TXT record in additional section. Discloses configuration to clients")
+	clientKeyPrefix  = flag.Int("client-key-prefix", 32, "prefix length IPv4 client addresses are masked to before use as mapping key")
+	clientKeyPrefix6 = flag.Int("client-key-prefix6", 128, "prefix length IPv6 client addresses are masked to before use as mapping key")
+	dnsClientKey     = flag.String("dns-client-key-source", "addr", "source of client identity for DNS queries: addr (query source address) or ecs (EDNS Client Subnet, if present, which has to be at least as long as -client-key-prefix or -client-key-prefix6 to match keys of proxied flows)")
+	dnsIfaceSubnets  = flag.String("dns-interface-subnets", "", "comma-separated list of network interfaces whose on-link subnets DNS queries are accepted from. UDP queries are checked by source address, TCP and encrypted ones by local address of connection, not by interface packets arrived on. Other queries are refused. Empty value allows all")
+	neverMap         = flag.String("never-map", strings.Join(dnsproxy.DefaultNeverMap, ","), "comma-separated list of DOMAIN[/QTYPE] entries which are resolved via upstream without mapping, including subdomains")
+	mapRulesFile     = flag.String("map-rules", "", "file with \"map DOMAIN[/QTYPE]\" and \"pass DOMAIN[/QTYPE]\" lines deciding whether domains and their subdomains are mapped or resolved via upstream. Most specific rule or -never-map entry wins. \"pass .\" makes listed domains the only mapped ones. File is reloaded when it changes")
+	preallocFile     = flag.String("prealloc", "", "file listing domains, one per line, mapped at startup for each of -prealloc-clients, so they have stable addresses before first query. Mappings are renewed while dns44 runs, so they never expire. File is read again on each renewal")
+	preallocClients  = flag.String("prealloc-clients", "", "comma-separated list of client addresses or prefixes -prealloc domains are mapped for. Addresses are masked to -client-key-prefix like addresses of querying clients")
+	rewriteTargets   = flag.String("rewrite-srv-targets", "", "comma-separated list of DOMAIN[/QTYPE] entries whose SRV and NAPTR responses get target address records removed, making clients resolve targets via mapping. Use \".\" for all domains")
+	addrsPerDomain   = flag.Int("addrs-per-domain", 1, "number of addresses mapped to each domain. Answers rotate them in round-robin order")
+	nxPassthrough    = flag.Bool("nxdomain-passthrough", false, "resolve mapped domains via upstream before mapping them and map only names which exist. Other answers, like NXDOMAIN or SERVFAIL, are passed to clients as is. Adds upstream round trip to each mapped query")
+	suppressAAAA     = flag.String("suppress-aaaa", "off", "answer to AAAA queries, including ones for never mapped domains: off (answer as usual), nodata or nxdomain")
+	dhcpLeases       = flag.String("dhcp-leases", "", "path to dnsmasq leases file or Kea CSV lease database. Host names of active leases are answered with leased addresses, without upstream and mapping")
+	dhcpDomain       = flag.String("dhcp-domain", "", "domain replacing domain part of DHCP lease host names, e.g. \"lan\"")
+	localQueries     = flag.String("local-queries", dnsproxy.LocalNXDomain.String(), "answer to queries for .local names, which are never mapped: nxdomain, upstream (pass to upstream) or mdns (resolve with multicast DNS)")
+	mdnsTimeout      = flag.Duration("mdns-timeout", dnsproxy.DefaultMDNSTimeout, "how long to wait for multicast DNS responses")
+	staticHost       = flag.String("static-host", "", "comma-separated list of DOMAIN=ADDRESS entries answered with fixed addresses, without upstream and mapping, and DOMAIN=map:BACKEND entries answered with addresses mapped to BACKEND domain. DOMAIN may start with \"*.\" to match all subdomains. Addresses of entries with the same domain are merged")
+	staticHostDirect = flag.Bool("static-host-direct", true, "forward proxied connections to static host addresses directly to them")
+	upstreamTimeout  = flag.Duration("dns-upstream-timeout", dnsproxy.DefaultUpstreamTimeout, "upstream DNS query timeout")
+	upstreamRetries  = flag.Int("dns-upstream-retries", 0, "number of retries of upstream DNS queries which failed with all upstreams")
+	upstreamBackoff  = flag.Duration("dns-upstream-retry-backoff", dnsproxy.DefaultRetryBackoff, "delay before first retry of failed upstream DNS query, doubled with each next retry")
+	healthInterval   = flag.Duration("dns-health-interval", 0, "interval of upstream DNS server health probes. Unhealthy upstreams are not used until they recover. Zero disables health checks")
+	healthFailures   = flag.Int("dns-health-failures", dnsproxy.DefaultHealthFailures, "number of consecutive failed probes which make upstream unhealthy")
+	healthProbe      = flag.String("dns-health-probe", dnsproxy.DefaultHealthProbe, "domain name queried for NS records to probe upstreams")
+	suppressAAAARule = flag.String("suppress-aaaa-rules", "", "comma-separated list of DOMAIN=POLICY entries overriding -suppress-aaaa for domains and their subdomains")
+	serveReverse     = flag.Bool("serve-reverse", true, "answer reverse zones of mapped ranges authoritatively, with PTR records pointing to mapped domains")
+	reverseAnyClient = flag.Bool("reverse-any-client", false, "answer PTR queries using mappings of any client when querying client has none. Needed if dns44 reverse zone is delegated from other resolver")
+	policyURL        = flag.String("policy-url", "", "URL of HTTP policy service deciding whether queried domains are mapped, passed to upstream or blocked. Queries are resolved with local rules when service fails")
+	policyScript     = flag.String("policy-script", "", "file with rules deciding whether queried domains are mapped, mapped to -pool of egress, passed to upstream or blocked, by conditions over query name, type, client, time and upstream answer. Can't be used with -policy-url")
+	policyTimeout    = flag.Duration("policy-timeout", dnsproxy.DefaultPolicyTimeout, "policy service request timeout")
+	rpzRefresh       = flag.Duration("rpz-refresh", dnsproxy.DefaultRPZRefresh, "how often -rpz zones are checked for updates")
+	feedRefresh      = flag.Duration("threat-feed-refresh", dnsproxy.DefaultFeedRefresh, "how often -threat-feed lists are fetched again")
+	ipfixCollector   = flag.String("ipfix-collector", "", "address of IPFIX collector proxied flow records are sent to over UDP, e.g. 192.168.1.2:4739")
+	ipfixTimeout     = flag.Duration("ipfix-active-timeout", flowexport.DefaultActiveTimeout, "interval of IPFIX records for long-lived flows")
+	ipfixDomainID    = flag.Uint("ipfix-domain-id", 0, "IPFIX observation domain ID")
+	logBackendName   = flag.String("log-backend", "auto", "log destination: stderr, journald (systemd journal with structured fields), eventlog (Windows Event Log) or auto, which picks journald when stderr goes to journal and eventlog when running as Windows service")
+	syslogURL        = flag.String("syslog", "", "syslog server logs are sent to as RFC 5424 messages, in addition to stderr: udp://HOST[:PORT], tcp://HOST[:PORT] or tls://HOST[:PORT]")
+	syslogFacility   = flag.String("syslog-facility", "daemon", "syslog facility: kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp or local0 to local7")
+	syslogQueries    = flag.Bool("syslog-queries", false, "send log lines of DNS queries and proxied connections to syslog too")
+	mqttURL          = flag.String("mqtt", "", "MQTT broker and topic prefix for per-client statistics and blocking pause commands: mqtt(s)://[USER:PASSWORD@]HOST[:PORT]/PREFIX")
+	mqttInterval     = flag.Duration("mqtt-interval", devices.DefaultPublishInterval, "interval of per-client statistics publications to MQTT")
+	mqttDiscovery    = flag.String("mqtt-discovery-prefix", devices.DefaultDiscoveryPrefix, "Home Assistant MQTT discovery prefix. Empty value disables discovery messages")
+	notifyPoolFull   = flag.Float64("notify-pool-threshold", 90, "address pool occupancy percentage triggering pool_full notification. Zero disables it")
+	notifyEvents     = flag.String("notify-events", strings.Join(notify.Events, ","), "comma-separated list of event kinds sent to notification sinks")
+	notifyCooldown   = flag.Duration("notify-cooldown", notify.DefaultCooldown, "minimal interval between notifications of one kind. Events in between are counted in the next notification")
+	policyCacheTTL   = flag.Duration("policy-cache-ttl", dnsproxy.DefaultPolicyCacheTTL, "how long policy service verdicts are cached, unless service specifies otherwise")
+	dnsSOANs         = flag.String("dns-soa-ns", dnsproxy.DefaultSOANs, "primary name server of synthetic SOA record in NODATA responses")
+	dnsSOAMbox       = flag.String("dns-soa-mbox", dnsproxy.DefaultSOAMbox, "responsible mailbox of synthetic SOA record in NODATA responses")
+	dnsNegativeTTL   = flag.Uint("dns-negative-ttl", 0, "TTL of synthetic SOA record in NODATA responses. Zero means same as -ttl")
+	dnsCompress      = flag.Bool("dns-compress", true, "compress names in DNS responses")
+	dnsMaxUDPSize    = flag.Int("dns-max-udp-size", 0, "cap on UDP DNS response size, applied below size advertised by client. Zero means no cap")
+	dnsTruncate      = flag.String("dns-truncate", "tc", "handling of synthesized UDP responses exceeding size limit: tc (drop records and set TC flag) or trim (drop records only)")
+	udpTimeout       = flag.Duration("udp-timeout", tproxy.UDPConnTrackTimeout, "idle timeout of proxied UDP sessions")
+	udpShortTimeout  = flag.Duration("udp-short-timeout", tproxy.DefaultUDPShortTimeout, "idle timeout of proxied DNS and NTP sessions")
+	udpLongTimeout   = flag.Duration("udp-long-timeout", tproxy.DefaultUDPLongTimeout, "idle timeout of proxied UDP sessions detected as QUIC or WireGuard")
+	udpWorkers       = flag.Int("udp-workers", 0, "number of workers forwarding UDP datagrams. Zero means number of CPUs")
+	copyBufSize      = flag.Int("tcp-buffer-size", tproxy.DefaultCopyBufSize, "size of buffers relaying proxied TCP streams, in bytes")
+	maxPendingConns  = flag.Int("tcp-max-pending", 0, "limit of TCP connections being set up at once. Connections beyond limit are closed. Zero means no limit")
+	maxAcceptRate    = flag.Float64("tcp-max-accept-rate", 0, "limit of accepted TCP connections per second. Connections beyond limit are closed. Zero means no limit")
+	resolvedCacheTTL = flag.Duration("resolved-cache-ttl", 0, "keep real addresses of mapped domains in mapping storage for this long, so proxy dials them without resolving domain for each connection. Zero disables cache")
+	loopCheck        = flag.String("loop-check", "warn", "check at startup whether dns44 own connections to mapped range are intercepted, which causes connection loops: warn, fail (refuse to start) or off")
+	proxyMode        = flag.String("proxy-mode", "tproxy", "how intercepted connections reach proxy: tproxy (TPROXY rules, TCP and UDP) or redirect (NAT REDIRECT rules, original destination is taken from SO_ORIGINAL_DST, TCP only)")
+	forbidPrivate    = flag.Bool("forbid-private", false, "refuse proxying connections to mapped domains which resolve to private, loopback or link-local addresses")
+	anyClient        = flag.Bool("any-client-fallback", false, "when reverse lookup for connecting client fails, use mapping made for any client")
+	tenants          tenantList
+	interceptRanges  prefixList
+	selfSources      prefixList
+	transferClients  prefixList
+	forbiddenRanges  prefixList
+	cidrRules        cidrRuleList
+	portRules        portRuleList
+	looseUDPRules    portRuleList
+	quotaRules       quotaRuleList
+	namedPools       namedRangeList
+	blockedRange     = &addressRange{}
+	blockPage        = flag.Bool("block-page", false, "answer HTTP connections to domains sinkholed by -blocked-range with page naming domain and rule which blocked it")
+	blockPageCACert  = flag.String("block-page-ca-cert", "", "CA certificate file used to issue certificates for block page served over HTTPS. Clients have to trust it. Without it HTTPS connections are just closed")
+	blockPageCAKey   = flag.String("block-page-ca-key", "", "private key file of -block-page-ca-cert")
+	poolRules        poolRuleList
+	notifySinks      sinkList
+	ip6Prefix        pairPrefix
+	rpzSources       stringList
+	threatFeeds      stringList
+	safeSearch       safeSearchList
+	deviceNames      stringList
 )
 
+var subcommands = map[string]func(args []string) int{
+	"backup":             runBackup,
+	"bench":              runBench,
+	"doctor":             runDoctor,
+	"init":               runInit,
+	"install-resolver":   runInstallResolver,
+	"pin":                runPin,
+	"restore":            runRestore,
+	"uninstall-resolver": runUninstallResolver,
+	"unpin":              runUnpin,
+}
+
 func init() {
-	flag.Var(ipRange, "ip-range", "IP address range where all DNS requests are mapped")
+	flag.Var(ipRange, "ip-range", "comma-separated list of IP address ranges START-END and prefixes where all DNS requests are mapped. Ranges must not overlap (can be repeated)")
+	flag.Var(blockedRange, "blocked-range", "comma-separated list of IP address ranges START-END and prefixes domains blocked by policy are mapped to, instead of NXDOMAIN answer. Proxy rejects connections to it, so blocks are visible on the wire. Empty value disables it")
+	flag.Var(&namedPools, "pool", "additional address pool NAME=RANGE[,RANGE...], where RANGE is START-END or prefix, which domains are directed to by -pool-rule. Ranges of pools must not overlap (can be repeated)")
+	flag.Var(&poolRules, "pool-rule", "DOMAIN=POOL entry making domain and its subdomains mapped to addresses from named pool instead of -ip-range. Most specific rule applies, \".\" matches all domains (can be repeated)")
 	flag.Var(dnsBindAddress, "dns-bind-address", "DNS service bind address")
 	flag.Var(proxyBindAddress, "proxy-bind-address", "transparent proxy service bind address")
+	flag.Var(proxyUDPAddress, "proxy-udp-bind-address", "UDP transparent proxy bind address. Defaults to -proxy-bind-address")
+	flag.Var(dotAddress, "dot-bind-address", "DNS-over-TLS service bind address, e.g. 0.0.0.0:853. Disabled unless set. Requires -dns-tls-cert and -dns-tls-key")
+	flag.Var(dohAddress, "doh-bind-address", "DNS-over-HTTPS service bind address, e.g. 0.0.0.0:443. Queries are served at /dns-query path. Disabled unless set. Requires -dns-tls-cert and -dns-tls-key")
+	flag.Var(doqAddress, "doq-bind-address", "DNS-over-QUIC service bind address, e.g. 0.0.0.0:853. Disabled unless set. Requires -dns-tls-cert and -dns-tls-key")
+	flag.Var(adminAddress, "admin-bind-address", "admin HTTP API bind address. It serves live log stream of DNS queries and proxied connections, pins mappings and reloads settings. Disabled unless set")
+	flag.Var(&tenants, "tenant", "additional set of listeners with its own mapping namespace: NAME,DNS_BIND_ADDRESS,PROXY_BIND_ADDRESS[,UDP_PROXY_BIND_ADDRESS] (can be repeated)")
+	flag.Var(&interceptRanges, "intercept-cidr", "comma-separated list of real address ranges proxy accepts connections to without prior DNS query, forwarding them to original destination (can be repeated)")
+	flag.Var(&transferClients, "transfer-allow", "comma-separated list of client address ranges allowed to transfer reverse zones of mapped ranges with AXFR or IXFR over TCP. Transfers hold PTR records of mappings of all clients (can be repeated)")
+	flag.Var(&selfSources, "dns-self-cidr", "comma-separated list of source address ranges of dns44 own outbound DNS queries. Queries from them are resolved via upstream without mapping (can be repeated)")
+	flag.Var(&portRules, "port-rule", "destination ports allowed for mapped domain and its subdomains: DOMAIN=PORT[-PORT][,...]. Most specific rule applies, \".\" matches all domains. Connections to other ports are rejected (can be repeated)")
+	flag.Var(&looseUDPRules, "udp-loose-rule", "UDP destination ports of mapped domain and its subdomains where sessions are tracked by client IP and destination only, surviving client source port changes: DOMAIN=PORT[-PORT][,...], e.g. .=443 for QUIC migration. Most specific rule applies, \".\" matches all domains (can be repeated)")
+	flag.Var(&quotaRules, "quota", "daily traffic limit of each client to mapped domain and its subdomains: DOMAIN=SIZE, where SIZE may have K, M, G or T suffix. Most specific rule applies, \".\" matches all domains (can be repeated)")
+	flag.Var(&forbiddenRanges, "forbid-cidr", "comma-separated list of address ranges proxied connections to mapped domains must not go to. Domains are checked by addresses they resolve to at dial time (can be repeated)")
+	flag.Var(&ip6Prefix, "ip6-prefix", "IPv6 prefix of /96 or shorter, e.g. ULA /64, for AAAA answers. Each mapped IPv6 address embeds mapped IPv4 address of the same domain in its last 32 bits. AAAA answers are empty if not set")
+	flag.Var(&rpzSources, "rpz", "Response Policy Zone blocking or passing queried domains to upstream, ahead of -policy-script and -policy-url: zone file path or axfr://[KEYNAME:SECRET@]HOST[:PORT]/ZONE[?alg=TSIG_ALGORITHM]. Earlier zones take precedence (can be repeated)")
+	flag.Var(&threatFeeds, "threat-feed", "threat intelligence feed blocking listed domains and their subdomains, ahead of -policy-script and -policy-url: [NAME=]PATH_OR_URL. Feed lists domains, hosts file entries, adblock rules or SHA-256 hashes of domains, one per line. Hits are logged and notified as \"threat\" event (can be repeated)")
+	flag.Var(&safeSearch, "safe-search", "force safe mode of search engines by answering their domains with addresses mapped to safe mode domains: ENGINE[,ENGINE...][@CLIENT[,...]], where CLIENT is address prefix or group:GROUP of -device. Engines are "+strings.Join(dnsproxy.SafeSearchEngines(), ", ")+". First rule applying to client wins, rule without clients applies to all clients (can be repeated)")
+	flag.Var(&deviceNames, "device", "friendly name and optional group of client: NAME[@GROUP]=ADDRESS|PREFIX|MAC. Names label clients in logs, notifications and MQTT statistics, groups scope -safe-search and policy rules. MAC addresses are resolved via ARP table of the host. Most specific entry wins (can be repeated)")
+	flag.Var(&notifySinks, "notify", "URL of notification sink for significant events: http(s)://... (JSON webhook), telegram://BOT_TOKEN@CHAT_ID or mqtt(s)://[USER:PASSWORD@]HOST[:PORT]/TOPIC (can be repeated)")
+	flag.Var(&cidrRules, "cidr-rule", "proxy routing rule by destination address: PREFIX,ACTION where ACTION is map, direct or block. First matching rule wins (can be repeated)")
 }
 
 func run() int {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			return cmd(os.Args[2:])
+		}
+	}
+
 	flag.Parse()
+	if err := loadConfig(flag.CommandLine); err != nil {
+		log.Fatalf("can't load config: %v", err)
+	}
 
 	if *showVersion {
 		fmt.Println(version)
 		return 0
 	}
+	if err := tuneRuntime(); err != nil {
+		log.Fatal(err)
+	}
+
+	queryLog, logClosers := setupLogging()
+	for _, closer := range logClosers {
+		defer closer.Close()
+	}
+
+	switch *loopCheck {
+	case "warn", "fail", "off":
+	default:
+		log.Fatalf("bad -loop-check value %q", *loopCheck)
+	}
+	switch *proxyMode {
+	case "tproxy", "redirect":
+	default:
+		log.Fatalf("bad -proxy-mode value %q", *proxyMode)
+	}
+	if len(transferClients) > 0 && !*serveReverse {
+		log.Fatalf("-transfer-allow requires -serve-reverse")
+	}
 
 	if *debug {
 		aglog.SetLevel(aglog.DEBUG)
@@ -118,30 +572,271 @@ func run() int {
 		aglog.SetLevel(aglog.ERROR)
 	}
 
-	ipPool, err := pool.New(ipRange.rangeStart, ipRange.rangeEnd)
+	ipPool, egressPools, err := newAddressPool()
 	if err != nil {
 		log.Fatalf("unable to create IP pool: %v", err)
 	}
 
-	ensureDir(*dbPath)
-	mapping, err := mapping.New(*dbPath, ipPool)
+	if *dbPath != mapping.InMemory {
+		ensureDir(*dbPath)
+	}
+	var hasher *mapping.NameHasher
+	if *privacyKeyFile != "" {
+		secret, err := readSecret(*privacyKeyFile)
+		if err != nil {
+			log.Fatalf("can't read privacy key: %v", err)
+		}
+		hasher = mapping.NewNameHasher(secret)
+	}
+	mapping, err := newMapper(*mappingBackend, *dbPath, ipPool, hasher)
 	if err != nil {
 		log.Fatalf("mapping init failed: %v", err)
 	}
+	var redactName func(string) string
+	if hasher != nil {
+		redactName = hasher.Hash
+	}
 	defer mapping.Close()
 
 	// Subscribe to the OS events.
 	appCtx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	notifier := newNotifier()
+	defer notifier.Close()
+	go watchPool(appCtx, notifier, poolUsage(mapping), *notifyPoolFull)
+	pressure := newTTLPressure()
+	go watchPressure(appCtx, pressure, poolUsage(mapping))
+	flows, flowExporter := startFlowExport()
+	defer flowExporter.Close()
+	names, err := devices.ParseNames(deviceNames)
+	if err != nil {
+		log.Fatalf("bad -device value: %v", err)
+	}
+	mon := monitoring{
+		notifier: notifier,
+		devices:  startMQTTBridge(appCtx, names),
+		names:    names,
+		redact:   redactName,
+		flows:    flows,
+		queryLog: queryLog,
+		pressure: pressure,
+		failOpen: newFailOpen(notifier),
+	}
+	var feedPolicies dnsproxy.PolicyChain
+	mon.policy, feedPolicies = decisionPolicy(notifier, redactName)
+
+	failed := make(chan error, 1)
+	var running []io.Closer
+	services := append(tenantList{{
+		dnsAddr:   dnsBindAddress.value,
+		proxyAddr: proxyBindAddress.value,
+		udpAddr:   proxyUDPAddress.value,
+		dotAddr:   dotAddress.value,
+		dohAddr:   dohAddress.value,
+		doqAddr:   doqAddress.value,
+	}}, tenants...)
+	var ownListeners []netip.AddrPort
+	if adminAddress.value.IsValid() {
+		mon.stream = logstream.NewHub()
+		ownListeners = append(ownListeners, adminAddress.value)
+	}
+	for _, t := range services {
+		ownListeners = append(ownListeners, t.dnsAddr, t.proxyAddr)
+		for _, addr := range []netip.AddrPort{t.udpAddr, t.dotAddr, t.dohAddr, t.doqAddr} {
+			if addr.IsValid() {
+				ownListeners = append(ownListeners, addr)
+			}
+		}
+	}
+	blockedPool, err := newBlockedPool()
+	if err != nil {
+		log.Fatalf("unable to create blocked domains pool: %v", err)
+	}
+	mon.blockReasons, mon.blockPage, err = newBlockPage()
+	if err != nil {
+		log.Fatalf("unable to set up block page: %v", err)
+	}
+	pins := make(map[string]pinner)
+	for _, t := range services {
+		var m, blocked listenerMapper = mapping, nil
+		if t.name != "" {
+			m = mapping.Namespace(t.name)
+		}
+		pins[t.name] = m
+		if blockedPool != nil {
+			blocked = mapping.Namespace(blockedNamespace(t.name)).WithPool(blockedPool)
+		}
+		// Egress mappings share tenant namespace, so proxy finds them.
+		egress := make(map[string]dnsproxy.Mapper, len(egressPools))
+		for name, p := range egressPools {
+			egress[name] = mapping.Namespace(t.name).WithPool(p)
+		}
+		for _, closer := range startServices(appCtx, t, m, blocked, egress, poolUsage(mapping), redactName, ownListeners, mon) {
+			defer closer.Close()
+			running = append(running, closer)
+			if s, ok := closer.(stoppable); ok {
+				go watchService(appCtx, s, failed, mon.failOpen)
+			}
+		}
+	}
+
+	reload := newReloader(running, feedPolicies)
+	admin, err := startAdmin(mon, pins, reload)
+	if err != nil {
+		log.Fatalf("unable to start admin server: %v", err)
+	}
+	if admin != nil {
+		defer admin.Close()
+	}
+
+	if *loopCheck != "off" {
+		if err := checkRedirectLoop(ipRange.ranges[0].End); err != nil {
+			if *loopCheck == "fail" {
+				log.Printf("redirect loop check failed: %v", err)
+				return 1
+			}
+			log.Printf("WARNING: %v", err)
+		}
+	}
+
+	notifyDump(appCtx, func() { dumpState(mapping, running, mon.flows) })
+	notifyReload(appCtx, func() { reload.reloadLogged("on SIGHUP") })
+
+	select {
+	case <-appCtx.Done():
+	case err := <-failed:
+		log.Printf("service stopped unexpectedly: %v", err)
+		return 1
+	}
+
+	return 0
+}
+
+// stoppable is a service which may stop on its own due to fatal error.
+type stoppable interface {
+	Addr() net.Addr
+	Done() <-chan struct{}
+	Err() error
+}
+
+// watchService reports failure of service. If failOpen is set, failed
+// service switches DNS to passthrough instead of stopping dns44.
+func watchService(ctx context.Context, s stoppable, failed chan<- error, failOpen *dnsproxy.FailOpen) {
+	select {
+	case <-ctx.Done():
+	case <-s.Done():
+		if err := s.Err(); err != nil {
+			if failOpen != nil {
+				log.Printf("service stopped unexpectedly: %v", err)
+				failOpen.SetFault("proxy "+s.Addr().String(), err)
+				return
+			}
+			select {
+			case failed <- err:
+			default:
+			}
+		}
+	}
+}
+
+func startServices(ctx context.Context, t tenant, m, blocked listenerMapper, egress map[string]dnsproxy.Mapper, usage func() (uint64, uint64, error), redactName func(string) string, ownListeners []netip.AddrPort, mon monitoring) []io.Closer {
+	var closers []io.Closer
+	label := ""
+	if t.name != "" {
+		label = fmt.Sprintf(" for namespace %q", t.name)
+	}
+
+	hosts := staticHosts()
 	dnsCfg := dnsproxy.Config{
-		ListenAddr: dnsBindAddress.value,
+		ListenAddr: t.dnsAddr,
 		Upstream:   *dnsUpstream,
-		Mapper:     mapping,
+		Mapper:     m,
 		TTL:        uint32(*ttl),
+		ClientKey:  dnsClientKeyExtractor(),
+
+		UpstreamTimeout:      *upstreamTimeout,
+		UpstreamTTL:          *upstreamTTL,
+		MinTTL:               uint32(*minTTL),
+		MaxTTL:               uint32(*maxTTL),
+		UpstreamRetries:      *upstreamRetries,
+		UpstreamRetryBackoff: *upstreamBackoff,
+		HealthCheckInterval:  *healthInterval,
+		HealthFailures:       *healthFailures,
+		HealthProbe:          *healthProbe,
+
+		InterfaceSubnets:   splitList(*dnsIfaceSubnets),
+		NeverMap:           splitList(*neverMap),
+		MapRulesFile:       *mapRulesFile,
+		PreallocFile:       *preallocFile,
+		PreallocClients:    preallocKeys(),
+		RewriteTargets:     splitList(*rewriteTargets),
+		Pair6:              ip6Prefix.value,
+		AddrsPerDomain:     *addrsPerDomain,
+		DisableCompression: !*dnsCompress,
+		MaxUDPSize:         *dnsMaxUDPSize,
+		Truncate:           truncateMode(),
+		ReverseAnyClient:   *reverseAnyClient,
+		SuppressAAAA:       aaaaPolicy(),
+		SuppressAAAARules:  splitList(*suppressAAAARule),
+		NXPassthrough:      *nxPassthrough,
+		SelfSources:        selfSources,
+		StaticHosts:        hosts,
+		SafeSearch:         safeSearch,
+		LeasesFile:         *dhcpLeases,
+		LeasesDomain:       *dhcpDomain,
+		LocalPolicy:        localPolicy(),
+		MDNSTimeout:        *mdnsTimeout,
+		DebugAnnotations:   *debugAnnotations,
+		StatusName:         *statusName,
+		Version:            version,
+		PoolUsage:          usage,
+		RedactName:         redactName,
+		Policy:             mon.policy,
+		Notifier:           mon.notifier,
+		QueryLog:           mon.queryLog,
+		TTLPressure:        mon.pressure,
+		FailOpen:           mon.failOpen,
+		SOA: dnsproxy.SOA{
+			Ns:   *dnsSOANs,
+			Mbox: *dnsSOAMbox,
+			TTL:  uint32(*dnsNegativeTTL),
+		},
+	}
+	if *serveReverse {
+		dnsCfg.ReverseZones = mappedPrefixes()
+		dnsCfg.TransferClients = transferClients
+	}
+	if len(egress) > 0 {
+		dnsCfg.EgressMappers = egress
+	}
+	if blocked != nil {
+		dnsCfg.BlockMapper = blocked
+		if mon.blockReasons != nil {
+			dnsCfg.BlockObserver = mon.blockReasons
+		}
+	}
+	if mon.devices != nil {
+		dnsCfg.Devices = mon.devices
+	}
+	if len(deviceNames) > 0 {
+		dnsCfg.ClientNames = mon.names
+	}
+	if mon.stream != nil {
+		dnsCfg.QueryObserver = queryStream{mon.stream}
+	}
+	if t.dotAddr.IsValid() || t.dohAddr.IsValid() || t.doqAddr.IsValid() {
+		tlsConfig, err := dnsTLSConfig()
+		if err != nil {
+			log.Fatalf("unable to set up encrypted DNS services: %v", err)
+		}
+		dnsCfg.TLSListenAddr = t.dotAddr
+		dnsCfg.HTTPSListenAddr = t.dohAddr
+		dnsCfg.QUICListenAddr = t.doqAddr
+		dnsCfg.TLSConfig = tlsConfig
 	}
 
-	log.Println("Starting DNS server...")
+	log.Printf("Starting DNS server%s...", label)
 	dnsProxy, err := dnsproxy.New(&dnsCfg)
 	if err != nil {
 		log.Fatalf("unable to instantiate DNS server: %v", err)
@@ -150,32 +845,336 @@ func run() int {
 	if err := dnsProxy.Start(); err != nil {
 		log.Fatalf("unable to start DNS server: %v", err)
 	}
-	defer dnsProxy.Close()
-	log.Println("DNS server started.")
+	closers = append(closers, dnsProxy)
+	log.Printf("DNS server%s started.", label)
 
 	proxyCfg := &tproxy.Config{
-		ListenAddr:  proxyBindAddress.value,
-		Mapper:      mapping,
-		DialTimeout: *dialTimeout,
+		ListenAddr:        t.proxyAddr,
+		UDPListenAddr:     t.udpAddr,
+		Mapper:            m,
+		DialTimeout:       *dialTimeout,
+		AnyClientFallback: *anyClient,
+		ClientKey:         tproxy.SourceClientKey{Masker: clientKeyMasker()},
+
+		LoopProtectRanges:    mappedPrefixes(),
+		LoopProtectListeners: ownListeners,
+		InterceptRanges:      interceptRanges,
+		CIDRRules:            proxyRules(hosts),
+		Pair6:                ip6Prefix.value,
+		LooseUDPRules:        looseUDPRules,
+		UDPTimeout:           *udpTimeout,
+		UDPShortTimeout:      *udpShortTimeout,
+		UDPLongTimeout:       *udpLongTimeout,
+		UDPWorkers:           *udpWorkers,
+		CopyBufSize:          *copyBufSize,
+		MaxPendingConns:      *maxPendingConns,
+		MaxAcceptRate:        *maxAcceptRate,
+		ResolvedCacheTTL:     *resolvedCacheTTL,
+		RedactName:           redactName,
+		ForbiddenRanges:      forbidden(),
+		PortRules:            portRules,
+		Quotas:               quotaRules,
+		Notifier:             mon.notifier,
+		ConnLog:              mon.queryLog,
+	}
+	if blocked != nil {
+		proxyCfg.BlockedRanges = blockedRange.prefixes()
+		proxyCfg.BlockedMapper = blocked
+		if mon.blockPage != nil {
+			proxyCfg.BlockPage = mon.blockPage
+		}
 	}
+	mon.observeProxy(proxyCfg)
 
-	log.Println("Starting UDP proxy server...")
-	udpProxy, err := tproxy.NewUDPProxy(appCtx, proxyCfg)
-	if err != nil {
-		log.Fatalf("unable to start UDP proxy: %v", err)
+	if *proxyMode == "redirect" {
+		proxyCfg.Transparent = tproxy.RedirectTransparent()
+		log.Printf("UDP proxy server%s is disabled in redirect mode.", label)
+	} else {
+		log.Printf("Starting UDP proxy server%s...", label)
+		udpProxy, err := tproxy.NewUDPProxy(ctx, proxyCfg)
+		if err != nil {
+			log.Fatalf("unable to start UDP proxy: %v", err)
+		}
+		closers = append(closers, udpProxy)
+		log.Printf("UDP proxy server%s started.", label)
 	}
-	defer udpProxy.Close()
-	log.Println("UDP proxy server started.")
 
-	log.Println("Starting TCP proxy server...")
-	if _, err := tproxy.NewTCPProxy(appCtx, proxyCfg); err != nil {
+	log.Printf("Starting TCP proxy server%s...", label)
+	tcpProxy, err := tproxy.NewTCPProxy(ctx, proxyCfg)
+	if err != nil {
 		log.Fatalf("unable to start TCP proxy: %v", err)
 	}
-	log.Println("TCP proxy server started.")
+	closers = append(closers, tcpProxy)
+	log.Printf("TCP proxy server%s started.", label)
 
-	<-appCtx.Done()
+	return closers
+}
 
-	return 0
+// forbidden returns ranges connections to mapped domains must not go to.
+func forbidden() []netip.Prefix {
+	ranges := append([]netip.Prefix(nil), forbiddenRanges...)
+	if *forbidPrivate {
+		ranges = append(ranges, tproxy.DefaultForbiddenRanges...)
+	}
+	return ranges
+}
+
+func mappedPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range addressRanges() {
+		prefixes = append(prefixes, r.prefixes()...)
+	}
+	if ip6Prefix.value != nil {
+		prefixes = append(prefixes, ip6Prefix.value.Prefix())
+	}
+	return prefixes
+}
+
+func clientKeyMasker() clientkey.Masker {
+	return clientkey.Masker{
+		Bits4: *clientKeyPrefix,
+		Bits6: *clientKeyPrefix6,
+	}
+}
+
+// preallocKeys returns keys of -prealloc-clients.
+func preallocKeys() []clientkey.Key {
+	var keys []clientkey.Key
+	for _, client := range splitList(*preallocClients) {
+		key, err := parseClientKey(client)
+		if err != nil {
+			log.Fatalf("bad -prealloc-clients entry: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// parseClientKey returns key of client given by address, which is masked
+// like addresses of querying clients, or by prefix.
+func parseClientKey(client string) (clientkey.Key, error) {
+	if prefix, err := netip.ParsePrefix(client); err == nil {
+		return clientkey.FromPrefix(prefix), nil
+	}
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return clientkey.Key{}, fmt.Errorf("client %q has to be address or prefix", client)
+	}
+	return clientKeyMasker().Key(addr), nil
+}
+
+// Client subnet lengths resolvers forward by default.
+const (
+	typicalECSPrefix4 = 24
+	typicalECSPrefix6 = 56
+)
+
+func dnsClientKeyExtractor() dnsproxy.ClientKeyExtractor {
+	switch *dnsClientKey {
+	case "addr":
+		return dnsproxy.AddrClientKey{Masker: clientKeyMasker()}
+	case "ecs":
+		if *clientKeyPrefix > typicalECSPrefix4 || *clientKeyPrefix6 > typicalECSPrefix6 {
+			log.Printf("WARNING: resolvers usually forward client subnets of /%d for IPv4 and /%d for IPv6. "+
+				"Queries with subnets shorter than -client-key-prefix /%d and -client-key-prefix6 /%d are refused client key, "+
+				"as proxy keys flows by source address masked to these prefixes",
+				typicalECSPrefix4, typicalECSPrefix6, *clientKeyPrefix, *clientKeyPrefix6)
+		}
+		return dnsproxy.ECSClientKey{Masker: clientKeyMasker()}
+	default:
+		log.Fatalf("unknown DNS client key source %q", *dnsClientKey)
+	}
+	return nil
+}
+
+// decisionPolicy returns policy of -rpz, -threat-feed and either
+// -policy-script or -policy-url, in that order. Zones and feeds are
+// returned apart too, as they refresh on their own and are kept on reload.
+func decisionPolicy(notifier *notify.Notifier, redactName func(string) string) (dnsproxy.Policy, dnsproxy.PolicyChain) {
+	var chain dnsproxy.PolicyChain
+	if len(rpzSources) > 0 {
+		policy, err := dnsproxy.NewRPZPolicy(rpzSources, *rpzRefresh)
+		if err != nil {
+			log.Fatalf("can't load response policy zones: %v", err)
+		}
+		chain = append(chain, policy)
+	}
+	if len(threatFeeds) > 0 {
+		policy, err := dnsproxy.NewFeedPolicy(threatFeeds, *feedRefresh, notifier, redactName)
+		if err != nil {
+			log.Fatalf("can't load threat feeds: %v", err)
+		}
+		chain = append(chain, policy)
+	}
+	policy, err := rulesPolicy(*policyScript, *policyURL, *policyTimeout, *policyCacheTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return joinPolicies(chain, policy), chain
+}
+
+// rulesPolicy returns policy of script or service URL, or nil if neither
+// is set.
+func rulesPolicy(script, url string, timeout, cacheTTL time.Duration) (dnsproxy.Policy, error) {
+	switch {
+	case script != "":
+		if url != "" {
+			return nil, errors.New("-policy-script and -policy-url are mutually exclusive")
+		}
+		policy, err := dnsproxy.LoadRulesPolicy(script)
+		if err != nil {
+			return nil, fmt.Errorf("can't load policy script: %w", err)
+		}
+		for _, egress := range policy.Egresses() {
+			if !poolDefined(egress) {
+				return nil, fmt.Errorf("policy script refers to egress %q not defined by -pool", egress)
+			}
+		}
+		return policy, nil
+	case url != "":
+		policy, err := dnsproxy.NewHTTPPolicy(url, timeout, cacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("can't set up policy service: %w", err)
+		}
+		return policy, nil
+	}
+	return nil, nil
+}
+
+// joinPolicies appends policy, unless it's nil, to chain and returns
+// the chain, its single policy or nil if it's empty.
+func joinPolicies(chain dnsproxy.PolicyChain, policy dnsproxy.Policy) dnsproxy.Policy {
+	if policy != nil {
+		chain = append(chain[:len(chain):len(chain)], policy)
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	}
+	return chain
+}
+
+type listenerMapper interface {
+	dnsproxy.Mapper
+	tproxy.Mapper
+	pinner
+}
+
+type mapper interface {
+	listenerMapper
+	mapping.Backend
+	Namespace(ns string) *mapping.NamespacedMapping
+}
+
+func newMapper(backend, dbPath string, addrPool mapping.AddrPool, hasher *mapping.NameHasher) (mapper, error) {
+	m, err := newStorage(backend, dbPath, addrPool)
+	if err != nil || hasher == nil {
+		return m, err
+	}
+	return mapping.NewPrivate(m, hasher), nil
+}
+
+func newStorage(backend, dbPath string, addrPool mapping.AddrPool) (mapper, error) {
+	if dbPath == mapping.InMemory {
+		return mapping.NewMemory(dbPath, addrPool, *snapshotInterval)
+	}
+	switch backend {
+	case "sqlite":
+		if *mappingKeyFile != "" {
+			return nil, errors.New("encryption is supported by memory mapping backend only")
+		}
+		return newSQLiteMapper(dbPath, addrPool)
+	case "memory":
+		if *mappingKeyFile != "" {
+			secret, err := readSecret(*mappingKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("can't read mapping key: %w", err)
+			}
+			return mapping.NewEncryptedMemory(dbPath, addrPool, *snapshotInterval, secret)
+		}
+		return mapping.NewMemory(dbPath, addrPool, *snapshotInterval)
+	default:
+		return nil, fmt.Errorf("unknown mapping backend %q", backend)
+	}
+}
+
+// readSecret reads key material from file.
+func readSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret = bytes.TrimSpace(secret); len(secret) == 0 {
+		return nil, fmt.Errorf("key file %q is empty", path)
+	}
+	return secret, nil
+}
+
+func splitList(list string) []string {
+	var res []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func aaaaPolicy() dnsproxy.AAAAPolicy {
+	policy, err := dnsproxy.ParseAAAAPolicy(*suppressAAAA)
+	if err != nil {
+		log.Fatalf("bad -suppress-aaaa value: %v", err)
+	}
+	return policy
+}
+
+func staticHosts() dnsproxy.StaticHosts {
+	hosts, err := dnsproxy.ParseStaticHosts(splitList(*staticHost))
+	if err != nil {
+		log.Fatalf("bad -static-host value: %v", err)
+	}
+	for _, addr := range hosts.Addrs() {
+		for _, prefix := range mappedPrefixes() {
+			if prefix.Contains(addr) {
+				log.Fatalf("static host address %s is within mapped range %s", addr, prefix)
+			}
+		}
+	}
+	return hosts
+}
+
+// proxyRules returns -cidr-rule rules followed by rules passing connections
+// to static host addresses through, so they don't need mapping.
+func proxyRules(hosts dnsproxy.StaticHosts) []tproxy.CIDRRule {
+	rules := append([]tproxy.CIDRRule(nil), cidrRules...)
+	if !*staticHostDirect {
+		return rules
+	}
+	for _, addr := range hosts.Addrs() {
+		rules = append(rules, tproxy.CIDRRule{
+			Prefix: netip.PrefixFrom(addr, addr.BitLen()),
+			Action: tproxy.ActionDirect,
+		})
+	}
+	return rules
+}
+
+func localPolicy() dnsproxy.LocalPolicy {
+	policy, err := dnsproxy.ParseLocalPolicy(*localQueries)
+	if err != nil {
+		log.Fatalf("bad -local-queries value: %v", err)
+	}
+	return policy
+}
+
+func truncateMode() dnsproxy.TruncateMode {
+	mode, err := dnsproxy.ParseTruncateMode(*dnsTruncate)
+	if err != nil {
+		log.Fatalf("bad -dns-truncate value: %v", err)
+	}
+	return mode
 }
 
 func ensureDir(path string) {
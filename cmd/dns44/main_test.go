@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestTenantList(t *testing.T) {
+	var l tenantList
+	for _, spec := range []string{
+		"vlan10,10.0.10.1:53,127.0.0.1:4481",
+		"vlan20,10.0.20.1:53,127.0.0.1:4482,127.0.0.1:4492",
+	} {
+		if err := l.Set(spec); err != nil {
+			t.Fatalf("Set(%q) failed: %v", spec, err)
+		}
+	}
+	if l[0].udpAddr.IsValid() {
+		t.Errorf("tenant without UDP address got %s", l[0].udpAddr)
+	}
+	if l[1].udpAddr != netip.MustParseAddrPort("127.0.0.1:4492") {
+		t.Errorf("got UDP address %s", l[1].udpAddr)
+	}
+	if s := l.String(); s != "vlan10,10.0.10.1:53,127.0.0.1:4481 vlan20,10.0.20.1:53,127.0.0.1:4482,127.0.0.1:4492" {
+		t.Errorf("unexpected String() %q", s)
+	}
+
+	for _, bad := range []string{
+		"vlan10,10.0.10.1:53",
+		",10.0.10.1:53,127.0.0.1:4481",
+		"vlan10,10.0.10.1:53,127.0.0.1:4481,bogus",
+		"vlan10,10.0.10.1:53,127.0.0.1:4481,127.0.0.1:4491,127.0.0.1:4501",
+	} {
+		if err := l.Set(bad); err == nil {
+			t.Errorf("bad tenant spec %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/dns44/blockpage"
+	"github.com/Snawoot/dns44/devices"
+	"github.com/Snawoot/dns44/dnsproxy"
+	"github.com/Snawoot/dns44/flowexport"
+	"github.com/Snawoot/dns44/logstream"
+	"github.com/Snawoot/dns44/mqtt"
+	"github.com/Snawoot/dns44/notify"
+	"github.com/Snawoot/dns44/tproxy"
+)
+
+// monitoring holds optional observers of services.
+type monitoring struct {
+	notifier *notify.Notifier
+	devices  *devices.Registry
+	flows    *flowexport.Table
+	// queryLog receives query and connection log lines. Nil means
+	// standard logger.
+	queryLog *log.Logger
+	// pressure shortens TTLs while address pool is crowded.
+	pressure *dnsproxy.TTLPressure
+	// failOpen switches DNS to passthrough while mapping or proxy fails.
+	failOpen *dnsproxy.FailOpen
+	// blockReasons and blockPage explain sinkholed blocks to clients.
+	blockReasons *blockpage.Reasons
+	blockPage    *blockpage.Server
+	// policy decides on queries of all namespaces, so feeds and zones
+	// are loaded once.
+	policy dnsproxy.Policy
+	// names gives friendly names and groups to clients.
+	names *devices.Names
+	// stream receives live log events for admin API subscribers, with
+	// domain names replaced by redact, if it's set.
+	stream *logstream.Hub
+	redact func(string) string
+}
+
+// observeProxy sets proxy hooks feeding device statistics, flow table and
+// live log stream.
+func (mon monitoring) observeProxy(cfg *tproxy.Config) {
+	if len(deviceNames) > 0 {
+		cfg.ClientNames = mon.names
+	}
+	if mon.devices == nil && mon.flows == nil && mon.stream == nil {
+		return
+	}
+	if mon.devices != nil {
+		cfg.Devices = mon.devices
+	}
+	cfg.OnConnect = func(info *tproxy.ConnInfo) error {
+		mon.devices.Connected(info.ClientKey)
+		mon.publishConn(logstream.KindConnect, info, 0, 0)
+		return nil
+	}
+	// Device traffic is counted once connection closes, so streams of
+	// connections remain spliced unless flows are exported.
+	cfg.OnClose = func(info *tproxy.ConnInfo, sent, received int64) {
+		mon.devices.AddTraffic(info.ClientKey, sent, received)
+		mon.flows.End(info)
+		mon.publishConn(logstream.KindClose, info, sent, received)
+	}
+	if mon.flows == nil {
+		return
+	}
+	cfg.OnData = func(info *tproxy.ConnInfo, toUpstream bool, n int) error {
+		sent, received := n, 0
+		if !toUpstream {
+			sent, received = 0, n
+		}
+		mon.flows.AddTraffic(info, flowexport.Flow{
+			Network:     info.Network,
+			Source:      info.Source,
+			Destination: info.Destination,
+			Host:        info.Host,
+		}, sent, received)
+		return nil
+	}
+}
+
+// poolCheckInterval is the interval of address pool occupancy checks.
+const poolCheckInterval = time.Minute
+
+// sinkList is a list of notification sinks given by URLs.
+type sinkList []string
+
+func (l *sinkList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, " ")
+}
+
+func (l *sinkList) Set(arg string) error {
+	if _, err := notify.ParseSink(arg); err != nil {
+		return err
+	}
+	*l = append(*l, arg)
+	return nil
+}
+
+// newNotifier returns notifier for configured sinks, or nil if there are
+// none.
+func newNotifier() *notify.Notifier {
+	if len(notifySinks) == 0 {
+		return nil
+	}
+	sinks := make([]notify.Sink, 0, len(notifySinks))
+	for _, spec := range notifySinks {
+		sink, err := notify.ParseSink(spec)
+		if err != nil {
+			log.Fatalf("bad notification sink: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	n, err := notify.New(sinks, splitList(*notifyEvents), *notifyCooldown)
+	if err != nil {
+		log.Fatalf("bad notification settings: %v", err)
+	}
+	return n
+}
+
+// watchPool notifies when address pool occupancy reaches threshold
+// percentage. Notification is repeated only after occupancy drops below
+// threshold and reaches it again.
+func watchPool(ctx context.Context, n *notify.Notifier, usage func() (uint64, uint64, error), threshold float64) {
+	if n == nil || threshold <= 0 {
+		return
+	}
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+	full := false
+	for {
+		used, size, err := usage()
+		if err != nil {
+			log.Printf("can't check address pool occupancy: %v", err)
+		} else if percent := float64(used) * 100 / float64(size); percent >= threshold && !full {
+			full = true
+			n.Notify(notify.EventPoolFull, "address pool is %.1f%% full: %d of %d addresses in use", percent, used, size)
+		} else if percent < threshold {
+			full = false
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newTTLPressure returns TTL adaptation configured by -ttl-pressure or
+// nil.
+func newTTLPressure() *dnsproxy.TTLPressure {
+	var steps []dnsproxy.TTLStep
+	for _, spec := range splitList(*ttlPressure) {
+		step, err := dnsproxy.ParseTTLStep(spec)
+		if err != nil {
+			log.Fatalf("bad -ttl-pressure value: %v", err)
+		}
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+	return dnsproxy.NewTTLPressure(steps)
+}
+
+// watchPressure feeds address pool occupancy to TTL adaptation.
+func watchPressure(ctx context.Context, p *dnsproxy.TTLPressure, usage func() (uint64, uint64, error)) {
+	if p == nil {
+		return
+	}
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+	for {
+		used, size, err := usage()
+		if err != nil {
+			log.Printf("can't check address pool occupancy: %v", err)
+		} else if size > 0 {
+			percent := float64(used) * 100 / float64(size)
+			if step, active, changed := p.Update(percent); changed && active {
+				log.Printf("address pool is %.1f%% full, shortening mapping TTL to %ds", percent, step.TTL)
+			} else if changed {
+				log.Printf("address pool is %.1f%% full, restoring normal TTL", percent)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newFailOpen returns passthrough switch enabled by -fail-open or nil.
+func newFailOpen(n *notify.Notifier) *dnsproxy.FailOpen {
+	if !*failOpen {
+		return nil
+	}
+	return dnsproxy.NewFailOpen(*failOpenFailures, *failOpenRetry, n)
+}
+
+// startMQTTBridge starts publishing per-client statistics to MQTT, if
+// configured, and returns registry tracking them. Clients are named by
+// names.
+func startMQTTBridge(ctx context.Context, names *devices.Names) *devices.Registry {
+	if *mqttURL == "" {
+		return nil
+	}
+	opts, prefix, err := mqtt.ParseURL(*mqttURL)
+	if err != nil {
+		log.Fatalf("bad -mqtt value: %v", err)
+	}
+	registry := devices.NewRegistry()
+	bridge := &devices.MQTTBridge{
+		Registry:        registry,
+		Options:         opts,
+		Prefix:          prefix,
+		Interval:        *mqttInterval,
+		DiscoveryPrefix: *mqttDiscovery,
+		Names:           names,
+	}
+	go bridge.Run(ctx)
+	return registry
+}
+
+// startFlowExport starts export of flow records to IPFIX collector, if
+// configured, and returns table tracking flows along with exporter.
+func startFlowExport() (*flowexport.Table, *flowexport.Exporter) {
+	if *ipfixCollector == "" {
+		return nil, nil
+	}
+	table := flowexport.NewTable()
+	exporter, err := flowexport.NewExporter(table, *ipfixCollector, uint32(*ipfixDomainID), *ipfixTimeout)
+	if err != nil {
+		log.Fatalf("can't start IPFIX export: %v", err)
+	}
+	return table, exporter
+}
@@ -0,0 +1,25 @@
+//go:build nosqlite
+
+package main
+
+import (
+	"errors"
+
+	"github.com/Snawoot/dns44/mapping"
+)
+
+// SQLite driver doesn't support some architectures, like MIPS. Such builds
+// use memory backend only.
+const defaultMappingBackend = "memory"
+
+func newSQLiteMapper(dbPath string, addrPool mapping.AddrPool) (mapper, error) {
+	return nil, errors.New("SQLite mapping backend is not available in this build")
+}
+
+func checkSQLite(dbPath string) error {
+	return errors.New("SQLite mapping backend is not available in this build")
+}
+
+func backupSQLite(dbPath, destDir string) error {
+	return errors.New("SQLite mapping backend is not available in this build")
+}
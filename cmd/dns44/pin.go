@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// runPin pins mapping given by arguments, or lists pinned mappings if there
+// are none, via admin API of running dns44.
+func runPin(args []string) int {
+	return pinCommand("pin", http.MethodPost, args)
+}
+
+// runUnpin unpins mapping via admin API of running dns44.
+func runUnpin(args []string) int {
+	return pinCommand("unpin", http.MethodDelete, args)
+}
+
+func pinCommand(name, method string, args []string) int {
+	flag.CommandLine.Init(name, flag.ExitOnError)
+	flag.CommandLine.Usage = func() {
+		if name == "pin" {
+			fmt.Fprintln(os.Stderr, "Usage: dns44 pin [options] [CLIENT ADDRESS [TENANT]]")
+		} else {
+			fmt.Fprintln(os.Stderr, "Usage: dns44 unpin [options] CLIENT ADDRESS [TENANT]")
+		}
+		fmt.Fprintln(os.Stderr, "Options locate admin API of running dns44, the same as in its configuration.")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	list := name == "pin" && flag.NArg() == 0
+	if !list && flag.NArg() != 2 && flag.NArg() != 3 {
+		flag.Usage()
+		return 2
+	}
+	if err := loadConfig(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	client, err := newAdminClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	if list {
+		err = client.listPins()
+	} else {
+		err = client.setPinned(method, flag.Arg(0), flag.Arg(1), flag.Arg(2))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// adminClient calls admin API of running dns44.
+type adminClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newAdminClient() (*adminClient, error) {
+	addr := adminAddress.value
+	if !addr.IsValid() {
+		return nil, errors.New("admin API is disabled, set -admin-bind-address")
+	}
+	if addr.Addr().IsUnspecified() {
+		loopback := netip.IPv6Loopback()
+		if addr.Addr().Is4() {
+			loopback = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		}
+		addr = netip.AddrPortFrom(loopback, addr.Port())
+	}
+	c := &adminClient{
+		base: "http://" + addr.String(),
+		http: &http.Client{Timeout: 10 * time.Second},
+	}
+	if *adminTokenFile != "" {
+		token, err := readSecret(*adminTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		c.token = string(token)
+	}
+	return c, nil
+}
+
+// do calls pins endpoint with query params and body, if it's not nil,
+// encoded as JSON.
+func (c *adminClient) do(method string, params url.Values, body, result any) error {
+	var content io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+"/pins?"+params.Encode(), content)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *adminClient) setPinned(method, client, addr, tenant string) error {
+	var entry pinEntry
+	if err := c.do(method, nil, pinRequest{
+		Tenant: tenant,
+		Client: client,
+		Addr:   addr,
+	}, &entry); err != nil {
+		return err
+	}
+	action := "unpinned"
+	if entry.Pinned {
+		action = "pinned"
+	}
+	fmt.Printf("%s => %s for client %s %s\n", entry.Domain, entry.Addr, entry.Client, action)
+	return nil
+}
+
+// listPins prints pinned mappings of all tenants.
+func (c *adminClient) listPins() error {
+	names := []string{""}
+	for _, t := range tenants {
+		names = append(names, t.name)
+	}
+	for _, tenant := range names {
+		var entries []pinEntry
+		if err := c.do(http.MethodGet, url.Values{"tenant": {tenant}}, nil, &entries); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			line := fmt.Sprintf("%s\t%s\t%s", entry.Client, entry.Addr, entry.Domain)
+			if tenant != "" {
+				line += "\t" + tenant
+			}
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
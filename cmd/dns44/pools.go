@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Snawoot/dns44/blockpage"
+	"github.com/Snawoot/dns44/mapping"
+	"github.com/Snawoot/dns44/pool"
+)
+
+// namedRange is an address pool which -pool-rule entries refer to.
+type namedRange struct {
+	name string
+	addressRange
+}
+
+type namedRangeList []namedRange
+
+func (l *namedRangeList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, r := range *l {
+		parts = append(parts, r.name+"="+r.addressRange.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *namedRangeList) Set(arg string) error {
+	name, spec, ok := strings.Cut(arg, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("pool %q has no name", arg)
+	}
+	r := namedRange{name: name}
+	if err := r.addressRange.Set(spec); err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// poolRule directs domain and its subdomains to named pool.
+type poolRule struct {
+	domain string
+	pool   string
+}
+
+type poolRuleList []poolRule
+
+func (l *poolRuleList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, r := range *l {
+		parts = append(parts, r.domain+"="+r.pool)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *poolRuleList) Set(arg string) error {
+	domain, name, ok := strings.Cut(arg, "=")
+	if !ok || domain == "" || name == "" {
+		return fmt.Errorf("bad pool rule %q, expected DOMAIN=POOL", arg)
+	}
+	*l = append(*l, poolRule{strings.ToLower(domain), name})
+	return nil
+}
+
+// addressRanges returns default range followed by ranges of named pools
+// and blocked domains range.
+func addressRanges() []addressRange {
+	ranges := []addressRange{*ipRange}
+	for _, r := range namedPools {
+		ranges = append(ranges, r.addressRange)
+	}
+	if blockedRange.isSet() {
+		ranges = append(ranges, *blockedRange)
+	}
+	return ranges
+}
+
+// blockedNamespace returns mapping namespace of blocked domains of
+// tenant. Tenant names can't contain commas, so it never clashes with
+// tenant namespace.
+func blockedNamespace(tenant string) string {
+	return tenant + ",blocked"
+}
+
+// newBlockedPool returns pool of -blocked-range or nil.
+func newBlockedPool() (mapping.AddrPool, error) {
+	if !blockedRange.isSet() {
+		return nil, nil
+	}
+	return pool.New(blockedRange.ranges)
+}
+
+// newBlockPage returns block page server if -block-page is set.
+func newBlockPage() (*blockpage.Reasons, *blockpage.Server, error) {
+	if !*blockPage {
+		return nil, nil, nil
+	}
+	if !blockedRange.isSet() {
+		return nil, nil, errors.New("-block-page requires -blocked-range")
+	}
+	var ca *blockpage.CA
+	if *blockPageCACert != "" || *blockPageCAKey != "" {
+		var err error
+		ca, err = blockpage.LoadCA(*blockPageCACert, *blockPageCAKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	reasons := blockpage.NewReasons()
+	return reasons, blockpage.New(reasons, ca), nil
+}
+
+// checkOverlap fails if address ranges overlap.
+func checkOverlap(ranges []addressRange) error {
+	var all []pool.Range
+	for _, r := range ranges {
+		all = append(all, r.ranges...)
+	}
+	for i, a := range all {
+		for _, b := range all[i+1:] {
+			if a.Overlaps(b) {
+				return fmt.Errorf("address ranges %s and %s overlap", a, b)
+			}
+		}
+	}
+	return nil
+}
+
+// newAddressPool returns pool of -ip-range, choosing named pools for
+// domains matched by -pool-rule, along with named pools by name, which
+// policy rules direct domains to as egress.
+func newAddressPool() (mapping.AddrPool, map[string]mapping.AddrPool, error) {
+	def, err := pool.New(ipRange.ranges)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkOverlap(addressRanges()); err != nil {
+		return nil, nil, err
+	}
+	if len(namedPools) == 0 {
+		if len(poolRules) > 0 {
+			return nil, nil, errors.New("-pool-rule requires -pool")
+		}
+		return def, nil, nil
+	}
+
+	pools := make(map[string]pool.AddressPool)
+	egress := make(map[string]mapping.AddrPool)
+	for _, r := range namedPools {
+		if _, ok := pools[r.name]; ok {
+			return nil, nil, fmt.Errorf("pool %q is defined twice", r.name)
+		}
+		p, err := pool.New(r.ranges)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pool %q: %w", r.name, err)
+		}
+		pools[r.name] = p
+		egress[r.name] = p
+	}
+	selector := pool.NewSelector(def)
+	for _, rule := range poolRules {
+		p, ok := pools[rule.pool]
+		if !ok {
+			return nil, nil, fmt.Errorf("pool rule %s=%s refers to undefined pool", rule.domain, rule.pool)
+		}
+		selector.Add(rule.domain, p)
+	}
+	return selector, egress, nil
+}
+
+// poolDefined reports whether -pool defines pool of given name.
+func poolDefined(name string) bool {
+	for _, r := range namedPools {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/dns44/dnsproxy"
+)
+
+// reloadOptions are options applied to running DNS services on reload.
+var reloadOptions = []string{
+	"dns-upstream",
+	"ttl",
+	"never-map",
+	"map-rules",
+	"policy-script",
+	"policy-url",
+	"policy-timeout",
+	"policy-cache-ttl",
+}
+
+// reloadSettings are values of reloadOptions.
+type reloadSettings struct {
+	Upstream       string        `json:"upstream"`
+	TTL            uint32        `json:"ttl"`
+	NeverMap       []string      `json:"never_map"`
+	MapRules       string        `json:"map_rules,omitempty"`
+	PolicyScript   string        `json:"policy_script,omitempty"`
+	PolicyURL      string        `json:"policy_url,omitempty"`
+	PolicyTimeout  time.Duration `json:"-"`
+	PolicyCacheTTL time.Duration `json:"-"`
+}
+
+// readReloadSettings reads reloadOptions again from -config file. Options
+// given on command line keep their values, options missing from file get
+// their defaults back.
+func readReloadSettings() (reloadSettings, error) {
+	var s reloadSettings
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	values := make(map[string]*string, len(reloadOptions))
+	for _, name := range reloadOptions {
+		f := flag.Lookup(name)
+		value := f.DefValue
+		if cmdlineOptions[name] {
+			value = f.Value.String()
+		}
+		values[name] = fs.String(name, value, f.Usage)
+	}
+	if *configFile != "" {
+		cfg, err := readConfig(*configFile)
+		if err != nil {
+			return s, err
+		}
+		if err := cfg.apply(fs, cmdlineOptions); err != nil {
+			return s, fmt.Errorf("%s: %w", *configFile, err)
+		}
+	}
+
+	ttl, err := strconv.ParseUint(*values["ttl"], 10, 32)
+	if err != nil {
+		return s, fmt.Errorf("bad -ttl value %q", *values["ttl"])
+	}
+	s.PolicyTimeout, err = time.ParseDuration(*values["policy-timeout"])
+	if err != nil {
+		return s, fmt.Errorf("bad -policy-timeout value %q", *values["policy-timeout"])
+	}
+	s.PolicyCacheTTL, err = time.ParseDuration(*values["policy-cache-ttl"])
+	if err != nil {
+		return s, fmt.Errorf("bad -policy-cache-ttl value %q", *values["policy-cache-ttl"])
+	}
+	s.Upstream = *values["dns-upstream"]
+	s.TTL = uint32(ttl)
+	s.NeverMap = splitList(*values["never-map"])
+	s.MapRules = *values["map-rules"]
+	s.PolicyScript = *values["policy-script"]
+	s.PolicyURL = *values["policy-url"]
+	return s, nil
+}
+
+// reloader applies settings read again to running DNS services without
+// restarting them, so listen sockets and mappings stay.
+type reloader struct {
+	mux     sync.Mutex
+	proxies []*dnsproxy.DNSProxy
+	// feeds are policies of -rpz and -threat-feed, which refresh on
+	// their own and are kept.
+	feeds dnsproxy.PolicyChain
+}
+
+func newReloader(services []io.Closer, feeds dnsproxy.PolicyChain) *reloader {
+	r := &reloader{feeds: feeds}
+	for _, s := range services {
+		if d, ok := s.(*dnsproxy.DNSProxy); ok {
+			r.proxies = append(r.proxies, d)
+		}
+	}
+	return r
+}
+
+// reload reads settings and applies them to all DNS services. It stops on
+// the first error: settings which fail don't change, but upstreams may be
+// replaced already when rules fail.
+func (r *reloader) reload() (reloadSettings, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	s, err := readReloadSettings()
+	if err != nil {
+		return s, err
+	}
+	policy, err := rulesPolicy(s.PolicyScript, s.PolicyURL, s.PolicyTimeout, s.PolicyCacheTTL)
+	if err != nil {
+		return s, err
+	}
+	rules := dnsproxy.Rules{
+		NeverMap:     s.NeverMap,
+		MapRulesFile: s.MapRules,
+		Policy:       joinPolicies(r.feeds, policy),
+	}
+	// All services get the same settings, so only the first one fails.
+	for _, d := range r.proxies {
+		if err := d.SetUpstream(s.Upstream); err != nil {
+			return s, err
+		}
+	}
+	for _, d := range r.proxies {
+		if err := d.SetRules(rules); err != nil {
+			return s, err
+		}
+		d.SetTTL(s.TTL)
+	}
+	return s, nil
+}
+
+// reloadLogged reloads settings and logs outcome. source tells what asked
+// for reload, like "on SIGHUP".
+func (r *reloader) reloadLogged(source string) (reloadSettings, error) {
+	s, err := r.reload()
+	if err != nil {
+		log.Printf("settings reload %s failed: %v", source, err)
+		return s, err
+	}
+	log.Printf("settings reloaded %s: upstream %q, TTL %d", source, s.Upstream, s.TTL)
+	return s, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// notifyReload does nothing on platforms without SIGHUP. Settings are
+// reloaded via admin API there.
+func notifyReload(ctx context.Context, reload func()) {}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/dnsproxy"
+)
+
+func TestReadReloadSettings(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "dns44.yaml")
+	defer func(config string, ttlValue uint, given map[string]bool) {
+		*configFile, *ttl, cmdlineOptions = config, ttlValue, given
+	}(*configFile, *ttl, cmdlineOptions)
+	*configFile, *ttl, cmdlineOptions = conf, 30, map[string]bool{"ttl": true}
+
+	write := func(content string) {
+		if err := os.WriteFile(conf, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+dns:
+  ttl: 60
+upstream:
+  servers: [1.1.1.1, 8.8.8.8]
+rules:
+  never_map: [example.com]
+policy:
+  timeout: 3s
+`)
+	s, err := readReloadSettings()
+	if err != nil {
+		t.Fatalf("readReloadSettings failed: %v", err)
+	}
+	expected := reloadSettings{
+		Upstream:       "1.1.1.1,8.8.8.8",
+		TTL:            30,
+		NeverMap:       []string{"example.com"},
+		PolicyTimeout:  3 * time.Second,
+		PolicyCacheTTL: dnsproxy.DefaultPolicyCacheTTL,
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("got %+v, expected %+v", s, expected)
+	}
+
+	// Options removed from file get their defaults back.
+	write("upstream:\n  servers: [9.9.9.9]\n")
+	s, err = readReloadSettings()
+	if err != nil {
+		t.Fatalf("readReloadSettings failed: %v", err)
+	}
+	if s.PolicyTimeout != dnsproxy.DefaultPolicyTimeout || !reflect.DeepEqual(s.NeverMap, dnsproxy.DefaultNeverMap) {
+		t.Errorf("removed options got %v, %q", s.PolicyTimeout, s.NeverMap)
+	}
+
+	write("policy:\n  timeout: soon\n")
+	if _, err := readReloadSettings(); err == nil {
+		t.Error("bad config file accepted")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// resolverMarker starts files written by install-resolver, so uninstall
+// never removes files it didn't create.
+const resolverMarker = "# Managed by dns44 install-resolver. Remove with dns44 uninstall-resolver.\n"
+
+const (
+	resolvedDropIn   = "/etc/systemd/resolved.conf.d/dns44.conf"
+	nmDropIn         = "/etc/NetworkManager/conf.d/dns44.conf"
+	nmDnsmasqDropIn  = "/etc/NetworkManager/dnsmasq.d/dns44.conf"
+	resolvedStateDir = "/run/systemd/resolve"
+	nmStateDir       = "/run/NetworkManager"
+)
+
+// resolverFile is a config file making host resolver use dns44.
+type resolverFile struct {
+	path    string
+	content string
+}
+
+// resolverMethod configures one kind of host resolver.
+type resolverMethod struct {
+	files  func(server netip.AddrPort, domains []string) []resolverFile
+	paths  []string
+	reload []string
+}
+
+var resolverMethods = map[string]resolverMethod{
+	// systemd-resolved routes domains with "~" prefix to the link DNS
+	// server; "~." routes all of them.
+	"resolved": {
+		files: func(server netip.AddrPort, domains []string) []resolverFile {
+			routes := make([]string, 0, len(domains))
+			for _, domain := range domains {
+				routes = append(routes, "~"+domain)
+			}
+			if len(routes) == 0 {
+				routes = append(routes, "~.")
+			}
+			return []resolverFile{{
+				path:    resolvedDropIn,
+				content: fmt.Sprintf("[Resolve]\nDNS=%s\nDomains=%s\n", server, strings.Join(routes, " ")),
+			}}
+		},
+		paths:  []string{resolvedDropIn},
+		reload: []string{"systemctl", "try-reload-or-restart", "systemd-resolved"},
+	},
+	// NetworkManager is switched to its dnsmasq plugin, which can forward
+	// domains to server on non-standard port.
+	"networkmanager": {
+		files: func(server netip.AddrPort, domains []string) []resolverFile {
+			target := fmt.Sprintf("%s#%d", server.Addr(), server.Port())
+			var servers strings.Builder
+			for _, domain := range domains {
+				fmt.Fprintf(&servers, "server=/%s/%s\n", domain, target)
+			}
+			if len(domains) == 0 {
+				fmt.Fprintf(&servers, "no-resolv\nserver=%s\n", target)
+			}
+			return []resolverFile{
+				{path: nmDropIn, content: "[main]\ndns=dnsmasq\n"},
+				{path: nmDnsmasqDropIn, content: servers.String()},
+			}
+		},
+		paths:  []string{nmDropIn, nmDnsmasqDropIn},
+		reload: []string{"nmcli", "general", "reload"},
+	},
+}
+
+// detectResolverMethod picks method for resolver running on host.
+func detectResolverMethod() (string, error) {
+	if _, err := os.Stat(resolvedStateDir); err == nil {
+		return "resolved", nil
+	}
+	if _, err := os.Stat(nmStateDir); err == nil {
+		return "networkmanager", nil
+	}
+	return "", errors.New("neither systemd-resolved nor NetworkManager is running, use -method option")
+}
+
+func resolverFlags(name string) (*flag.FlagSet, *string, *bool) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	method := fs.String("method", "auto", "host resolver to configure: auto, resolved (systemd-resolved drop-in) or networkmanager (NetworkManager dnsmasq plugin)")
+	dryRun := fs.Bool("dry-run", false, "print changes instead of applying them")
+	return fs, method, dryRun
+}
+
+func resolverMethodByName(name string) (resolverMethod, error) {
+	if name == "auto" {
+		var err error
+		if name, err = detectResolverMethod(); err != nil {
+			return resolverMethod{}, err
+		}
+	}
+	method, ok := resolverMethods[name]
+	if !ok {
+		return resolverMethod{}, fmt.Errorf("unknown resolver method %q", name)
+	}
+	return method, nil
+}
+
+// runInstallResolver configures host resolver to send queries for given
+// domains, or all queries, to dns44.
+func runInstallResolver(args []string) int {
+	fs, methodName, dryRun := resolverFlags("install-resolver")
+	server := &addrPort{value: dnsBindAddress.value}
+	fs.Var(server, "dns-server", "address of dns44 DNS server")
+	domains := fs.String("domains", "", "comma-separated list of domains resolved via dns44. Empty value sends all queries to dns44")
+	fs.Parse(args)
+
+	method, err := resolverMethodByName(*methodName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "install-resolver: %v\n", err)
+		return 2
+	}
+	var domainList []string
+	for _, domain := range splitList(*domains) {
+		domainList = append(domainList, strings.Trim(strings.ToLower(domain), "."))
+	}
+
+	for _, f := range method.files(server.value, domainList) {
+		content := resolverMarker + f.content
+		if *dryRun {
+			fmt.Printf("# %s\n%s\n", f.path, content)
+			continue
+		}
+		if err := checkResolverFile(f.path); err != nil {
+			fmt.Fprintf(os.Stderr, "install-resolver: %v\n", err)
+			return 1
+		}
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "install-resolver: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(f.path, []byte(content), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "install-resolver: %v\n", err)
+			return 1
+		}
+		fmt.Printf("wrote %s\n", f.path)
+	}
+	return reloadResolver(method, *dryRun)
+}
+
+// runUninstallResolver removes configuration written by install-resolver.
+func runUninstallResolver(args []string) int {
+	fs, methodName, dryRun := resolverFlags("uninstall-resolver")
+	fs.Parse(args)
+
+	method, err := resolverMethodByName(*methodName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "uninstall-resolver: %v\n", err)
+		return 2
+	}
+	for _, path := range method.paths {
+		if err := checkResolverFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "uninstall-resolver: %v\n", err)
+			return 1
+		}
+		if *dryRun {
+			fmt.Printf("would remove %s\n", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "uninstall-resolver: %v\n", err)
+			return 1
+		}
+		fmt.Printf("removed %s\n", path)
+	}
+	return reloadResolver(method, *dryRun)
+}
+
+// checkResolverFile refuses to touch existing file not written by
+// install-resolver.
+func checkResolverFile(path string) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(content, []byte(resolverMarker)) {
+		return fmt.Errorf("%s exists and wasn't written by dns44, refusing to change it", path)
+	}
+	return nil
+}
+
+func reloadResolver(method resolverMethod, dryRun bool) int {
+	if dryRun {
+		fmt.Printf("would run %s\n", strings.Join(method.reload, " "))
+		return 0
+	}
+	cmd := exec.Command(method.reload[0], method.reload[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "resolver reload failed (%v), run %q manually\n", err, strings.Join(method.reload, " "))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	rtdebug "runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// memoryLimitShare is part of cgroup memory limit taken as soft memory
+// limit by "-memory-limit auto", leaving room for non-heap memory.
+const memoryLimitShare = 0.9
+
+// tuneRuntime applies -gomaxprocs and -memory-limit options.
+func tuneRuntime() error {
+	var cpus float64
+	var cgroupMemory int64
+	if *maxProcs == "auto" || *memLimit == "auto" {
+		var err error
+		cpus, cgroupMemory, err = cgroupLimits()
+		if err != nil {
+			log.Printf("can't read cgroup limits: %v", err)
+		}
+	}
+
+	switch *maxProcs {
+	case "off":
+	case "auto":
+		// Explicit environment setting wins, as it does for Go runtime.
+		if os.Getenv("GOMAXPROCS") != "" || cpus == 0 {
+			break
+		}
+		procs := int(math.Max(1, math.Floor(cpus)))
+		if procs < runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(procs)
+			log.Printf("GOMAXPROCS set to %d by cgroup CPU quota", procs)
+		}
+	default:
+		procs, err := strconv.Atoi(*maxProcs)
+		if err != nil || procs <= 0 {
+			return fmt.Errorf("bad -gomaxprocs value %q", *maxProcs)
+		}
+		runtime.GOMAXPROCS(procs)
+	}
+
+	switch *memLimit {
+	case "off":
+	case "auto":
+		if os.Getenv("GOMEMLIMIT") != "" || cgroupMemory == 0 {
+			break
+		}
+		limit := int64(float64(cgroupMemory) * memoryLimitShare)
+		rtdebug.SetMemoryLimit(limit)
+		log.Printf("soft memory limit set to %d bytes by cgroup memory limit", limit)
+	default:
+		limit, err := parseMemorySize(*memLimit)
+		if err != nil {
+			return fmt.Errorf("bad -memory-limit value: %w", err)
+		}
+		rtdebug.SetMemoryLimit(limit)
+	}
+	return nil
+}
+
+// parseMemorySize parses number of bytes, optionally with K, M or G binary
+// suffix.
+func parseMemorySize(arg string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(arg))
+	unit := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("bad size %q", arg)
+	}
+	return n * unit, nil
+}
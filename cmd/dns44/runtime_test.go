@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseMemorySize(t *testing.T) {
+	for _, tc := range []struct {
+		arg  string
+		size int64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"64K", 64 << 10, true},
+		{"256m", 256 << 20, true},
+		{" 2G ", 2 << 30, true},
+		{"8589934591G", 8589934591 << 30, true},
+		{"8589934592G", 0, false},
+		{"9223372036854775808", 0, false},
+		{"", 0, false},
+		{"0", 0, false},
+		{"-1M", 0, false},
+		{"G", 0, false},
+		{"1T", 0, false},
+		{"1.5G", 0, false},
+	} {
+		size, err := parseMemorySize(tc.arg)
+		if tc.ok && (err != nil || size != tc.size) {
+			t.Errorf("parseMemorySize(%q) = %d, %v, expected %d", tc.arg, size, err, tc.size)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("parseMemorySize(%q) = %d, expected error", tc.arg, size)
+		}
+	}
+}
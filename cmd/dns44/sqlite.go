@@ -0,0 +1,19 @@
+//go:build !nosqlite
+
+package main
+
+import "github.com/Snawoot/dns44/mapping"
+
+const defaultMappingBackend = "sqlite"
+
+func newSQLiteMapper(dbPath string, addrPool mapping.AddrPool) (mapper, error) {
+	return mapping.New(dbPath, addrPool)
+}
+
+func checkSQLite(dbPath string) error {
+	return mapping.CheckSQLite(dbPath)
+}
+
+func backupSQLite(dbPath, destDir string) error {
+	return mapping.BackupSQLite(dbPath, destDir)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// reloadingCert serves TLS certificate of encrypted DNS listeners and loads
+// it again when its files change, so renewed certificates apply without
+// restart.
+type reloadingCert struct {
+	certFile string
+	keyFile  string
+
+	mux     sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newReloadingCert(certFile, keyFile string) (*reloadingCert, error) {
+	c := &reloadingCert{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// filesModTime returns the latest modification time of certificate files.
+func (c *reloadingCert) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("can't stat TLS certificate file: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *reloadingCert) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load TLS certificate: %w", err)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. Certificate which
+// fails to load keeps previous one in use.
+func (c *reloadingCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if now := time.Now(); now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		modTime, err := c.filesModTime()
+		if err == nil && !modTime.Equal(c.modTime) {
+			err = c.load(modTime)
+			if err == nil {
+				log.Printf("TLS certificate %s reloaded", c.certFile)
+			}
+		}
+		if err != nil {
+			log.Printf("TLS certificate reload failed: %v", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// dnsTLSConfig returns TLS configuration of encrypted DNS listeners.
+func dnsTLSConfig() (*tls.Config, error) {
+	if *dnsTLSCert == "" || *dnsTLSKey == "" {
+		return nil, fmt.Errorf("encrypted DNS listeners require -dns-tls-cert and -dns-tls-key")
+	}
+	cert, err := newReloadingCert(*dnsTLSCert, *dnsTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: cert.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,204 @@
+// Package devices keeps per-client statistics and lets blocking be paused
+// for particular clients.
+package devices
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// idleTTL is how long client is kept after its last query or connection,
+// unless its blocking is paused. Statistics of forgotten client start
+// over.
+const idleTTL = 24 * time.Hour
+
+// Stats is a snapshot of client statistics.
+type Stats struct {
+	Key         clientkey.Key
+	Queries     uint64
+	Blocked     uint64
+	Connections uint64
+	Sent        uint64
+	Received    uint64
+	// Paused reports whether blocking is paused for client.
+	Paused bool
+	// PausedUntil is when pause ends. It's zero for pause without time
+	// limit.
+	PausedUntil time.Time
+}
+
+type device struct {
+	queries     atomic.Uint64
+	blocked     atomic.Uint64
+	connections atomic.Uint64
+	sent        atomic.Uint64
+	received    atomic.Uint64
+
+	// Fields below are guarded by Registry mutex.
+	seen        time.Time
+	paused      bool
+	pausedUntil time.Time
+}
+
+// Registry tracks clients, identified by mapping client keys. Clients
+// idle for a day are forgotten. Nil Registry tracks nothing.
+type Registry struct {
+	now func() time.Time
+
+	mux       sync.Mutex
+	devices   map[clientkey.Key]*device
+	lastPurge time.Time
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		now:     time.Now,
+		devices: make(map[clientkey.Key]*device),
+	}
+}
+
+func (r *Registry) device(key clientkey.Key) *device {
+	now := r.now()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if now.Sub(r.lastPurge) > time.Minute {
+		for k, d := range r.devices {
+			if now.Sub(d.seen) > idleTTL && !r.pausedLocked(d) {
+				delete(r.devices, k)
+			}
+		}
+		r.lastPurge = now
+	}
+	d, ok := r.devices[key]
+	if !ok {
+		d = new(device)
+		r.devices[key] = d
+	}
+	d.seen = now
+	return d
+}
+
+// Query counts DNS query of client.
+func (r *Registry) Query(key clientkey.Key) {
+	if r != nil {
+		r.device(key).queries.Add(1)
+	}
+}
+
+// Blocked counts query or connection of client which was blocked.
+func (r *Registry) Blocked(key clientkey.Key) {
+	if r != nil {
+		r.device(key).blocked.Add(1)
+	}
+}
+
+// Connected counts proxied connection of client.
+func (r *Registry) Connected(key clientkey.Key) {
+	if r != nil {
+		r.device(key).connections.Add(1)
+	}
+}
+
+// AddTraffic counts bytes client sent and received via proxy.
+func (r *Registry) AddTraffic(key clientkey.Key, sent, received int64) {
+	if r == nil {
+		return
+	}
+	d := r.device(key)
+	d.sent.Add(uint64(sent))
+	d.received.Add(uint64(received))
+}
+
+// Pause pauses blocking for client for duration d, or until Resume if d
+// isn't positive.
+func (r *Registry) Pause(key clientkey.Key, d time.Duration) {
+	dev := r.device(key)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	dev.paused = true
+	dev.pausedUntil = time.Time{}
+	if d > 0 {
+		dev.pausedUntil = r.now().Add(d)
+	}
+}
+
+// Resume ends pause of blocking for client.
+func (r *Registry) Resume(key clientkey.Key) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if d, ok := r.devices[key]; ok {
+		d.paused = false
+	}
+}
+
+// BlockingPaused reports whether blocking is paused for client.
+func (r *Registry) BlockingPaused(key clientkey.Key) bool {
+	if r == nil {
+		return false
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	d, ok := r.devices[key]
+	return ok && r.pausedLocked(d)
+}
+
+func (r *Registry) pausedLocked(d *device) bool {
+	if d.paused && !d.pausedUntil.IsZero() && !r.now().Before(d.pausedUntil) {
+		d.paused = false
+	}
+	return d.paused
+}
+
+// Devices returns statistics of all known clients, ordered by key.
+func (r *Registry) Devices() []Stats {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res := make([]Stats, 0, len(r.devices))
+	for key, d := range r.devices {
+		st := Stats{
+			Key:         key,
+			Queries:     d.queries.Load(),
+			Blocked:     d.blocked.Load(),
+			Connections: d.connections.Load(),
+			Sent:        d.sent.Load(),
+			Received:    d.received.Load(),
+			Paused:      r.pausedLocked(d),
+		}
+		if st.Paused {
+			st.PausedUntil = d.pausedUntil
+		}
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key.String() < res[j].Key.String()
+	})
+	return res
+}
+
+// Find returns key of known client with given ID.
+func (r *Registry) Find(id string) (clientkey.Key, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for key := range r.devices {
+		if ID(key) == id {
+			return key, true
+		}
+	}
+	return clientkey.Key{}, false
+}
+
+// ID returns client identifier usable as MQTT topic level and Home
+// Assistant object ID.
+func ID(key clientkey.Key) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key.String())
+}
@@ -0,0 +1,113 @@
+package devices
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	phone := clientkey.FromAddr(netip.MustParseAddr("192.168.1.10"))
+	tv := clientkey.FromPrefix(netip.MustParsePrefix("192.168.2.0/24"))
+
+	r.Query(phone)
+	r.Query(phone)
+	r.Blocked(phone)
+	r.Connected(tv)
+	r.AddTraffic(tv, 100, 2000)
+	r.AddTraffic(tv, 50, 0)
+
+	stats := r.Devices()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 devices, got %+v", stats)
+	}
+	if st := stats[0]; st.Key != phone || st.Queries != 2 || st.Blocked != 1 {
+		t.Errorf("unexpected phone stats %+v", st)
+	}
+	if st := stats[1]; st.Key != tv || st.Connections != 1 || st.Sent != 150 || st.Received != 2000 {
+		t.Errorf("unexpected TV stats %+v", st)
+	}
+
+	if key, ok := r.Find("192_168_2_0_24"); !ok || key != tv {
+		t.Errorf("Find returned %v, %v", key, ok)
+	}
+	if _, ok := r.Find("unknown"); ok {
+		t.Error("unknown device found")
+	}
+
+	r.Pause(phone, time.Hour)
+	if !r.BlockingPaused(phone) || r.BlockingPaused(tv) {
+		t.Error("only phone must be paused")
+	}
+	now = now.Add(time.Hour)
+	if r.BlockingPaused(phone) {
+		t.Error("pause must expire")
+	}
+	r.Pause(tv, 0)
+	now = now.Add(24 * time.Hour)
+	if !r.BlockingPaused(tv) {
+		t.Error("pause without limit must last until resumed")
+	}
+	r.Resume(tv)
+	if r.BlockingPaused(tv) {
+		t.Error("pause must end on resume")
+	}
+
+	var nilRegistry *Registry
+	nilRegistry.Query(phone)
+	if nilRegistry.BlockingPaused(phone) {
+		t.Error("nil registry must not pause blocking")
+	}
+}
+
+func TestRegistryEviction(t *testing.T) {
+	r := NewRegistry()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	phone := clientkey.FromAddr(netip.MustParseAddr("192.168.1.10"))
+	tv := clientkey.FromAddr(netip.MustParseAddr("192.168.1.20"))
+	laptop := clientkey.FromAddr(netip.MustParseAddr("192.168.1.30"))
+
+	r.Query(phone)
+	r.Query(tv)
+	r.Pause(tv, 0)
+	now = now.Add(idleTTL / 2)
+	r.Query(laptop)
+	now = now.Add(idleTTL/2 + time.Minute)
+	r.Query(laptop)
+
+	stats := r.Devices()
+	if len(stats) != 2 || stats[0].Key != tv || stats[1].Key != laptop {
+		t.Errorf("expected idle phone to be evicted and paused TV kept, got %+v", stats)
+	}
+}
+
+func TestMQTTBridgeCommands(t *testing.T) {
+	r := NewRegistry()
+	phone := clientkey.FromAddr(netip.MustParseAddr("192.168.1.10"))
+	r.Query(phone)
+	b := &MQTTBridge{Registry: r, Prefix: "dns44", refresh: make(chan struct{}, 1)}
+
+	b.handleCommand("dns44/192_168_1_10/pause/set", []byte("ON"))
+	if st := r.Devices()[0]; !st.Paused || !st.PausedUntil.IsZero() {
+		t.Errorf("expected pause without limit, got %+v", st)
+	}
+	b.handleCommand("dns44/192_168_1_10/pause/set", []byte("off"))
+	if r.BlockingPaused(phone) {
+		t.Error("expected pause to end")
+	}
+	b.handleCommand("dns44/192_168_1_10/pause/set", []byte("30m"))
+	if st := r.Devices()[0]; !st.Paused || st.PausedUntil.IsZero() {
+		t.Errorf("expected pause with limit, got %+v", st)
+	}
+	b.handleCommand("dns44/192_168_1_10/pause/set", []byte("bogus"))
+	b.handleCommand("dns44/unknown/pause/set", []byte("ON"))
+	if !r.BlockingPaused(phone) {
+		t.Error("bad commands must be ignored")
+	}
+}
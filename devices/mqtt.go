@@ -0,0 +1,246 @@
+package devices
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/dns44/mqtt"
+)
+
+const (
+	// DefaultPublishInterval is the default interval of statistics
+	// publications.
+	DefaultPublishInterval = 30 * time.Second
+	// DefaultDiscoveryPrefix is the default Home Assistant MQTT discovery
+	// prefix.
+	DefaultDiscoveryPrefix = "homeassistant"
+	// reconnectDelay is the delay before reconnection to broker.
+	reconnectDelay = 10 * time.Second
+	dialTimeout    = 10 * time.Second
+)
+
+// MQTTBridge publishes client statistics to MQTT broker and accepts
+// commands pausing blocking. Topics are:
+//
+//	PREFIX/status            "online" or "offline", retained
+//	PREFIX/ID/state          JSON statistics of client, retained
+//	PREFIX/ID/pause/set      "ON", "OFF" or pause duration like "30m"
+//
+// where ID is client ID, see ID function.
+type MQTTBridge struct {
+	Registry *Registry
+	Options  mqtt.Options
+	// Prefix is the topic prefix, e.g. "dns44".
+	Prefix string
+	// Interval defaults to DefaultPublishInterval.
+	Interval time.Duration
+	// DiscoveryPrefix, if set, enables Home Assistant MQTT discovery
+	// messages, so clients show up as devices with sensors and pause
+	// switch.
+	DiscoveryPrefix string
+	// Names, if set, gives names and groups to clients in published state
+	// and discovered devices.
+	Names *Names
+
+	// refresh requests publication of changed state.
+	refresh chan struct{}
+}
+
+// Run keeps bridge connected to broker until ctx is done.
+func (b *MQTTBridge) Run(ctx context.Context) {
+	interval := b.Interval
+	if interval <= 0 {
+		interval = DefaultPublishInterval
+	}
+	b.refresh = make(chan struct{}, 1)
+	for {
+		err := b.session(ctx, interval)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("MQTT bridge: %v, reconnecting in %v", err, reconnectDelay)
+		select {
+		case <-time.After(reconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *MQTTBridge) session(ctx context.Context, interval time.Duration) error {
+	opts := b.Options
+	opts.WillTopic = b.Prefix + "/status"
+	opts.WillPayload = []byte("offline")
+	opts.WillRetain = true
+	opts.OnMessage = b.handleCommand
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	client, err := mqtt.Dial(dialCtx, opts)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Subscribe(b.Prefix + "/+/pause/set"); err != nil {
+		return err
+	}
+	if err := client.Publish(opts.WillTopic, []byte("online"), true); err != nil {
+		return err
+	}
+	log.Printf("MQTT bridge connected to %s", opts.Addr)
+
+	discovered := make(map[string]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := b.publish(client, discovered); err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-b.refresh:
+		case <-client.Done():
+			return client.Err()
+		case <-ctx.Done():
+			client.Publish(opts.WillTopic, []byte("offline"), true)
+			return ctx.Err()
+		}
+	}
+}
+
+type deviceState struct {
+	Name        string `json:"name,omitempty"`
+	Group       string `json:"group,omitempty"`
+	Queries     uint64 `json:"queries"`
+	Blocked     uint64 `json:"blocked"`
+	Connections uint64 `json:"connections"`
+	Sent        uint64 `json:"sent"`
+	Received    uint64 `json:"received"`
+	Paused      string `json:"paused"`
+	PausedUntil string `json:"paused_until,omitempty"`
+}
+
+func (b *MQTTBridge) publish(client *mqtt.Client, discovered map[string]bool) error {
+	for _, st := range b.Registry.Devices() {
+		id := ID(st.Key)
+		if b.DiscoveryPrefix != "" && !discovered[id] {
+			if err := b.discover(client, id, st); err != nil {
+				return err
+			}
+			discovered[id] = true
+		}
+		name, group := b.Names.ClientName(st.Key)
+		state := deviceState{
+			Name:        name,
+			Group:       group,
+			Queries:     st.Queries,
+			Blocked:     st.Blocked,
+			Connections: st.Connections,
+			Sent:        st.Sent,
+			Received:    st.Received,
+			Paused:      "OFF",
+		}
+		if st.Paused {
+			state.Paused = "ON"
+			if !st.PausedUntil.IsZero() {
+				state.PausedUntil = st.PausedUntil.Format(time.RFC3339)
+			}
+		}
+		payload, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if err := client.Publish(b.Prefix+"/"+id+"/state", payload, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discoverySensors are statistics announced to Home Assistant, with their
+// units.
+var discoverySensors = []struct{ name, unit string }{
+	{"queries", ""},
+	{"blocked", ""},
+	{"connections", ""},
+	{"sent", "B"},
+	{"received", "B"},
+}
+
+func (b *MQTTBridge) discover(client *mqtt.Client, id string, st Stats) error {
+	device := map[string]interface{}{
+		"identifiers": []string{"dns44_" + id},
+		"name":        "dns44 " + st.Key.String(),
+	}
+	if name, group := b.Names.ClientName(st.Key); name != "" {
+		device["name"] = name
+		if group != "" {
+			device["suggested_area"] = group
+		}
+	}
+	stateTopic := b.Prefix + "/" + id + "/state"
+	availability := b.Prefix + "/status"
+	announce := func(component, object string, config map[string]interface{}) error {
+		config["unique_id"] = "dns44_" + id + "_" + object
+		config["device"] = device
+		config["state_topic"] = stateTopic
+		config["availability_topic"] = availability
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		return client.Publish(fmt.Sprintf("%s/%s/dns44_%s/%s/config", b.DiscoveryPrefix, component, id, object), payload, true)
+	}
+	for _, sensor := range discoverySensors {
+		config := map[string]interface{}{
+			"name":           sensor.name,
+			"value_template": "{{ value_json." + sensor.name + " }}",
+			"state_class":    "total_increasing",
+		}
+		if sensor.unit != "" {
+			config["unit_of_measurement"] = sensor.unit
+			config["device_class"] = "data_size"
+		}
+		if err := announce("sensor", sensor.name, config); err != nil {
+			return err
+		}
+	}
+	return announce("switch", "pause", map[string]interface{}{
+		"name":           "pause blocking",
+		"command_topic":  b.Prefix + "/" + id + "/pause/set",
+		"value_template": "{{ value_json.paused }}",
+	})
+}
+
+// handleCommand handles pause command for client.
+func (b *MQTTBridge) handleCommand(topic string, payload []byte) {
+	id := strings.TrimSuffix(strings.TrimPrefix(topic, b.Prefix+"/"), "/pause/set")
+	key, ok := b.Registry.Find(id)
+	if !ok {
+		log.Printf("MQTT bridge: pause command for unknown client %q ignored", id)
+		return
+	}
+	switch cmd := strings.TrimSpace(string(payload)); strings.ToUpper(cmd) {
+	case "ON":
+		b.Registry.Pause(key, 0)
+		log.Printf("MQTT bridge: blocking paused for %s", key.String())
+	case "OFF":
+		b.Registry.Resume(key)
+		log.Printf("MQTT bridge: blocking resumed for %s", key.String())
+	default:
+		d, err := time.ParseDuration(cmd)
+		if err != nil || d <= 0 {
+			log.Printf("MQTT bridge: bad pause command %q for %s", cmd, key.String())
+			return
+		}
+		b.Registry.Pause(key, d)
+		log.Printf("MQTT bridge: blocking paused for %s for %v", key.String(), d)
+	}
+	select {
+	case b.refresh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,155 @@
+package devices
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// arpRefreshInterval is how often ARP table is read again to resolve MAC
+// addresses of named devices.
+const arpRefreshInterval = 30 * time.Second
+
+// arpTable is the kernel IPv4 neighbour table on Linux.
+const arpTable = "/proc/net/arp"
+
+// Names assigns friendly names and groups to clients by address, prefix
+// or MAC address. MAC addresses are resolved with IPv4 ARP table of the
+// host, so they work only for clients on directly attached networks. Nil
+// Names knows no clients.
+type Names struct {
+	entries []nameEntry
+	readARP func() (map[netip.Addr]string, error)
+
+	mux        sync.Mutex
+	macs       map[netip.Addr]string
+	arpChecked time.Time
+}
+
+type nameEntry struct {
+	name   string
+	group  string
+	prefix netip.Prefix
+	mac    string
+}
+
+// ParseNames parses entries in NAME[@GROUP]=ADDRESS, NAME[@GROUP]=PREFIX
+// or NAME[@GROUP]=MAC format. Entries with MAC or single address take
+// precedence over prefixes, longer prefixes take precedence over shorter
+// ones.
+func ParseNames(specs []string) (*Names, error) {
+	n := &Names{readARP: readARPTable}
+	for _, spec := range specs {
+		label, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("device %q is not in NAME[@GROUP]=ADDRESS format", spec)
+		}
+		name, group, _ := strings.Cut(strings.TrimSpace(label), "@")
+		if name == "" {
+			return nil, fmt.Errorf("empty device name in %q", spec)
+		}
+		e := nameEntry{name: name, group: group}
+		value = strings.TrimSpace(value)
+		if mac, err := net.ParseMAC(value); err == nil {
+			e.mac = mac.String()
+		} else if prefix, err := netip.ParsePrefix(value); err == nil {
+			e.prefix = prefix.Masked()
+		} else if addr, err := netip.ParseAddr(value); err == nil {
+			addr = addr.Unmap()
+			e.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			return nil, fmt.Errorf("bad address, prefix or MAC address in device %q", spec)
+		}
+		n.entries = append(n.entries, e)
+	}
+	return n, nil
+}
+
+// ClientName returns name and group of client, or empty strings if client
+// isn't named. Client keys which are prefixes match entries with prefixes
+// covering them.
+func (n *Names) ClientName(key clientkey.Key) (name, group string) {
+	if n == nil || len(n.entries) == 0 {
+		return "", ""
+	}
+	keyPrefix, err := netip.ParsePrefix(key.String())
+	if err != nil {
+		addr, err := netip.ParseAddr(key.String())
+		if err != nil {
+			return "", ""
+		}
+		keyPrefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	}
+	single := keyPrefix.IsSingleIP()
+	best := -1
+	var found *nameEntry
+	for i := range n.entries {
+		e := &n.entries[i]
+		bits := -1
+		switch {
+		case e.mac != "":
+			if single && n.mac(keyPrefix.Addr()) == e.mac {
+				bits = 129
+			}
+		case e.prefix.Bits() <= keyPrefix.Bits() && e.prefix.Contains(keyPrefix.Addr()):
+			bits = e.prefix.Bits()
+		}
+		if bits > best {
+			best, found = bits, e
+		}
+	}
+	if found == nil {
+		return "", ""
+	}
+	return found.name, found.group
+}
+
+// mac returns MAC address of neighbour addr, reading ARP table if it's
+// stale.
+func (n *Names) mac(addr netip.Addr) string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if time.Since(n.arpChecked) > arpRefreshInterval {
+		n.arpChecked = time.Now()
+		macs, err := n.readARP()
+		if err == nil {
+			n.macs = macs
+		}
+	}
+	return n.macs[addr]
+}
+
+// readARPTable reads complete entries of Linux ARP table.
+func readARPTable() (map[netip.Addr]string, error) {
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	macs := make(map[netip.Addr]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			continue
+		}
+		macs[addr] = mac.String()
+	}
+	return macs, scanner.Err()
+}
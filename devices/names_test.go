@@ -0,0 +1,53 @@
+package devices
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+func TestNames(t *testing.T) {
+	names, err := ParseNames([]string{
+		"lan@home=192.168.1.0/24",
+		"kids@kids=192.168.1.128/25",
+		"tablet@kids=192.168.1.200",
+		"laptop=AA:BB:CC:00:11:22",
+		"v6@home=fd00::/64",
+	})
+	if err != nil {
+		t.Fatalf("ParseNames failed: %v", err)
+	}
+	names.readARP = func() (map[netip.Addr]string, error) {
+		return map[netip.Addr]string{netip.MustParseAddr("192.168.1.10"): "aa:bb:cc:00:11:22"}, nil
+	}
+	for _, tc := range []struct {
+		key         clientkey.Key
+		name, group string
+	}{
+		{clientkey.FromAddr(netip.MustParseAddr("192.168.1.5")), "lan", "home"},
+		{clientkey.FromAddr(netip.MustParseAddr("192.168.1.10")), "laptop", ""},
+		{clientkey.FromAddr(netip.MustParseAddr("192.168.1.130")), "kids", "kids"},
+		{clientkey.FromAddr(netip.MustParseAddr("192.168.1.200")), "tablet", "kids"},
+		{clientkey.FromAddr(netip.MustParseAddr("::ffff:192.168.1.200")), "tablet", "kids"},
+		{clientkey.FromPrefix(netip.MustParsePrefix("192.168.1.0/24")), "lan", "home"},
+		{clientkey.FromPrefix(netip.MustParsePrefix("192.168.0.0/16")), "", ""},
+		{clientkey.FromPrefix(netip.MustParsePrefix("fd00::1234/64")), "v6", "home"},
+		{clientkey.FromAddr(netip.MustParseAddr("10.0.0.1")), "", ""},
+		{clientkey.Named("alice"), "", ""},
+	} {
+		if name, group := names.ClientName(tc.key); name != tc.name || group != tc.group {
+			t.Errorf("%s: got (%q, %q), expected (%q, %q)", tc.key, name, group, tc.name, tc.group)
+		}
+	}
+
+	var nilNames *Names
+	if name, _ := nilNames.ClientName(clientkey.FromAddr(netip.MustParseAddr("192.168.1.5"))); name != "" {
+		t.Errorf("nil Names returned %q", name)
+	}
+	for _, spec := range []string{"nameless", "=192.168.1.1", "bad=192.168.1.300"} {
+		if _, err := ParseNames([]string{spec}); err == nil {
+			t.Errorf("bad entry %q accepted", spec)
+		}
+	}
+}
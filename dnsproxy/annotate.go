@@ -0,0 +1,74 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// maxTXTString is the maximum length of character string in TXT record.
+const maxTXTString = 255
+
+// annotate attaches text describing how query was handled to response.
+// EDNS clients get it as Extended DNS Error (RFC 8914) with "Other" code,
+// others as TXT record in additional section.
+func annotate(ctx *proxy.DNSContext, text string) {
+	text = "dns44: " + text
+	resp := ctx.Res
+	if reqOpt := ctx.Req.IsEdns0(); reqOpt != nil {
+		opt := resp.IsEdns0()
+		if opt == nil {
+			resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+			opt = resp.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeOther,
+			ExtraText: text,
+		})
+		return
+	}
+
+	var chunks []string
+	for len(text) > maxTXTString {
+		chunks = append(chunks, text[:maxTXTString])
+		text = text[maxTXTString:]
+	}
+	chunks = append(chunks, text)
+	resp.Extra = append(resp.Extra, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   ctx.Req.Question[0].Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+		},
+		Txt: chunks,
+	})
+}
+
+// mappedAddrs lists addresses of answer for annotation.
+func mappedAddrs(resp *dns.Msg) string {
+	addrs := answerAddrs(resp)
+	if len(addrs) == 0 {
+		return ""
+	}
+	return " to " + strings.Join(addrs, ", ")
+}
+
+// answerAddrs returns addresses in answer section.
+func answerAddrs(resp *dns.Msg) []string {
+	var addrs []string
+	for _, rr := range resp.Answer {
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
@@ -0,0 +1,93 @@
+package dnsproxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestDebugAnnotations(t *testing.T) {
+	d := startProxy(t, &Config{
+		Mapper:           new(countingMapper),
+		NeverMap:         []string{"example.org"},
+		DebugAnnotations: true,
+	}, new(atomic.Int32))
+
+	for _, tc := range []struct {
+		name     string
+		edns     bool
+		expected string
+	}{
+		{"example.com.", true, "dns44: mapped to 172.24.0.1"},
+		{"example.com.", false, "dns44: mapped to 172.24.0.1"},
+		{"www.example.org.", true, `dns44: passed to upstream: never map entry "example.org."`},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		if tc.edns {
+			req.SetEdns0(1232, false)
+		}
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+
+		var texts []string
+		if tc.edns {
+			if opt := resp.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeOther {
+						texts = append(texts, ede.ExtraText)
+					}
+				}
+			}
+		} else {
+			for _, rr := range resp.Extra {
+				if txt, ok := rr.(*dns.TXT); ok {
+					texts = append(texts, strings.Join(txt.Txt, ""))
+				}
+			}
+		}
+		if len(texts) != 1 || texts[0] != tc.expected {
+			t.Errorf("%s (EDNS %v): annotations %q, expected %q", tc.name, tc.edns, texts, tc.expected)
+		}
+	}
+}
+
+type recordingObserver struct {
+	mux    sync.Mutex
+	events []QueryEvent
+}
+
+func (o *recordingObserver) ObserveQuery(ev *QueryEvent) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.events = append(o.events, *ev)
+}
+
+func TestQueryObserver(t *testing.T) {
+	observer := new(recordingObserver)
+	d := startProxy(t, &Config{
+		Mapper:        new(countingMapper),
+		QueryObserver: observer,
+	}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String()); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	observer.mux.Lock()
+	defer observer.mux.Unlock()
+	if len(observer.events) != 1 {
+		t.Fatalf("%d events observed, expected 1", len(observer.events))
+	}
+	ev := observer.events[0]
+	if ev.Name != "example.com" || ev.Type != dns.TypeA || ev.Decision != "mapped to 172.24.0.1" || !ev.Client.IsValid() {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
@@ -0,0 +1,70 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// ClientKeyExtractor computes mapping client key for a DNS query. Embedders
+// may implement it to identify clients by means other than source address.
+type ClientKeyExtractor interface {
+	DNSClientKey(ctx *proxy.DNSContext) (clientkey.Key, error)
+}
+
+// AddrClientKey derives client key from query source address.
+type AddrClientKey struct {
+	Masker clientkey.Masker
+}
+
+func (k AddrClientKey) DNSClientKey(ctx *proxy.DNSContext) (clientkey.Key, error) {
+	addrPort, err := netip.ParseAddrPort(ctx.Addr.String())
+	if err != nil {
+		return clientkey.Key{}, fmt.Errorf("can't parse client address %q: %w", ctx.Addr.String(), err)
+	}
+	return k.Masker.Key(addrPort.Addr()), nil
+}
+
+// ECSClientKey derives client key from EDNS Client Subnet option if query
+// carries one, falling back to query source address otherwise. It's useful
+// when dns44 sits behind another resolver which forwards client subnet.
+//
+// Proxy keys flows by their source address masked with the same Masker, so
+// client subnet has to be at least as long as masking prefix for keys to
+// match. Queries with shorter subnets are refused a key, as any key given to
+// them would never match flows of the client.
+type ECSClientKey struct {
+	Masker clientkey.Masker
+}
+
+func (k ECSClientKey) DNSClientKey(ctx *proxy.DNSContext) (clientkey.Key, error) {
+	if opt := ctx.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			subnet, ok := o.(*dns.EDNS0_SUBNET)
+			if !ok {
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(subnet.Address)
+			if !ok {
+				break
+			}
+			addr = addr.Unmap()
+			bits := k.Masker.Bits6
+			if addr.Is4() {
+				bits = k.Masker.Bits4
+			}
+			if bits <= 0 || bits > addr.BitLen() {
+				bits = addr.BitLen()
+			}
+			if int(subnet.SourceNetmask) < bits {
+				return clientkey.Key{}, fmt.Errorf("client subnet %s/%d is shorter than client key prefix /%d", addr, subnet.SourceNetmask, bits)
+			}
+			return k.Masker.Key(addr), nil
+		}
+	}
+	return AddrClientKey(k).DNSClientKey(ctx)
+}
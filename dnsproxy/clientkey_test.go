@@ -0,0 +1,63 @@
+package dnsproxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestECSClientKey(t *testing.T) {
+	query := func(subnet string) *proxy.DNSContext {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if subnet != "" {
+			prefix := netip.MustParsePrefix(subnet)
+			family := uint16(1)
+			if prefix.Addr().Is6() {
+				family = 2
+			}
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        family,
+				SourceNetmask: uint8(prefix.Bits()),
+				Address:       prefix.Addr().AsSlice(),
+			})
+		}
+		return &proxy.DNSContext{
+			Req:  req,
+			Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 53), Port: 53},
+		}
+	}
+	for _, tc := range []struct {
+		masker   clientkey.Masker
+		subnet   string
+		expected string
+	}{
+		{clientkey.Masker{}, "", "10.0.0.53"},
+		{clientkey.Masker{}, "192.168.1.10/32", "192.168.1.10"},
+		{clientkey.Masker{Bits4: 24}, "192.168.1.0/24", "192.168.1.0/24"},
+		{clientkey.Masker{Bits4: 24}, "192.168.1.10/32", "192.168.1.0/24"},
+		{clientkey.Masker{Bits6: 56}, "2001:db8:0:100::/56", "2001:db8:0:100::/56"},
+		{clientkey.Masker{}, "192.168.1.0/24", ""},
+		{clientkey.Masker{Bits4: 24}, "192.168.0.0/16", ""},
+		{clientkey.Masker{Bits4: 24}, "2001:db8::/56", ""},
+	} {
+		key, err := ECSClientKey{Masker: tc.masker}.DNSClientKey(query(tc.subnet))
+		if tc.expected == "" {
+			if err == nil {
+				t.Errorf("%+v got key %q for subnet %s shorter than masking prefix", tc.masker, key, tc.subnet)
+			}
+			continue
+		}
+		if err != nil || key.String() != tc.expected {
+			t.Errorf("%+v got key %q, %v for subnet %q, expected %q", tc.masker, key, err, tc.subnet, tc.expected)
+		}
+	}
+}
@@ -1,12 +1,63 @@
 package dnsproxy
 
 import (
+	"crypto/tls"
+	"log"
 	"net/netip"
 	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/notify"
+	"github.com/Snawoot/dns44/pool"
 )
 
 type Mapper interface {
-	EnsureMapping(clientKey, domainName string, ttl time.Duration) (netip.Addr, error)
+	EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error)
+}
+
+// MultiMapper is implemented by mappers able to map several addresses to
+// one domain.
+type MultiMapper interface {
+	EnsureMappings(clientKey clientkey.Key, domainName string, count int, ttl time.Duration) ([]netip.Addr, error)
+}
+
+// BlockObserver learns which domains are blocked for clients and why.
+type BlockObserver interface {
+	RecordBlock(clientKey clientkey.Key, domainName, reason string)
+}
+
+// QueryEvent describes answered query. Name is redacted if RedactName is
+// set.
+type QueryEvent struct {
+	Client    netip.AddrPort
+	ClientKey clientkey.Key
+	Device    string
+	Name      string
+	Type      uint16
+	// Result is the answer as written to query log, Decision tells why
+	// query got it and Reason names policy rule which decided on query.
+	Result   string
+	Decision string
+	Reason   string
+}
+
+// QueryObserver receives events of answered queries, e.g. for live log
+// stream.
+type QueryObserver interface {
+	ObserveQuery(ev *QueryEvent)
+}
+
+// DeviceTracker counts queries of clients and may pause blocking for them.
+type DeviceTracker interface {
+	Query(clientKey clientkey.Key)
+	Blocked(clientKey clientkey.Key)
+	BlockingPaused(clientKey clientkey.Key) bool
+}
+
+// ClientNames gives friendly names and groups to clients. Empty name
+// means client isn't named.
+type ClientNames interface {
+	ClientName(clientKey clientkey.Key) (name, group string)
 }
 
 // Config is the DNS proxy configuration.
@@ -14,12 +65,277 @@ type Config struct {
 	// ListenAddr is the address the DNS server is supposed to listen to.
 	ListenAddr netip.AddrPort
 
-	// Upstream is the upstream that the requests will be forwarded to.  The
-	// format of an upstream is the one that can be consumed by
-	// [proxy.ParseUpstreamsConfig].
+	// TLSListenAddr, HTTPSListenAddr and QUICListenAddr, if set, are
+	// addresses of DNS-over-TLS, DNS-over-HTTPS and DNS-over-QUIC
+	// listeners. DNS-over-HTTPS queries are served at /dns-query path.
+	TLSListenAddr   netip.AddrPort
+	HTTPSListenAddr netip.AddrPort
+	QUICListenAddr  netip.AddrPort
+
+	// TLSConfig carries server certificate of encrypted listeners. It's
+	// required if any of them is set.
+	TLSConfig *tls.Config
+
+	// Upstream lists upstreams that the requests will be forwarded to,
+	// separated by commas or spaces.  The format of an upstream is the one
+	// that can be consumed by [proxy.ParseUpstreamsConfig], optionally
+	// followed by "#timeout=DURATION" overriding UpstreamTimeout.
 	Upstream string
 
+	// UpstreamTimeout is the upstream query timeout. Defaults to
+	// DefaultUpstreamTimeout.
+	UpstreamTimeout time.Duration
+
+	// UpstreamRetries is the number of retries of passthrough queries
+	// which failed with all upstreams.
+	UpstreamRetries int
+
+	// UpstreamRetryBackoff is the delay before first retry, doubled with
+	// each next one. Defaults to DefaultRetryBackoff.
+	UpstreamRetryBackoff time.Duration
+
+	// HealthCheckInterval is the interval of upstream health probes. Zero
+	// disables health checks.
+	HealthCheckInterval time.Duration
+
+	// HealthFailures is the number of consecutive failed probes which make
+	// upstream unhealthy. Unhealthy upstreams are not used until probe
+	// succeeds, unless all upstreams are unhealthy. Defaults to
+	// DefaultHealthFailures.
+	HealthFailures int
+
+	// HealthProbe is the name queried for NS records to probe upstreams.
+	// Defaults to DefaultHealthProbe.
+	HealthProbe string
+
 	// Mapper is the database which grants one to one mapping between domain and network address
 	Mapper Mapper
 	TTL    uint32
+
+	// UpstreamTTL makes address queries of mapped domains resolve via
+	// upstream first. TTL of upstream answer, clamped by MinTTL and
+	// MaxTTL, replaces TTL in synthesized answer and mapping lease. TTL is
+	// used if upstream has no answer records or fails. Zero MaxTTL means
+	// no upper bound.
+	UpstreamTTL bool
+	MinTTL      uint32
+	MaxTTL      uint32
+
+	// ClientKey computes mapping client key for queries. Defaults to
+	// AddrClientKey with no masking.
+	ClientKey ClientKeyExtractor
+
+	// InterfaceSubnets restricts service to queries from on-link subnets
+	// of listed network interfaces: UDP queries are checked by source
+	// address, stream ones by local address of connection. Embedded
+	// proxy doesn't expose ingress interface of packets, so routed clients
+	// behind listed interfaces are refused, and spoofed on-link sources
+	// are accepted whatever interface they came from. Other queries are
+	// answered with REFUSED. Empty list allows all.
+	InterfaceSubnets []string
+
+	// NeverMap lists domains which are always resolved via upstream, along
+	// with their subdomains. Entry format is DOMAIN[/QTYPE], where optional
+	// QTYPE restricts exception to one query type. It's useful for
+	// protocols exchanging IP literals, such as STUN and NTP.
+	NeverMap []string
+
+	// MapRulesFile is the path to file with "map DOMAIN[/QTYPE]" and
+	// "pass DOMAIN[/QTYPE]" lines deciding whether domains and their
+	// subdomains are mapped or passed to upstream. The most specific rule
+	// or NeverMap entry wins, NeverMap wins ties. Domain "." matches all
+	// names, so "pass ." makes map rules an allowlist. File is reloaded
+	// when it changes.
+	MapRulesFile string
+
+	// PreallocFile is the path to file listing domains, one per line,
+	// which are mapped for each of PreallocClients when proxy starts, so
+	// they have stable addresses before clients query them. Mappings are
+	// renewed while proxy runs and file is read again on each renewal.
+	PreallocFile string
+
+	// PreallocClients are keys of clients domains of PreallocFile are
+	// mapped for.
+	PreallocClients []clientkey.Key
+
+	// RewriteTargets lists domains, in NeverMap format, whose SRV and NAPTR
+	// responses get address records of targets removed, so clients have to
+	// resolve targets and get mapped addresses. Responses for other domains
+	// are passed through untouched.
+	RewriteTargets []string
+
+	// Pair6 enables mapped AAAA answers with IPv6 addresses paired to
+	// mapped IPv4 addresses. AAAA answers are empty if it's nil.
+	Pair6 *pool.Pair6
+
+	// AddrsPerDomain is the number of addresses mapped to each domain.
+	// Answers rotate them in round-robin order. Values above 1 require
+	// Mapper to implement MultiMapper.
+	AddrsPerDomain int
+
+	// DisableCompression turns off name compression in responses. Some
+	// clients choke on compressed messages.
+	DisableCompression bool
+
+	// MaxUDPSize caps UDP response size below size advertised by client.
+	// It must be zero, meaning no cap, or between 512 and 65535.
+	MaxUDPSize int
+
+	// Truncate selects how synthesized responses exceeding UDP size
+	// limit are cut down.
+	Truncate TruncateMode
+
+	// SOA is attached to synthesized NODATA responses, e.g. AAAA answers
+	// when Pair6 is nil.
+	SOA SOA
+
+	// SuppressAAAA selects answer to AAAA queries, including ones for
+	// domains in NeverMap. Policies other than AAAAAllow keep clients from
+	// reaching destinations over IPv6 bypassing the proxy.
+	SuppressAAAA AAAAPolicy
+
+	// SuppressAAAARules override SuppressAAAA for domains and their
+	// subdomains. Entry format is DOMAIN=POLICY, where POLICY is off,
+	// nodata or nxdomain. Most specific entry wins.
+	SuppressAAAARules []string
+
+	// NXPassthrough makes address queries of mapped domains resolve
+	// via upstream first. Only names upstream answers with NOERROR are
+	// mapped, other responses, like NXDOMAIN or SERVFAIL, are passed to
+	// clients as is.
+	NXPassthrough bool
+
+	// ReverseZones lists mapped address ranges. Reverse zones covering
+	// them are served authoritatively, with PTR records pointing to mapped
+	// domains, so resolvers may delegate these zones to dns44. Mapper has
+	// to implement ReverseMapper to answer PTR queries.
+	ReverseZones []netip.Prefix
+
+	// ReverseAnyClient makes PTR answers use mappings of any client when
+	// querying client has none. It's needed when queries come via other
+	// resolver, but it exposes domains of one client to others.
+	ReverseAnyClient bool
+
+	// TransferClients lists client address ranges allowed to transfer
+	// reverse zones with AXFR or IXFR over TCP. Transfers hold PTR records
+	// of mappings of all clients. Mapper has to implement MappingWalker if
+	// it's set.
+	TransferClients []netip.Prefix
+
+	// SelfSources lists source addresses of dns44's own outbound
+	// resolution. Queries from them are resolved via upstream without
+	// mapping, so upstream dials which happen to reach dns44 don't get fake
+	// addresses and loop back into the proxy.
+	SelfSources []netip.Prefix
+
+	// StaticHosts are answered with fixed addresses, bypassing upstream
+	// and mapper. Subdomains are not affected.
+	StaticHosts StaticHosts
+
+	// SafeSearch rules answer search engine domains with addresses mapped
+	// to their safe mode domains, forcing safe search for clients.
+	// StaticHosts take precedence.
+	SafeSearch []SafeSearchRule
+
+	// LeasesFile is the path to dnsmasq leases file or Kea CSV lease
+	// database. Host names of active leases are answered with leased
+	// addresses, bypassing upstream and mapper. File is reloaded when it
+	// changes.
+	LeasesFile string
+
+	// LeasesDomain, if set, replaces domain part of lease host names.
+	LeasesDomain string
+
+	// LocalPolicy selects answer to queries for names in .local domain,
+	// which belong to multicast DNS and are never mapped.
+	LocalPolicy LocalPolicy
+
+	// MDNSTimeout is how long mDNS responses are awaited with LocalMDNS
+	// policy. Defaults to DefaultMDNSTimeout.
+	MDNSTimeout time.Duration
+
+	// DebugAnnotations makes responses describe which rule matched query
+	// and which addresses were assigned, as Extended DNS Error text or TXT
+	// record in additional section. It's meant for troubleshooting only,
+	// as it discloses configuration to clients.
+	DebugAnnotations bool
+
+	// StatusName is the name answered with TXT record describing resolver
+	// state, so clients can check they actually use dns44. Empty value
+	// disables it.
+	StatusName string
+
+	// Version is the program version reported in status record.
+	Version string
+
+	// PoolUsage returns number of mapped addresses in use and address pool
+	// size for status record. Pool occupancy isn't reported if it's nil.
+	PoolUsage func() (used, size uint64, err error)
+
+	// RedactName replaces domain names in logs, e.g. with their hashes.
+	// Answers aren't logged then, except for addresses.
+	RedactName func(name string) string
+
+	// QueryLog receives log lines of answered queries. Defaults to
+	// standard logger.
+	QueryLog *log.Logger
+
+	// Policy decides handling of queries to be mapped or passed to
+	// upstream ahead of NeverMap and AAAA suppression rules. Queries from
+	// SelfSources and for .local names are never submitted to it.
+	Policy Policy
+
+	// BlockMapper, if set, maps domains blocked by Policy to addresses
+	// answered instead of NXDOMAIN. It's meant to allocate them from a
+	// dedicated range which proxy rejects, so blocks are visible on the
+	// wire.
+	BlockMapper Mapper
+
+	// EgressMappers map domains which Policy directs to named egress with
+	// PolicyEgress action. They're meant to allocate addresses from
+	// separate ranges, so firewall rules can route such connections
+	// differently.
+	EgressMappers map[string]Mapper
+
+	// BlockObserver, if set, is told about each query blocked by Policy.
+	BlockObserver BlockObserver
+
+	// QueryObserver, if set, is told about each answered query.
+	QueryObserver QueryObserver
+
+	// Notifier receives events about upstream health changes, mapping
+	// failures and queries blocked by Policy.
+	Notifier *notify.Notifier
+
+	// TTLPressure shortens TTL of new mappings and of responses while
+	// address pool is crowded.
+	TTLPressure *TTLPressure
+
+	// FailOpen, if set, passes queries to upstream instead of mapping them
+	// while mapping or proxy is unhealthy. Without it, mapping errors fail
+	// queries.
+	FailOpen *FailOpen
+
+	// Devices, if set, counts queries of clients and queries blocked by
+	// Policy. Queries of clients it reports as paused are not blocked.
+	Devices DeviceTracker
+
+	// ClientNames, if set, names clients in query log and gives device
+	// name and group to Policy and SafeSearch rules.
+	ClientNames ClientNames
+}
+
+// DefaultNeverMap lists well-known domains of protocols which break when
+// their addresses are mapped.
+var DefaultNeverMap = []string{
+	"stun.l.google.com",
+	"stun.services.mozilla.com",
+	"stun.cloudflare.com",
+	"turn.cloudflare.com",
+	"global.stun.twilio.com",
+	"global.turn.twilio.com",
+	"pool.ntp.org",
+	"time.windows.com",
+	"time.apple.com",
+	"time.google.com",
 }
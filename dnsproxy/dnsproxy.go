@@ -9,18 +9,81 @@ import (
 	"net"
 	"net/netip"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/notify"
+	"github.com/Snawoot/dns44/pool"
+
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/miekg/dns"
 )
 
+// upstreamCloseDelay is how long replaced upstreams are kept open.
+const upstreamCloseDelay = 30 * time.Second
+
 // DNSProxy is a struct that manages the DNS proxy server.  This server's
 // purpose is to redirect queries to a specified SNI proxy.
 type DNSProxy struct {
-	proxy  *proxy.Proxy
-	mapper Mapper
-	ttl    uint32
+	proxy            *proxy.Proxy
+	mapper           Mapper
+	ttl              atomic.Uint32
+	ttlPressure      *TTLPressure
+	upstreamTTL      bool
+	minTTL           uint32
+	maxTTL           uint32
+	failOpen         *FailOpen
+	blockMapper      Mapper
+	egressMappers    map[string]Mapper
+	blockObserver    BlockObserver
+	queryObserver    QueryObserver
+	clientKey        ClientKeyExtractor
+	ifaces           *ifaceFilter
+	rewriteTargets   *domainList
+	pair6            *pool.Pair6
+	addrsPerDomain   int
+	rotation         atomic.Uint32
+	compress         bool
+	maxUDPSize       int
+	truncateMode     TruncateMode
+	soa              SOA
+	aaaaPolicies     *aaaaPolicies
+	reverseZones     []*reverseZone
+	reverseAnyClient bool
+	transferClients  []netip.Prefix
+	selfSources      []netip.Prefix
+	staticHosts      StaticHosts
+	safeSearch       []SafeSearchRule
+	clientNames      ClientNames
+	leases           *leaseTable
+	localPolicy      LocalPolicy
+	mdnsTimeout      time.Duration
+	health           *healthMonitor
+	prealloc         *preallocator
+	upstreamTimeout  time.Duration
+	retries          int
+	retryBackoff     time.Duration
+	queries          flightGroup[*dns.Msg]
+	mappings         flightGroup[[]netip.Addr]
+	debugAnnotations bool
+	verifyNames      bool
+	statusName       string
+	version          string
+	poolUsage        func() (used, size uint64, err error)
+	started          time.Time
+	redactName       func(name string) string
+	queryLog         *log.Logger
+	notifier         *notify.Notifier
+	devices          DeviceTracker
+	// stop is closed by Close to interrupt retries of upstream queries.
+	stop chan struct{}
+
+	// upstreamConfig overrides upstreams the proxy was created with, if set.
+	upstreamConfig atomic.Pointer[proxy.UpstreamConfig]
+	// rules decide whether queries are mapped. They are replaced as a whole,
+	// so each query sees consistent rules.
+	rules atomic.Pointer[ruleSet]
 }
 
 // type check
@@ -37,9 +100,126 @@ func New(cfg *Config) (d *DNSProxy, err error) {
 		proxy: &proxy.Proxy{
 			Config: proxyConfig,
 		},
-		mapper: cfg.Mapper,
-		ttl:    cfg.TTL,
+		mapper:           cfg.Mapper,
+		clientKey:        cfg.ClientKey,
+		pair6:            cfg.Pair6,
+		compress:         !cfg.DisableCompression,
+		maxUDPSize:       cfg.MaxUDPSize,
+		truncateMode:     cfg.Truncate,
+		soa:              cfg.SOA.withDefaults(),
+		reverseZones:     newReverseZones(cfg.ReverseZones),
+		reverseAnyClient: cfg.ReverseAnyClient,
+		transferClients:  cfg.TransferClients,
+		selfSources:      cfg.SelfSources,
+		staticHosts:      cfg.StaticHosts,
+		safeSearch:       cfg.SafeSearch,
+		clientNames:      cfg.ClientNames,
+		localPolicy:      cfg.LocalPolicy,
+		mdnsTimeout:      cfg.MDNSTimeout,
+		upstreamTimeout:  cfg.UpstreamTimeout,
+		retries:          cfg.UpstreamRetries,
+		retryBackoff:     cfg.UpstreamRetryBackoff,
+		debugAnnotations: cfg.DebugAnnotations,
+		verifyNames:      cfg.NXPassthrough,
+		upstreamTTL:      cfg.UpstreamTTL,
+		minTTL:           cfg.MinTTL,
+		maxTTL:           cfg.MaxTTL,
+		statusName:       normalizeName(cfg.StatusName),
+		version:          cfg.Version,
+		poolUsage:        cfg.PoolUsage,
+		redactName:       cfg.RedactName,
+		queryLog:         cfg.QueryLog,
+		notifier:         cfg.Notifier,
+		devices:          cfg.Devices,
+		stop:             make(chan struct{}),
+	}
+	if cfg.MaxTTL != 0 && cfg.MaxTTL < cfg.MinTTL {
+		return nil, fmt.Errorf("dnsproxy: invalid configuration: maximal TTL %d is below minimal TTL %d", cfg.MaxTTL, cfg.MinTTL)
+	}
+	if cfg.MaxUDPSize != 0 && (cfg.MaxUDPSize < dns.MinMsgSize || cfg.MaxUDPSize > dns.MaxMsgSize) {
+		return nil, fmt.Errorf("dnsproxy: invalid configuration: UDP size limit %d is out of range [%d, %d]",
+			cfg.MaxUDPSize, dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	if cfg.AddrsPerDomain > 1 {
+		if _, ok := cfg.Mapper.(MultiMapper); !ok {
+			return nil, fmt.Errorf("dnsproxy: invalid configuration: mapper doesn't support several addresses per domain")
+		}
+		for name, m := range cfg.EgressMappers {
+			if _, ok := m.(MultiMapper); !ok {
+				return nil, fmt.Errorf("dnsproxy: invalid configuration: mapper of egress %q doesn't support several addresses per domain", name)
+			}
+		}
+		d.addrsPerDomain = cfg.AddrsPerDomain
+	}
+	if len(cfg.TransferClients) > 0 {
+		if _, ok := cfg.Mapper.(MappingWalker); !ok {
+			return nil, fmt.Errorf("dnsproxy: invalid configuration: mapper doesn't support zone transfers")
+		}
+	}
+	if d.retryBackoff <= 0 {
+		d.retryBackoff = DefaultRetryBackoff
+	}
+	if d.mdnsTimeout <= 0 {
+		d.mdnsTimeout = DefaultMDNSTimeout
+	}
+	if d.queryLog == nil {
+		d.queryLog = log.Default()
+	}
+	if d.clientKey == nil {
+		d.clientKey = AddrClientKey{}
+	}
+	if len(cfg.InterfaceSubnets) > 0 {
+		d.ifaces, err = newIfaceFilter(cfg.InterfaceSubnets)
+		if err != nil {
+			return nil, fmt.Errorf("dnsproxy: invalid configuration: %w", err)
+		}
+	}
+	rules, err := newRuleSet(Rules{
+		NeverMap:     cfg.NeverMap,
+		MapRulesFile: cfg.MapRulesFile,
+		Policy:       cfg.Policy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dnsproxy: %w", err)
+	}
+	d.rules.Store(rules)
+	d.rewriteTargets, err = newDomainList(cfg.RewriteTargets)
+	if err != nil {
+		return nil, fmt.Errorf("dnsproxy: invalid target rewrite list: %w", err)
+	}
+	if cfg.LeasesFile != "" {
+		d.leases, err = newLeaseTable(cfg.LeasesFile, cfg.LeasesDomain)
+		if err != nil {
+			return nil, fmt.Errorf("dnsproxy: invalid configuration: %w", err)
+		}
+	}
+	if cfg.PreallocFile != "" {
+		d.prealloc, err = newPreallocator(cfg.PreallocFile, cfg.PreallocClients)
+		if err != nil {
+			return nil, fmt.Errorf("dnsproxy: invalid configuration: %w", err)
+		}
+		d.prealloc.ensure = func(clientKey clientkey.Key, domainName string, ttl time.Duration) error {
+			_, err := d.ensureMappings(d.mapper, clientKey, domainName, ttl)
+			return err
+		}
+		d.prealloc.ttl = d.ttl.Load
+	}
+	d.aaaaPolicies, err = newAAAAPolicies(cfg.SuppressAAAA, cfg.SuppressAAAARules)
+	if err != nil {
+		return nil, fmt.Errorf("dnsproxy: invalid AAAA rules: %w", err)
+	}
+	if cfg.HealthCheckInterval > 0 {
+		d.health = newHealthMonitor(cfg.HealthCheckInterval, cfg.HealthFailures, cfg.HealthProbe, d.currentUpstreams)
+		d.health.notifier = cfg.Notifier
 	}
+	d.ttl.Store(cfg.TTL)
+	d.ttlPressure = cfg.TTLPressure
+	d.failOpen = cfg.FailOpen
+	d.blockMapper = cfg.BlockMapper
+	d.egressMappers = cfg.EgressMappers
+	d.blockObserver = cfg.BlockObserver
+	d.queryObserver = cfg.QueryObserver
+	d.proxy.Config.BeforeRequestHandler = d.validateRequest
 	d.proxy.Config.RequestHandler = d.requestHandler
 
 	return d, nil
@@ -47,91 +227,603 @@ func New(cfg *Config) (d *DNSProxy, err error) {
 
 // Start starts the DNSProxy server.
 func (d *DNSProxy) Start() (err error) {
+	d.started = time.Now()
+	// Mappings are made before listeners start, so the first queries
+	// already get them.
+	if d.prealloc != nil {
+		d.prealloc.start()
+	}
 	err = d.proxy.Start()
+	if err == nil && d.health != nil {
+		d.health.start()
+	}
 	return err
 }
 
 // Close implements the [io.Closer] interface for DNSProxy.
 func (d *DNSProxy) Close() (err error) {
+	close(d.stop)
 	err = d.proxy.Stop()
+	if d.health != nil {
+		d.health.close()
+	}
+	if d.prealloc != nil {
+		d.prealloc.close()
+	}
+	if upstreamCfg := d.upstreamConfig.Swap(nil); upstreamCfg != nil {
+		upstreamCfg.Close()
+	}
 	return err
 }
 
+// SetUpstream replaces upstream used to resolve non-mapped queries. It
+// doesn't disturb listeners and can be called while proxy is running.
+func (d *DNSProxy) SetUpstream(upstream string) error {
+	upstreamCfg, err := parseUpstream(upstream, d.upstreamTimeout)
+	if err != nil {
+		return fmt.Errorf("dnsproxy: %w", err)
+	}
+
+	if old := d.upstreamConfig.Swap(upstreamCfg); old != nil {
+		// Let in-flight queries finish with old upstreams.
+		time.AfterFunc(upstreamCloseDelay, func() {
+			old.Close()
+		})
+	}
+	return nil
+}
+
+// currentUpstreams returns upstream config used for queries.
+func (d *DNSProxy) currentUpstreams() *proxy.UpstreamConfig {
+	if upstreamCfg := d.upstreamConfig.Load(); upstreamCfg != nil {
+		return upstreamCfg
+	}
+	return d.proxy.UpstreamConfig
+}
+
+// queryUpstreams returns custom upstream config for passthrough query. It's
+// nil if configured upstreams have to be used.
+func (d *DNSProxy) queryUpstreams() *proxy.UpstreamConfig {
+	if d.health == nil {
+		return d.upstreamConfig.Load()
+	}
+	current := d.currentUpstreams()
+	if upstreamCfg := d.health.filter(current); upstreamCfg != current {
+		return upstreamCfg
+	}
+	return d.upstreamConfig.Load()
+}
+
+// UpstreamStatus returns health state of upstreams. It's empty if health
+// checks are disabled or haven't run yet.
+func (d *DNSProxy) UpstreamStatus() []UpstreamStatus {
+	if d.health == nil {
+		return nil
+	}
+	return d.health.statuses()
+}
+
+// SetTTL changes TTL of synthesized responses and mapping lease duration.
+func (d *DNSProxy) SetTTL(ttl uint32) {
+	d.ttl.Store(ttl)
+}
+
+// TTL returns TTL currently used for synthesized responses.
+func (d *DNSProxy) TTL() uint32 {
+	return d.ttl.Load()
+}
+
+// Rules are rule sets deciding whether queries are mapped, which can be
+// replaced while proxy is running.
+type Rules struct {
+	// NeverMap has format of Config.NeverMap.
+	NeverMap []string
+	// MapRulesFile has format of Config.MapRulesFile.
+	MapRulesFile string
+	// Policy is consulted like Config.Policy. Nil disables it.
+	Policy Policy
+}
+
+// ruleSet is parsed Rules.
+type ruleSet struct {
+	neverMap *domainList
+	mapRules *mapRules
+	policy   Policy
+}
+
+func newRuleSet(rules Rules) (*ruleSet, error) {
+	neverMap, err := newDomainList(rules.NeverMap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid never-map list: %w", err)
+	}
+	rs := &ruleSet{
+		neverMap: neverMap,
+		policy:   rules.Policy,
+	}
+	if rules.MapRulesFile != "" {
+		rs.mapRules, err = newMapRules(rules.MapRulesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// SetRules replaces never-map list, map rules and policy. Queries being
+// answered finish with rules they started with. On error rules in use stay.
+func (d *DNSProxy) SetRules(rules Rules) error {
+	rs, err := newRuleSet(rules)
+	if err != nil {
+		return fmt.Errorf("dnsproxy: %w", err)
+	}
+	d.rules.Store(rs)
+	return nil
+}
+
 // requestHandler is a [proxy.RequestHandler] implementation which purpose is
 // to implement the actual mapping logic.
 func (d *DNSProxy) requestHandler(p *proxy.Proxy, ctx *proxy.DNSContext) (err error) {
 	qName := ctx.Req.Question[0].Name
 	qType := ctx.Req.Question[0].Qtype
 
-	clientKey := "<bogus>"
 	clientAddrPort, err := netip.ParseAddrPort(ctx.Addr.String())
 	if err != nil {
-		log.Println("can't parse ctx.Addr %q: %v", ctx.Addr.String(), err)
+		log.Printf("can't parse ctx.Addr %q: %v", ctx.Addr.String(), err)
 		clientAddrPort = netip.MustParseAddrPort("0.0.0.0:0")
-	} else {
-		clientKey = clientAddrPort.Addr().String()
+	}
+	clientKey, err := d.clientKey.DNSClientKey(ctx)
+	if err != nil {
+		log.Printf("can't compute client key: %v", err)
+		clientKey = clientkey.Named("<bogus>")
+	}
+	if d.devices != nil {
+		d.devices.Query(clientKey)
+	}
+	var device, group string
+	if d.clientNames != nil {
+		device, group = d.clientNames.ClientName(clientKey)
+	}
+	clientLabel := clientAddrPort.String()
+	if device != "" {
+		clientLabel = device + "(" + clientLabel + ")"
 	}
 	result := "???"
+	// decision describes why query got its answer, for debug annotations
+	// and query observer.
+	decision := ""
+	policyReason := ""
+	synthesized := true
 	defer func() {
-		log.Printf("DNS %s ?%s %s => %s", clientAddrPort.String(), dns.TypeToString[qType], qName, result)
+		if d.debugAnnotations && ctx.Res != nil && decision != "" {
+			annotate(ctx, decision)
+			d.fitResponse(ctx, synthesized)
+		}
+		if d.redactName != nil {
+			result = redactedResult(ctx.Res)
+		}
+		d.queryLog.Printf("DNS %s ?%s %s => %s", clientLabel, dns.TypeToString[qType], d.logName(qName), result)
+		if d.queryObserver != nil {
+			d.queryObserver.ObserveQuery(&QueryEvent{
+				Client:    clientAddrPort,
+				ClientKey: clientKey,
+				Device:    device,
+				Name:      d.logName(normalizeName(qName)),
+				Type:      qType,
+				Result:    result,
+				Decision:  decision,
+				Reason:    policyReason,
+			})
+		}
 	}()
 
-	if qType == dns.TypeA || qType == dns.TypeAAAA {
-		if err := d.rewrite(clientKey, qName, qType, ctx); err != nil {
-			return fmt.Errorf("rewrite error: %w", err)
+	if d.ifaces != nil && !d.ifaces.allowed(ctx) {
+		ctx.Res = new(dns.Msg).SetRcode(ctx.Req, dns.RcodeRefused)
+		result = "REFUSED (interface not allowed)"
+		decision = "interface not allowed"
+		return nil
+	}
+
+	if d.statusName != "" && normalizeName(qName) == d.statusName {
+		d.serveStatus(ctx)
+		d.fitResponse(ctx, true)
+		result = fmt.Sprintf("%s %s (status)", dns.RcodeToString[ctx.Res.Rcode], logRRRepr(ctx.Res.Answer))
+		decision = "status name"
+		return nil
+	}
+
+	if zone := d.findZone(normalizeName(qName)); zone != nil {
+		if qType == dns.TypeAXFR || qType == dns.TypeIXFR {
+			result, err = d.serveTransfer(ctx, zone, clientAddrPort.Addr())
+			if err != nil {
+				return fmt.Errorf("zone transfer error: %w", err)
+			}
+			decision = "zone transfer of " + zone.name
+			return nil
+		}
+		if err := d.serveReverse(ctx, zone, clientKey); err != nil {
+			return fmt.Errorf("reverse zone error: %w", err)
+		}
+		synthesized = false
+		d.fitResponse(ctx, synthesized)
+		result = fmt.Sprintf("%s %s (authoritative)", dns.RcodeToString[ctx.Res.Rcode], logRRRepr(ctx.Res.Answer))
+		decision = "authoritative for reverse zone " + zone.name
+		return nil
+	}
+
+	if host := d.staticHosts.lookup(normalizeName(qName)); host != nil {
+		if err := d.serveStatic(ctx, clientKey, host); err != nil {
+			return fmt.Errorf("static host error: %w", err)
 		}
+		d.fitResponse(ctx, true)
+		result = fmt.Sprintf("%s (static)", logRRRepr(ctx.Res.Answer))
+		decision = "static host"
+		if host.Backend != "" {
+			decision += " mapped via backend " + host.Backend + mappedAddrs(ctx.Res)
+		}
+		return nil
+	}
+	if target := safeSearchTarget(d.safeSearch, clientKey, group, normalizeName(qName)); target != "" {
+		if err := d.serveStatic(ctx, clientKey, &HostTemplate{Backend: target}); err != nil {
+			return fmt.Errorf("safe search error: %w", err)
+		}
+		d.fitResponse(ctx, true)
+		result = fmt.Sprintf("%s (safe search)", logRRRepr(ctx.Res.Answer))
+		decision = "safe search mapped via " + target + mappedAddrs(ctx.Res)
+		return nil
+	}
+	if d.leases != nil {
+		if addrs := d.leases.lookup(normalizeName(qName)); addrs != nil {
+			if err := d.serveStatic(ctx, clientKey, &HostTemplate{Addrs: addrs}); err != nil {
+				return fmt.Errorf("DHCP lease error: %w", err)
+			}
+			d.fitResponse(ctx, true)
+			result = fmt.Sprintf("%s (DHCP lease)", logRRRepr(ctx.Res.Answer))
+			decision = "DHCP lease"
+			return nil
+		}
+	}
+
+	localName := isLocalName(normalizeName(qName))
+	if localName && d.localPolicy != LocalUpstream {
+		if err := d.serveLocal(ctx); err != nil {
+			return fmt.Errorf("mDNS error: %w", err)
+		}
+		d.fitResponse(ctx, true)
+		result = fmt.Sprintf("%s %s (.local)", dns.RcodeToString[ctx.Res.Rcode], logRRRepr(ctx.Res.Answer))
+		decision = ".local name, policy " + d.localPolicy.String()
+		return nil
+	}
+
+	selfQuery := d.isSelfQuery(clientAddrPort.Addr())
+	rules := d.rules.Load()
+	policyAction, egress := PolicyDefault, ""
+	// upstreamRes is upstream response fetched for policy, reused if query
+	// is passed to upstream.
+	var upstreamRes *dns.Msg
+	if !selfQuery && !localName {
+		policyAction, egress, policyReason = d.decide(rules.policy, PolicyQuery{
+			Name:      normalizeName(qName),
+			Type:      qType,
+			ClientKey: clientKey,
+			Device:    device,
+			Group:     group,
+			Answer: func() []netip.Addr {
+				if _, err := d.nameExists(p, ctx); err != nil {
+					log.Printf("can't resolve %s for policy: %v", d.logName(qName), err)
+					return nil
+				}
+				upstreamRes = ctx.Res.Copy()
+				return responseAddrs(ctx.Res)
+			},
+		})
+	}
+	mapper := d.mapper
+	if policyAction == PolicyEgress {
+		if m, ok := d.egressMappers[egress]; ok {
+			mapper = m
+		} else {
+			log.Printf("policy directed %s to unknown egress %q, mapping it as usual", d.logName(qName), egress)
+		}
+	}
+	if policyAction == PolicyBlock && d.devices != nil && d.devices.BlockingPaused(clientKey) {
+		policyAction = PolicyDefault
+	}
+	if policyAction == PolicyBlock {
+		if d.blockMapper != nil {
+			if err := d.serveBlocked(ctx, clientKey, normalizeName(qName)); err != nil {
+				return fmt.Errorf("blocked domain mapping error: %w", err)
+			}
+			d.fitResponse(ctx, true)
+			result = fmt.Sprintf("%s (policy)", logRRRepr(ctx.Res.Answer))
+			decision = "blocked by policy, sinkholed" + mappedAddrs(ctx.Res)
+		} else {
+			ctx.Res = new(dns.Msg)
+			ctx.Res.SetRcode(ctx.Req, dns.RcodeNameError)
+			ctx.Res.Ns = []dns.RR{d.negativeSOA(qName)}
+			d.fitResponse(ctx, true)
+			result = "NXDOMAIN (policy)"
+			decision = "blocked by policy"
+		}
+		d.notifier.Notify(notify.EventBlocked, "query %s from %s blocked by policy", d.logName(qName), clientLabel)
+		if d.blockObserver != nil {
+			d.blockObserver.RecordBlock(clientKey, normalizeName(qName), policyReason)
+		}
+		if d.devices != nil {
+			d.devices.Blocked(clientKey)
+		}
+		return nil
+	}
+
+	aaaaPolicy := AAAAAllow
+	if (qType == dns.TypeAAAA || qType == dns.TypeANY) && !selfQuery && policyAction == PolicyDefault {
+		aaaaPolicy = d.aaaaPolicies.policy(normalizeName(qName))
+	}
+	if qType == dns.TypeAAAA && aaaaPolicy != AAAAAllow {
+		d.suppressAAAA(ctx, aaaaPolicy)
+		d.fitResponse(ctx, true)
+		result = fmt.Sprintf("%s (AAAA suppressed)", dns.RcodeToString[ctx.Res.Rcode])
+		decision = "AAAA suppressed, policy " + aaaaPolicy.String()
+		return nil
+	}
+
+	neverMapEntry, neverMapMatched := rules.neverMap.matchEntry(normalizeName(qName), qType)
+	mapRule, mapRuleAction := rules.mapRules.match(normalizeName(qName), qType)
+	if mapRuleAction != PolicyDefault && (!neverMapMatched || len(mapRule) > len(neverMapEntry)) {
+		neverMapMatched = false
+	} else {
+		mapRuleAction = PolicyDefault
+	}
+	neverMap := selfQuery || localName || isSingleLabel(normalizeName(qName)) || neverMapMatched || mapRuleAction == PolicyPass
+	switch policyAction {
+	case PolicyMap, PolicyEgress:
+		neverMap = selfQuery || localName
+	case PolicyPass:
+		neverMap = true
+	}
+	mappable := (qType == dns.TypeA || qType == dns.TypeAAAA || qType == dns.TypeANY) && !neverMap
+	failOpen := mappable && !d.failOpen.allowMapping()
+	mapTTL := d.ttl.Load()
+	if mappable && !failOpen && (d.verifyNames || d.upstreamTTL) {
+		exists, err := d.nameExists(p, ctx)
+		if err != nil && d.verifyNames {
+			return err
+		}
+		if err == nil && !exists && d.verifyNames {
+			synthesized = false
+			d.fitResponse(ctx, synthesized)
+			result = fmt.Sprintf("%s (not resolved upstream)", dns.RcodeToString[ctx.Res.Rcode])
+			decision = "passed to upstream: name doesn't resolve"
+			return nil
+		}
+		if err == nil && exists && d.upstreamTTL {
+			mapTTL = d.answerTTL(ctx.Res, mapTTL)
+		}
+	}
+	if mappable && !failOpen {
+		err := d.rewrite(mapper, clientKey, normalizeName(qName), aaaaPolicy == AAAAAllow, mapTTL, ctx)
+		d.failOpen.mappingDone(err)
+		if err != nil {
+			d.notifier.Notify(notify.EventMappingError, "can't map %s: %v", d.logName(qName), err)
+			if d.failOpen == nil {
+				return fmt.Errorf("rewrite error: %w", err)
+			}
+			log.Printf("can't map %s, passing query to upstream: %v", d.logName(qName), err)
+			failOpen = true
+		}
+	}
+	if mappable && !failOpen {
+		d.fitResponse(ctx, true)
 		result = logRRRepr(ctx.Res.Answer)
+		if ctx.Res.Truncated {
+			result += " (truncated)"
+		}
+		decision = "mapped" + mappedAddrs(ctx.Res)
+		if policyAction == PolicyMap {
+			decision += " by policy"
+		} else if policyAction == PolicyEgress {
+			decision += fmt.Sprintf(" by policy via egress %q", egress)
+		} else if mapRuleAction == PolicyMap {
+			decision += fmt.Sprintf(" by map rule %q", mapRule+".")
+		}
 		return nil
 	}
 
-	err = p.Resolve(ctx)
-	if err != nil {
-		return err
+	synthesized = false
+	switch {
+	case failOpen:
+		decision = "passed to upstream: fail-open"
+	case selfQuery:
+		decision = "passed to upstream: self query"
+	case policyAction == PolicyPass:
+		decision = "passed to upstream: policy"
+	case localName:
+		decision = "passed to upstream: .local name"
+	case neverMapMatched:
+		decision = fmt.Sprintf("passed to upstream: never map entry %q", neverMapEntry+".")
+	case mapRuleAction == PolicyPass:
+		decision = fmt.Sprintf("passed to upstream: map rule %q", mapRule+".")
+	case isSingleLabel(normalizeName(qName)):
+		decision = "passed to upstream: single-label name"
+	default:
+		decision = "passed to upstream"
+	}
+
+	if upstreamRes != nil {
+		ctx.Res = upstreamRes
+	} else {
+		ctx.CustomUpstreamConfig = d.queryUpstreams()
+		err = d.coalescedResolve(p, ctx)
+		if err != nil {
+			return err
+		}
+	}
+	// Upstream cookies are meaningless to client.
+	stripCookies(ctx.Res)
+
+	if (qType == dns.TypeSRV || qType == dns.TypeNAPTR) && ctx.Res != nil &&
+		d.rewriteTargets.match(normalizeName(qName), qType) {
+		stripTargetAddrs(ctx.Res)
 	}
+	d.fitResponse(ctx, synthesized)
 
 	result = logRRRepr(ctx.Res.Answer)
+	switch {
+	case failOpen:
+		result += " (fail-open)"
+	case selfQuery:
+		result += " (self query)"
+	case neverMap:
+		result += " (never map)"
+	}
 	return nil
 }
 
-// rewrite rewrites the specified query and redirects the response to the
-// configured IP addresses.
-func (d *DNSProxy) rewrite(clientKey string, qName string, qType uint16, ctx *proxy.DNSContext) error {
+// nameExists resolves query via upstream to learn whether queried name
+// exists. Upstream response is left in ctx.
+func (d *DNSProxy) nameExists(p *proxy.Proxy, ctx *proxy.DNSContext) (bool, error) {
+	ctx.CustomUpstreamConfig = d.queryUpstreams()
+	if err := d.coalescedResolve(p, ctx); err != nil {
+		return false, err
+	}
+	stripCookies(ctx.Res)
+	return ctx.Res.Rcode == dns.RcodeSuccess, nil
+}
+
+// responseAddrs returns addresses of A and AAAA records of response.
+func responseAddrs(resp *dns.Msg) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+// answerTTL returns the lowest TTL of answer records in upstream response,
+// clamped by minimal and maximal TTL. It's fallback if there are none.
+func (d *DNSProxy) answerTTL(resp *dns.Msg, fallback uint32) uint32 {
+	if len(resp.Answer) == 0 {
+		return fallback
+	}
+	ttl := resp.Answer[0].Header().Ttl
+	for _, rr := range resp.Answer[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if ttl < d.minTTL {
+		ttl = d.minTTL
+	}
+	if d.maxTTL != 0 && ttl > d.maxTTL {
+		ttl = d.maxTTL
+	}
+	return ttl
+}
+
+// isSelfQuery reports whether query came from dns44's own egress address.
+func (d *DNSProxy) isSelfQuery(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range d.selfSources {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite answers the query with addresses mapper maps to domainName.
+// Answer TTL is baseTTL, unless TTL pressure shortens it, and mapping lease
+// outlives answer by a second.
+func (d *DNSProxy) rewrite(mapper Mapper, clientKey clientkey.Key, domainName string, allowAAAA bool, baseTTL uint32, ctx *proxy.DNSContext) error {
+	qName := ctx.Req.Question[0].Name
+	qType := ctx.Req.Question[0].Qtype
 	resp := &dns.Msg{}
 	resp.SetReply(ctx.Req)
-	resp.Compress = true
 
-	domainName := strings.TrimSuffix(strings.ToLower(qName), ".")
-	answerAddress, err := d.mapper.EnsureMapping(clientKey, domainName, time.Duration(d.ttl+1)*time.Second)
-	if err != nil {
-		return fmt.Errorf("mapping error: %w", err)
+	ttl := d.ttlPressure.apply(baseTTL)
+	wantA := qType == dns.TypeA || qType == dns.TypeANY
+	wantAAAA := (qType == dns.TypeAAAA || qType == dns.TypeANY) && d.pair6 != nil && allowAAAA
+	var answerAddrs []netip.Addr
+	if wantA || wantAAAA {
+		var err error
+		answerAddrs, err = d.ensureMappings(mapper, clientKey, domainName, time.Duration(ttl+1)*time.Second)
+		if err != nil {
+			return fmt.Errorf("mapping error: %w", err)
+		}
 	}
 
-	hdr := dns.RR_Header{
-		Name:   qName,
-		Rrtype: qType,
-		Class:  dns.ClassINET,
-		Ttl:    d.ttl,
+	hdr := func(rrType uint16) dns.RR_Header {
+		return dns.RR_Header{
+			Name:   qName,
+			Rrtype: rrType,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		}
 	}
 
-	switch qType {
-	case dns.TypeA:
-		resp.Answer = append(resp.Answer, &dns.A{
-			Hdr: hdr,
-			A:   answerAddress.AsSlice(),
-		})
-	case dns.TypeAAAA:
-		resp.Answer = []dns.RR{}
+	resp.Answer = []dns.RR{}
+	if wantA {
+		for _, addr := range answerAddrs {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: hdr(dns.TypeA),
+				A:   addr.AsSlice(),
+			})
+		}
+	}
+	if wantAAAA {
+		for _, addr := range answerAddrs {
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  hdr(dns.TypeAAAA),
+				AAAA: d.pair6.To6(addr).AsSlice(),
+			})
+		}
+	}
+	if len(resp.Answer) == 0 {
+		// NODATA
+		resp.Ns = []dns.RR{d.negativeSOA(qName)}
 	}
 
 	ctx.Res = resp
 	return nil
 }
 
+// ensureMappings returns addresses mapped to domain, rotated for
+// round-robin if there are several of them.
+func (d *DNSProxy) ensureMappings(mapper Mapper, clientKey clientkey.Key, domainName string, ttl time.Duration) ([]netip.Addr, error) {
+	// Concurrent queries for the same domain, e.g. A and AAAA, share one
+	// mapper call.
+	addrs, err, _ := d.mappings.do(clientKey.String()+"\x00"+domainName, func() ([]netip.Addr, error) {
+		if d.addrsPerDomain <= 1 {
+			addr, err := mapper.EnsureMapping(clientKey, domainName, ttl)
+			if err != nil {
+				return nil, err
+			}
+			return []netip.Addr{addr}, nil
+		}
+		return mapper.(MultiMapper).EnsureMappings(clientKey, domainName, d.addrsPerDomain, ttl)
+	})
+	if err != nil || len(addrs) <= 1 {
+		return addrs, err
+	}
+	shift := int(d.rotation.Add(1) % uint32(len(addrs)))
+	rotated := make([]netip.Addr, 0, len(addrs))
+	rotated = append(rotated, addrs[shift:]...)
+	return append(rotated, addrs[:shift]...), nil
+}
+
 // createProxyConfig creates DNS proxy configuration.
 func createProxyConfig(cfg *Config) (proxyConfig proxy.Config, err error) {
-	upstreamCfg, err := proxy.ParseUpstreamsConfig([]string{cfg.Upstream}, nil)
+	upstreamCfg, err := parseUpstream(cfg.Upstream, cfg.UpstreamTimeout)
 	if err != nil {
-		return proxyConfig, fmt.Errorf("failed to parse upstream %s: %w", cfg.Upstream, err)
+		return proxyConfig, err
 	}
 
 	ip := net.IP(cfg.ListenAddr.Addr().AsSlice())
@@ -149,16 +841,52 @@ func createProxyConfig(cfg *Config) (proxyConfig proxy.Config, err error) {
 	proxyConfig.TCPListenAddr = []*net.TCPAddr{tcpPort}
 	proxyConfig.UpstreamConfig = upstreamCfg
 
+	encrypted := false
+	if cfg.TLSListenAddr.IsValid() {
+		proxyConfig.TLSListenAddr = []*net.TCPAddr{net.TCPAddrFromAddrPort(cfg.TLSListenAddr)}
+		encrypted = true
+	}
+	if cfg.HTTPSListenAddr.IsValid() {
+		proxyConfig.HTTPSListenAddr = []*net.TCPAddr{net.TCPAddrFromAddrPort(cfg.HTTPSListenAddr)}
+		encrypted = true
+	}
+	if cfg.QUICListenAddr.IsValid() {
+		proxyConfig.QUICListenAddr = []*net.UDPAddr{net.UDPAddrFromAddrPort(cfg.QUICListenAddr)}
+		encrypted = true
+	}
+	if encrypted {
+		if cfg.TLSConfig == nil {
+			return proxyConfig, fmt.Errorf("encrypted listeners require TLS configuration")
+		}
+		proxyConfig.TLSConfig = cfg.TLSConfig
+	}
+
 	return proxyConfig, nil
 }
 
+// logName returns domain name as it should appear in logs.
+func (d *DNSProxy) logName(name string) string {
+	if d.redactName == nil {
+		return name
+	}
+	return d.redactName(normalizeName(name))
+}
+
+// redactedResult describes response for logs without domain names.
+func redactedResult(resp *dns.Msg) string {
+	if resp == nil {
+		return "???"
+	}
+	return fmt.Sprintf("%s [ %s ]", dns.RcodeToString[resp.Rcode], strings.Join(answerAddrs(resp), "; "))
+}
+
 func logRRRepr(rrs []dns.RR) string {
 	var b strings.Builder
 	b.WriteString("[ ")
 	length := len(rrs)
 	for i, rr := range rrs {
 		b.WriteString(rr.String())
-		if i < length - 1 {
+		if i < length-1 {
 			b.WriteString("; ")
 		}
 	}
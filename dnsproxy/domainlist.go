@@ -0,0 +1,73 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// domainList matches domain names with their subdomains, optionally
+// restricted to particular query types.
+type domainList struct {
+	// entries maps domain name to query types. Nil set matches any type.
+	entries map[string]map[uint16]struct{}
+}
+
+// newDomainList parses list entries in DOMAIN[/QTYPE] format. Domain "."
+// matches all names.
+func newDomainList(specs []string) (*domainList, error) {
+	l := &domainList{
+		entries: make(map[string]map[uint16]struct{}),
+	}
+	for _, spec := range specs {
+		rawName, typeName, hasType := strings.Cut(spec, "/")
+		name := normalizeName(rawName)
+		if name == "" && strings.TrimSpace(rawName) != "." {
+			return nil, fmt.Errorf("empty domain in entry %q", spec)
+		}
+		if !hasType {
+			l.entries[name] = nil
+			continue
+		}
+		qType, ok := dns.StringToType[strings.ToUpper(typeName)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type in entry %q", spec)
+		}
+		types, ok := l.entries[name]
+		if ok && types == nil {
+			continue
+		}
+		if !ok {
+			types = make(map[uint16]struct{})
+			l.entries[name] = types
+		}
+		types[qType] = struct{}{}
+	}
+	return l, nil
+}
+
+func (l *domainList) match(domainName string, qType uint16) bool {
+	_, ok := l.matchEntry(domainName, qType)
+	return ok
+}
+
+// matchEntry returns domain of the most specific matching entry.
+func (l *domainList) matchEntry(domainName string, qType uint16) (string, bool) {
+	for name := domainName; ; {
+		if types, ok := l.entries[name]; ok {
+			if _, typeOK := types[qType]; typeOK || types == nil {
+				return name, true
+			}
+		}
+		if name == "" {
+			return "", false
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
+
+// normalizeName converts DNS name to the form used as mapping key.
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
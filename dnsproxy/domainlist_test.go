@@ -0,0 +1,42 @@
+package dnsproxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDomainListMatch(t *testing.T) {
+	l, err := newDomainList([]string{"pool.ntp.org", "Example.COM./AAAA", "both.example.net/A", "both.example.net"})
+	if err != nil {
+		t.Fatalf("newDomainList failed: %v", err)
+	}
+	testCases := []struct {
+		name    string
+		qType   uint16
+		matched bool
+	}{
+		{"pool.ntp.org", dns.TypeA, true},
+		{"0.pool.ntp.org", dns.TypeAAAA, true},
+		{"ntp.org", dns.TypeA, false},
+		{"xpool.ntp.org", dns.TypeA, false},
+		{"www.example.com", dns.TypeAAAA, true},
+		{"www.example.com", dns.TypeA, false},
+		{"both.example.net", dns.TypeAAAA, true},
+	}
+	for _, tc := range testCases {
+		if matched := l.match(tc.name, tc.qType); matched != tc.matched {
+			t.Errorf("match(%q, %s) = %v, expected %v", tc.name, dns.TypeToString[tc.qType], matched, tc.matched)
+		}
+	}
+	root, err := newDomainList([]string{"./SRV"})
+	if err != nil {
+		t.Fatalf("newDomainList failed: %v", err)
+	}
+	if !root.match("_sip._tcp.example.com", dns.TypeSRV) || root.match("example.com", dns.TypeA) {
+		t.Errorf("root entry doesn't match as expected")
+	}
+	if _, err := newDomainList([]string{"example.com/BOGUS"}); err == nil {
+		t.Errorf("bad query type accepted")
+	}
+}
@@ -0,0 +1,89 @@
+package dnsproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+func selfSignedConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns44.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("can't create certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func TestEncryptedListeners(t *testing.T) {
+	local := netip.MustParseAddrPort("127.0.0.1:0")
+	if _, err := New(&Config{
+		ListenAddr:    local,
+		Upstream:      "127.0.0.1:1",
+		TLSListenAddr: local,
+	}); err == nil {
+		t.Fatal("encrypted listener without TLS configuration accepted")
+	}
+
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{
+		Mapper:          mapper,
+		TLSListenAddr:   local,
+		HTTPSListenAddr: local,
+		QUICListenAddr:  local,
+		TLSConfig:       selfSignedConfig(t),
+	}, new(atomic.Int32))
+
+	for _, addr := range []string{
+		"tls://" + d.proxy.Addr(proxy.ProtoTLS).String(),
+		"https://" + d.proxy.Addr(proxy.ProtoHTTPS).String() + "/dns-query",
+		"quic://" + d.proxy.Addr(proxy.ProtoQUIC).String(),
+	} {
+		u, err := upstream.AddressToUpstream(addr, &upstream.Options{
+			Timeout:            5 * time.Second,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: can't create client: %v", addr, err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := u.Exchange(req)
+		u.Close()
+		if err != nil {
+			t.Fatalf("%s: exchange failed: %v", addr, err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "172.24.0.1" {
+			t.Errorf("%s: unexpected answer %v", addr, resp.Answer)
+		}
+	}
+	if calls := mapper.calls.Load(); calls != 3 {
+		t.Errorf("mapper called %d times, expected 3", calls)
+	}
+}
@@ -0,0 +1,160 @@
+package dnsproxy
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Snawoot/dns44/notify"
+)
+
+const (
+	// DefaultFailOpenFailures is the number of consecutive mapping errors
+	// which switch DNS proxies to passthrough.
+	DefaultFailOpenFailures = 3
+	// DefaultFailOpenRetry is the interval between attempts to map
+	// while in passthrough mode.
+	DefaultFailOpenRetry = 30 * time.Second
+)
+
+// FailOpen switches DNS proxies to passthrough mode, answering all queries
+// with real addresses from upstream, while mapping storage or proxy is
+// unhealthy. Clients then connect to destinations directly, so the network
+// keeps working during incidents. It may be shared by several DNSProxy
+// instances. Nil value never switches.
+type FailOpen struct {
+	maxFailures int
+	retry       time.Duration
+	notifier    *notify.Notifier
+
+	mux       sync.Mutex
+	failures  int
+	mapErr    error
+	faults    map[string]error
+	nextProbe time.Time
+	active    atomic.Bool
+}
+
+// NewFailOpen returns FailOpen switching to passthrough after maxFailures
+// consecutive mapping errors. While mapping is failing, one query per
+// retry interval still tries mapping to detect recovery. Zero values
+// select defaults.
+func NewFailOpen(maxFailures int, retry time.Duration, notifier *notify.Notifier) *FailOpen {
+	if maxFailures <= 0 {
+		maxFailures = DefaultFailOpenFailures
+	}
+	if retry <= 0 {
+		retry = DefaultFailOpenRetry
+	}
+	return &FailOpen{
+		maxFailures: maxFailures,
+		retry:       retry,
+		notifier:    notifier,
+		faults:      make(map[string]error),
+	}
+}
+
+// Active reports whether passthrough mode is on.
+func (f *FailOpen) Active() bool {
+	return f != nil && f.active.Load()
+}
+
+// Reason describes faults which turned passthrough mode on. It's empty if
+// mode is off.
+func (f *FailOpen) Reason() string {
+	if f == nil {
+		return ""
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.reasonLocked()
+}
+
+func (f *FailOpen) reasonLocked() string {
+	var reasons []string
+	if f.mapErr != nil {
+		reasons = append(reasons, "mapping: "+f.mapErr.Error())
+	}
+	for source, err := range f.faults {
+		reasons = append(reasons, source+": "+err.Error())
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
+
+// SetFault records state of subsystem named source. Passthrough mode is
+// on while any subsystem has a fault. Nil err clears fault.
+func (f *FailOpen) SetFault(source string, err error) {
+	if f == nil {
+		return
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err == nil {
+		delete(f.faults, source)
+	} else {
+		f.faults[source] = err
+	}
+	f.update()
+}
+
+// allowMapping reports whether query may be mapped. Mapping isn't
+// allowed while proxy has faults, or while mapping is failing, except
+// for one probe query per retry interval.
+func (f *FailOpen) allowMapping() bool {
+	if !f.Active() {
+		return true
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if len(f.faults) > 0 || f.mapErr == nil {
+		return false
+	}
+	now := time.Now()
+	if now.Before(f.nextProbe) {
+		return false
+	}
+	f.nextProbe = now.Add(f.retry)
+	return true
+}
+
+// mappingDone records result of mapping attempt.
+func (f *FailOpen) mappingDone(err error) {
+	if f == nil {
+		return
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err == nil {
+		f.failures = 0
+		f.mapErr = nil
+	} else {
+		f.failures++
+		if f.failures >= f.maxFailures && f.mapErr == nil {
+			f.mapErr = err
+			f.nextProbe = time.Now().Add(f.retry)
+		}
+	}
+	f.update()
+}
+
+// update switches mode according to recorded faults. It must be called
+// with mux held.
+func (f *FailOpen) update() {
+	active := f.mapErr != nil || len(f.faults) > 0
+	if active == f.active.Load() {
+		return
+	}
+	f.active.Store(active)
+	if active {
+		reason := f.reasonLocked()
+		log.Printf("WARNING: switching DNS to passthrough mode, queries are answered without mapping: %s", reason)
+		f.notifier.Notify(notify.EventFailOpen, "DNS switched to passthrough mode: %s", reason)
+		return
+	}
+	log.Printf("faults are cleared, leaving DNS passthrough mode")
+	f.notifier.Notify(notify.EventFailOpenEnd, "DNS left passthrough mode")
+}
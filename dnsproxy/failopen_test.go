@@ -0,0 +1,86 @@
+package dnsproxy
+
+import (
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+type flakyMapper struct {
+	broken atomic.Bool
+	calls  atomic.Int32
+}
+
+func (m *flakyMapper) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	m.calls.Add(1)
+	if m.broken.Load() {
+		return netip.Addr{}, errors.New("database is locked")
+	}
+	return netip.MustParseAddr("172.24.0.1"), nil
+}
+
+func TestFailOpen(t *testing.T) {
+	mapper := new(flakyMapper)
+	failOpen := NewFailOpen(2, time.Hour, nil)
+	d := startProxy(t, &Config{Mapper: mapper, FailOpen: failOpen}, new(atomic.Int32))
+	query := func() *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+		resp, _, err := client.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		return resp
+	}
+	mapped := func(resp *dns.Msg) bool {
+		return resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 1 && resp.Answer[0].(*dns.A).A.String() == "172.24.0.1"
+	}
+
+	mapper.broken.Store(true)
+	for i := 0; i < 2; i++ {
+		// Upstream has no A records, passthrough answer is empty.
+		if resp := query(); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Fatalf("query %d with broken mapping: expected passthrough, got %v", i, resp)
+		}
+	}
+	if !failOpen.Active() {
+		t.Fatal("passthrough mode isn't active after consecutive mapping failures")
+	}
+	query()
+	if calls := mapper.calls.Load(); calls != 2 {
+		t.Errorf("mapper was called %d times, expected no calls in passthrough mode", calls)
+	}
+
+	// Probe after retry interval detects recovery.
+	mapper.broken.Store(false)
+	failOpen.mux.Lock()
+	failOpen.nextProbe = time.Time{}
+	failOpen.mux.Unlock()
+	if resp := query(); !mapped(resp) {
+		t.Fatalf("probe query wasn't mapped: %v", resp)
+	}
+	if failOpen.Active() {
+		t.Error("passthrough mode is active after successful mapping")
+	}
+
+	failOpen.SetFault("TCP proxy", errors.New("listener closed"))
+	if reason := failOpen.Reason(); reason != "TCP proxy: listener closed" {
+		t.Errorf("Reason() = %q", reason)
+	}
+	if resp := query(); mapped(resp) {
+		t.Error("query was mapped while proxy is down")
+	}
+	failOpen.SetFault("TCP proxy", nil)
+	if resp := query(); !mapped(resp) {
+		t.Errorf("query wasn't mapped after proxy recovery: %v", resp)
+	}
+}
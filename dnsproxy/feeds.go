@@ -0,0 +1,276 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Snawoot/dns44/notify"
+)
+
+const (
+	// DefaultFeedRefresh is how often threat feeds are fetched again.
+	DefaultFeedRefresh = time.Hour
+	// feedTimeout limits download of one feed.
+	feedTimeout = time.Minute
+	// maxFeedSize limits size of downloaded feed.
+	maxFeedSize = 64 << 20
+	// maxFeedLine is length of the longest feed line parsed. Longer lines
+	// can't hold entries and are skipped.
+	maxFeedLine = 4096
+)
+
+// FeedPolicy blocks domains listed in threat intelligence feeds, along
+// with their subdomains. Feeds are local files or HTTP(S) URLs with one
+// entry per line, which is domain name, hosts file line like
+// "0.0.0.0 example.com", adblock rule like "||example.com^" or hex
+// SHA-256 hash of domain name without trailing dot. Lines starting with #
+// or ! are comments. Hits are logged and reported as notify.EventThreat.
+// Feeds are fetched again in background as queries arrive, at most once
+// per refresh interval. Failed fetch keeps previous version of feed.
+type FeedPolicy struct {
+	feeds      []*feed
+	refresh    time.Duration
+	client     *http.Client
+	notifier   *notify.Notifier
+	redactName func(string) string
+	checked    atomic.Int64
+	refreshing atomic.Bool
+}
+
+type feed struct {
+	name string
+	src  string
+
+	mux     sync.RWMutex
+	list    *feedList
+	etag    string
+	modTime time.Time
+}
+
+// feedList is parsed content of a feed.
+type feedList struct {
+	domains map[string]struct{}
+	hashes  map[[sha256.Size]byte]struct{}
+}
+
+// NewFeedPolicy loads feeds given as NAME=SOURCE or just SOURCE, where
+// SOURCE is file path or HTTP(S) URL. Zero refresh means
+// DefaultFeedRefresh. redactName, if set, masks domain names in logs and
+// notifications.
+func NewFeedPolicy(feeds []string, refresh time.Duration, notifier *notify.Notifier, redactName func(string) string) (*FeedPolicy, error) {
+	if refresh <= 0 {
+		refresh = DefaultFeedRefresh
+	}
+	p := &FeedPolicy{
+		refresh:    refresh,
+		client:     &http.Client{Timeout: feedTimeout},
+		notifier:   notifier,
+		redactName: redactName,
+	}
+	for _, spec := range feeds {
+		f := &feed{src: spec}
+		if name, src, ok := strings.Cut(spec, "="); ok && !strings.Contains(name, "/") {
+			f.name, f.src = name, src
+		} else {
+			f.name = spec
+		}
+		if err := p.load(f); err != nil {
+			return nil, fmt.Errorf("can't load threat feed %s: %w", f.name, err)
+		}
+		p.feeds = append(p.feeds, f)
+	}
+	p.checked.Store(time.Now().UnixNano())
+	return p, nil
+}
+
+// load fetches feed unless it's unchanged since previous fetch.
+func (p *FeedPolicy) load(f *feed) error {
+	if !strings.HasPrefix(f.src, "http://") && !strings.HasPrefix(f.src, "https://") {
+		return f.loadFile()
+	}
+	req, err := http.NewRequest(http.MethodGet, f.src, nil)
+	if err != nil {
+		return err
+	}
+	f.mux.RLock()
+	if f.list != nil && f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	f.mux.RUnlock()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("feed server responded with status %s", resp.Status)
+	}
+	body := &io.LimitedReader{R: resp.Body, N: maxFeedSize + 1}
+	list, err := parseFeed(body)
+	if err != nil {
+		return err
+	}
+	if body.N == 0 {
+		return fmt.Errorf("feed is larger than %d bytes", maxFeedSize)
+	}
+	f.mux.Lock()
+	f.list = list
+	f.etag = resp.Header.Get("ETag")
+	f.mux.Unlock()
+	return nil
+}
+
+func (f *feed) loadFile() error {
+	fi, err := os.Stat(f.src)
+	if err != nil {
+		return err
+	}
+	f.mux.RLock()
+	unchanged := f.list != nil && fi.ModTime().Equal(f.modTime)
+	f.mux.RUnlock()
+	if unchanged {
+		return nil
+	}
+	file, err := os.Open(f.src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	list, err := parseFeed(file)
+	if err != nil {
+		return err
+	}
+	f.mux.Lock()
+	f.list = list
+	f.modTime = fi.ModTime()
+	f.mux.Unlock()
+	return nil
+}
+
+func (f *feed) current() *feedList {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	return f.list
+}
+
+// parseFeed reads feed entries. Lines longer than maxFeedLine are skipped.
+func parseFeed(r io.Reader) (*feedList, error) {
+	list := &feedList{
+		domains: make(map[string]struct{}),
+		hashes:  make(map[[sha256.Size]byte]struct{}),
+	}
+	rd := bufio.NewReaderSize(r, maxFeedLine)
+	for {
+		line, err := rd.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = rd.ReadSlice('\n')
+			}
+		} else {
+			list.add(string(line))
+		}
+		switch {
+		case err == io.EOF:
+			return list, nil
+		case err != nil:
+			return list, err
+		}
+	}
+}
+
+// add parses feed line.
+func (l *feedList) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' {
+		return
+	}
+	if comment := strings.IndexByte(line, '#'); comment >= 0 {
+		line = strings.TrimSpace(line[:comment])
+	}
+	fields := strings.Fields(line)
+	entry := fields[len(fields)-1]
+	if len(entry) == 2*sha256.Size {
+		var hash [sha256.Size]byte
+		if _, err := hex.Decode(hash[:], []byte(entry)); err == nil {
+			l.hashes[hash] = struct{}{}
+			return
+		}
+	}
+	entry = strings.TrimSuffix(strings.TrimPrefix(entry, "||"), "^")
+	if name := normalizeName(entry); name != "" && name != "localhost" && !strings.ContainsAny(name, "/*:") {
+		l.domains[name] = struct{}{}
+	}
+}
+
+// contains reports whether domain name or one of its parent domains is
+// listed.
+func (l *feedList) contains(name string) (string, bool) {
+	for name != "" {
+		if _, ok := l.domains[name]; ok {
+			return name, true
+		}
+		if len(l.hashes) > 0 {
+			if _, ok := l.hashes[sha256.Sum256([]byte(name))]; ok {
+				return name, true
+			}
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return "", false
+}
+
+func (p *FeedPolicy) Decide(ctx context.Context, q PolicyQuery) (PolicyAction, error) {
+	action, _, err := p.DecideReason(ctx, q)
+	return action, err
+}
+
+// DecideReason blocks query if its name is listed in any feed, naming
+// the feed and the listed domain.
+func (p *FeedPolicy) DecideReason(ctx context.Context, q PolicyQuery) (PolicyAction, string, error) {
+	p.maybeRefresh()
+	for _, f := range p.feeds {
+		listed, ok := f.current().contains(q.Name)
+		if !ok {
+			continue
+		}
+		name := q.Name
+		if p.redactName != nil {
+			name, listed = p.redactName(name), p.redactName(listed)
+		}
+		log.Printf("threat feed %s hit: %s queried by %s", f.name, name, q.ClientKey)
+		p.notifier.Notify(notify.EventThreat, "%s queried by %s is listed in threat feed %s", name, q.ClientKey, f.name)
+		return PolicyBlock, "threat feed " + f.name + ": " + listed, nil
+	}
+	return PolicyDefault, "", nil
+}
+
+// maybeRefresh starts update of feeds in background if refresh interval
+// has passed since last check.
+func (p *FeedPolicy) maybeRefresh() {
+	if time.Since(time.Unix(0, p.checked.Load())) < p.refresh || !p.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer p.refreshing.Store(false)
+		for _, f := range p.feeds {
+			if err := p.load(f); err != nil {
+				log.Printf("threat feed %s refresh failed, keeping previous version: %v", f.name, err)
+			}
+		}
+		p.checked.Store(time.Now().UnixNano())
+	}()
+}
@@ -0,0 +1,130 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseFeed(t *testing.T) {
+	hash := sha256.Sum256([]byte("hashed.example.net"))
+	list, err := parseFeed(strings.NewReader(fmt.Sprintf(`# plain list
+malware.example.com
+0.0.0.0 tracker.example.org # hosts file
+127.0.0.1 localhost
+||ads.example.net^
+! adblock comment
+%s
+`, hex.EncodeToString(hash[:]))))
+	if err != nil {
+		t.Fatalf("parseFeed failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		listed string
+	}{
+		{"malware.example.com", "malware.example.com"},
+		{"a.b.malware.example.com", "malware.example.com"},
+		{"example.com", ""},
+		{"tracker.example.org", "tracker.example.org"},
+		{"ads.example.net", "ads.example.net"},
+		{"cdn.hashed.example.net", "hashed.example.net"},
+		{"example.net", ""},
+		{"localhost", ""},
+	} {
+		listed, ok := list.contains(tc.name)
+		if listed != tc.listed || ok != (tc.listed != "") {
+			t.Errorf("contains(%q) = (%q, %v), expected %q", tc.name, listed, ok, tc.listed)
+		}
+	}
+}
+
+func TestParseFeedLongLines(t *testing.T) {
+	long := strings.Repeat("x", 100<<10)
+	list, err := parseFeed(strings.NewReader("first.example.com\n" + long + "\nsecond.example.com\n" + long))
+	if err != nil {
+		t.Fatalf("parseFeed failed: %v", err)
+	}
+	for _, name := range []string{"first.example.com", "second.example.com"} {
+		if _, ok := list.contains(name); !ok {
+			t.Errorf("%s isn't listed", name)
+		}
+	}
+	if len(list.domains) != 2 {
+		t.Errorf("unexpected entries %v", list.domains)
+	}
+}
+
+func TestOversizedFeed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		line := []byte(strings.Repeat("x", 1<<10) + "\n")
+		for written := 0; written <= maxFeedSize; written += len(line) {
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	if _, err := NewFeedPolicy([]string{srv.URL}, 0, nil, nil); err == nil {
+		t.Error("oversized feed was loaded")
+	}
+}
+
+func TestFeedPolicy(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, "phishing.example.com")
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "local.txt")
+	if err := os.WriteFile(path, []byte("malware.example.org\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := NewFeedPolicy([]string{"remote=" + srv.URL + "/feed.txt", path}, 0, nil, nil)
+	if err != nil {
+		t.Fatalf("NewFeedPolicy failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		action PolicyAction
+		reason string
+	}{
+		{"login.phishing.example.com", PolicyBlock, "threat feed remote: phishing.example.com"},
+		{"malware.example.org", PolicyBlock, "threat feed " + path + ": malware.example.org"},
+		{"example.com", PolicyDefault, ""},
+	} {
+		action, reason, err := policy.DecideReason(context.Background(), PolicyQuery{Name: tc.name})
+		if err != nil || action != tc.action || reason != tc.reason {
+			t.Errorf("%s: got (%s, %q, %v), expected (%s, %q)", tc.name, action, reason, err, tc.action, tc.reason)
+		}
+	}
+
+	if err := policy.load(policy.feeds[0]); err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("feed was fetched %d times", fetches.Load())
+	}
+	if action, _ := policy.Decide(context.Background(), PolicyQuery{Name: "phishing.example.com"}); action != PolicyBlock {
+		t.Error("unmodified feed was dropped on refresh")
+	}
+
+	if _, err := NewFeedPolicy([]string{srv.URL + "/missing", filepath.Join(t.TempDir(), "missing")}, 0, nil, nil); err == nil {
+		t.Error("missing feed was loaded")
+	}
+}
@@ -0,0 +1,93 @@
+package dnsproxy
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// flightGroup coalesces concurrent calls with the same key, so only one of
+// them is executed and others wait for its result. Zero value is ready to
+// use.
+type flightGroup[V any] struct {
+	mux   sync.Mutex
+	calls map[string]*flightCall[V]
+}
+
+type flightCall[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+}
+
+// do executes fn unless call with the same key is in progress, in which
+// case it waits for that call and returns its result with shared set.
+func (g *flightGroup[V]) do(key string, fn func() (V, error)) (val V, err error, shared bool) {
+	g.mux.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mux.Unlock()
+		<-call.done
+		return call.val, call.err, true
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[V])
+	}
+	call := &flightCall[V]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mux.Unlock()
+
+	defer func() {
+		g.mux.Lock()
+		delete(g.calls, key)
+		g.mux.Unlock()
+		close(call.done)
+	}()
+	call.val, call.err = fn()
+	return call.val, call.err, false
+}
+
+// queryKey identifies passthrough queries which can share one upstream
+// response: same question, flags, EDNS and transport.
+func queryKey(ctx *proxy.DNSContext) string {
+	req := ctx.Req
+	q := req.Question[0]
+	var b strings.Builder
+	// Name case is kept, as clients may randomize it and expect it back.
+	b.WriteString(q.Name)
+	b.WriteByte(' ')
+	b.WriteString(strconv.Itoa(int(q.Qtype)))
+	b.WriteByte(' ')
+	b.WriteString(strconv.Itoa(int(q.Qclass)))
+	b.WriteByte(' ')
+	b.WriteString(string(ctx.Proto))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatBool(req.RecursionDesired))
+	b.WriteString(strconv.FormatBool(req.CheckingDisabled))
+	b.WriteString(strconv.FormatBool(req.AuthenticatedData))
+	if opt := req.IsEdns0(); opt != nil {
+		b.WriteByte(' ')
+		b.WriteString(opt.String())
+	}
+	return b.String()
+}
+
+// coalescedResolve resolves passthrough query, sharing upstream response
+// with identical concurrent queries.
+func (d *DNSProxy) coalescedResolve(p *proxy.Proxy, ctx *proxy.DNSContext) error {
+	resp, err, shared := d.queries.do(queryKey(ctx), func() (*dns.Msg, error) {
+		err := d.resolve(p, ctx)
+		if ctx.Res == nil {
+			return nil, err
+		}
+		// Caller keeps processing its response, so waiters get a copy.
+		return ctx.Res.Copy(), err
+	})
+	if shared && resp != nil {
+		ctx.Res = resp.Copy()
+		ctx.Res.Id = ctx.Req.Id
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package dnsproxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var (
+		g       flightGroup[int]
+		calls   atomic.Int32
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+	const callers = 10
+	results := make(chan int, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, _, _ := g.do("key", func() (int, error) {
+				calls.Add(1)
+				<-release
+				return 42, nil
+			})
+			results <- val
+		}()
+	}
+	// Let callers pile up before first call finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("function was called %d times, expected 1", n)
+	}
+	for val := range results {
+		if val != 42 {
+			t.Errorf("unexpected result %d", val)
+		}
+	}
+
+	if _, _, shared := g.do("key", func() (int, error) { return 0, nil }); shared {
+		t.Errorf("finished call result is reused")
+	}
+}
+
+func TestCoalescedPassthrough(t *testing.T) {
+	var queries atomic.Int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteMsg(new(dns.Msg).SetReply(req))
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen UDP: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	d, err := New(&Config{
+		ListenAddr: netip.MustParseAddrPort("127.0.0.1:0"),
+		Upstream:   pc.LocalAddr().String(),
+		Mapper:     new(countingMapper),
+		TTL:        60,
+	})
+	if err != nil {
+		t.Fatalf("can't create proxy: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("can't start proxy: %v", err)
+	}
+	defer d.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeMX)
+			resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+			if err != nil {
+				t.Errorf("exchange failed: %v", err)
+				return
+			}
+			if resp.Id != req.Id || resp.Rcode != dns.RcodeSuccess {
+				t.Errorf("unexpected response: %v", resp)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries, expected 1", n)
+	}
+}
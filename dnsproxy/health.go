@@ -0,0 +1,239 @@
+package dnsproxy
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/dns44/notify"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultHealthFailures is the number of consecutive failed probes
+	// which make upstream unhealthy.
+	DefaultHealthFailures = 3
+	// DefaultHealthProbe is the name queried for NS records to probe
+	// upstreams.
+	DefaultHealthProbe = "."
+	// healthLatencyWeight is the weight of last probe in latency average.
+	healthLatencyWeight = 0.3
+)
+
+var errServerFailure = errors.New("upstream responded with SERVFAIL")
+
+// UpstreamStatus is the health state of upstream.
+type UpstreamStatus struct {
+	Address string
+	Healthy bool
+	// Latency is the moving average of successful probe round trip time.
+	Latency time.Duration
+	// Failures is the number of consecutive failed probes.
+	Failures int
+	Probes   uint64
+	Failed   uint64
+	LastErr  error
+}
+
+// healthMonitor probes upstreams periodically and keeps unhealthy ones out
+// of use until they recover.
+type healthMonitor struct {
+	interval    time.Duration
+	maxFailures int
+	probeName   string
+	upstreams   func() *proxy.UpstreamConfig
+	notifier    *notify.Notifier
+
+	mux     sync.Mutex
+	status  map[string]*UpstreamStatus
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newHealthMonitor(interval time.Duration, maxFailures int, probeName string, upstreams func() *proxy.UpstreamConfig) *healthMonitor {
+	if maxFailures <= 0 {
+		maxFailures = DefaultHealthFailures
+	}
+	if probeName == "" {
+		probeName = DefaultHealthProbe
+	}
+	return &healthMonitor{
+		interval:    interval,
+		maxFailures: maxFailures,
+		probeName:   dns.Fqdn(probeName),
+		upstreams:   upstreams,
+		status:      make(map[string]*UpstreamStatus),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (m *healthMonitor) start() {
+	m.started = true
+	go m.run()
+}
+
+func (m *healthMonitor) close() {
+	if !m.started {
+		return
+	}
+	m.started = false
+	close(m.stop)
+	<-m.done
+}
+
+func (m *healthMonitor) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.probeAll()
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *healthMonitor) probeAll() {
+	upstreams := allUpstreams(m.upstreams())
+	var wg sync.WaitGroup
+	for _, u := range upstreams {
+		wg.Add(1)
+		go func(u upstream.Upstream) {
+			defer wg.Done()
+			m.probe(u)
+		}(u)
+	}
+	wg.Wait()
+
+	// Forget upstreams which were replaced.
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for addr := range m.status {
+		if _, ok := upstreams[addr]; !ok {
+			delete(m.status, addr)
+		}
+	}
+}
+
+func (m *healthMonitor) probe(u upstream.Upstream) {
+	req := new(dns.Msg)
+	req.SetQuestion(m.probeName, dns.TypeNS)
+	start := time.Now()
+	resp, err := u.Exchange(req)
+	rtt := time.Since(start)
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = errServerFailure
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	st, ok := m.status[u.Address()]
+	if !ok {
+		st = &UpstreamStatus{Address: u.Address(), Healthy: true}
+		m.status[u.Address()] = st
+	}
+	st.Probes++
+	if err != nil {
+		st.Failed++
+		st.Failures++
+		st.LastErr = err
+		if st.Healthy && st.Failures >= m.maxFailures {
+			st.Healthy = false
+			log.Printf("upstream %s is unhealthy: %v", st.Address, err)
+			m.notifier.Notify(notify.EventUpstreamDown, "upstream %s is unhealthy: %v", st.Address, err)
+		}
+		return
+	}
+	st.Failures = 0
+	if st.Latency == 0 {
+		st.Latency = rtt
+	} else {
+		st.Latency = time.Duration(healthLatencyWeight*float64(rtt) + (1-healthLatencyWeight)*float64(st.Latency))
+	}
+	if !st.Healthy {
+		st.Healthy = true
+		log.Printf("upstream %s recovered", st.Address)
+		m.notifier.Notify(notify.EventUpstreamUp, "upstream %s recovered", st.Address)
+	}
+}
+
+// statuses returns snapshot of upstreams state.
+func (m *healthMonitor) statuses() []UpstreamStatus {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	res := make([]UpstreamStatus, 0, len(m.status))
+	for _, st := range m.status {
+		res = append(res, *st)
+	}
+	return res
+}
+
+// filter returns upstream config without unhealthy upstreams. Upstream
+// lists where all upstreams are unhealthy are kept as is: slow answer is
+// better than none.
+func (m *healthMonitor) filter(cfg *proxy.UpstreamConfig) *proxy.UpstreamConfig {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	unhealthy := false
+	for _, st := range m.status {
+		if !st.Healthy {
+			unhealthy = true
+			break
+		}
+	}
+	if !unhealthy {
+		return cfg
+	}
+
+	healthy := func(list []upstream.Upstream) []upstream.Upstream {
+		var res []upstream.Upstream
+		for _, u := range list {
+			if st, ok := m.status[u.Address()]; !ok || st.Healthy {
+				res = append(res, u)
+			}
+		}
+		if len(res) == 0 {
+			return list
+		}
+		return res
+	}
+	filtered := &proxy.UpstreamConfig{
+		Upstreams:                healthy(cfg.Upstreams),
+		DomainReservedUpstreams:  make(map[string][]upstream.Upstream, len(cfg.DomainReservedUpstreams)),
+		SpecifiedDomainUpstreams: make(map[string][]upstream.Upstream, len(cfg.SpecifiedDomainUpstreams)),
+		SubdomainExclusions:      cfg.SubdomainExclusions,
+	}
+	for domain, list := range cfg.DomainReservedUpstreams {
+		filtered.DomainReservedUpstreams[domain] = healthy(list)
+	}
+	for domain, list := range cfg.SpecifiedDomainUpstreams {
+		filtered.SpecifiedDomainUpstreams[domain] = healthy(list)
+	}
+	return filtered
+}
+
+// allUpstreams returns upstreams of config by address.
+func allUpstreams(cfg *proxy.UpstreamConfig) map[string]upstream.Upstream {
+	res := make(map[string]upstream.Upstream)
+	add := func(list []upstream.Upstream) {
+		for _, u := range list {
+			res[u.Address()] = u
+		}
+	}
+	add(cfg.Upstreams)
+	for _, list := range cfg.DomainReservedUpstreams {
+		add(list)
+	}
+	for _, list := range cfg.SpecifiedDomainUpstreams {
+		add(list)
+	}
+	return res
+}
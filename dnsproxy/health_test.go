@@ -0,0 +1,76 @@
+package dnsproxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+type stubUpstream struct {
+	addr    string
+	failing atomic.Bool
+}
+
+func (u *stubUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	if u.failing.Load() {
+		return nil, errors.New("timeout")
+	}
+	return new(dns.Msg).SetReply(req), nil
+}
+
+func (u *stubUpstream) Address() string { return u.addr }
+func (u *stubUpstream) Close() error    { return nil }
+
+func TestHealthMonitor(t *testing.T) {
+	a, b := &stubUpstream{addr: "a"}, &stubUpstream{addr: "b"}
+	cfg := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{a, b},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"example.org.": {a},
+		},
+	}
+	m := newHealthMonitor(0, 2, "", func() *proxy.UpstreamConfig { return cfg })
+
+	m.probeAll()
+	if m.filter(cfg) != cfg {
+		t.Fatalf("config is filtered while all upstreams are healthy")
+	}
+
+	a.failing.Store(true)
+	m.probeAll()
+	if m.filter(cfg) != cfg {
+		t.Fatalf("upstream is unhealthy after single failure")
+	}
+	m.probeAll()
+	filtered := m.filter(cfg)
+	if len(filtered.Upstreams) != 1 || filtered.Upstreams[0] != b {
+		t.Errorf("unhealthy upstream is not filtered out: %v", filtered.Upstreams)
+	}
+	if list := filtered.DomainReservedUpstreams["example.org."]; len(list) != 1 || list[0] != a {
+		t.Errorf("list of only unhealthy upstreams is not kept: %v", list)
+	}
+	for _, st := range m.statuses() {
+		if st.Address == "a" && (st.Healthy || st.Failures != 2 || st.Failed != 2 || st.Probes != 3 || st.LastErr == nil) {
+			t.Errorf("unexpected status of failing upstream: %+v", st)
+		}
+		if st.Address == "b" && (!st.Healthy || st.Failures != 0 || st.Probes != 3) {
+			t.Errorf("unexpected status of healthy upstream: %+v", st)
+		}
+	}
+
+	a.failing.Store(false)
+	m.probeAll()
+	if m.filter(cfg) != cfg {
+		t.Errorf("upstream hasn't recovered after successful probe")
+	}
+
+	cfg = &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{b}}
+	m.probeAll()
+	if st := m.statuses(); len(st) != 1 || st[0].Address != "b" {
+		t.Errorf("status of removed upstream is kept: %+v", st)
+	}
+}
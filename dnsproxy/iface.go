@@ -0,0 +1,108 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+const ifaceRefreshInterval = 10 * time.Second
+
+// ifaceFilter decides whether query came from on-link subnet of one of
+// allowed interfaces. Embedded proxy doesn't expose packet info of UDP
+// queries, so it can't tell ingress interface: UDP query is accepted if
+// its client is on-link for allowed interface and, for stream transports,
+// if local end of connection belongs to allowed interface.
+type ifaceFilter struct {
+	names   []string
+	mux     sync.Mutex
+	nets    []netip.Prefix
+	updated time.Time
+}
+
+func newIfaceFilter(names []string) (*ifaceFilter, error) {
+	f := &ifaceFilter{
+		names: names,
+	}
+	if _, err := f.loadNets(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *ifaceFilter) loadNets() ([]netip.Prefix, error) {
+	var nets []netip.Prefix
+	for _, name := range f.names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("can't find interface %q: %w", name, err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("can't get addresses of interface %q: %w", name, err)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+			ones, _ := ipNet.Mask.Size()
+			nets = append(nets, netip.PrefixFrom(ip.Unmap(), ones))
+		}
+	}
+	return nets, nil
+}
+
+func (f *ifaceFilter) currentNets() []netip.Prefix {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if time.Since(f.updated) > ifaceRefreshInterval {
+		nets, err := f.loadNets()
+		if err != nil {
+			log.Printf("interface addresses refresh failed: %v", err)
+		} else {
+			f.nets = nets
+		}
+		f.updated = time.Now()
+	}
+	return f.nets
+}
+
+func (f *ifaceFilter) allowed(ctx *proxy.DNSContext) bool {
+	nets := f.currentNets()
+
+	if ctx.Conn != nil {
+		if _, isUDP := ctx.Conn.(*net.UDPConn); !isUDP {
+			local, err := netip.ParseAddrPort(ctx.Conn.LocalAddr().String())
+			if err != nil {
+				return false
+			}
+			for _, n := range nets {
+				if n.Addr() == local.Addr().Unmap() {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	client, err := netip.ParseAddrPort(ctx.Addr.String())
+	if err != nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(client.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const leaseRefreshInterval = 5 * time.Second
+
+// keaHeader starts header line of Kea memfile lease database.
+const keaHeader = "address,"
+
+// leaseTable answers host names from DHCP leases file of dnsmasq or Kea.
+// File is reloaded when it changes.
+type leaseTable struct {
+	path    string
+	domain  string
+	mux     sync.Mutex
+	hosts   map[string][]netip.Addr
+	modTime time.Time
+	checked time.Time
+}
+
+func newLeaseTable(path, domain string) (*leaseTable, error) {
+	t := &leaseTable{
+		path:   path,
+		domain: normalizeName(domain),
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *leaseTable) reload() error {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return fmt.Errorf("can't stat leases file: %w", err)
+	}
+	if fi.ModTime().Equal(t.modTime) && t.hosts != nil {
+		return nil
+	}
+	f, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("can't open leases file: %w", err)
+	}
+	defer f.Close()
+	leases, err := parseLeases(f, time.Now())
+	if err != nil {
+		return fmt.Errorf("can't parse leases file %q: %w", t.path, err)
+	}
+	hosts := make(map[string][]netip.Addr)
+	for _, l := range leases {
+		name := l.hostname
+		if t.domain != "" {
+			// Hostnames are qualified with our domain regardless of what
+			// client has sent.
+			name, _, _ = strings.Cut(name, ".")
+			name += "." + t.domain
+		}
+		hosts[name] = append(hosts[name], l.addr)
+	}
+	t.hosts = hosts
+	t.modTime = fi.ModTime()
+	return nil
+}
+
+func (t *leaseTable) lookup(domainName string) []netip.Addr {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if time.Since(t.checked) > leaseRefreshInterval {
+		if err := t.reload(); err != nil {
+			log.Printf("DHCP leases refresh failed: %v", err)
+		}
+		t.checked = time.Now()
+	}
+	return t.hosts[domainName]
+}
+
+type lease struct {
+	hostname string
+	addr     netip.Addr
+}
+
+// parseLeases reads active leases with known hostnames from dnsmasq
+// leases file or Kea CSV lease database.
+func parseLeases(r io.Reader, now time.Time) ([]lease, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(keaHeader))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if string(head) == keaHeader {
+		return parseKeaLeases(br, now)
+	}
+	return parseDnsmasqLeases(br, now)
+}
+
+// parseDnsmasqLeases parses lines in "EXPIRY MAC|IAID ADDRESS HOSTNAME
+// CLIENTID" format. Zero expiry means infinite lease, hostname "*" means
+// none.
+func parseDnsmasqLeases(r io.Reader, now time.Time) ([]lease, error) {
+	var res []lease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad expiry time %q: %w", fields[0], err)
+		}
+		if expiry != 0 && time.Unix(expiry, 0).Before(now) {
+			continue
+		}
+		res = appendLease(res, fields[3], fields[2])
+	}
+	return res, scanner.Err()
+}
+
+// parseKeaLeases parses Kea memfile CSV database. Only leases in default
+// state are active.
+func parseKeaLeases(r io.Reader, now time.Time) ([]lease, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "expire", "hostname", "state"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("column %q is missing", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i := columns[name]; i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	// Kea appends lease updates to the file, so later records win.
+	latest := make(map[string]int)
+	var res []lease
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		address := field(record, "address")
+		expire, err := strconv.ParseInt(field(record, "expire"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad expire time of %s: %w", address, err)
+		}
+		active := field(record, "state") == "0" && time.Unix(expire, 0).After(now)
+		if i, ok := latest[address]; ok {
+			res[i] = lease{}
+		}
+		if !active {
+			delete(latest, address)
+			continue
+		}
+		before := len(res)
+		res = appendLease(res, field(record, "hostname"), address)
+		if len(res) > before {
+			latest[address] = before
+		}
+	}
+
+	active := res[:0]
+	for _, l := range res {
+		if l.hostname != "" {
+			active = append(active, l)
+		}
+	}
+	return active, nil
+}
+
+func appendLease(leases []lease, hostname, address string) []lease {
+	hostname = normalizeName(hostname)
+	if hostname == "" || hostname == "*" {
+		return leases
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return leases
+	}
+	return append(leases, lease{hostname: hostname, addr: addr.Unmap()})
+}
@@ -0,0 +1,97 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	leases, err := parseLeases(strings.NewReader(`1700003600 aa:bb:cc:dd:ee:01 192.168.1.50 printer 01:aa:bb:cc:dd:ee:01
+1600000000 aa:bb:cc:dd:ee:02 192.168.1.51 expired *
+0 aa:bb:cc:dd:ee:03 192.168.1.52 NAS.lan *
+1700003600 aa:bb:cc:dd:ee:04 192.168.1.53 * *
+duid 00:01:00:01:2c:1f:aa:bb:aa:bb:cc:dd:ee:ff
+1700003600 1234 fd00::50 printer 00:01:00:01
+`), now)
+	if err != nil {
+		t.Fatalf("parseLeases failed: %v", err)
+	}
+	expected := []lease{
+		{"printer", netip.MustParseAddr("192.168.1.50")},
+		{"nas.lan", netip.MustParseAddr("192.168.1.52")},
+		{"printer", netip.MustParseAddr("fd00::50")},
+	}
+	if len(leases) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, leases)
+	}
+	for i := range expected {
+		if leases[i] != expected[i] {
+			t.Errorf("lease %d: expected %v, got %v", i, expected[i], leases[i])
+		}
+	}
+}
+
+func TestParseKeaLeases(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	leases, err := parseLeases(strings.NewReader(`address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id
+192.168.1.50,aa:bb:cc:dd:ee:01,,3600,1700003600,1,0,0,printer.,0,,0
+192.168.1.51,aa:bb:cc:dd:ee:02,,3600,1700003600,1,0,0,laptop,0,,0
+192.168.1.51,aa:bb:cc:dd:ee:02,,3600,1700003600,1,0,0,laptop,2,,0
+192.168.1.52,aa:bb:cc:dd:ee:03,,3600,1600000000,1,0,0,expired,0,,0
+192.168.1.53,aa:bb:cc:dd:ee:04,,3600,1700003600,1,0,0,old,0,,0
+192.168.1.53,aa:bb:cc:dd:ee:04,,3600,1700007200,1,0,0,new,0,,0
+`), now)
+	if err != nil {
+		t.Fatalf("parseLeases failed: %v", err)
+	}
+	expected := []lease{
+		{"printer", netip.MustParseAddr("192.168.1.50")},
+		{"new", netip.MustParseAddr("192.168.1.53")},
+	}
+	if len(leases) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, leases)
+	}
+	for i := range expected {
+		if leases[i] != expected[i] {
+			t.Errorf("lease %d: expected %v, got %v", i, expected[i], leases[i])
+		}
+	}
+}
+
+func TestLeaseTableReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	if err := os.WriteFile(path, []byte("0 aa:bb:cc:dd:ee:01 192.168.1.50 printer.home *\n"), 0644); err != nil {
+		t.Fatalf("can't write leases: %v", err)
+	}
+	table, err := newLeaseTable(path, "lan.")
+	if err != nil {
+		t.Fatalf("newLeaseTable failed: %v", err)
+	}
+	if addrs := table.lookup("printer.lan"); len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.168.1.50") {
+		t.Fatalf("unexpected addresses of printer.lan: %v", addrs)
+	}
+	if addrs := table.lookup("printer.home"); addrs != nil {
+		t.Errorf("lease domain is not replaced: %v", addrs)
+	}
+
+	if err := os.WriteFile(path, []byte("0 aa:bb:cc:dd:ee:01 192.168.1.60 printer *\n"), 0644); err != nil {
+		t.Fatalf("can't write leases: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("can't change leases file time: %v", err)
+	}
+	table.checked = time.Time{}
+	if addrs := table.lookup("printer.lan"); len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.168.1.60") {
+		t.Errorf("leases are not reloaded: %v", addrs)
+	}
+
+	if _, err := newLeaseTable(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Errorf("missing leases file accepted")
+	}
+}
@@ -0,0 +1,117 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const mapRulesRefreshInterval = 5 * time.Second
+
+// mapRules decide whether domains are mapped or passed to upstream. Rules
+// file is reloaded when it changes.
+type mapRules struct {
+	path    string
+	mux     sync.Mutex
+	mapped  *domainList
+	passed  *domainList
+	modTime time.Time
+	checked time.Time
+}
+
+func newMapRules(path string) (*mapRules, error) {
+	r := &mapRules{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *mapRules) reload() error {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("can't stat map rules file: %w", err)
+	}
+	if fi.ModTime().Equal(r.modTime) && r.mapped != nil {
+		return nil
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return fmt.Errorf("can't open map rules file: %w", err)
+	}
+	defer f.Close()
+	mapped, passed, err := parseMapRules(f)
+	if err != nil {
+		return fmt.Errorf("can't parse map rules file %q: %w", r.path, err)
+	}
+	r.mapped, r.passed = mapped, passed
+	r.modTime = fi.ModTime()
+	return nil
+}
+
+// parseMapRules parses lines "map DOMAIN[/QTYPE]" and "pass DOMAIN[/QTYPE]".
+// Empty lines and lines starting with # are ignored.
+func parseMapRules(rd io.Reader) (mapped, passed *domainList, err error) {
+	var mapSpecs, passSpecs []string
+	scanner := bufio.NewScanner(rd)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("line %d: rule has to be \"map DOMAIN\" or \"pass DOMAIN\"", lineNo)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "map":
+			mapSpecs = append(mapSpecs, fields[1])
+		case "pass":
+			passSpecs = append(passSpecs, fields[1])
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown action %q", lineNo, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if mapped, err = newDomainList(mapSpecs); err != nil {
+		return nil, nil, err
+	}
+	if passed, err = newDomainList(passSpecs); err != nil {
+		return nil, nil, err
+	}
+	return mapped, passed, nil
+}
+
+// match returns domain of the most specific rule matching name along with
+// its action, PolicyMap or PolicyPass. Pass wins over map rule for the
+// same domain. Action is PolicyDefault if no rule matches.
+func (r *mapRules) match(domainName string, qType uint16) (string, PolicyAction) {
+	if r == nil {
+		return "", PolicyDefault
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if time.Since(r.checked) > mapRulesRefreshInterval {
+		if err := r.reload(); err != nil {
+			log.Printf("map rules refresh failed: %v", err)
+		}
+		r.checked = time.Now()
+	}
+	mapEntry, mapOK := r.mapped.matchEntry(domainName, qType)
+	passEntry, passOK := r.passed.matchEntry(domainName, qType)
+	switch {
+	case passOK && (!mapOK || len(passEntry) >= len(mapEntry)):
+		return passEntry, PolicyPass
+	case mapOK:
+		return mapEntry, PolicyMap
+	default:
+		return "", PolicyDefault
+	}
+}
@@ -0,0 +1,88 @@
+package dnsproxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestMapRulesMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map.rules")
+	if err := os.WriteFile(path, []byte(`
+# Only streaming services are mapped.
+pass .
+map example.com
+pass static.example.com
+map example.org/AAAA
+`), 0644); err != nil {
+		t.Fatalf("can't write rules: %v", err)
+	}
+	rules, err := newMapRules(path)
+	if err != nil {
+		t.Fatalf("newMapRules failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		qType    uint16
+		entry    string
+		expected PolicyAction
+	}{
+		{"www.example.com", dns.TypeA, "example.com", PolicyMap},
+		{"cdn.static.example.com", dns.TypeA, "static.example.com", PolicyPass},
+		{"example.net", dns.TypeA, "", PolicyPass},
+		{"example.org", dns.TypeAAAA, "example.org", PolicyMap},
+		{"example.org", dns.TypeA, "", PolicyPass},
+	} {
+		if entry, action := rules.match(tc.name, tc.qType); entry != tc.entry || action != tc.expected {
+			t.Errorf("%s %s: got (%q, %s), expected (%q, %s)", dns.TypeToString[tc.qType], tc.name, entry, action, tc.entry, tc.expected)
+		}
+	}
+
+	var nilRules *mapRules
+	if _, action := nilRules.match("example.com", dns.TypeA); action != PolicyDefault {
+		t.Errorf("nil rules returned %s", action)
+	}
+	for _, bad := range []string{"map", "drop example.com", "map example.com/BOGUS"} {
+		if _, _, err := parseMapRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("rules %q accepted", bad)
+		}
+	}
+}
+
+func TestMapRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map.rules")
+	if err := os.WriteFile(path, []byte("pass .\nmap mapped.example.com\nmap example.org\n"), 0644); err != nil {
+		t.Fatalf("can't write rules: %v", err)
+	}
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{
+		Mapper:       mapper,
+		NeverMap:     []string{"stun.example.org"},
+		MapRulesFile: path,
+	}, new(atomic.Int32))
+
+	for _, tc := range []struct {
+		name   string
+		mapped bool
+	}{
+		{"mapped.example.com.", true},
+		{"example.com.", false},
+		{"www.example.org.", true},
+		{"stun.example.org.", false},
+	} {
+		before := mapper.calls.Load()
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		if _, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String()); err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		if mapped := mapper.calls.Load() > before; mapped != tc.mapped {
+			t.Errorf("%s: mapped=%v, expected %v", tc.name, mapped, tc.mapped)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// mdnsDomain is the domain resolved with multicast DNS (RFC 6762).
+const mdnsDomain = "local"
+
+// DefaultMDNSTimeout is how long mDNS responses are awaited.
+const DefaultMDNSTimeout = time.Second
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// LocalPolicy selects how queries for names in .local domain are answered.
+// Such names are never mapped.
+type LocalPolicy int
+
+const (
+	// LocalNXDomain answers .local queries with NXDOMAIN, as unicast DNS
+	// has no authority over them.
+	LocalNXDomain LocalPolicy = iota
+	// LocalUpstream passes .local queries to upstream.
+	LocalUpstream
+	// LocalMDNS resolves .local queries with one-shot multicast DNS query
+	// on behalf of client.
+	LocalMDNS
+)
+
+var localPolicyNames = map[LocalPolicy]string{
+	LocalNXDomain: "nxdomain",
+	LocalUpstream: "upstream",
+	LocalMDNS:     "mdns",
+}
+
+func (p LocalPolicy) String() string {
+	if name, ok := localPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("LocalPolicy(%d)", int(p))
+}
+
+// ParseLocalPolicy parses policy name: nxdomain, upstream or mdns.
+func ParseLocalPolicy(name string) (LocalPolicy, error) {
+	for policy, policyName := range localPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown .local policy %q", name)
+}
+
+// isLocalName reports whether normalized domain name belongs to .local
+// domain.
+func isLocalName(domainName string) bool {
+	return domainName == mdnsDomain || strings.HasSuffix(domainName, "."+mdnsDomain)
+}
+
+// isSingleLabel reports whether normalized domain name is a single-label
+// name. Such names are resolved with LLMNR or search domains, so they are
+// not mapped.
+func isSingleLabel(domainName string) bool {
+	return domainName != "" && !strings.Contains(domainName, ".")
+}
+
+// serveLocal answers .local query according to policy other than
+// LocalUpstream.
+func (d *DNSProxy) serveLocal(ctx *proxy.DNSContext) error {
+	if d.localPolicy == LocalMDNS {
+		resp, err := queryMDNS(ctx.Req, d.mdnsTimeout)
+		if err == nil {
+			ctx.Res = resp
+			return nil
+		}
+		if !errors.Is(err, errNoMDNSResponse) {
+			return err
+		}
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(ctx.Req, dns.RcodeNameError)
+	resp.Ns = []dns.RR{d.negativeSOA(ctx.Req.Question[0].Name)}
+	ctx.Res = resp
+	return nil
+}
+
+var errNoMDNSResponse = errors.New("no mDNS response")
+
+// queryMDNS sends legacy unicast query (RFC 6762, section 6.7) to mDNS
+// group and returns first matching response.
+func queryMDNS(req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(req.Question[0].Name, req.Question[0].Qtype)
+	query.RecursionDesired = false
+	wire, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("can't pack mDNS query: %w", err)
+	}
+
+	// Responses come from responder addresses, so socket can't be
+	// connected to the group.
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't open mDNS socket: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.WriteTo(wire, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("can't send mDNS query: %w", err)
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, errNoMDNSResponse
+			}
+			return nil, fmt.Errorf("can't receive mDNS response: %w", err)
+		}
+		mdnsResp := new(dns.Msg)
+		if mdnsResp.Unpack(buf[:n]) != nil || !mdnsResp.Response || mdnsResp.Id != query.Id ||
+			len(mdnsResp.Answer) == 0 {
+			continue
+		}
+
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		for _, rr := range mdnsResp.Answer {
+			// Drop cache-flush bit.
+			rr.Header().Class &^= 1 << 15
+			resp.Answer = append(resp.Answer, rr)
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,65 @@
+package dnsproxy
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestLocalNames(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"printer.local":  true,
+		"local":          true,
+		"a.b.local":      true,
+		"printer.locale": false,
+		"local.lan":      false,
+	} {
+		if got := isLocalName(name); got != expected {
+			t.Errorf("isLocalName(%q) = %v, expected %v", name, got, expected)
+		}
+	}
+	for name, expected := range map[string]bool{
+		"printer":     true,
+		"printer.lan": false,
+		"":            false,
+	} {
+		if got := isSingleLabel(name); got != expected {
+			t.Errorf("isSingleLabel(%q) = %v, expected %v", name, got, expected)
+		}
+	}
+}
+
+func TestLocalPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy LocalPolicy
+		rcode  int
+	}{
+		{LocalNXDomain, dns.RcodeNameError},
+		{LocalUpstream, dns.RcodeSuccess},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			mapper := new(countingMapper)
+			d := startProxy(t, &Config{Mapper: mapper, LocalPolicy: tc.policy}, new(atomic.Int32))
+			for _, name := range []string{"printer.local.", "printer."} {
+				req := new(dns.Msg)
+				req.SetQuestion(name, dns.TypeA)
+				resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+				if err != nil {
+					t.Fatalf("%s exchange failed: %v", name, err)
+				}
+				rcode := tc.rcode
+				if name == "printer." {
+					rcode = dns.RcodeSuccess
+				}
+				if resp.Rcode != rcode || len(resp.Answer) != 0 {
+					t.Errorf("%s: unexpected response %v", name, resp)
+				}
+			}
+			if calls := mapper.calls.Load(); calls != 0 {
+				t.Errorf("mapper was called %d times for unmappable names", calls)
+			}
+		})
+	}
+}
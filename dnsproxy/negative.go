@@ -0,0 +1,59 @@
+package dnsproxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultSOANs is the default primary name server of synthetic SOA.
+	DefaultSOANs = "dns44.invalid."
+	// DefaultSOAMbox is the default responsible mailbox of synthetic SOA.
+	DefaultSOAMbox = "hostmaster.dns44.invalid."
+)
+
+// SOA is the template of SOA record attached to synthesized negative
+// responses, so resolvers cache them according to RFC 2308. Record owner
+// is the queried name.
+type SOA struct {
+	// Ns and Mbox are primary name server and responsible mailbox. Empty
+	// values are replaced with DefaultSOANs and DefaultSOAMbox.
+	Ns   string
+	Mbox string
+	// TTL is both record TTL and negative caching TTL. Zero means TTL of
+	// synthesized positive answers.
+	TTL uint32
+}
+
+func (s SOA) withDefaults() SOA {
+	if s.Ns == "" {
+		s.Ns = DefaultSOANs
+	}
+	if s.Mbox == "" {
+		s.Mbox = DefaultSOAMbox
+	}
+	s.Ns, s.Mbox = dns.Fqdn(s.Ns), dns.Fqdn(s.Mbox)
+	return s
+}
+
+// negativeSOA returns SOA record for negative response to qName.
+func (d *DNSProxy) negativeSOA(qName string) *dns.SOA {
+	ttl := d.soa.TTL
+	if ttl == 0 {
+		ttl = d.ttl.Load()
+	}
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   qName,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ns:      d.soa.Ns,
+		Mbox:    d.soa.Mbox,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
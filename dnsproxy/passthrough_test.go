@@ -0,0 +1,558 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/pool"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// localOption is EDNS option clients attach to queries.
+const localOption = dns.EDNS0LOCALSTART + 44
+
+type countingMapper struct {
+	calls atomic.Int32
+}
+
+func (m *countingMapper) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	m.calls.Add(1)
+	return netip.MustParseAddr("172.24.0.1"), nil
+}
+
+var upstreamRecords = map[uint16][]string{
+	dns.TypeMX:     {"example.com. 300 IN MX 10 mx.example.com."},
+	dns.TypeTXT:    {"example.com. 300 IN TXT \"v=spf1 -all\""},
+	dns.TypeSRV:    {"example.com. 300 IN SRV 10 0 5060 sip.example.com."},
+	dns.TypeSOA:    {"example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"},
+	dns.TypeNS:     {"example.com. 300 IN NS ns.example.com."},
+	dns.TypeDS:     {"example.com. 300 IN DS 12345 13 2 4e2e2a8d4b0f1a7c3c9e9d1d9c3f0b7e6a2d1c0b9a8f7e6d5c4b3a2918070605"},
+	dns.TypeDNSKEY: {"example.com. 300 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ=="},
+}
+
+func hasOption(opt *dns.OPT, code uint16) bool {
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// startUpstream starts DNS server answering with upstreamRecords. It
+// counts queries carrying localOption in optionsSeen.
+func startUpstream(t testing.TB, optionsSeen *atomic.Int32) string {
+	t.Helper()
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		switch q.Name {
+		case "nonexistent.example.com.":
+			resp.Rcode = dns.RcodeNameError
+		case "broken.example.com.":
+			resp.Rcode = dns.RcodeServerFailure
+		case "short.example.com.", "long.example.com.":
+			ttl := uint32(5)
+			if q.Name == "long.example.com." {
+				ttl = 86400
+			}
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+		}
+		if q.Name == "big.example.com." && q.Qtype == dns.TypeTXT {
+			for i := 0; i < 40; i++ {
+				resp.Answer = append(resp.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+					Txt: []string{strings.Repeat("x", 100)},
+				})
+			}
+		}
+		for _, s := range upstreamRecords[q.Qtype] {
+			if q.Name != "example.com." {
+				break
+			}
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Errorf("bad test record %q: %v", s, err)
+				return
+			}
+			resp.Answer = append(resp.Answer, rr)
+		}
+		if opt := req.IsEdns0(); opt != nil {
+			resp.SetEdns0(opt.UDPSize(), opt.Do())
+			if hasOption(opt, localOption) {
+				optionsSeen.Add(1)
+			}
+		}
+		if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+			size := dns.MinMsgSize
+			if opt := req.IsEdns0(); opt != nil {
+				size = int(opt.UDPSize())
+			}
+			resp.Truncate(size)
+		}
+		w.WriteMsg(resp)
+	})
+
+	// TCP port picked for UDP one may be busy, so few attempts are made.
+	var (
+		pc  net.PacketConn
+		l   net.Listener
+		err error
+	)
+	for attempt := 0; attempt < 10; attempt++ {
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("can't listen UDP: %v", err)
+		}
+		l, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatalf("can't listen TCP: %v", err)
+	}
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: l, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	t.Cleanup(func() {
+		udpServer.Shutdown()
+		tcpServer.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func startProxy(t testing.TB, cfg *Config, optionsSeen *atomic.Int32) *DNSProxy {
+	t.Helper()
+	cfg.ListenAddr = netip.MustParseAddrPort("127.0.0.1:0")
+	cfg.Upstream = startUpstream(t, optionsSeen)
+	cfg.TTL = 60
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatalf("can't create proxy: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("can't start proxy: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestNonAddressPassthrough(t *testing.T) {
+	mapper := new(countingMapper)
+	var optionsSeen atomic.Int32
+	d := startProxy(t, &Config{Mapper: mapper}, &optionsSeen)
+	queries := 0
+
+	for qType, records := range upstreamRecords {
+		for _, network := range []string{"udp", "tcp"} {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", qType)
+			req.SetEdns0(1232, true)
+			req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_LOCAL{
+				Code: localOption,
+				Data: []byte("dns44"),
+			})
+			queries++
+			addr := d.proxy.Addr(proxy.ProtoUDP).String()
+			if network == "tcp" {
+				addr = d.proxy.Addr(proxy.ProtoTCP).String()
+			}
+			client := &dns.Client{Net: network, Timeout: 5 * time.Second}
+			resp, _, err := client.Exchange(req, addr)
+			if err != nil {
+				t.Fatalf("%s %s exchange failed: %v", network, dns.TypeToString[qType], err)
+			}
+			if len(resp.Answer) != len(records) {
+				t.Fatalf("%s %s: unexpected answer %v", network, dns.TypeToString[qType], resp.Answer)
+			}
+			for i, s := range records {
+				expected, _ := dns.NewRR(s)
+				if !dns.IsDuplicate(resp.Answer[i], expected) {
+					t.Errorf("%s %s: answer %v, expected %v", network, dns.TypeToString[qType], resp.Answer[i], expected)
+				}
+			}
+			opt := resp.IsEdns0()
+			if opt == nil {
+				t.Fatalf("%s %s: EDNS is missing in response", network, dns.TypeToString[qType])
+			}
+			if !opt.Do() {
+				t.Errorf("%s %s: DO bit is lost", network, dns.TypeToString[qType])
+			}
+		}
+	}
+
+	if seen := int(optionsSeen.Load()); seen != queries {
+		t.Errorf("EDNS option reached upstream with %d of %d queries", seen, queries)
+	}
+	if calls := mapper.calls.Load(); calls != 0 {
+		t.Errorf("mapper was called %d times for non-address queries", calls)
+	}
+}
+
+func TestPassthroughTruncation(t *testing.T) {
+	d := startProxy(t, &Config{Mapper: new(countingMapper)}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.example.com.", dns.TypeTXT)
+	udpClient := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	resp, _, err := udpClient.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("UDP exchange failed: %v", err)
+	}
+	if !resp.Truncated {
+		t.Errorf("oversized UDP response is not truncated")
+	}
+
+	tcpClient := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	resp, _, err = tcpClient.Exchange(req, d.proxy.Addr(proxy.ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("TCP exchange failed: %v", err)
+	}
+	if resp.Truncated || len(resp.Answer) != 40 {
+		t.Errorf("TCP response is incomplete: truncated=%v, %d answers", resp.Truncated, len(resp.Answer))
+	}
+}
+
+func TestNXPassthrough(t *testing.T) {
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{Mapper: mapper, NXPassthrough: true}, new(atomic.Int32))
+
+	client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	for _, tc := range []struct {
+		name  string
+		rcode int
+		calls int32
+	}{
+		{"example.com.", dns.RcodeSuccess, 1},
+		{"nonexistent.example.com.", dns.RcodeNameError, 1},
+		{"broken.example.com.", dns.RcodeServerFailure, 1},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		resp, _, err := client.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("%s: exchange failed: %v", tc.name, err)
+		}
+		if resp.Rcode != tc.rcode {
+			t.Errorf("%s: got %s, expected %s", tc.name, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tc.rcode])
+		}
+		if calls := mapper.calls.Load(); calls != tc.calls {
+			t.Errorf("%s: mapper called %d times, expected %d", tc.name, calls, tc.calls)
+		}
+	}
+}
+
+func TestUnspecifiedBindSource(t *testing.T) {
+	cfg := &Config{Mapper: new(countingMapper), TTL: 60}
+	cfg.ListenAddr = netip.MustParseAddrPort("0.0.0.0:0")
+	cfg.Upstream = startUpstream(t, new(atomic.Int32))
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatalf("can't create proxy: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("can't start proxy: %v", err)
+	}
+	defer d.Close()
+
+	// Connected client socket drops responses sent from other address than
+	// queried one.
+	port := netip.MustParseAddrPort(d.proxy.Addr(proxy.ProtoUDP).String()).Port()
+	client := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, _, err := client.Exchange(req, netip.AddrPortFrom(netip.MustParseAddr(addr), port).String()); err != nil {
+			t.Errorf("query to %s failed: %v", addr, err)
+		}
+	}
+}
+
+func TestUpstreamTTL(t *testing.T) {
+	mapper := new(recordingMapper)
+	d := startProxy(t, &Config{Mapper: mapper, UpstreamTTL: true, MinTTL: 30, MaxTTL: 3600}, new(atomic.Int32))
+
+	client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	for i, tc := range []struct {
+		name string
+		ttl  uint32
+	}{
+		{"short.example.com.", 30},
+		{"long.example.com.", 3600},
+		// Configured TTL is used without upstream answer.
+		{"example.com.", 60},
+		{"nonexistent.example.com.", 60},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		resp, _, err := client.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("%s: exchange failed: %v", tc.name, err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != tc.ttl {
+			t.Errorf("%s: got answer %v, expected TTL %d", tc.name, resp.Answer, tc.ttl)
+		}
+		mapper.mux.Lock()
+		lease := mapper.ttls[i]
+		mapper.mux.Unlock()
+		if expected := time.Duration(tc.ttl+1) * time.Second; lease != expected {
+			t.Errorf("%s: got lease %v, expected %v", tc.name, lease, expected)
+		}
+	}
+
+	if _, err := New(&Config{
+		ListenAddr: netip.MustParseAddrPort("127.0.0.1:0"),
+		Upstream:   "127.0.0.1:1",
+		MinTTL:     600,
+		MaxTTL:     60,
+	}); err == nil {
+		t.Error("maximal TTL below minimal one accepted")
+	}
+}
+
+func TestAddressQueryMapped(t *testing.T) {
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{Mapper: mapper}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "172.24.0.1" {
+		t.Errorf("unexpected answer for mapped query: %v", resp.Answer)
+	}
+	if calls := mapper.calls.Load(); calls != 1 {
+		t.Errorf("mapper was called %d times, expected 1", calls)
+	}
+}
+
+func TestPairedAnswers(t *testing.T) {
+	pair6, err := pool.NewPair6(netip.MustParsePrefix("fd44::/96"))
+	if err != nil {
+		t.Fatalf("NewPair6 failed: %v", err)
+	}
+	d := startProxy(t, &Config{Mapper: new(countingMapper), Pair6: pair6}, new(atomic.Int32))
+
+	answers := make(map[uint16]netip.Addr)
+	for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeANY} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", qType)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("%s exchange failed: %v", dns.TypeToString[qType], err)
+		}
+		for _, rr := range resp.Answer {
+			var addr netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				addr, _ = netip.AddrFromSlice(rr.AAAA)
+			}
+			if prev, ok := answers[rr.Header().Rrtype]; ok && prev != addr {
+				t.Errorf("inconsistent %s answers: %s and %s", dns.TypeToString[rr.Header().Rrtype], prev, addr)
+			}
+			answers[rr.Header().Rrtype] = addr
+		}
+	}
+	if len(answers) != 2 {
+		t.Fatalf("expected both A and AAAA answers, got %v", answers)
+	}
+	if pair6.To6(answers[dns.TypeA]) != answers[dns.TypeAAAA] {
+		t.Errorf("AAAA answer %s isn't paired with A answer %s", answers[dns.TypeAAAA], answers[dns.TypeA])
+	}
+}
+
+type multiMapper struct {
+	countingMapper
+}
+
+func (m *multiMapper) EnsureMappings(clientKey clientkey.Key, domainName string, count int, ttl time.Duration) ([]netip.Addr, error) {
+	res := make([]netip.Addr, 0, count)
+	for i := 0; i < count; i++ {
+		res = append(res, netip.AddrFrom4([4]byte{172, 24, 0, byte(i + 1)}))
+	}
+	return res, nil
+}
+
+func TestAddrsPerDomainRotation(t *testing.T) {
+	d := startProxy(t, &Config{Mapper: new(multiMapper), AddrsPerDomain: 3}, new(atomic.Int32))
+
+	firsts := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		if len(resp.Answer) != 3 {
+			t.Fatalf("expected 3 answers, got %v", resp.Answer)
+		}
+		firsts[resp.Answer[0].(*dns.A).A.String()] = true
+	}
+	if len(firsts) != 3 {
+		t.Errorf("answers aren't rotated: first addresses seen %v", firsts)
+	}
+
+	if _, err := New(&Config{
+		ListenAddr:     netip.MustParseAddrPort("127.0.0.1:0"),
+		Upstream:       "127.0.0.1:53",
+		Mapper:         new(countingMapper),
+		AddrsPerDomain: 2,
+	}); err == nil || !strings.Contains(err.Error(), "several addresses") {
+		t.Errorf("mapper without MultiMapper support accepted")
+	}
+}
+
+func TestSelfQuery(t *testing.T) {
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{
+		Mapper:       mapper,
+		SuppressAAAA: AAAANXDomain,
+		SelfSources:  []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}, new(atomic.Int32))
+
+	for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", qType)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("%s exchange failed: %v", dns.TypeToString[qType], err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Errorf("%s: expected upstream answer, got %s with answers %v",
+				dns.TypeToString[qType], dns.RcodeToString[resp.Rcode], resp.Answer)
+		}
+	}
+	if calls := mapper.calls.Load(); calls != 0 {
+		t.Errorf("mapper was called %d times for self queries", calls)
+	}
+}
+
+func TestAAAANoData(t *testing.T) {
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{
+		Mapper: mapper,
+		SOA:    SOA{Mbox: "admin.example.net", TTL: 30},
+	}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeAAAA)
+	resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Fatalf("expected NODATA, got %s with answers %v", dns.RcodeToString[resp.Rcode], resp.Answer)
+	}
+	if len(resp.Ns) != 1 {
+		t.Fatalf("expected SOA in authority section, got %v", resp.Ns)
+	}
+	soa, ok := resp.Ns[0].(*dns.SOA)
+	if !ok || soa.Hdr.Name != "example.com." || soa.Ns != DefaultSOANs ||
+		soa.Mbox != "admin.example.net." || soa.Minttl != 30 || soa.Hdr.Ttl != 30 {
+		t.Errorf("unexpected SOA: %v", resp.Ns[0])
+	}
+	if calls := mapper.calls.Load(); calls != 0 {
+		t.Errorf("mapper was called %d times for unanswerable query", calls)
+	}
+}
+
+type blockAll struct{}
+
+func (blockAll) Decide(ctx context.Context, q PolicyQuery) (PolicyAction, error) {
+	return PolicyBlock, nil
+}
+
+type fixedMapper netip.Addr
+
+func (m fixedMapper) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	return netip.Addr(m), nil
+}
+
+func TestBlockMapper(t *testing.T) {
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{
+		Mapper:      mapper,
+		Policy:      blockAll{},
+		BlockMapper: fixedMapper(netip.MustParseAddr("172.31.255.1")),
+	}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "172.31.255.1" {
+		t.Errorf("unexpected answer for blocked query: %v", resp)
+	}
+	if calls := mapper.calls.Load(); calls != 0 {
+		t.Errorf("blocked domain was mapped by regular mapper")
+	}
+
+	req.SetQuestion("example.com.", dns.TypeAAAA)
+	resp, err = dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("unexpected answer for blocked AAAA query without pairing: %v", resp)
+	}
+}
+
+func TestPolicyEgress(t *testing.T) {
+	policy, err := ParseRulesPolicy(strings.NewReader(`
+egress video name=short.example.com answer=192.0.2.0/24
+pass answer=192.0.2.1
+`))
+	if err != nil {
+		t.Fatalf("ParseRulesPolicy failed: %v", err)
+	}
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{
+		Mapper:        mapper,
+		Policy:        policy,
+		EgressMappers: map[string]Mapper{"video": fixedMapper(netip.MustParseAddr("172.25.0.1"))},
+	}, new(atomic.Int32))
+
+	for _, tc := range []struct {
+		name, expected string
+	}{
+		{"short.example.com.", "172.25.0.1"},
+		// Upstream answer checked by policy is passed to client.
+		{"long.example.com.", "192.0.2.1"},
+		{"example.com.", "172.24.0.1"},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("%s: exchange failed: %v", tc.name, err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != tc.expected {
+			t.Errorf("%s: got answer %v, expected %s", tc.name, resp.Answer, tc.expected)
+		}
+	}
+	if calls := mapper.calls.Load(); calls != 1 {
+		t.Errorf("regular mapper was called %d times, expected once", calls)
+	}
+}
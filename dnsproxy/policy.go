@@ -0,0 +1,365 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultPolicyTimeout is how long policy service answers are awaited.
+	DefaultPolicyTimeout = time.Second
+	// DefaultPolicyCacheTTL is how long policy service verdicts are cached
+	// unless service specifies otherwise.
+	DefaultPolicyCacheTTL = time.Minute
+	// policyCacheSize caps number of cached verdicts. Expired ones are
+	// dropped once it's reached.
+	policyCacheSize = 65536
+	// policyFailureTTL is how long queries are left to local rules after
+	// failed policy request, so unavailable service doesn't delay them.
+	policyFailureTTL = 5 * time.Second
+	// policyBreakerFailures is the number of consecutive failed policy
+	// requests which make all queries go to local rules without asking
+	// service. One request per policyBreakerRetry still goes to service
+	// to detect recovery.
+	policyBreakerFailures = 3
+	policyBreakerRetry    = 30 * time.Second
+)
+
+// PolicyAction is the verdict of Policy for a query.
+type PolicyAction int
+
+const (
+	// PolicyDefault leaves query to local rules.
+	PolicyDefault PolicyAction = iota
+	// PolicyMap maps queried domain, even if local rules say otherwise.
+	PolicyMap
+	// PolicyPass resolves query via upstream without mapping.
+	PolicyPass
+	// PolicyBlock answers query with NXDOMAIN.
+	PolicyBlock
+	// PolicyEgress maps queried domain to addresses of egress pool named
+	// by policy, like PolicyMap does with the default one.
+	PolicyEgress
+)
+
+var policyActionNames = map[PolicyAction]string{
+	PolicyDefault: "default",
+	PolicyMap:     "map",
+	PolicyPass:    "pass",
+	PolicyBlock:   "block",
+	PolicyEgress:  "egress",
+}
+
+func (a PolicyAction) String() string {
+	if name, ok := policyActionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("PolicyAction(%d)", int(a))
+}
+
+// ParsePolicyAction parses action name: default, map, pass, block or
+// egress.
+func ParsePolicyAction(name string) (PolicyAction, error) {
+	for action, actionName := range policyActionNames {
+		if actionName == name {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown policy action %q", name)
+}
+
+// PolicyQuery describes query submitted to Policy.
+type PolicyQuery struct {
+	// Name is normalized domain name, without trailing dot.
+	Name      string
+	Type      uint16
+	ClientKey clientkey.Key
+	// Device and Group are friendly name and group of client, if it's
+	// named.
+	Device string
+	Group  string
+	// Answer returns addresses of A and AAAA records of upstream answer to
+	// the query, resolving it on the first call. It's nil if answer can't
+	// be learned.
+	Answer func() []netip.Addr
+}
+
+// Policy decides how queries are handled instead of local rules, e.g. by
+// asking external service. Queries it fails to decide are left to local
+// rules.
+type Policy interface {
+	Decide(ctx context.Context, q PolicyQuery) (PolicyAction, error)
+}
+
+// ExplainingPolicy is implemented by policies able to tell why they made
+// decision, e.g. which rule matched.
+type ExplainingPolicy interface {
+	DecideReason(ctx context.Context, q PolicyQuery) (action PolicyAction, reason string, err error)
+}
+
+// EgressPolicy is implemented by policies able to direct queries to named
+// egress pools. Egress is set only along with PolicyEgress action.
+type EgressPolicy interface {
+	DecideEgress(ctx context.Context, q PolicyQuery) (action PolicyAction, egress, reason string, err error)
+}
+
+// PolicyChain asks policies in order. The first verdict other than
+// PolicyDefault wins. Failing policies are skipped, their error is
+// returned only if no other policy decides.
+type PolicyChain []Policy
+
+func (c PolicyChain) Decide(ctx context.Context, q PolicyQuery) (PolicyAction, error) {
+	action, _, err := c.DecideReason(ctx, q)
+	return action, err
+}
+
+func (c PolicyChain) DecideReason(ctx context.Context, q PolicyQuery) (PolicyAction, string, error) {
+	action, _, reason, err := c.DecideEgress(ctx, q)
+	return action, reason, err
+}
+
+func (c PolicyChain) DecideEgress(ctx context.Context, q PolicyQuery) (PolicyAction, string, string, error) {
+	var firstErr error
+	for _, p := range c {
+		action, egress, reason, err := decideEgress(ctx, p, q)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if action != PolicyDefault {
+			return action, egress, reason, nil
+		}
+	}
+	return PolicyDefault, "", "", firstErr
+}
+
+// decideEgress asks policy for verdict along with egress and reason, as
+// far as policy supports them.
+func decideEgress(ctx context.Context, p Policy, q PolicyQuery) (action PolicyAction, egress, reason string, err error) {
+	switch p := p.(type) {
+	case EgressPolicy:
+		return p.DecideEgress(ctx, q)
+	case ExplainingPolicy:
+		action, reason, err = p.DecideReason(ctx, q)
+	default:
+		action, err = p.Decide(ctx, q)
+	}
+	return action, "", reason, err
+}
+
+// HTTPPolicy asks HTTP service for query verdicts, caching them. Service
+// gets GET request with name, type and client query parameters and
+// responds with JSON object like {"action": "map", "ttl": 60}, where ttl
+// is optional verdict cache time in seconds. Optional "reason" field
+// explains decision. Once service fails several requests in a row, queries
+// are left to local rules without asking it, until it recovers.
+type HTTPPolicy struct {
+	url      *url.URL
+	client   *http.Client
+	cacheTTL time.Duration
+	requests flightGroup[policyVerdict]
+
+	mux       sync.Mutex
+	cache     map[string]policyVerdict
+	failures  int
+	broken    bool
+	nextProbe time.Time
+}
+
+type policyVerdict struct {
+	action PolicyAction
+	reason string
+	expire time.Time
+}
+
+type policyResponse struct {
+	Action string `json:"action"`
+	TTL    *int   `json:"ttl,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewHTTPPolicy returns policy asking service at serviceURL. Zero timeout
+// and cacheTTL mean defaults.
+func NewHTTPPolicy(serviceURL string, timeout, cacheTTL time.Duration) (*HTTPPolicy, error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad policy service URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("bad policy service URL %q: scheme must be http or https", serviceURL)
+	}
+	if timeout <= 0 {
+		timeout = DefaultPolicyTimeout
+	}
+	if cacheTTL <= 0 {
+		cacheTTL = DefaultPolicyCacheTTL
+	}
+	return &HTTPPolicy{
+		url:      u,
+		client:   &http.Client{Timeout: timeout},
+		cacheTTL: cacheTTL,
+		cache:    make(map[string]policyVerdict),
+	}, nil
+}
+
+func (p *HTTPPolicy) Decide(ctx context.Context, q PolicyQuery) (PolicyAction, error) {
+	action, _, err := p.DecideReason(ctx, q)
+	return action, err
+}
+
+func (p *HTTPPolicy) DecideReason(ctx context.Context, q PolicyQuery) (PolicyAction, string, error) {
+	params := url.Values{
+		"name":   {q.Name},
+		"type":   {dns.TypeToString[q.Type]},
+		"client": {q.ClientKey.String()},
+	}
+	if q.Device != "" {
+		params.Set("device", q.Device)
+	}
+	if q.Group != "" {
+		params.Set("group", q.Group)
+	}
+	key := params.Encode()
+	now := time.Now()
+	p.mux.Lock()
+	verdict, ok := p.cache[key]
+	p.mux.Unlock()
+	if ok && now.Before(verdict.expire) {
+		return verdict.action, verdict.reason, nil
+	}
+	if !p.allowRequest(now) {
+		return PolicyDefault, "", nil
+	}
+
+	verdict, err, _ := p.requests.do(key, func() (policyVerdict, error) {
+		verdict, err := p.ask(ctx, params)
+		p.requestDone(err)
+		if err != nil {
+			verdict = policyVerdict{PolicyDefault, "", time.Now().Add(policyFailureTTL)}
+		}
+		p.store(key, verdict)
+		return verdict, err
+	})
+	return verdict.action, verdict.reason, err
+}
+
+// allowRequest reports whether service may be asked. It isn't asked while
+// it's broken, except for one probe request per policyBreakerRetry.
+func (p *HTTPPolicy) allowRequest(now time.Time) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !p.broken {
+		return true
+	}
+	if now.Before(p.nextProbe) {
+		return false
+	}
+	p.nextProbe = now.Add(policyBreakerRetry)
+	return true
+}
+
+// requestDone records result of service request.
+func (p *HTTPPolicy) requestDone(err error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if err == nil {
+		if p.broken {
+			log.Printf("policy service recovered")
+		}
+		p.failures = 0
+		p.broken = false
+		return
+	}
+	p.failures++
+	if p.failures >= policyBreakerFailures && !p.broken {
+		p.broken = true
+		p.nextProbe = time.Now().Add(policyBreakerRetry)
+		log.Printf("WARNING: policy service failed %d requests in a row, leaving queries to local rules: %v", p.failures, err)
+	}
+}
+
+func (p *HTTPPolicy) ask(ctx context.Context, params url.Values) (policyVerdict, error) {
+	u := *p.url
+	query := u.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return policyVerdict{}, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return policyVerdict{}, fmt.Errorf("policy request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return policyVerdict{}, fmt.Errorf("policy service responded with status %s", resp.Status)
+	}
+	var pr policyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		return policyVerdict{}, fmt.Errorf("bad policy service response: %w", err)
+	}
+	action, err := ParsePolicyAction(pr.Action)
+	if err == nil && action == PolicyEgress {
+		err = errors.New("egress action isn't supported by policy service")
+	}
+	if err != nil {
+		return policyVerdict{}, fmt.Errorf("bad policy service response: %w", err)
+	}
+	ttl := p.cacheTTL
+	if pr.TTL != nil {
+		ttl = time.Duration(*pr.TTL) * time.Second
+	}
+	reason := pr.Reason
+	if reason == "" {
+		reason = "policy service"
+	}
+	return policyVerdict{action, reason, time.Now().Add(ttl)}, nil
+}
+
+func (p *HTTPPolicy) store(key string, verdict policyVerdict) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if len(p.cache) >= policyCacheSize {
+		now := time.Now()
+		for k, v := range p.cache {
+			if !now.Before(v.expire) {
+				delete(p.cache, k)
+			}
+		}
+		if len(p.cache) >= policyCacheSize {
+			p.cache = make(map[string]policyVerdict)
+		}
+	}
+	p.cache[key] = verdict
+}
+
+// decide asks policy for verdict along with egress and reason, if policy
+// tells them, falling back to local rules on failure.
+func (d *DNSProxy) decide(policy Policy, q PolicyQuery) (action PolicyAction, egress, reason string) {
+	if policy == nil {
+		return PolicyDefault, "", ""
+	}
+	action, egress, reason, err := decideEgress(context.Background(), policy, q)
+	if err != nil {
+		log.Printf("policy decision for %s failed, using local rules: %v", d.logName(q.Name), err)
+		return PolicyDefault, "", ""
+	}
+	return action, egress, reason
+}
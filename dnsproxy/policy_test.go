@@ -0,0 +1,125 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestHTTPPolicy(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("client") != "127.0.0.1" || r.URL.Query().Get("type") != "A" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Query().Get("name") {
+		case "blocked.example.com":
+			fmt.Fprint(w, `{"action": "block"}`)
+		case "mapped.example.org":
+			fmt.Fprint(w, `{"action": "map"}`)
+		case "passed.example.com":
+			fmt.Fprint(w, `{"action": "pass", "ttl": 0}`)
+		default:
+			http.Error(w, "failure", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	policy, err := NewHTTPPolicy(srv.URL+"/decide?token=x", 0, 0)
+	if err != nil {
+		t.Fatalf("NewHTTPPolicy failed: %v", err)
+	}
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{
+		Mapper:   mapper,
+		NeverMap: []string{"example.org"},
+		Policy:   policy,
+	}, new(atomic.Int32))
+
+	for _, tc := range []struct {
+		name     string
+		rcode    int
+		mapped   bool
+		requests int32
+	}{
+		{"blocked.example.com.", dns.RcodeNameError, false, 1},
+		{"blocked.example.com.", dns.RcodeNameError, false, 1},
+		{"mapped.example.org.", dns.RcodeSuccess, true, 2},
+		{"passed.example.com.", dns.RcodeSuccess, false, 3},
+		{"passed.example.com.", dns.RcodeSuccess, false, 4},
+		{"broken.example.com.", dns.RcodeSuccess, true, 5},
+		{"broken.example.com.", dns.RcodeSuccess, true, 5},
+	} {
+		calls := mapper.calls.Load()
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		if resp.Rcode != tc.rcode {
+			t.Errorf("%s: rcode %s, expected %s", tc.name, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tc.rcode])
+		}
+		if mapped := mapper.calls.Load() > calls; mapped != tc.mapped {
+			t.Errorf("%s: mapped = %v, expected %v", tc.name, mapped, tc.mapped)
+		}
+		if n := requests.Load(); n != tc.requests {
+			t.Errorf("%s: %d policy requests, expected %d", tc.name, n, tc.requests)
+		}
+	}
+}
+
+func TestHTTPPolicyBreaker(t *testing.T) {
+	var (
+		requests atomic.Int32
+		healthy  atomic.Bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "failure", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"action": "block"}`)
+	}))
+	defer srv.Close()
+	policy, err := NewHTTPPolicy(srv.URL, 0, 0)
+	if err != nil {
+		t.Fatalf("NewHTTPPolicy failed: %v", err)
+	}
+	decide := func(name string) (PolicyAction, error) {
+		return policy.Decide(context.Background(), PolicyQuery{Name: name, Type: dns.TypeA})
+	}
+
+	for i := 0; i < policyBreakerFailures; i++ {
+		if _, err := decide(fmt.Sprintf("%d.example.com", i)); err == nil {
+			t.Fatal("failed policy request succeeded")
+		}
+	}
+	if action, err := decide("next.example.com"); action != PolicyDefault || err != nil {
+		t.Errorf("broken service got %v, %v, expected default verdict", action, err)
+	}
+	if n := requests.Load(); n != policyBreakerFailures {
+		t.Errorf("broken service got %d requests, expected %d", n, policyBreakerFailures)
+	}
+
+	// Probe after retry interval detects recovery.
+	healthy.Store(true)
+	policy.mux.Lock()
+	policy.nextProbe = time.Now()
+	policy.mux.Unlock()
+	if action, err := decide("probe.example.com"); action != PolicyBlock || err != nil {
+		t.Errorf("probe got %v, %v", action, err)
+	}
+	if action, err := decide("next.example.com"); action != PolicyBlock || err != nil {
+		t.Errorf("recovered service got %v, %v", action, err)
+	}
+}
@@ -0,0 +1,139 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/miekg/dns"
+)
+
+// preallocator keeps domains listed in file mapped for fixed set of
+// clients, so they have addresses before clients query them. Mappings are
+// renewed at half of TTL, so they never expire while proxy runs. File is
+// read again on each renewal.
+type preallocator struct {
+	path    string
+	clients []clientkey.Key
+	domains []string
+	ensure  func(clientKey clientkey.Key, domainName string, ttl time.Duration) error
+	ttl     func() uint32
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newPreallocator(path string, clients []clientkey.Key) (*preallocator, error) {
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no clients to preallocate mappings for")
+	}
+	p := &preallocator{
+		path:    path,
+		clients: clients,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	var err error
+	if p.domains, err = p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *preallocator) load() ([]string, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open preallocation list: %w", err)
+	}
+	defer f.Close()
+	domains, err := parsePreallocList(f)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse preallocation list %q: %w", p.path, err)
+	}
+	return domains, nil
+}
+
+// parsePreallocList parses list of domains, one per line. Empty lines and
+// lines starting with # are ignored.
+func parsePreallocList(rd io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(rd)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := normalizeName(line)
+		if _, ok := dns.IsDomainName(name); !ok || name == "" {
+			return nil, fmt.Errorf("line %d: bad domain name %q", lineNo, line)
+		}
+		domains = append(domains, name)
+	}
+	return domains, scanner.Err()
+}
+
+// interval returns period of mapping renewals.
+func (p *preallocator) interval() time.Duration {
+	interval := time.Duration(p.ttl()) * time.Second / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// preallocate maps all listed domains for all clients. Leases outlast the
+// next renewal.
+func (p *preallocator) preallocate() {
+	lease := time.Duration(p.ttl())*time.Second + p.interval()
+	failed := 0
+	var lastErr error
+	for _, clientKey := range p.clients {
+		for _, domainName := range p.domains {
+			if err := p.ensure(clientKey, domainName, lease); err != nil {
+				failed++
+				lastErr = err
+			}
+		}
+	}
+	if failed > 0 {
+		log.Printf("preallocation of %d mappings failed, last error: %v", failed, lastErr)
+	}
+}
+
+func (p *preallocator) start() {
+	p.preallocate()
+	p.started = true
+	go p.run()
+}
+
+func (p *preallocator) close() {
+	if !p.started {
+		return
+	}
+	p.started = false
+	close(p.stop)
+	<-p.done
+}
+
+func (p *preallocator) run() {
+	defer close(p.done)
+	for {
+		select {
+		case <-time.After(p.interval()):
+		case <-p.stop:
+			return
+		}
+		if domains, err := p.load(); err != nil {
+			log.Printf("preallocation list refresh failed: %v", err)
+		} else {
+			p.domains = domains
+		}
+		p.preallocate()
+	}
+}
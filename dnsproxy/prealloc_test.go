@@ -0,0 +1,93 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+type recordingMapper struct {
+	mux    sync.Mutex
+	mapped []string
+	ttls   []time.Duration
+}
+
+func (m *recordingMapper) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.mapped = append(m.mapped, clientKey.String()+" "+domainName)
+	m.ttls = append(m.ttls, ttl)
+	return netip.MustParseAddr("172.24.0.1"), nil
+}
+
+func TestParsePreallocList(t *testing.T) {
+	domains, err := parsePreallocList(strings.NewReader(`
+# Critical services
+Example.com.
+  bank.example.org
+`))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if expected := []string{"example.com", "bank.example.org"}; !reflect.DeepEqual(domains, expected) {
+		t.Errorf("got %q, expected %q", domains, expected)
+	}
+	if _, err := parsePreallocList(strings.NewReader("bad..name\n")); err == nil {
+		t.Error("bad domain name accepted")
+	}
+}
+
+func TestPrealloc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prealloc.list")
+	if err := os.WriteFile(path, []byte("example.com\nexample.org\n"), 0644); err != nil {
+		t.Fatalf("can't write list: %v", err)
+	}
+	mapper := new(recordingMapper)
+	cfg := &Config{
+		ListenAddr:   netip.MustParseAddrPort("127.0.0.1:0"),
+		Upstream:     "127.0.0.1:1",
+		Mapper:       mapper,
+		TTL:          60,
+		PreallocFile: path,
+	}
+	if _, err := New(cfg); err == nil {
+		t.Fatal("preallocation without clients accepted")
+	}
+	cfg.PreallocClients = []clientkey.Key{
+		clientkey.FromAddr(netip.MustParseAddr("192.168.1.10")),
+		clientkey.FromPrefix(netip.MustParsePrefix("10.0.0.0/24")),
+	}
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatalf("can't create proxy: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("can't start proxy: %v", err)
+	}
+	defer d.Close()
+
+	mapper.mux.Lock()
+	defer mapper.mux.Unlock()
+	expected := []string{
+		"192.168.1.10 example.com",
+		"192.168.1.10 example.org",
+		"10.0.0.0/24 example.com",
+		"10.0.0.0/24 example.org",
+	}
+	if !reflect.DeepEqual(mapper.mapped, expected) {
+		t.Errorf("mapped %q, expected %q", mapper.mapped, expected)
+	}
+	// Leases outlast renewal at half of TTL.
+	for _, ttl := range mapper.ttls {
+		if ttl != 90*time.Second {
+			t.Errorf("got lease %v, expected %v", ttl, 90*time.Second)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// pressureHysteresis is how many percentage points occupancy has to drop
+// below step threshold before step is left, so TTL doesn't flap around
+// threshold.
+const pressureHysteresis = 5
+
+// TTLStep shortens TTL to TTL seconds once address pool occupancy reaches
+// Occupancy percent.
+type TTLStep struct {
+	Occupancy float64
+	TTL       uint32
+}
+
+func (s TTLStep) String() string {
+	return strconv.FormatFloat(s.Occupancy, 'f', -1, 64) + "=" + strconv.FormatUint(uint64(s.TTL), 10)
+}
+
+// ParseTTLStep parses step in "PERCENT=TTL" format.
+func ParseTTLStep(s string) (TTLStep, error) {
+	percent, ttl, ok := strings.Cut(s, "=")
+	if !ok {
+		return TTLStep{}, fmt.Errorf("TTL step %q has no TTL", s)
+	}
+	occupancy, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(percent), "%"), 64)
+	if err != nil || occupancy <= 0 || occupancy > 100 {
+		return TTLStep{}, fmt.Errorf("bad occupancy in TTL step %q", s)
+	}
+	seconds, err := strconv.ParseUint(strings.TrimSpace(ttl), 10, 32)
+	if err != nil || seconds == 0 {
+		return TTLStep{}, fmt.Errorf("bad TTL in TTL step %q", s)
+	}
+	return TTLStep{Occupancy: occupancy, TTL: uint32(seconds)}, nil
+}
+
+// TTLPressure shortens TTL of new mappings and of responses carrying
+// them while address pool is crowded, so addresses are recycled faster.
+// Responses are shortened along with leases, so clients never cache
+// address which may be reassigned. It may be shared by several DNSProxy
+// instances using the same pool. Nil value never changes TTL.
+type TTLPressure struct {
+	steps []TTLStep
+	mux   sync.Mutex
+	// active is index of current step plus one, or zero.
+	active atomic.Int32
+}
+
+// NewTTLPressure returns TTLPressure with given steps. The step with
+// highest reached occupancy applies.
+func NewTTLPressure(steps []TTLStep) *TTLPressure {
+	steps = append([]TTLStep(nil), steps...)
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].Occupancy < steps[j].Occupancy
+	})
+	return &TTLPressure{
+		steps: steps,
+	}
+}
+
+// Update selects step by address pool occupancy percentage. It returns
+// selected step, whether any step is active and whether selection
+// changed.
+func (p *TTLPressure) Update(occupancy float64) (step TTLStep, active, changed bool) {
+	if p == nil {
+		return TTLStep{}, false, false
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	cur := int(p.active.Load()) - 1
+	next := -1
+	for i, s := range p.steps {
+		threshold := s.Occupancy
+		if i <= cur {
+			threshold -= pressureHysteresis
+		}
+		if occupancy >= threshold {
+			next = i
+		}
+	}
+	p.active.Store(int32(next + 1))
+	if next < 0 {
+		return TTLStep{}, false, next != cur
+	}
+	return p.steps[next], true, next != cur
+}
+
+// apply returns TTL of response and mapping lease for configured TTL.
+func (p *TTLPressure) apply(ttl uint32) uint32 {
+	if p == nil {
+		return ttl
+	}
+	i := p.active.Load()
+	if i == 0 || p.steps[i-1].TTL >= ttl {
+		return ttl
+	}
+	return p.steps[i-1].TTL
+}
@@ -0,0 +1,63 @@
+package dnsproxy
+
+import "testing"
+
+func TestParseTTLStep(t *testing.T) {
+	step, err := ParseTTLStep("80%=60")
+	if err != nil {
+		t.Fatalf("ParseTTLStep failed: %v", err)
+	}
+	if step != (TTLStep{Occupancy: 80, TTL: 60}) {
+		t.Errorf("got %+v", step)
+	}
+	if s := step.String(); s != "80=60" {
+		t.Errorf("String() = %q", s)
+	}
+	for _, spec := range []string{"80", "0=60", "101=60", "80=0", "x=60", "80=-1"} {
+		if _, err := ParseTTLStep(spec); err == nil {
+			t.Errorf("bad step %q accepted", spec)
+		}
+	}
+}
+
+func TestTTLPressure(t *testing.T) {
+	p := NewTTLPressure([]TTLStep{{95, 30}, {80, 300}})
+	steps := []struct {
+		occupancy float64
+		active    bool
+		changed   bool
+		ttl       uint32
+	}{
+		{50, false, false, 900},
+		{85, true, true, 300},
+		{96, true, true, 30},
+		// Hysteresis keeps step until occupancy drops 5 points below.
+		{92, true, false, 30},
+		{89, true, true, 300},
+		{76, true, false, 300},
+		{74, false, true, 900},
+	}
+	for _, s := range steps {
+		_, active, changed := p.Update(s.occupancy)
+		if active != s.active || changed != s.changed {
+			t.Errorf("Update(%v) = active %v, changed %v", s.occupancy, active, changed)
+		}
+		if ttl := p.apply(900); ttl != s.ttl {
+			t.Errorf("at %v%% apply(900) = %d; expected %d", s.occupancy, ttl, s.ttl)
+		}
+	}
+
+	p = NewTTLPressure([]TTLStep{{80, 300}})
+	p.Update(80)
+	if ttl := p.apply(60); ttl != 60 {
+		t.Errorf("apply(60) = %d, step must not lengthen TTL", ttl)
+	}
+
+	var nilPressure *TTLPressure
+	if _, active, _ := nilPressure.Update(100); active {
+		t.Error("nil TTLPressure is active")
+	}
+	if ttl := nilPressure.apply(900); ttl != 900 {
+		t.Errorf("nil apply(900) = %d", ttl)
+	}
+}
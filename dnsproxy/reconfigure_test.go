@@ -0,0 +1,137 @@
+package dnsproxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func queryProxy(t *testing.T, d *DNSProxy, name string, qType uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qType)
+	client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("%s exchange failed: %v", name, err)
+	}
+	return resp
+}
+
+func TestSetUpstream(t *testing.T) {
+	d := startProxy(t, &Config{Mapper: new(countingMapper)}, new(atomic.Int32))
+	if resp := queryProxy(t, d, "example.com.", dns.TypeTXT); len(resp.Answer) != 1 {
+		t.Fatalf("unexpected answer of initial upstream: %v", resp.Answer)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen UDP: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg).SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{"replaced"},
+		})
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	if err := d.SetUpstream("bogus#timeout="); err == nil {
+		t.Error("bad upstream accepted")
+	}
+	if err := d.SetUpstream(pc.LocalAddr().String()); err != nil {
+		t.Fatalf("SetUpstream failed: %v", err)
+	}
+	resp := queryProxy(t, d, "example.com.", dns.TypeTXT)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != "replaced" {
+		t.Errorf("query wasn't answered by new upstream: %v", resp.Answer)
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	mapper := new(recordingMapper)
+	d := startProxy(t, &Config{Mapper: mapper}, new(atomic.Int32))
+	for _, ttl := range []uint32{60, 300} {
+		d.SetTTL(ttl)
+		if d.TTL() != ttl {
+			t.Errorf("TTL() returned %d after SetTTL(%d)", d.TTL(), ttl)
+		}
+		resp := queryProxy(t, d, "example.com.", dns.TypeA)
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != ttl {
+			t.Errorf("unexpected answer with TTL %d: %v", ttl, resp.Answer)
+		}
+		mapper.mux.Lock()
+		lease := mapper.ttls[len(mapper.ttls)-1]
+		mapper.mux.Unlock()
+		// Lease outlives answer by a second.
+		if expected := time.Duration(ttl+1) * time.Second; lease != expected {
+			t.Errorf("got lease %v, expected %v", lease, expected)
+		}
+	}
+}
+
+func TestSetRules(t *testing.T) {
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{Mapper: mapper}, new(atomic.Int32))
+	mapped := func() bool {
+		t.Helper()
+		before := mapper.calls.Load()
+		queryProxy(t, d, "example.com.", dns.TypeA)
+		return mapper.calls.Load() != before
+	}
+	if !mapped() {
+		t.Fatal("domain isn't mapped by initial rules")
+	}
+
+	if err := d.SetRules(Rules{NeverMap: []string{"example.com"}}); err != nil {
+		t.Fatalf("SetRules failed: %v", err)
+	}
+	if mapped() {
+		t.Error("domain is mapped despite never-map entry")
+	}
+
+	rulesFile := filepath.Join(t.TempDir(), "rules")
+	if err := os.WriteFile(rulesFile, []byte("pass example.com\n"), 0644); err != nil {
+		t.Fatalf("can't write rules: %v", err)
+	}
+	if err := d.SetRules(Rules{MapRulesFile: rulesFile}); err != nil {
+		t.Fatalf("SetRules failed: %v", err)
+	}
+	if mapped() {
+		t.Error("domain is mapped despite pass rule")
+	}
+
+	if err := d.SetRules(Rules{Policy: blockAll{}}); err != nil {
+		t.Fatalf("SetRules failed: %v", err)
+	}
+	if resp := queryProxy(t, d, "example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("domain isn't blocked by new policy: %v", resp)
+	}
+
+	// Bad rules leave rules in use.
+	if err := d.SetRules(Rules{MapRulesFile: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("missing map rules file accepted")
+	}
+	if err := d.SetRules(Rules{NeverMap: []string{"example.com/BOGUS"}}); err == nil {
+		t.Error("bad never-map entry accepted")
+	}
+	if resp := queryProxy(t, d, "example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("rules changed by failed SetRules: %v", resp)
+	}
+
+	if err := d.SetRules(Rules{}); err != nil {
+		t.Fatalf("SetRules failed: %v", err)
+	}
+	if !mapped() {
+		t.Error("domain isn't mapped after rules were cleared")
+	}
+}
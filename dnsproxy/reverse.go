@@ -0,0 +1,229 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// ReverseMapper is implemented by mappers able to find domain mapped to
+// address. It's required to answer PTR queries.
+type ReverseMapper interface {
+	ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (domainName string, ok bool, err error)
+}
+
+// AnyClientReverseMapper is implemented by mappers able to find domain
+// mapped to address for any client.
+type AnyClientReverseMapper interface {
+	ReverseLookupAnyClient(addr netip.Addr) (domainName string, ok bool, err error)
+}
+
+// reverseZone is in-addr.arpa or ip6.arpa zone served authoritatively.
+type reverseZone struct {
+	// name is the lowercase zone name without trailing dot.
+	name string
+	// prefixes list addresses within zone which may have PTR records.
+	prefixes []netip.Prefix
+}
+
+// newReverseZones returns zones covering prefixes. Zones are cut at octet
+// boundary for IPv4 and at nibble boundary for IPv6.
+func newReverseZones(prefixes []netip.Prefix) []*reverseZone {
+	byName := make(map[string]*reverseZone)
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		name := reverseZoneName(prefix)
+		zone, ok := byName[name]
+		if !ok {
+			zone = &reverseZone{name: name}
+			byName[name] = zone
+		}
+		zone.prefixes = append(zone.prefixes, prefix)
+	}
+	zones := make([]*reverseZone, 0, len(byName))
+	for _, zone := range byName {
+		zones = append(zones, zone)
+	}
+	// Most specific zones first.
+	sort.Slice(zones, func(i, j int) bool {
+		return len(zones[i].name) > len(zones[j].name)
+	})
+	return zones
+}
+
+func reverseZoneName(prefix netip.Prefix) string {
+	var labels []string
+	if prefix.Addr().Is4() {
+		a4 := prefix.Addr().As4()
+		for i := 0; i < prefix.Bits()/8; i++ {
+			labels = append(labels, strconv.Itoa(int(a4[i])))
+		}
+		labels = append(reverseLabels(labels), "in-addr", "arpa")
+	} else {
+		a16 := prefix.Addr().As16()
+		for i := 0; i < prefix.Bits()/4; i++ {
+			labels = append(labels, strconv.FormatUint(uint64(a16[i/2]>>(4*(1-i%2))&0xf), 16))
+		}
+		labels = append(reverseLabels(labels), "ip6", "arpa")
+	}
+	return strings.Join(labels, ".")
+}
+
+func reverseLabels(labels []string) []string {
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// parseReverseName returns address prefix encoded in reverse lookup name.
+// Full names, like 1.0.24.172.in-addr.arpa, yield single address prefixes.
+func parseReverseName(name string) (netip.Prefix, bool) {
+	if rest, ok := strings.CutSuffix(name, "in-addr.arpa"); ok {
+		labels := splitReverseLabels(rest)
+		if len(labels) > 4 {
+			return netip.Prefix{}, false
+		}
+		var a4 [4]byte
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || strconv.FormatUint(octet, 10) != label {
+				return netip.Prefix{}, false
+			}
+			a4[i] = byte(octet)
+		}
+		return netip.PrefixFrom(netip.AddrFrom4(a4), len(labels)*8), true
+	}
+	if rest, ok := strings.CutSuffix(name, "ip6.arpa"); ok {
+		labels := splitReverseLabels(rest)
+		if len(labels) > 32 {
+			return netip.Prefix{}, false
+		}
+		var a16 [16]byte
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Prefix{}, false
+			}
+			a16[i/2] |= byte(nibble) << (4 * (1 - i%2))
+		}
+		return netip.PrefixFrom(netip.AddrFrom16(a16), len(labels)*4), true
+	}
+	return netip.Prefix{}, false
+}
+
+// splitReverseLabels splits labels preceding reverse zone suffix and puts
+// them into address order.
+func splitReverseLabels(rest string) []string {
+	if rest == "" {
+		return nil
+	}
+	return reverseLabels(strings.Split(strings.TrimSuffix(rest, "."), "."))
+}
+
+// findZone returns zone containing name, if any.
+func (d *DNSProxy) findZone(name string) *reverseZone {
+	for _, zone := range d.reverseZones {
+		if name == zone.name || strings.HasSuffix(name, "."+zone.name) {
+			return zone
+		}
+	}
+	return nil
+}
+
+// serveReverse answers query within reverse zone authoritatively.
+func (d *DNSProxy) serveReverse(ctx *proxy.DNSContext, zone *reverseZone, clientKey clientkey.Key) error {
+	q := ctx.Req.Question[0]
+	name := normalizeName(q.Name)
+	resp := new(dns.Msg)
+	resp.SetReply(ctx.Req)
+	resp.Authoritative = true
+	ctx.Res = resp
+
+	zoneFQDN := zone.name + "."
+	if name == zone.name {
+		switch q.Qtype {
+		case dns.TypeSOA:
+			resp.Answer = []dns.RR{d.negativeSOA(zoneFQDN)}
+		case dns.TypeNS:
+			resp.Answer = []dns.RR{&dns.NS{
+				Hdr: dns.RR_Header{Name: zoneFQDN, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: d.ttl.Load()},
+				Ns:  d.soa.Ns,
+			}}
+		default:
+			resp.Ns = []dns.RR{d.negativeSOA(zoneFQDN)}
+		}
+		return nil
+	}
+
+	// Names within zone are either addresses from zone prefixes or empty
+	// non-terminals leading to them.
+	prefix, ok := parseReverseName(name)
+	exists := false
+	if ok {
+		for _, zonePrefix := range zone.prefixes {
+			if zonePrefix.Overlaps(prefix) {
+				exists = true
+				break
+			}
+		}
+	}
+	domainName := ""
+	if exists && prefix.IsSingleIP() {
+		var err error
+		domainName, err = d.reverseLookup(prefix.Addr(), clientKey)
+		if err != nil {
+			return err
+		}
+		exists = domainName != ""
+	}
+	switch {
+	case !exists:
+		resp.Rcode = dns.RcodeNameError
+		resp.Ns = []dns.RR{d.negativeSOA(zoneFQDN)}
+	case domainName != "" && q.Qtype == dns.TypePTR:
+		resp.Answer = []dns.RR{&dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: d.ttl.Load()},
+			Ptr: dns.Fqdn(domainName),
+		}}
+	default:
+		resp.Ns = []dns.RR{d.negativeSOA(zoneFQDN)}
+	}
+	return nil
+}
+
+// reverseLookup returns domain mapped to addr, or empty string if there is
+// none.
+func (d *DNSProxy) reverseLookup(addr netip.Addr, clientKey clientkey.Key) (string, error) {
+	if d.pair6 != nil && addr.Is6() {
+		if addr4, ok := d.pair6.To4(addr); ok {
+			addr = addr4
+		}
+	}
+	mapper, ok := d.mapper.(ReverseMapper)
+	if !ok {
+		return "", nil
+	}
+	domainName, found, err := mapper.ReverseLookup(clientKey, addr)
+	if err != nil {
+		return "", err
+	}
+	if !found && d.reverseAnyClient {
+		if anyClient, ok := d.mapper.(AnyClientReverseMapper); ok {
+			domainName, found, err = anyClient.ReverseLookupAnyClient(addr)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if !found {
+		return "", nil
+	}
+	return domainName, nil
+}
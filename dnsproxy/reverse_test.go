@@ -0,0 +1,116 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/pool"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// reverseMapper knows single mapping of example.com. made by other client.
+type reverseMapper struct {
+	countingMapper
+}
+
+func (m *reverseMapper) ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (string, bool, error) {
+	return "", false, nil
+}
+
+func (m *reverseMapper) ReverseLookupAnyClient(addr netip.Addr) (string, bool, error) {
+	if addr == netip.MustParseAddr("172.24.0.1") {
+		return "example.com", true, nil
+	}
+	return "", false, nil
+}
+
+func TestReverseZoneName(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"172.24.0.0/16": "24.172.in-addr.arpa",
+		"172.24.0.0/20": "24.172.in-addr.arpa",
+		"10.0.0.0/8":    "10.in-addr.arpa",
+		"fd44::/96":     "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.4.4.d.f.ip6.arpa",
+	} {
+		if got := reverseZoneName(netip.MustParsePrefix(prefix)); got != want {
+			t.Errorf("reverseZoneName(%s) = %q, expected %q", prefix, got, want)
+		}
+	}
+}
+
+func TestParseReverseName(t *testing.T) {
+	for name, want := range map[string]string{
+		"1.0.24.172.in-addr.arpa": "172.24.0.1/32",
+		"24.172.in-addr.arpa":     "172.24.0.0/16",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.4.4.d.f.ip6.arpa": "fd44::1/128",
+	} {
+		got, ok := parseReverseName(name)
+		if !ok || got.String() != want {
+			t.Errorf("parseReverseName(%q) = %v, %v, expected %s", name, got, ok, want)
+		}
+	}
+	for _, name := range []string{"01.0.24.172.in-addr.arpa", "x.24.172.in-addr.arpa", "1.1.1.0.24.172.in-addr.arpa", "example.com"} {
+		if _, ok := parseReverseName(name); ok {
+			t.Errorf("bad name %q parsed", name)
+		}
+	}
+}
+
+func TestReverseZone(t *testing.T) {
+	pair6, err := pool.NewPair6(netip.MustParsePrefix("fd44::/96"))
+	if err != nil {
+		t.Fatalf("NewPair6 failed: %v", err)
+	}
+	d := startProxy(t, &Config{
+		Mapper:           new(reverseMapper),
+		Pair6:            pair6,
+		ReverseZones:     []netip.Prefix{netip.MustParsePrefix("172.24.0.0/16"), pair6.Prefix()},
+		ReverseAnyClient: true,
+	}, new(atomic.Int32))
+
+	for _, tc := range []struct {
+		name   string
+		qType  uint16
+		rcode  int
+		answer string
+	}{
+		{"1.0.24.172.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "example.com."},
+		{"1.0.0.0.8.1.c.a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.4.4.d.f.ip6.arpa.", dns.TypePTR, dns.RcodeSuccess, "example.com."},
+		{"1.0.24.172.in-addr.arpa.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"2.0.24.172.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, ""},
+		{"0.24.172.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, ""},
+		{"24.172.in-addr.arpa.", dns.TypeSOA, dns.RcodeSuccess, DefaultSOANs},
+		{"24.172.in-addr.arpa.", dns.TypeNS, dns.RcodeSuccess, DefaultSOANs},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qType)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		if !resp.Authoritative || resp.Rcode != tc.rcode {
+			t.Errorf("%s %s: got %s, authoritative=%v", dns.TypeToString[tc.qType], tc.name, dns.RcodeToString[resp.Rcode], resp.Authoritative)
+			continue
+		}
+		var answer string
+		if len(resp.Answer) == 1 {
+			switch rr := resp.Answer[0].(type) {
+			case *dns.PTR:
+				answer = rr.Ptr
+			case *dns.NS:
+				answer = rr.Ns
+			case *dns.SOA:
+				answer = rr.Ns
+			}
+		}
+		if answer != tc.answer {
+			t.Errorf("%s %s: unexpected answer %v", dns.TypeToString[tc.qType], tc.name, resp.Answer)
+		}
+		if answer == "" && len(resp.Ns) != 1 {
+			t.Errorf("%s %s: negative answer without SOA", dns.TypeToString[tc.qType], tc.name)
+		}
+	}
+}
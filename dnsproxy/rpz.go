@@ -0,0 +1,395 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultRPZRefresh is how often RPZ sources are checked for updates.
+	DefaultRPZRefresh = 5 * time.Minute
+	// rpzTimeout limits zone transfer and SOA queries to RPZ server.
+	rpzTimeout = 30 * time.Second
+)
+
+// RPZPolicy decides on queries with QNAME triggers of Response Policy
+// Zones, loaded from zone files or transferred with AXFR. Trigger actions
+// map to verdicts as follows:
+//
+//	CNAME .              block (NXDOMAIN)
+//	CNAME *.             block (NODATA)
+//	CNAME rpz-drop.      block
+//	CNAME rpz-passthru.  pass
+//	local data           block
+//
+// rpz-tcp-only action and IP, NSDNAME and NSIP triggers are ignored. Zones
+// are searched in order they are given and the first zone with matching
+// trigger wins. Within zone exact trigger wins over wildcard one and more
+// specific wildcard wins over less specific. Sources are checked for
+// updates in background as queries arrive, at most once per refresh
+// interval. Zone transfers are repeated only when SOA serial changes.
+type RPZPolicy struct {
+	sources    []*rpzSource
+	refresh    time.Duration
+	checked    atomic.Int64
+	refreshing atomic.Bool
+}
+
+// rpzSource is a zone file or a zone on primary server along with its last
+// loaded content.
+type rpzSource struct {
+	// path is zone file path, if zone is loaded from file.
+	path string
+	// server, zone and TSIG parameters locate zone to transfer.
+	server  string
+	zone    string
+	keyName string
+	secret  string
+	alg     string
+
+	mux     sync.RWMutex
+	rules   *rpzZone
+	modTime time.Time
+}
+
+// rpzZone holds triggers of a single policy zone.
+type rpzZone struct {
+	name      string
+	serial    uint32
+	exact     map[string]rpzRule
+	wildcards map[string]rpzRule
+}
+
+type rpzRule struct {
+	action PolicyAction
+	// text is trigger record as it's given in zone.
+	text string
+}
+
+// NewRPZPolicy loads policy zones from sources, which are zone file paths
+// or URLs like axfr://[KEYNAME:SECRET@]HOST[:PORT]/ZONE?alg=TSIG_ALGORITHM.
+// TSIG algorithm defaults to hmac-sha256. Zero refresh means
+// DefaultRPZRefresh.
+func NewRPZPolicy(sources []string, refresh time.Duration) (*RPZPolicy, error) {
+	if refresh <= 0 {
+		refresh = DefaultRPZRefresh
+	}
+	p := &RPZPolicy{refresh: refresh}
+	for _, spec := range sources {
+		src, err := parseRPZSource(spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := src.load(); err != nil {
+			return nil, fmt.Errorf("can't load RPZ %s: %w", src, err)
+		}
+		p.sources = append(p.sources, src)
+	}
+	p.checked.Store(time.Now().UnixNano())
+	return p, nil
+}
+
+func parseRPZSource(spec string) (*rpzSource, error) {
+	if !strings.Contains(spec, "://") {
+		return &rpzSource{path: spec}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("bad RPZ URL: %w", err)
+	}
+	if u.Scheme != "axfr" {
+		return nil, fmt.Errorf("bad RPZ URL %q: scheme must be axfr", spec)
+	}
+	zone := strings.Trim(u.Path, "/")
+	if zone == "" {
+		return nil, fmt.Errorf("bad RPZ URL %q: zone name is missing", spec)
+	}
+	src := &rpzSource{
+		server: u.Host,
+		zone:   dns.Fqdn(strings.ToLower(zone)),
+		alg:    dns.HmacSHA256,
+	}
+	if u.Port() == "" {
+		src.server = net.JoinHostPort(u.Hostname(), "53")
+	}
+	if u.User != nil {
+		src.keyName = dns.Fqdn(u.User.Username())
+		src.secret, _ = u.User.Password()
+		if src.secret == "" {
+			return nil, fmt.Errorf("bad RPZ URL %q: TSIG secret is missing", spec)
+		}
+	}
+	if alg := u.Query().Get("alg"); alg != "" {
+		src.alg = dns.Fqdn(strings.ToLower(alg))
+	}
+	return src, nil
+}
+
+func (s *rpzSource) String() string {
+	if s.path != "" {
+		return s.path
+	}
+	return "axfr://" + s.server + "/" + strings.TrimSuffix(s.zone, ".")
+}
+
+// load reads zone from file or transfers it from server, unless it's
+// unchanged since previous load.
+func (s *rpzSource) load() error {
+	if s.path != "" {
+		return s.loadFile()
+	}
+	return s.transfer()
+}
+
+func (s *rpzSource) loadFile() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if s.current() != nil && fi.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zone, err := parseRPZ(f, s.path)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.rules = zone
+	s.modTime = fi.ModTime()
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *rpzSource) transfer() error {
+	if cur := s.current(); cur != nil {
+		serial, err := s.serial()
+		if err != nil {
+			return err
+		}
+		if serial == cur.serial {
+			return nil
+		}
+	}
+	t := &dns.Transfer{
+		DialTimeout:  rpzTimeout,
+		ReadTimeout:  rpzTimeout,
+		WriteTimeout: rpzTimeout,
+	}
+	req := new(dns.Msg)
+	req.SetAxfr(s.zone)
+	if s.keyName != "" {
+		t.TsigSecret = map[string]string{s.keyName: s.secret}
+		req.SetTsig(s.keyName, s.alg, 300, time.Now().Unix())
+	}
+	envelopes, err := t.In(req, s.server)
+	if err != nil {
+		return err
+	}
+	var records []dns.RR
+	for env := range envelopes {
+		if env.Error != nil {
+			return env.Error
+		}
+		records = append(records, env.RR...)
+	}
+	zone, err := newRPZZone(records)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.rules = zone
+	s.mux.Unlock()
+	return nil
+}
+
+// serial queries server for SOA serial of zone.
+func (s *rpzSource) serial() (uint32, error) {
+	client := &dns.Client{Net: "tcp", Timeout: rpzTimeout}
+	req := new(dns.Msg)
+	req.SetQuestion(s.zone, dns.TypeSOA)
+	if s.keyName != "" {
+		client.TsigSecret = map[string]string{s.keyName: s.secret}
+		req.SetTsig(s.keyName, s.alg, 300, time.Now().Unix())
+	}
+	resp, _, err := client.Exchange(req, s.server)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("SOA query failed: %s", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("SOA query got no SOA record")
+}
+
+func (s *rpzSource) current() *rpzZone {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.rules
+}
+
+// parseRPZ reads policy zone in master file format.
+func parseRPZ(r io.Reader, filename string) (*rpzZone, error) {
+	zp := dns.NewZoneParser(r, "", filename)
+	var records []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return newRPZZone(records)
+}
+
+// newRPZZone builds policy zone of records, which have to start with SOA.
+func newRPZZone(records []dns.RR) (*rpzZone, error) {
+	if len(records) == 0 {
+		return nil, errors.New("policy zone is empty")
+	}
+	soa, ok := records[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.New("policy zone doesn't start with SOA record")
+	}
+	zone := &rpzZone{
+		name:      normalizeName(soa.Hdr.Name),
+		serial:    soa.Serial,
+		exact:     make(map[string]rpzRule),
+		wildcards: make(map[string]rpzRule),
+	}
+	ignored := 0
+	for _, rr := range records[1:] {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNS:
+			continue
+		}
+		trigger, ok := strings.CutSuffix(normalizeName(rr.Header().Name), "."+zone.name)
+		if !ok {
+			continue
+		}
+		action, ok := rpzAction(rr)
+		if !ok || rpzUnsupportedTrigger(trigger) {
+			ignored++
+			continue
+		}
+		rule := rpzRule{action, strings.ReplaceAll(rr.String(), "\t", " ")}
+		rules := zone.exact
+		if trigger == "*" {
+			trigger, rules = "", zone.wildcards
+		} else if base, ok := strings.CutPrefix(trigger, "*."); ok {
+			trigger, rules = base, zone.wildcards
+		}
+		if _, ok := rules[trigger]; !ok {
+			rules[trigger] = rule
+		}
+	}
+	if ignored > 0 {
+		log.Printf("RPZ %s: ignored %d records with unsupported triggers or actions", zone.name, ignored)
+	}
+	return zone, nil
+}
+
+// rpzAction returns verdict for policy record.
+func rpzAction(rr dns.RR) (PolicyAction, bool) {
+	cname, ok := rr.(*dns.CNAME)
+	if !ok {
+		// Local data is meant to direct clients to a walled garden.
+		return PolicyBlock, true
+	}
+	switch strings.ToLower(cname.Target) {
+	case "rpz-passthru.":
+		return PolicyPass, true
+	case "rpz-tcp-only.":
+		return PolicyDefault, false
+	default:
+		// ".", "*.", "rpz-drop." and local data CNAME.
+		return PolicyBlock, true
+	}
+}
+
+// rpzUnsupportedTrigger reports whether trigger matches something else
+// than query name.
+func rpzUnsupportedTrigger(trigger string) bool {
+	labels := strings.Split(trigger, ".")
+	for _, label := range labels {
+		switch label {
+		case "rpz-ip", "rpz-nsip", "rpz-nsdname", "rpz-client-ip":
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds rule for domain name.
+func (z *rpzZone) lookup(name string) (rpzRule, bool) {
+	if rule, ok := z.exact[name]; ok {
+		return rule, true
+	}
+	for {
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		if rule, ok := z.wildcards[parent]; ok {
+			return rule, true
+		}
+		name = parent
+	}
+	rule, ok := z.wildcards[""]
+	return rule, ok
+}
+
+func (p *RPZPolicy) Decide(ctx context.Context, q PolicyQuery) (PolicyAction, error) {
+	action, _, err := p.DecideReason(ctx, q)
+	return action, err
+}
+
+// DecideReason returns action of the first matching trigger along with
+// the zone and trigger record.
+func (p *RPZPolicy) DecideReason(ctx context.Context, q PolicyQuery) (PolicyAction, string, error) {
+	p.maybeRefresh()
+	for _, src := range p.sources {
+		zone := src.current()
+		if rule, ok := zone.lookup(q.Name); ok {
+			return rule.action, "RPZ " + zone.name + ": " + rule.text, nil
+		}
+	}
+	return PolicyDefault, "", nil
+}
+
+// maybeRefresh starts update of sources in background if refresh interval
+// has passed since last check.
+func (p *RPZPolicy) maybeRefresh() {
+	if time.Since(time.Unix(0, p.checked.Load())) < p.refresh || !p.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer p.refreshing.Store(false)
+		for _, src := range p.sources {
+			if err := src.load(); err != nil {
+				log.Printf("RPZ %s refresh failed, keeping previous version: %v", src, err)
+			}
+		}
+		p.checked.Store(time.Now().UnixNano())
+	}()
+}
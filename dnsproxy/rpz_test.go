@@ -0,0 +1,146 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testRPZ = `$ORIGIN rpz.example.
+$TTL 300
+@                   SOA ns.example. admin.example. 1 3600 600 86400 300
+@                   NS  ns.example.
+bad.example.com     CNAME .
+*.bad.example.com   CNAME .
+good.bad.example.com CNAME rpz-passthru.
+nodata.example.net  CNAME *.
+garden.example.net  A   192.0.2.1
+*.ads.example.org   CNAME rpz-drop.
+tcp.example.org     CNAME rpz-tcp-only.
+32.1.2.0.192.rpz-ip CNAME .
+`
+
+func TestRPZPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpz.zone")
+	if err := os.WriteFile(path, []byte(testRPZ), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewRPZPolicy([]string{path}, 0)
+	if err != nil {
+		t.Fatalf("NewRPZPolicy failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		action PolicyAction
+	}{
+		{"bad.example.com", PolicyBlock},
+		{"www.bad.example.com", PolicyBlock},
+		{"good.bad.example.com", PolicyPass},
+		{"x.good.bad.example.com", PolicyBlock},
+		{"example.com", PolicyDefault},
+		{"nodata.example.net", PolicyBlock},
+		{"garden.example.net", PolicyBlock},
+		{"ads.example.org", PolicyDefault},
+		{"a.b.ads.example.org", PolicyBlock},
+		{"tcp.example.org", PolicyDefault},
+		{"192.0.2.1", PolicyDefault},
+	} {
+		action, reason, err := policy.DecideReason(context.Background(), PolicyQuery{Name: tc.name, Type: dns.TypeA})
+		if err != nil {
+			t.Fatalf("%s: DecideReason failed: %v", tc.name, err)
+		}
+		if action != tc.action {
+			t.Errorf("%s: got action %s, expected %s", tc.name, action, tc.action)
+		}
+		if action != PolicyDefault && !strings.HasPrefix(reason, "RPZ rpz.example: ") {
+			t.Errorf("%s: unexpected reason %q", tc.name, reason)
+		}
+	}
+}
+
+func TestRPZTransfer(t *testing.T) {
+	var records []dns.RR
+	zp := dns.NewZoneParser(strings.NewReader(testRPZ), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		records = append(records, rr)
+	}
+	records = append(records, records[0])
+
+	const keyName, secret = "rpz-key.", "c2VjcmV0"
+	mux := dns.NewServeMux()
+	mux.HandleFunc("rpz.example.", func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			w.WriteMsg(new(dns.Msg).SetRcode(req, dns.RcodeRefused))
+			return
+		}
+		if req.Question[0].Qtype == dns.TypeSOA {
+			resp := new(dns.Msg).SetReply(req)
+			resp.Answer = records[:1]
+			resp.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+			w.WriteMsg(resp)
+			return
+		}
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: records}
+		close(ch)
+		(&dns.Transfer{TsigSecret: map[string]string{keyName: secret}}).Out(w, req, ch)
+		w.Hijack()
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: l, Handler: mux, TsigSecret: map[string]string{keyName: secret}}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	policy, err := NewRPZPolicy([]string{"axfr://rpz-key:" + secret + "@" + l.Addr().String() + "/rpz.example"}, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("NewRPZPolicy failed: %v", err)
+	}
+	if action, _ := policy.Decide(context.Background(), PolicyQuery{Name: "www.bad.example.com"}); action != PolicyBlock {
+		t.Errorf("got action %s for transferred trigger", action)
+	}
+	if err := policy.sources[0].load(); err != nil {
+		t.Errorf("refresh with unchanged serial failed: %v", err)
+	}
+
+	if _, err := NewRPZPolicy([]string{"axfr://" + l.Addr().String() + "/rpz.example"}, 0); err == nil {
+		t.Error("transfer without TSIG key succeeded")
+	}
+}
+
+type staticPolicy struct {
+	action PolicyAction
+	err    error
+}
+
+func (p staticPolicy) Decide(ctx context.Context, q PolicyQuery) (PolicyAction, error) {
+	return p.action, p.err
+}
+
+func TestPolicyChain(t *testing.T) {
+	failure := errors.New("failure")
+	for _, tc := range []struct {
+		chain  PolicyChain
+		action PolicyAction
+		err    error
+	}{
+		{PolicyChain{staticPolicy{PolicyDefault, nil}, staticPolicy{PolicyPass, nil}}, PolicyPass, nil},
+		{PolicyChain{staticPolicy{PolicyBlock, nil}, staticPolicy{PolicyPass, nil}}, PolicyBlock, nil},
+		{PolicyChain{staticPolicy{PolicyBlock, failure}, staticPolicy{PolicyMap, nil}}, PolicyMap, nil},
+		{PolicyChain{staticPolicy{PolicyDefault, failure}, staticPolicy{PolicyDefault, nil}}, PolicyDefault, failure},
+	} {
+		action, err := tc.chain.Decide(context.Background(), PolicyQuery{Name: "example.com"})
+		if action != tc.action || err != tc.err {
+			t.Errorf("got (%s, %v), expected (%s, %v)", action, err, tc.action, tc.err)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RulesPolicy decides on queries with script of rules, one per line:
+//
+//	ACTION [EGRESS] CONDITION...
+//
+// where ACTION is map, pass, block, default or egress, the last one
+// followed by egress pool name. Each CONDITION is KEY=VALUE[,VALUE...] or
+// KEY!=VALUE[,VALUE...], matching if attribute KEY has any (or, with !=,
+// none) of listed values:
+//
+//	name     queried domain or its parent domain, or shell pattern
+//	type     query type, like AAAA
+//	client   address or prefix covering mapping client key
+//	device   client device name, if it's named
+//	group    client device group
+//	hour     local hour or inclusive range of them, like 22-6
+//	weekday  local day of week or range of them, like mon-fri
+//	answer   address or prefix covering any address of upstream answer
+//
+// Fields are separated by any whitespace. First rule with all conditions
+// matching wins, rule without conditions matches any query. Empty lines
+// and lines starting with # are ignored.
+type RulesPolicy struct {
+	rules []policyRule
+	now   func() time.Time
+}
+
+type policyRule struct {
+	action PolicyAction
+	egress string
+	conds  []ruleCond
+	// text is rule source with its line number.
+	text string
+}
+
+// ruleEnv holds query attributes conditions are checked against. answer
+// is resolved only if some rule gets to answer condition.
+type ruleEnv struct {
+	q       PolicyQuery
+	client  string
+	hour    int
+	weekday int
+	answer  []netip.Addr
+	// resolved tells whether answer is set.
+	resolved bool
+}
+
+func (env *ruleEnv) answerAddrs() []netip.Addr {
+	if !env.resolved {
+		env.resolved = true
+		if env.q.Answer != nil {
+			env.answer = env.q.Answer()
+		}
+	}
+	return env.answer
+}
+
+type ruleCond struct {
+	key    string
+	negate bool
+	// match reports whether query has any of condition values.
+	match func(env *ruleEnv) bool
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ruleKeys build matchers of condition values by attribute name.
+var ruleKeys = map[string]func(values []string) (func(env *ruleEnv) bool, error){
+	"name": func(values []string) (func(env *ruleEnv) bool, error) {
+		var (
+			domains  []string
+			patterns []string
+		)
+		for _, v := range values {
+			if !strings.ContainsAny(v, "*?[") {
+				domains = append(domains, normalizeName(v))
+				continue
+			}
+			if _, err := path.Match(v, ""); err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %w", v, err)
+			}
+			patterns = append(patterns, strings.ToLower(v))
+		}
+		return func(env *ruleEnv) bool {
+			name := env.q.Name
+			for _, domain := range domains {
+				if domain == "" || name == domain || strings.HasSuffix(name, "."+domain) {
+					return true
+				}
+			}
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, name); ok {
+					return true
+				}
+			}
+			return false
+		}, nil
+	},
+	"type": func(values []string) (func(env *ruleEnv) bool, error) {
+		types := make(map[uint16]bool)
+		for _, v := range values {
+			qType, ok := dns.StringToType[strings.ToUpper(v)]
+			if !ok {
+				return nil, fmt.Errorf("unknown query type %q", v)
+			}
+			types[qType] = true
+		}
+		return func(env *ruleEnv) bool { return types[env.q.Type] }, nil
+	},
+	"client": func(values []string) (func(env *ruleEnv) bool, error) {
+		prefixes, err := parseRulePrefixes(values)
+		if err != nil {
+			return nil, err
+		}
+		return func(env *ruleEnv) bool {
+			for _, prefix := range prefixes {
+				if keyWithin(env.client, prefix) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	},
+	"device": func(values []string) (func(env *ruleEnv) bool, error) {
+		return func(env *ruleEnv) bool { return containsString(values, env.q.Device) }, nil
+	},
+	"group": func(values []string) (func(env *ruleEnv) bool, error) {
+		return func(env *ruleEnv) bool { return containsString(values, env.q.Group) }, nil
+	},
+	"hour": func(values []string) (func(env *ruleEnv) bool, error) {
+		hours, err := parseRuleRanges(values, 24, func(s string) (int, bool) {
+			n, err := strconv.Atoi(s)
+			return n, err == nil && n >= 0 && n < 24
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(env *ruleEnv) bool { return hours[env.hour] }, nil
+	},
+	"weekday": func(values []string) (func(env *ruleEnv) bool, error) {
+		days, err := parseRuleRanges(values, len(weekdayNames), func(s string) (int, bool) {
+			for i, name := range weekdayNames {
+				if strings.EqualFold(s, name) {
+					return i, true
+				}
+			}
+			return 0, false
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(env *ruleEnv) bool { return days[env.weekday] }, nil
+	},
+	"answer": func(values []string) (func(env *ruleEnv) bool, error) {
+		prefixes, err := parseRulePrefixes(values)
+		if err != nil {
+			return nil, err
+		}
+		return func(env *ruleEnv) bool {
+			for _, addr := range env.answerAddrs() {
+				for _, prefix := range prefixes {
+					if prefix.Contains(addr.Unmap()) {
+						return true
+					}
+				}
+			}
+			return false
+		}, nil
+	},
+}
+
+// parseRulePrefixes parses addresses and prefixes.
+func parseRulePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad address or prefix %q", v)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseRuleRanges parses values and inclusive ranges FIRST-LAST of them
+// into set of n values. Ranges with LAST below FIRST wrap around.
+func parseRuleRanges(values []string, n int, parse func(string) (int, bool)) ([]bool, error) {
+	set := make([]bool, n)
+	for _, v := range values {
+		firstStr, lastStr, isRange := strings.Cut(v, "-")
+		if !isRange {
+			lastStr = firstStr
+		}
+		first, ok1 := parse(firstStr)
+		last, ok2 := parse(lastStr)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("bad value %q", v)
+		}
+		for i := first; ; i = (i + 1) % n {
+			set[i] = true
+			if i == last {
+				break
+			}
+		}
+	}
+	return set, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// keyWithin reports whether client key, which is an address or a prefix,
+// lies within prefix.
+func keyWithin(key string, prefix netip.Prefix) bool {
+	if addr, err := netip.ParseAddr(key); err == nil {
+		return prefix.Contains(addr.Unmap())
+	}
+	keyPrefix, err := netip.ParsePrefix(key)
+	if err != nil {
+		return false
+	}
+	return keyPrefix.Bits() >= prefix.Bits() && prefix.Contains(keyPrefix.Addr())
+}
+
+// parseRuleCond parses KEY=VALUE[,VALUE...] or KEY!=VALUE[,VALUE...].
+func parseRuleCond(field string) (ruleCond, error) {
+	key, list, ok := strings.Cut(field, "=")
+	if !ok || list == "" {
+		return ruleCond{}, fmt.Errorf("bad condition %q, expected KEY=VALUE", field)
+	}
+	cond := ruleCond{key: strings.TrimSuffix(key, "!")}
+	cond.negate = cond.key != key
+	build, ok := ruleKeys[cond.key]
+	if !ok {
+		return ruleCond{}, fmt.Errorf("unknown condition key %q", cond.key)
+	}
+	match, err := build(strings.Split(list, ","))
+	if err != nil {
+		return ruleCond{}, fmt.Errorf("condition %q: %w", field, err)
+	}
+	cond.match = match
+	return cond, nil
+}
+
+// parseRule parses rule line split into fields.
+func parseRule(fields []string) (policyRule, error) {
+	var rule policyRule
+	switch fields[0] {
+	case "egress":
+		if len(fields) < 2 || strings.Contains(fields[1], "=") {
+			return rule, errors.New("egress action requires egress pool name")
+		}
+		rule.action, rule.egress = PolicyEgress, fields[1]
+		fields = fields[2:]
+	default:
+		action, err := ParsePolicyAction(fields[0])
+		if err != nil {
+			return rule, err
+		}
+		rule.action = action
+		fields = fields[1:]
+	}
+	for _, field := range fields {
+		cond, err := parseRuleCond(field)
+		if err != nil {
+			return rule, err
+		}
+		rule.conds = append(rule.conds, cond)
+	}
+	// Upstream answer is checked last, so other conditions spare
+	// resolution of queries they don't match.
+	sort.SliceStable(rule.conds, func(i, j int) bool {
+		return rule.conds[i].key != "answer" && rule.conds[j].key == "answer"
+	})
+	return rule, nil
+}
+
+// LoadRulesPolicy reads rules script from file.
+func LoadRulesPolicy(filename string) (*RulesPolicy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't open rules script: %w", err)
+	}
+	defer f.Close()
+	policy, err := ParseRulesPolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return policy, nil
+}
+
+// ParseRulesPolicy parses rules script.
+func ParseRulesPolicy(r io.Reader) (*RulesPolicy, error) {
+	policy := &RulesPolicy{now: time.Now}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		rule.text = fmt.Sprintf("line %d: %s", lineNo, strings.Join(fields, " "))
+		policy.rules = append(policy.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Egresses returns egress pool names rules refer to.
+func (p *RulesPolicy) Egresses() []string {
+	var egresses []string
+	for _, rule := range p.rules {
+		if rule.action == PolicyEgress && !containsString(egresses, rule.egress) {
+			egresses = append(egresses, rule.egress)
+		}
+	}
+	return egresses
+}
+
+func (p *RulesPolicy) Decide(ctx context.Context, q PolicyQuery) (PolicyAction, error) {
+	action, _, _, err := p.DecideEgress(ctx, q)
+	return action, err
+}
+
+func (p *RulesPolicy) DecideReason(ctx context.Context, q PolicyQuery) (PolicyAction, string, error) {
+	action, _, reason, err := p.DecideEgress(ctx, q)
+	return action, reason, err
+}
+
+// DecideEgress returns action and egress of the first matching rule along
+// with the rule itself.
+func (p *RulesPolicy) DecideEgress(ctx context.Context, q PolicyQuery) (PolicyAction, string, string, error) {
+	now := p.now()
+	env := &ruleEnv{
+		q:       q,
+		client:  q.ClientKey.String(),
+		hour:    now.Hour(),
+		weekday: int(now.Weekday()),
+	}
+	for _, rule := range p.rules {
+		if rule.matches(env) {
+			return rule.action, rule.egress, rule.text, nil
+		}
+	}
+	return PolicyDefault, "", "", nil
+}
+
+func (r *policyRule) matches(env *ruleEnv) bool {
+	for _, cond := range r.conds {
+		if cond.match(env) == cond.negate {
+			return false
+		}
+	}
+	return true
+}
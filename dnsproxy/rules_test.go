@@ -0,0 +1,180 @@
+package dnsproxy
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseRuleCond(t *testing.T) {
+	env := &ruleEnv{
+		q: PolicyQuery{
+			Name:   "www.example.com",
+			Type:   dns.TypeAAAA,
+			Device: "tablet",
+			Answer: func() []netip.Addr {
+				return []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+			},
+		},
+		client:  "192.168.1.0/24",
+		hour:    22,
+		weekday: 6,
+	}
+	for src, expected := range map[string]bool{
+		"name=example.com":                true,
+		"name=ample.com":                  false,
+		"name=EXAMPLE.COM.":               true,
+		"name=.":                          true,
+		"name=*.example.*":                true,
+		"name!=example.org,test":          true,
+		"type=A,aaaa":                     true,
+		"type!=AAAA":                      false,
+		"client=192.168.0.0/16":           true,
+		"client=192.168.1.128/25":         false,
+		"client=192.168.1.1":              false,
+		"device=phone,tablet":             true,
+		"group=kids":                      false,
+		"group!=kids":                     true,
+		"hour=22":                         true,
+		"hour=21-6":                       true,
+		"hour=8-17":                       false,
+		"weekday=sat,sun":                 true,
+		"weekday=mon-fri":                 false,
+		"weekday=fri-sun":                 true,
+		"answer=192.0.2.0/24":             true,
+		"answer=2001:db8::1":              true,
+		"answer!=198.51.100.0/24":         true,
+		"answer=198.51.100.0/24,10.0.0.1": false,
+	} {
+		cond, err := parseRuleCond(src)
+		if err != nil {
+			t.Errorf("%s: parse error: %v", src, err)
+			continue
+		}
+		if got := cond.match(env) != cond.negate; got != expected {
+			t.Errorf("%s = %v, expected %v", src, got, expected)
+		}
+	}
+	for _, src := range []string{
+		"name",
+		"name=",
+		"unknown=1",
+		"type=BOGUS",
+		"client=bogus",
+		"name=[",
+		"hour=24",
+		"hour=1-",
+		"weekday=monday",
+		"answer=10.0.0.0/33",
+	} {
+		if _, err := parseRuleCond(src); err == nil {
+			t.Errorf("%s: parsed, expected error", src)
+		}
+	}
+}
+
+func TestRulesPolicy(t *testing.T) {
+	policy, err := ParseRulesPolicy(strings.NewReader(`
+# Work hours
+block name=games.example hour=9-17 weekday=mon-fri
+pass	name=bank.example
+pass  type=MX
+block group=kids name=social.example
+egress video name=video.example answer=192.0.2.0/24
+map client=10.0.0.0/8
+`))
+	if err != nil {
+		t.Fatalf("ParseRulesPolicy failed: %v", err)
+	}
+	policy.now = func() time.Time { return time.Date(2024, 3, 5, 10, 0, 0, 0, time.Local) }
+	for _, tc := range []struct {
+		name     string
+		qType    uint16
+		client   string
+		expected PolicyAction
+	}{
+		{"play.games.example", dns.TypeA, "192.168.1.1", PolicyBlock},
+		{"www.bank.example", dns.TypeA, "10.0.0.1", PolicyPass},
+		{"example.com", dns.TypeMX, "10.0.0.1", PolicyPass},
+		{"example.com", dns.TypeA, "10.0.0.1", PolicyMap},
+		{"example.com", dns.TypeA, "192.168.1.1", PolicyDefault},
+	} {
+		action, err := policy.Decide(context.Background(), PolicyQuery{
+			Name:      tc.name,
+			Type:      tc.qType,
+			ClientKey: clientkey.FromAddr(netip.MustParseAddr(tc.client)),
+		})
+		if err != nil || action != tc.expected {
+			t.Errorf("%s %s from %s: (%s, %v), expected %s", dns.TypeToString[tc.qType], tc.name, tc.client, action, err, tc.expected)
+		}
+	}
+
+	action, err := policy.Decide(context.Background(), PolicyQuery{
+		Name:      "social.example",
+		Type:      dns.TypeA,
+		ClientKey: clientkey.FromAddr(netip.MustParseAddr("10.0.0.1")),
+		Device:    "tablet",
+		Group:     "kids",
+	})
+	if err != nil || action != PolicyBlock {
+		t.Errorf("query of kids group: (%s, %v), expected %s", action, err, PolicyBlock)
+	}
+
+	_, reason, err := policy.DecideReason(context.Background(), PolicyQuery{
+		Name:      "play.games.example",
+		Type:      dns.TypeA,
+		ClientKey: clientkey.FromAddr(netip.MustParseAddr("192.168.1.1")),
+	})
+	if want := "line 3: block name=games.example hour=9-17 weekday=mon-fri"; err != nil || reason != want {
+		t.Errorf("DecideReason returned reason %q (%v), expected %q", reason, err, want)
+	}
+
+	// Upstream answer is resolved only for rules getting to it.
+	resolved := 0
+	answer := func(addr string) func() []netip.Addr {
+		return func() []netip.Addr {
+			resolved++
+			return []netip.Addr{netip.MustParseAddr(addr)}
+		}
+	}
+	for _, tc := range []struct {
+		name, answer   string
+		expected       PolicyAction
+		expectedEgress string
+		resolved       int
+	}{
+		{"www.video.example", "192.0.2.1", PolicyEgress, "video", 1},
+		{"www.video.example", "198.51.100.1", PolicyDefault, "", 1},
+		{"www.bank.example", "192.0.2.1", PolicyPass, "", 0},
+		{"example.com", "192.0.2.1", PolicyDefault, "", 0},
+	} {
+		resolved = 0
+		action, egress, _, err := policy.DecideEgress(context.Background(), PolicyQuery{
+			Name:      tc.name,
+			Type:      dns.TypeA,
+			ClientKey: clientkey.FromAddr(netip.MustParseAddr("192.168.1.1")),
+			Answer:    answer(tc.answer),
+		})
+		if err != nil || action != tc.expected || egress != tc.expectedEgress {
+			t.Errorf("%s answered with %s: (%s, %q, %v), expected (%s, %q)", tc.name, tc.answer, action, egress, err, tc.expected, tc.expectedEgress)
+		}
+		if resolved != tc.resolved {
+			t.Errorf("%s answered with %s: resolved %d times, expected %d", tc.name, tc.answer, resolved, tc.resolved)
+		}
+	}
+	if egresses := policy.Egresses(); len(egresses) != 1 || egresses[0] != "video" {
+		t.Errorf("Egresses returned %q, expected [video]", egresses)
+	}
+
+	for _, script := range []string{"drop name=x", "map hour", "map name=x type=", "egress", "egress name=x"} {
+		if _, err := ParseRulesPolicy(strings.NewReader(script)); err == nil {
+			t.Errorf("script %q accepted", script)
+		}
+	}
+}
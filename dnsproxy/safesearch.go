@@ -0,0 +1,152 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// safeSearchEngine lists domains of search engine or video service and
+// the domain which enforces its safe mode.
+type safeSearchEngine struct {
+	target string
+	names  []string
+	// match, if set, matches domains in addition to names.
+	match func(name string) bool
+}
+
+var youtubeNames = []string{
+	"www.youtube.com",
+	"m.youtube.com",
+	"youtubei.googleapis.com",
+	"youtube.googleapis.com",
+	"www.youtube-nocookie.com",
+}
+
+var safeSearchEngines = map[string]safeSearchEngine{
+	"google":           {target: "forcesafesearch.google.com", match: isGoogleSearch},
+	"bing":             {target: "strict.bing.com", names: []string{"bing.com", "www.bing.com"}},
+	"duckduckgo":       {target: "safe.duckduckgo.com", names: []string{"duckduckgo.com", "www.duckduckgo.com", "start.duckduckgo.com"}},
+	"youtube":          {target: "restrict.youtube.com", names: youtubeNames},
+	"youtube-moderate": {target: "restrictmoderate.youtube.com", names: youtubeNames},
+}
+
+// isGoogleSearch matches Google search domains of all countries, like
+// www.google.com or google.co.uk.
+func isGoogleSearch(name string) bool {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(name, "www."), "google.")
+	return ok && rest != "" && strings.Count(rest, ".") <= 1
+}
+
+// SafeSearchEngines returns names of supported engines.
+func SafeSearchEngines() []string {
+	names := make([]string, 0, len(safeSearchEngines))
+	for name := range safeSearchEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SafeSearchRule enforces safe mode of engines for clients, answering
+// their domains with addresses mapped to safe mode domains, like CNAME
+// to forcesafesearch.google.com would do.
+type SafeSearchRule struct {
+	Engines []string
+	// Clients and Groups limit rule to client keys within prefixes and
+	// to clients of device groups. Rule without both matches all
+	// clients.
+	Clients []netip.Prefix
+	Groups  []string
+}
+
+// ParseSafeSearchRule parses rule in ENGINE[,ENGINE...][@CLIENT[,CLIENT...]]
+// format, where CLIENT is prefix or group:GROUP.
+func ParseSafeSearchRule(spec string) (SafeSearchRule, error) {
+	var rule SafeSearchRule
+	engines, clients, hasClients := strings.Cut(spec, "@")
+	for _, engine := range strings.Split(engines, ",") {
+		engine = strings.ToLower(strings.TrimSpace(engine))
+		if _, ok := safeSearchEngines[engine]; !ok {
+			return rule, fmt.Errorf("unknown safe search engine %q in %q, known are %s", engine, spec, strings.Join(SafeSearchEngines(), ", "))
+		}
+		rule.Engines = append(rule.Engines, engine)
+	}
+	if !hasClients {
+		return rule, nil
+	}
+	for _, client := range strings.Split(clients, ",") {
+		client = strings.TrimSpace(client)
+		if group, ok := strings.CutPrefix(client, "group:"); ok {
+			if group == "" {
+				return rule, fmt.Errorf("empty group in safe search rule %q", spec)
+			}
+			rule.Groups = append(rule.Groups, group)
+			continue
+		}
+		prefix, err := netip.ParsePrefix(client)
+		if err != nil {
+			return rule, fmt.Errorf("bad client prefix in safe search rule %q: %w", spec, err)
+		}
+		rule.Clients = append(rule.Clients, prefix.Masked())
+	}
+	return rule, nil
+}
+
+func (r SafeSearchRule) String() string {
+	s := strings.Join(r.Engines, ",")
+	clients := make([]string, 0, len(r.Clients)+len(r.Groups))
+	for _, prefix := range r.Clients {
+		clients = append(clients, prefix.String())
+	}
+	for _, group := range r.Groups {
+		clients = append(clients, "group:"+group)
+	}
+	if len(clients) > 0 {
+		s += "@" + strings.Join(clients, ",")
+	}
+	return s
+}
+
+func (r SafeSearchRule) appliesTo(clientKey clientkey.Key, group string) bool {
+	if len(r.Clients) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	for _, prefix := range r.Clients {
+		if keyWithin(clientKey.String(), prefix) {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// safeSearchTarget returns safe mode domain for domain name queried by
+// client of device group. The first rule applying to client decides.
+func safeSearchTarget(rules []SafeSearchRule, clientKey clientkey.Key, group, domainName string) string {
+	for _, rule := range rules {
+		if !rule.appliesTo(clientKey, group) {
+			continue
+		}
+		for _, name := range rule.Engines {
+			engine := safeSearchEngines[name]
+			if engine.match != nil && engine.match(domainName) {
+				return engine.target
+			}
+			for _, engineName := range engine.names {
+				if engineName == domainName {
+					return engine.target
+				}
+			}
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestParseSafeSearchRule(t *testing.T) {
+	rule, err := ParseSafeSearchRule("Google,youtube-moderate@192.168.10.0/24, 10.0.0.1/8,group:kids")
+	if err != nil {
+		t.Fatalf("ParseSafeSearchRule failed: %v", err)
+	}
+	if s := rule.String(); s != "google,youtube-moderate@192.168.10.0/24,10.0.0.0/8,group:kids" {
+		t.Errorf("unexpected rule %q", s)
+	}
+	for _, spec := range []string{"", "altavista", "google@", "google@10.0.0.1", "google@group:"} {
+		if _, err := ParseSafeSearchRule(spec); err == nil {
+			t.Errorf("bad rule %q accepted", spec)
+		}
+	}
+}
+
+func TestSafeSearchTarget(t *testing.T) {
+	var rules []SafeSearchRule
+	for _, spec := range []string{"youtube,google@192.168.10.0/24", "youtube-moderate,bing"} {
+		rule, err := ParseSafeSearchRule(spec)
+		if err != nil {
+			t.Fatalf("ParseSafeSearchRule failed: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	kid := clientkey.FromAddr(netip.MustParseAddr("192.168.10.5"))
+	adult := clientkey.FromAddr(netip.MustParseAddr("192.168.1.5"))
+	for _, tc := range []struct {
+		client clientkey.Key
+		name   string
+		target string
+	}{
+		{kid, "www.google.com", "forcesafesearch.google.com"},
+		{kid, "google.co.uk", "forcesafesearch.google.com"},
+		{kid, "mail.google.com", ""},
+		{kid, "forcesafesearch.google.com", ""},
+		{kid, "m.youtube.com", "restrict.youtube.com"},
+		{kid, "www.bing.com", ""},
+		{adult, "www.google.com", ""},
+		{adult, "m.youtube.com", "restrictmoderate.youtube.com"},
+		{adult, "www.bing.com", "strict.bing.com"},
+	} {
+		if target := safeSearchTarget(rules, tc.client, "", tc.name); target != tc.target {
+			t.Errorf("%s for %s: got %q, expected %q", tc.name, tc.client, target, tc.target)
+		}
+	}
+
+	rule, err := ParseSafeSearchRule("google@group:kids")
+	if err != nil {
+		t.Fatalf("ParseSafeSearchRule failed: %v", err)
+	}
+	rules = []SafeSearchRule{rule}
+	if target := safeSearchTarget(rules, adult, "kids", "www.google.com"); target != "forcesafesearch.google.com" {
+		t.Errorf("group rule didn't apply to group client, got %q", target)
+	}
+	if target := safeSearchTarget(rules, adult, "", "www.google.com"); target != "" {
+		t.Errorf("group rule applied to client out of group, got %q", target)
+	}
+}
+
+func TestSafeSearch(t *testing.T) {
+	mapper := new(namingMapper)
+	rule, err := ParseSafeSearchRule("google@127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("ParseSafeSearchRule failed: %v", err)
+	}
+	d := startProxy(t, &Config{Mapper: mapper, SafeSearch: []SafeSearchRule{rule}}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.google.com.", dns.TypeA)
+	resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "www.google.com." {
+		t.Fatalf("unexpected answer: %v", resp.Answer)
+	}
+	if domainName, _ := mapper.domainName.Load().(string); domainName != "forcesafesearch.google.com" {
+		t.Errorf("mapped domain is %q, expected safe search domain", domainName)
+	}
+}
@@ -0,0 +1,111 @@
+package dnsproxy
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// TruncateMode defines how synthesized responses exceeding UDP size limit
+// are cut down.
+type TruncateMode int
+
+const (
+	// TruncateTC drops records which don't fit and sets TC flag, so
+	// clients retry over TCP.
+	TruncateTC TruncateMode = iota
+	// TruncateTrim drops records which don't fit and leaves TC flag unset
+	// if some answers remain. Any subset of mapped addresses is valid, so
+	// clients don't need to retry over TCP.
+	TruncateTrim
+)
+
+var truncateModeNames = map[TruncateMode]string{
+	TruncateTC:   "tc",
+	TruncateTrim: "trim",
+}
+
+func (m TruncateMode) String() string {
+	if name, ok := truncateModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("TruncateMode(%d)", int(m))
+}
+
+// ParseTruncateMode parses truncation mode name: tc or trim.
+func ParseTruncateMode(name string) (TruncateMode, error) {
+	for mode, modeName := range truncateModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown truncation mode %q", name)
+}
+
+// udpSize returns size limit of UDP response to req.
+func (d *DNSProxy) udpSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if d.maxUDPSize != 0 && size > d.maxUDPSize {
+		size = d.maxUDPSize
+	}
+	return size
+}
+
+// fitResponse applies compression setting and UDP size limit to response.
+// Truncation mode applies to synthesized responses only: passthrough
+// responses could be truncated already and keep their TC flag.
+func (d *DNSProxy) fitResponse(ctx *proxy.DNSContext, synthesized bool) {
+	resp := ctx.Res
+	if resp == nil {
+		return
+	}
+	resp.Compress = d.compress
+	if ctx.Proto != proxy.ProtoUDP {
+		return
+	}
+	if d.compress {
+		// Truncate turns compression off for messages which fit without
+		// it. Some clients require compression anyway.
+		resp.Truncate(d.udpSize(ctx.Req))
+		resp.Compress = true
+	} else {
+		truncateUncompressed(resp, d.udpSize(ctx.Req))
+	}
+	if synthesized && d.truncateMode == TruncateTrim && len(resp.Answer) > 0 {
+		resp.Truncated = false
+	}
+}
+
+// truncateUncompressed drops records from the end of response until it fits
+// size without compression. Unlike [dns.Msg.Truncate] it never compresses
+// the message. OPT record is retained.
+func truncateUncompressed(resp *dns.Msg, size int) {
+	for resp.Len() > size {
+		if i := lastNonOPT(resp.Extra); i >= 0 {
+			resp.Extra = append(resp.Extra[:i], resp.Extra[i+1:]...)
+			continue
+		}
+		switch {
+		case len(resp.Ns) > 0:
+			resp.Ns = resp.Ns[:len(resp.Ns)-1]
+		case len(resp.Answer) > 0:
+			resp.Answer = resp.Answer[:len(resp.Answer)-1]
+		default:
+			return
+		}
+		resp.Truncated = true
+	}
+}
+
+func lastNonOPT(rrs []dns.RR) int {
+	for i := len(rrs) - 1; i >= 0; i-- {
+		if rrs[i].Header().Rrtype != dns.TypeOPT {
+			return i
+		}
+	}
+	return -1
+}
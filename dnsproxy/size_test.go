@@ -0,0 +1,109 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+const longName = "a-rather-long-subdomain-name-to-make-records-bigger.example.com."
+
+func exchangeA(t *testing.T, d *DNSProxy, network string, ednsSize uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(longName, dns.TypeA)
+	if ednsSize != 0 {
+		req.SetEdns0(ednsSize, false)
+	}
+	proto := proxy.ProtoUDP
+	if network == "tcp" {
+		proto = proxy.ProtoTCP
+	}
+	client := &dns.Client{Net: network, Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(req, d.proxy.Addr(proto).String())
+	if err != nil {
+		t.Fatalf("%s exchange failed: %v", network, err)
+	}
+	return resp
+}
+
+func TestSynthesizedTruncation(t *testing.T) {
+	const addrs = 64
+	for _, tc := range []struct {
+		name       string
+		cfg        Config
+		network    string
+		ednsSize   uint16
+		truncated  bool
+		allAnswers bool
+	}{
+		{"udp", Config{}, "udp", 0, true, false},
+		{"udp trim", Config{Truncate: TruncateTrim}, "udp", 0, false, false},
+		{"udp edns", Config{}, "udp", 4096, false, true},
+		{"udp edns capped", Config{MaxUDPSize: 512}, "udp", 4096, true, false},
+		{"tcp", Config{}, "tcp", 0, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.Mapper = new(multiMapper)
+			cfg.AddrsPerDomain = addrs
+			d := startProxy(t, &cfg, new(atomic.Int32))
+			resp := exchangeA(t, d, tc.network, tc.ednsSize)
+			if resp.Truncated != tc.truncated {
+				t.Errorf("truncated = %v, expected %v", resp.Truncated, tc.truncated)
+			}
+			if (len(resp.Answer) == addrs) != tc.allAnswers {
+				t.Errorf("got %d answers of %d", len(resp.Answer), addrs)
+			}
+			if len(resp.Answer) == 0 {
+				t.Errorf("all answers were dropped")
+			}
+		})
+	}
+}
+
+func TestCompressionSetting(t *testing.T) {
+	counts := make(map[bool]int)
+	for _, disable := range []bool{false, true} {
+		d := startProxy(t, &Config{
+			Mapper:             new(multiMapper),
+			AddrsPerDomain:     64,
+			DisableCompression: disable,
+			Truncate:           TruncateTrim,
+		}, new(atomic.Int32))
+		counts[disable] = len(exchangeA(t, d, "udp", 0).Answer)
+	}
+	if counts[true] >= counts[false] {
+		t.Errorf("uncompressed response fits %d answers, compressed fits %d", counts[true], counts[false])
+	}
+}
+
+func TestMaxUDPSizeValidation(t *testing.T) {
+	for size, ok := range map[int]bool{0: true, 100: false, 512: true, 1232: true, 70000: false} {
+		_, err := New(&Config{
+			ListenAddr: netip.MustParseAddrPort("127.0.0.1:0"),
+			Upstream:   "127.0.0.1:53",
+			Mapper:     new(countingMapper),
+			MaxUDPSize: size,
+		})
+		if (err == nil) != ok {
+			t.Errorf("MaxUDPSize %d: unexpected error %v", size, err)
+		}
+	}
+}
+
+func TestParseTruncateMode(t *testing.T) {
+	for _, mode := range []TruncateMode{TruncateTC, TruncateTrim} {
+		parsed, err := ParseTruncateMode(mode.String())
+		if err != nil || parsed != mode {
+			t.Errorf("round trip of %v failed: %v, %v", mode, parsed, err)
+		}
+	}
+	if _, err := ParseTruncateMode("bogus"); err == nil {
+		t.Errorf("bogus mode accepted")
+	}
+}
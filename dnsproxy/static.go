@@ -0,0 +1,157 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// backendPrefix marks static host value naming mapping backend.
+const backendPrefix = "map:"
+
+// HostTemplate is the answer template of static host.
+type HostTemplate struct {
+	// Addrs are fixed addresses of the host.
+	Addrs []netip.Addr
+	// Backend, if set, makes host answered with addresses mapped to
+	// Backend domain, so proxied connections to the host go to Backend.
+	Backend string
+}
+
+// StaticHosts maps normalized domain names to answer templates. Names
+// starting with "*." match all subdomains of the rest of the name.
+type StaticHosts map[string]*HostTemplate
+
+// ParseStaticHosts parses entries in DOMAIN=ADDRESS or DOMAIN=map:BACKEND
+// format. Addresses of entries with the same domain are merged.
+func ParseStaticHosts(specs []string) (StaticHosts, error) {
+	hosts := make(StaticHosts)
+	for _, spec := range specs {
+		rawName, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("static host %q is not in DOMAIN=ADDRESS format", spec)
+		}
+		name := normalizeName(rawName)
+		if name == "" || name == "*" {
+			return nil, fmt.Errorf("empty domain in static host %q", spec)
+		}
+		if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			return nil, fmt.Errorf("wildcard is allowed only as first label in static host %q", spec)
+		}
+		host := hosts[name]
+		if host == nil {
+			host = new(HostTemplate)
+			hosts[name] = host
+		}
+		value = strings.TrimSpace(value)
+		if backend, ok := strings.CutPrefix(value, backendPrefix); ok {
+			backend = normalizeName(backend)
+			if backend == "" {
+				return nil, fmt.Errorf("empty backend in static host %q", spec)
+			}
+			host.Backend = backend
+		} else {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad address in static host %q: %w", spec, err)
+			}
+			host.Addrs = append(host.Addrs, addr.Unmap())
+		}
+		if host.Backend != "" && len(host.Addrs) > 0 {
+			return nil, fmt.Errorf("static host %q has both addresses and backend", name)
+		}
+	}
+	return hosts, nil
+}
+
+// Addrs returns fixed addresses of all static hosts.
+func (h StaticHosts) Addrs() []netip.Addr {
+	var res []netip.Addr
+	for _, host := range h {
+		res = append(res, host.Addrs...)
+	}
+	return res
+}
+
+// lookup returns template for domain name. Exact entry takes precedence
+// over wildcards, more specific wildcards take precedence over others.
+func (h StaticHosts) lookup(domainName string) *HostTemplate {
+	if len(h) == 0 {
+		return nil
+	}
+	if host, ok := h[domainName]; ok {
+		return host
+	}
+	for name := domainName; ; {
+		var ok bool
+		_, name, ok = strings.Cut(name, ".")
+		if !ok {
+			return nil
+		}
+		if host, ok := h["*."+name]; ok {
+			return host
+		}
+	}
+}
+
+// serveBlocked answers address query for blocked domain with address
+// mapped by BlockMapper, paired with IPv6 one for AAAA queries.
+func (d *DNSProxy) serveBlocked(ctx *proxy.DNSContext, clientKey clientkey.Key, domainName string) error {
+	q := ctx.Req.Question[0]
+	host := &HostTemplate{}
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY || (q.Qtype == dns.TypeAAAA && d.pair6 != nil) {
+		addr, err := d.blockMapper.EnsureMapping(clientKey, domainName, time.Duration(d.ttl.Load()+1)*time.Second)
+		if err != nil {
+			return err
+		}
+		host.Addrs = append(host.Addrs, addr)
+		if d.pair6 != nil {
+			host.Addrs = append(host.Addrs, d.pair6.To6(addr))
+		}
+	}
+	return d.serveStatic(ctx, clientKey, host)
+}
+
+// serveStatic answers query for static host without upstream. Query types
+// other than A, AAAA and ANY get NODATA.
+func (d *DNSProxy) serveStatic(ctx *proxy.DNSContext, clientKey clientkey.Key, host *HostTemplate) error {
+	q := ctx.Req.Question[0]
+	if host.Backend != "" && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY) {
+		policy := d.aaaaPolicies.policy(normalizeName(q.Name))
+		if q.Qtype == dns.TypeAAAA && policy != AAAAAllow {
+			d.suppressAAAA(ctx, policy)
+			return nil
+		}
+		return d.rewrite(d.mapper, clientKey, host.Backend, policy == AAAAAllow, d.ttl.Load(), ctx)
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(ctx.Req)
+	resp.Authoritative = true
+	ttl := d.ttl.Load()
+	for _, addr := range host.Addrs {
+		switch {
+		case addr.Is4() && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   addr.AsSlice(),
+			})
+		case addr.Is6() && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: addr.AsSlice(),
+			})
+		}
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{d.negativeSOA(q.Name)}
+	}
+	ctx.Res = resp
+	return nil
+}
@@ -0,0 +1,159 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestParseStaticHosts(t *testing.T) {
+	hosts, err := ParseStaticHosts([]string{
+		"Printer.LAN. = 192.168.1.50",
+		"printer.lan=fd00::50",
+		"nas.lan=::ffff:192.168.1.2",
+	})
+	if err != nil {
+		t.Fatalf("ParseStaticHosts failed: %v", err)
+	}
+	if got := hosts["printer.lan"].Addrs; len(got) != 2 ||
+		got[0] != netip.MustParseAddr("192.168.1.50") || got[1] != netip.MustParseAddr("fd00::50") {
+		t.Errorf("unexpected printer.lan addresses: %v", got)
+	}
+	if got := hosts["nas.lan"].Addrs; len(got) != 1 || !got[0].Is4() {
+		t.Errorf("mapped IPv6 address is not unmapped: %v", got)
+	}
+	if n := len(hosts.Addrs()); n != 3 {
+		t.Errorf("expected 3 addresses, got %d", n)
+	}
+
+	for _, specs := range [][]string{
+		{"printer.lan"},
+		{"=192.168.1.50"},
+		{"printer.lan=printer"},
+		{"*=192.168.1.50"},
+		{"apps.*.lan=192.168.1.50"},
+		{"*.apps.lan=map:"},
+		{"*.apps.lan=map:traefik.lan", "*.apps.lan=192.168.1.50"},
+	} {
+		if _, err := ParseStaticHosts(specs); err == nil {
+			t.Errorf("bad entries %q accepted", specs)
+		}
+	}
+}
+
+func TestStaticHostsLookup(t *testing.T) {
+	hosts, err := ParseStaticHosts([]string{
+		"*.apps.lan=map:Traefik.lan.",
+		"*.db.apps.lan=192.168.1.60",
+		"admin.apps.lan=192.168.1.70",
+	})
+	if err != nil {
+		t.Fatalf("ParseStaticHosts failed: %v", err)
+	}
+	for name, expected := range map[string]*HostTemplate{
+		"grafana.apps.lan":    hosts["*.apps.lan"],
+		"a.b.apps.lan":        hosts["*.apps.lan"],
+		"pg.db.apps.lan":      hosts["*.db.apps.lan"],
+		"db.apps.lan":         hosts["*.apps.lan"],
+		"admin.apps.lan":      hosts["admin.apps.lan"],
+		"apps.lan":            nil,
+		"example.com":         nil,
+		"grafana.apps.lan.ru": nil,
+	} {
+		if got := hosts.lookup(name); got != expected {
+			t.Errorf("lookup(%q) = %v, expected %v", name, got, expected)
+		}
+	}
+	if backend := hosts["*.apps.lan"].Backend; backend != "traefik.lan" {
+		t.Errorf("backend is not normalized: %q", backend)
+	}
+}
+
+type namingMapper struct {
+	countingMapper
+	domainName atomic.Value
+}
+
+func (m *namingMapper) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	m.domainName.Store(domainName)
+	return m.countingMapper.EnsureMapping(clientKey, domainName, ttl)
+}
+
+func TestStaticHostBackend(t *testing.T) {
+	mapper := new(namingMapper)
+	hosts, err := ParseStaticHosts([]string{"*.apps.lan=map:traefik.lan"})
+	if err != nil {
+		t.Fatalf("ParseStaticHosts failed: %v", err)
+	}
+	d := startProxy(t, &Config{Mapper: mapper, StaticHosts: hosts}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetQuestion("grafana.apps.lan.", dns.TypeA)
+	resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "grafana.apps.lan." ||
+		resp.Answer[0].(*dns.A).A.String() != "172.24.0.1" {
+		t.Fatalf("unexpected answer: %v", resp.Answer)
+	}
+	if domainName, _ := mapper.domainName.Load().(string); domainName != "traefik.lan" {
+		t.Errorf("mapped domain is %q, expected backend", domainName)
+	}
+
+	req.SetQuestion("grafana.apps.lan.", dns.TypeMX)
+	resp, err = dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Errorf("expected NODATA for MX query, got %v", resp)
+	}
+}
+
+func TestStaticHosts(t *testing.T) {
+	mapper := new(countingMapper)
+	hosts, err := ParseStaticHosts([]string{"printer.lan=192.168.1.50"})
+	if err != nil {
+		t.Fatalf("ParseStaticHosts failed: %v", err)
+	}
+	d := startProxy(t, &Config{Mapper: mapper, StaticHosts: hosts}, new(atomic.Int32))
+
+	for _, tc := range []struct {
+		name    string
+		qType   uint16
+		answers int
+	}{
+		{"printer.lan.", dns.TypeA, 1},
+		{"PRINTER.lan.", dns.TypeANY, 1},
+		{"printer.lan.", dns.TypeAAAA, 0},
+		{"printer.lan.", dns.TypeMX, 0},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qType)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("%s %s exchange failed: %v", tc.name, dns.TypeToString[tc.qType], err)
+		}
+		if !resp.Authoritative || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != tc.answers {
+			t.Errorf("%s %s: unexpected response %v", tc.name, dns.TypeToString[tc.qType], resp)
+			continue
+		}
+		if tc.answers == 0 {
+			if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Errorf("%s %s: SOA is missing in NODATA response", tc.name, dns.TypeToString[tc.qType])
+			}
+		} else if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "192.168.1.50" {
+			t.Errorf("%s %s: unexpected answer %v", tc.name, dns.TypeToString[tc.qType], resp.Answer)
+		}
+	}
+	if calls := mapper.calls.Load(); calls != 0 {
+		t.Errorf("mapper was called %d times for static host", calls)
+	}
+}
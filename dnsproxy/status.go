@@ -0,0 +1,48 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// DefaultStatusName is the name answered with resolver status. Domain
+// .test is reserved (RFC 2606), so it never clashes with real names.
+const DefaultStatusName = "status.dns44.test"
+
+// serveStatus answers query for status name with TXT record describing
+// resolver: version, uptime and address pool occupancy.
+func (d *DNSProxy) serveStatus(ctx *proxy.DNSContext) {
+	q := ctx.Req.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(ctx.Req)
+	resp.Authoritative = true
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		resp.Ns = []dns.RR{d.negativeSOA(q.Name)}
+		ctx.Res = resp
+		return
+	}
+
+	txt := []string{
+		"version=" + d.version,
+		"uptime=" + time.Since(d.started).Truncate(time.Second).String(),
+	}
+	if d.poolUsage != nil {
+		if used, size, err := d.poolUsage(); err == nil {
+			txt = append(txt, fmt.Sprintf("pool=%d/%d", used, size))
+		} else {
+			txt = append(txt, "pool=unknown")
+		}
+	}
+	if d.failOpen.Active() {
+		txt = append(txt, "mode=passthrough")
+	}
+	resp.Answer = []dns.RR{&dns.TXT{
+		// Status changes all the time, so it must not be cached.
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: txt,
+	}}
+	ctx.Res = resp
+}
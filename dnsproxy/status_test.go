@@ -0,0 +1,50 @@
+package dnsproxy
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestStatusName(t *testing.T) {
+	mapper := new(countingMapper)
+	d := startProxy(t, &Config{
+		Mapper:     mapper,
+		StatusName: DefaultStatusName,
+		Version:    "v1.2.3",
+		PoolUsage:  func() (uint64, uint64, error) { return 5, 254, nil },
+	}, new(atomic.Int32))
+
+	exchange := func(qType uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("Status.DNS44.test.", qType)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		return resp
+	}
+
+	resp := exchange(dns.TypeTXT)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("unexpected status answer: %v", resp.Answer)
+	}
+	txt := strings.Join(resp.Answer[0].(*dns.TXT).Txt, " ")
+	if !strings.HasPrefix(txt, "version=v1.2.3 uptime=") || !strings.HasSuffix(txt, " pool=5/254") {
+		t.Errorf("unexpected status record: %q", txt)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 0 {
+		t.Errorf("status record TTL is %d", ttl)
+	}
+
+	resp = exchange(dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Errorf("expected NODATA for A query, got %v", resp)
+	}
+	if calls := mapper.calls.Load(); calls != 0 {
+		t.Errorf("status name was mapped")
+	}
+}
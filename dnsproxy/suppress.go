@@ -0,0 +1,102 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// AAAAPolicy selects how AAAA queries are answered.
+type AAAAPolicy int
+
+const (
+	// AAAAAllow answers AAAA queries as usual: mapped domains get paired
+	// addresses, other domains get upstream answers.
+	AAAAAllow AAAAPolicy = iota
+	// AAAANoData answers AAAA queries with NODATA, so clients use IPv4.
+	AAAANoData
+	// AAAANXDomain answers AAAA queries with NXDOMAIN. Some clients give
+	// up on NODATA slower, but resolvers may apply NXDOMAIN to all types
+	// of the name (RFC 8020), so it's only safe for clients querying
+	// dns44 directly.
+	AAAANXDomain
+)
+
+var aaaaPolicyNames = map[AAAAPolicy]string{
+	AAAAAllow:    "off",
+	AAAANoData:   "nodata",
+	AAAANXDomain: "nxdomain",
+}
+
+func (p AAAAPolicy) String() string {
+	if name, ok := aaaaPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("AAAAPolicy(%d)", int(p))
+}
+
+// ParseAAAAPolicy parses policy name: off, nodata or nxdomain.
+func ParseAAAAPolicy(name string) (AAAAPolicy, error) {
+	for policy, policyName := range aaaaPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown AAAA policy %q", name)
+}
+
+// aaaaPolicies picks AAAA policy for domain. Most specific rule wins.
+type aaaaPolicies struct {
+	fallback AAAAPolicy
+	rules    map[string]AAAAPolicy
+}
+
+// newAAAAPolicies parses rules in DOMAIN=POLICY format. Rules apply to
+// subdomains as well.
+func newAAAAPolicies(fallback AAAAPolicy, specs []string) (*aaaaPolicies, error) {
+	p := &aaaaPolicies{
+		fallback: fallback,
+		rules:    make(map[string]AAAAPolicy),
+	}
+	for _, spec := range specs {
+		rawName, policyName, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("rule %q is not in DOMAIN=POLICY format", spec)
+		}
+		name := normalizeName(rawName)
+		if name == "" && strings.TrimSpace(rawName) != "." {
+			return nil, fmt.Errorf("empty domain in rule %q", spec)
+		}
+		policy, err := ParseAAAAPolicy(strings.TrimSpace(policyName))
+		if err != nil {
+			return nil, fmt.Errorf("bad rule %q: %w", spec, err)
+		}
+		p.rules[name] = policy
+	}
+	return p, nil
+}
+
+func (p *aaaaPolicies) policy(domainName string) AAAAPolicy {
+	for name := domainName; ; {
+		if policy, ok := p.rules[name]; ok {
+			return policy
+		}
+		if name == "" {
+			return p.fallback
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
+
+// suppressAAAA answers AAAA query according to policy.
+func (d *DNSProxy) suppressAAAA(ctx *proxy.DNSContext, policy AAAAPolicy) {
+	resp := new(dns.Msg)
+	resp.SetReply(ctx.Req)
+	if policy == AAAANXDomain {
+		resp.Rcode = dns.RcodeNameError
+	}
+	resp.Ns = []dns.RR{d.negativeSOA(ctx.Req.Question[0].Name)}
+	ctx.Res = resp
+}
@@ -0,0 +1,86 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Snawoot/dns44/pool"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestAAAAPolicies(t *testing.T) {
+	p, err := newAAAAPolicies(AAAANoData, []string{"example.com=nxdomain", "open.example.com=off"})
+	if err != nil {
+		t.Fatalf("newAAAAPolicies failed: %v", err)
+	}
+	for name, want := range map[string]AAAAPolicy{
+		"example.org":          AAAANoData,
+		"example.com":          AAAANXDomain,
+		"www.example.com":      AAAANXDomain,
+		"open.example.com":     AAAAAllow,
+		"www.open.example.com": AAAAAllow,
+	} {
+		if got := p.policy(name); got != want {
+			t.Errorf("policy(%q) = %v, expected %v", name, got, want)
+		}
+	}
+	for _, spec := range []string{"example.com", "example.com=bogus", "=nodata"} {
+		if _, err := newAAAAPolicies(AAAAAllow, []string{spec}); err == nil {
+			t.Errorf("bad rule %q accepted", spec)
+		}
+	}
+}
+
+func TestSuppressAAAA(t *testing.T) {
+	pair6, err := pool.NewPair6(netip.MustParsePrefix("fd44::/96"))
+	if err != nil {
+		t.Fatalf("NewPair6 failed: %v", err)
+	}
+	d := startProxy(t, &Config{
+		Mapper:            new(countingMapper),
+		Pair6:             pair6,
+		NeverMap:          []string{"example.com"},
+		SuppressAAAA:      AAAANoData,
+		SuppressAAAARules: []string{"bad.example.org=nxdomain", "open.example.org=off"},
+	}, new(atomic.Int32))
+
+	for _, tc := range []struct {
+		name    string
+		qType   uint16
+		rcode   int
+		answers []uint16
+	}{
+		{"example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"example.org.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"bad.example.org.", dns.TypeAAAA, dns.RcodeNameError, nil},
+		{"open.example.org.", dns.TypeAAAA, dns.RcodeSuccess, []uint16{dns.TypeAAAA}},
+		{"example.org.", dns.TypeANY, dns.RcodeSuccess, []uint16{dns.TypeA}},
+		{"open.example.org.", dns.TypeANY, dns.RcodeSuccess, []uint16{dns.TypeA, dns.TypeAAAA}},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qType)
+		resp, err := dns.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		var types []uint16
+		for _, rr := range resp.Answer {
+			types = append(types, rr.Header().Rrtype)
+		}
+		if resp.Rcode != tc.rcode || len(types) != len(tc.answers) {
+			t.Errorf("%s %s: got %s with answers %v", dns.TypeToString[tc.qType], tc.name, dns.RcodeToString[resp.Rcode], resp.Answer)
+			continue
+		}
+		for i := range types {
+			if types[i] != tc.answers[i] {
+				t.Errorf("%s %s: unexpected answers %v", dns.TypeToString[tc.qType], tc.name, resp.Answer)
+			}
+		}
+		if len(types) == 0 && len(resp.Ns) != 1 {
+			t.Errorf("%s %s: negative answer without SOA", dns.TypeToString[tc.qType], tc.name)
+		}
+	}
+}
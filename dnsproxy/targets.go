@@ -0,0 +1,37 @@
+package dnsproxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// stripTargetAddrs removes address records of SRV and NAPTR targets from
+// additional section of resp. It makes clients resolve targets on their
+// own, which gets them mapped addresses.
+func stripTargetAddrs(resp *dns.Msg) {
+	targets := make(map[string]struct{})
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Extra} {
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.SRV:
+				targets[normalizeName(rr.Target)] = struct{}{}
+			case *dns.NAPTR:
+				targets[normalizeName(rr.Replacement)] = struct{}{}
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			if _, ok := targets[normalizeName(rr.Header().Name)]; ok {
+				continue
+			}
+		}
+		extra = append(extra, rr)
+	}
+	resp.Extra = extra
+}
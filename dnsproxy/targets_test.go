@@ -0,0 +1,37 @@
+package dnsproxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStripTargetAddrs(t *testing.T) {
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("bad RR %q: %v", s, err)
+		}
+		return rr
+	}
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{
+		mustRR("_sip._tcp.example.com. 300 IN SRV 10 0 5060 sip.example.com."),
+		mustRR("example.com. 300 IN NAPTR 10 0 \"s\" \"SIP+D2T\" \"\" _sip._tcp.example.com."),
+	}
+	resp.Extra = []dns.RR{
+		mustRR("sip.example.com. 300 IN A 192.0.2.1"),
+		mustRR("SIP.example.com. 300 IN AAAA 2001:db8::1"),
+		mustRR("other.example.com. 300 IN A 192.0.2.2"),
+		mustRR("sip.example.com. 300 IN TXT \"keep\""),
+	}
+	stripTargetAddrs(resp)
+	if len(resp.Extra) != 2 {
+		t.Fatalf("unexpected additional section after strip: %v", resp.Extra)
+	}
+	for _, rr := range resp.Extra {
+		if rr.Header().Name == "sip.example.com." && rr.Header().Rrtype != dns.TypeTXT {
+			t.Errorf("target address record was kept: %v", rr)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// transferChunk is the number of records per message of zone transfer.
+const transferChunk = 128
+
+// MappingWalker is implemented by mappers able to list their mappings. It's
+// required to serve zone transfers.
+type MappingWalker interface {
+	WalkMappings(fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error
+}
+
+// transferAllowed reports whether client may transfer zones.
+func (d *DNSProxy) transferAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range d.transferClients {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTransfer answers AXFR and IXFR queries for reverse zone with PTR
+// records of mappings of all clients. IXFR gets full zone, as RFC 1995
+// allows. Transfer is written to connection directly, as it may take
+// several messages, and ctx.Res is left nil, so connection gets closed.
+func (d *DNSProxy) serveTransfer(ctx *proxy.DNSContext, zone *reverseZone, client netip.Addr) (string, error) {
+	refuse := func(reason string) (string, error) {
+		ctx.Res = new(dns.Msg).SetRcode(ctx.Req, dns.RcodeRefused)
+		return "REFUSED (" + reason + ")", nil
+	}
+	switch {
+	case !d.transferAllowed(client):
+		return refuse("transfer not allowed")
+	case normalizeName(ctx.Req.Question[0].Name) != zone.name:
+		return refuse("not authoritative")
+	case ctx.Proto != proxy.ProtoTCP || ctx.Conn == nil:
+		return refuse("transfer requires TCP")
+	}
+
+	ttl := d.ttl.Load()
+	soa := d.negativeSOA(zone.name + ".")
+	// Mappings change all the time, so each transfer is a new version.
+	soa.Serial = uint32(time.Now().Unix())
+	records := []dns.RR{soa, &dns.NS{
+		Hdr: dns.RR_Header{Name: zone.name + ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+		Ns:  d.soa.Ns,
+	}}
+
+	type ptr struct {
+		addr       netip.Addr
+		domainName string
+	}
+	seen := make(map[ptr]bool)
+	var ptrs []ptr
+	err := d.mapper.(MappingWalker).WalkMappings(func(clientKey, domainName string, addr netip.Addr, expire time.Time) {
+		p := ptr{addr, dns.Fqdn(domainName)}
+		if seen[p] || !zone.contains(addr) {
+			return
+		}
+		seen[p] = true
+		ptrs = append(ptrs, p)
+		if d.pair6 != nil {
+			p6 := ptr{d.pair6.To6(addr), p.domainName}
+			if zone.contains(p6.addr) && !seen[p6] {
+				seen[p6] = true
+				ptrs = append(ptrs, p6)
+			}
+		}
+	})
+	if err != nil {
+		return "", fmt.Errorf("can't list mappings: %w", err)
+	}
+	sort.Slice(ptrs, func(i, j int) bool {
+		if ptrs[i].addr != ptrs[j].addr {
+			return ptrs[i].addr.Less(ptrs[j].addr)
+		}
+		return ptrs[i].domainName < ptrs[j].domainName
+	})
+	for _, p := range ptrs {
+		name, err := dns.ReverseAddr(p.addr.String())
+		if err != nil {
+			continue
+		}
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: p.domainName,
+		})
+	}
+	records = append(records, soa)
+
+	for start := 0; start < len(records); start += transferChunk {
+		end := start + transferChunk
+		if end > len(records) {
+			end = len(records)
+		}
+		msg := new(dns.Msg)
+		msg.SetReply(ctx.Req)
+		msg.Authoritative = true
+		msg.Compress = true
+		msg.Answer = records[start:end]
+		if err := writeTCPMsg(ctx.Conn, msg); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d records (zone transfer)", len(records)), nil
+}
+
+// contains reports whether address belongs to zone.
+func (z *reverseZone) contains(addr netip.Addr) bool {
+	for _, prefix := range z.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTCPMsg writes length-prefixed message to DNS over TCP connection.
+func writeTCPMsg(conn net.Conn, msg *dns.Msg) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 2)
+	binary.BigEndian.PutUint16(prefix, uint16(len(packed)))
+	_, err = (&net.Buffers{prefix, packed}).WriteTo(conn)
+	return err
+}
@@ -0,0 +1,93 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// walkingMapper lists the same mapping for two clients and one mapping
+// outside of reverse zones.
+type walkingMapper struct {
+	countingMapper
+}
+
+func (m *walkingMapper) WalkMappings(fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error {
+	expire := time.Now().Add(time.Minute)
+	fn("10.0.0.1", "example.com", netip.MustParseAddr("172.24.0.1"), expire)
+	fn("10.0.0.2", "example.com", netip.MustParseAddr("172.24.0.1"), expire)
+	fn("10.0.0.2", "example.org", netip.MustParseAddr("172.24.0.2"), expire)
+	fn("10.0.0.2", "example.net", netip.MustParseAddr("10.0.0.1"), expire)
+	return nil
+}
+
+func TestZoneTransfer(t *testing.T) {
+	d := startProxy(t, &Config{
+		Mapper:          new(walkingMapper),
+		ReverseZones:    []netip.Prefix{netip.MustParsePrefix("172.24.0.0/16")},
+		TransferClients: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetAxfr("24.172.in-addr.arpa.")
+	tr := new(dns.Transfer)
+	envelopes, err := tr.In(req, d.proxy.Addr(proxy.ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	var records []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			t.Fatalf("transfer failed: %v", e.Error)
+		}
+		records = append(records, e.RR...)
+	}
+	var ptrs []string
+	for _, rr := range records {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			ptrs = append(ptrs, ptr.Hdr.Name+" "+ptr.Ptr)
+		}
+	}
+	expected := []string{"1.0.24.172.in-addr.arpa. example.com.", "2.0.24.172.in-addr.arpa. example.org."}
+	if len(ptrs) != len(expected) || ptrs[0] != expected[0] || ptrs[1] != expected[1] {
+		t.Errorf("transferred PTR records %v, expected %v", ptrs, expected)
+	}
+	if len(records) != len(expected)+3 {
+		t.Errorf("transfer has %d records, expected SOA, NS, PTRs and SOA", len(records))
+	}
+
+	udpClient := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	resp, _, err := udpClient.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("transfer over UDP got %v, %v; expected REFUSED", resp, err)
+	}
+}
+
+func TestZoneTransferRefused(t *testing.T) {
+	d := startProxy(t, &Config{
+		Mapper:          new(walkingMapper),
+		ReverseZones:    []netip.Prefix{netip.MustParsePrefix("172.24.0.0/16")},
+		TransferClients: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+	}, new(atomic.Int32))
+
+	req := new(dns.Msg)
+	req.SetAxfr("24.172.in-addr.arpa.")
+	client := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(req, d.proxy.Addr(proxy.ProtoTCP).String())
+	if err != nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("transfer from foreign client got %v, %v; expected REFUSED", resp, err)
+	}
+
+	if _, err := New(&Config{
+		Upstream:        "127.0.0.1:53",
+		ListenAddr:      netip.MustParseAddrPort("127.0.0.1:0"),
+		Mapper:          new(countingMapper),
+		TransferClients: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}); err == nil {
+		t.Error("transfers enabled with mapper unable to list mappings")
+	}
+}
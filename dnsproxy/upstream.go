@@ -0,0 +1,125 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+const (
+	// DefaultUpstreamTimeout is the upstream query timeout. It's below
+	// usual client timeout, so clients get an answer from other upstream
+	// or retry instead of waiting in vain.
+	DefaultUpstreamTimeout = 4 * time.Second
+	// DefaultRetryBackoff is the delay before first retry of failed
+	// passthrough query. It doubles with each retry.
+	DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// timeoutSuffix introduces upstream-specific timeout, e.g.
+// "tls://1.1.1.1#timeout=2s".
+const timeoutSuffix = "#timeout="
+
+// parseUpstream parses upstreams separated by commas or spaces. Upstreams
+// without own timeout get the timeout given.
+func parseUpstream(upstreams string, timeout time.Duration) (*proxy.UpstreamConfig, error) {
+	if timeout <= 0 {
+		timeout = DefaultUpstreamTimeout
+	}
+	entries := strings.FieldsFunc(upstreams, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+
+	// Upstreams are parsed in groups by timeout, because options apply to
+	// whole parse call.
+	var timeouts []time.Duration
+	groups := make(map[time.Duration][]string)
+	for _, entry := range entries {
+		entryTimeout := timeout
+		if addr, rawTimeout, ok := strings.Cut(entry, timeoutSuffix); ok {
+			var err error
+			entryTimeout, err = time.ParseDuration(rawTimeout)
+			if err != nil || entryTimeout <= 0 {
+				return nil, fmt.Errorf("bad timeout of upstream %s", entry)
+			}
+			entry = addr
+		}
+		if _, ok := groups[entryTimeout]; !ok {
+			timeouts = append(timeouts, entryTimeout)
+		}
+		groups[entryTimeout] = append(groups[entryTimeout], entry)
+	}
+
+	var res *proxy.UpstreamConfig
+	for _, groupTimeout := range timeouts {
+		upstreamCfg, err := proxy.ParseUpstreamsConfig(groups[groupTimeout], &upstream.Options{
+			Timeout: groupTimeout,
+		})
+		if err != nil {
+			if res != nil {
+				res.Close()
+			}
+			return nil, fmt.Errorf("failed to parse upstream %s: %w", upstreams, err)
+		}
+		if res == nil {
+			res = upstreamCfg
+			continue
+		}
+		mergeUpstreams(res, upstreamCfg)
+	}
+	if res == nil {
+		return nil, fmt.Errorf("no upstreams in %q", upstreams)
+	}
+	return res, nil
+}
+
+// mergeUpstreams appends upstreams of src to dst.
+func mergeUpstreams(dst, src *proxy.UpstreamConfig) {
+	dst.Upstreams = append(dst.Upstreams, src.Upstreams...)
+	mergeLists := func(dst *map[string][]upstream.Upstream, src map[string][]upstream.Upstream) {
+		if *dst == nil && len(src) > 0 {
+			*dst = make(map[string][]upstream.Upstream, len(src))
+		}
+		for domain, list := range src {
+			(*dst)[domain] = append((*dst)[domain], list...)
+		}
+	}
+	mergeLists(&dst.DomainReservedUpstreams, src.DomainReservedUpstreams)
+	mergeLists(&dst.SpecifiedDomainUpstreams, src.SpecifiedDomainUpstreams)
+	if src.SubdomainExclusions != nil {
+		if dst.SubdomainExclusions == nil {
+			dst.SubdomainExclusions = stringutil.NewSet()
+		}
+		src.SubdomainExclusions.Range(func(s string) bool {
+			dst.SubdomainExclusions.Add(s)
+			return true
+		})
+	}
+}
+
+// resolve passes query to upstreams, retrying failed attempts with
+// exponential backoff. Pending retry is abandoned once proxy is closed.
+func (d *DNSProxy) resolve(p *proxy.Proxy, ctx *proxy.DNSContext) error {
+	delay := d.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.Resolve(ctx)
+		if err == nil || attempt >= d.retries {
+			return err
+		}
+		log.Printf("upstream query %s failed, retrying in %v: %v", d.logName(ctx.Req.Question[0].Name), delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-d.stop:
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
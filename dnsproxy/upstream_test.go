@@ -0,0 +1,123 @@
+package dnsproxy
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func TestParseUpstream(t *testing.T) {
+	upstreamCfg, err := parseUpstream("1.1.1.1, 8.8.8.8#timeout=2s [/example.org/]9.9.9.9#timeout=2s", 0)
+	if err != nil {
+		t.Fatalf("parseUpstream failed: %v", err)
+	}
+	defer upstreamCfg.Close()
+	if len(upstreamCfg.Upstreams) != 2 {
+		t.Errorf("expected 2 default upstreams, got %v", upstreamCfg.Upstreams)
+	}
+	if list := upstreamCfg.DomainReservedUpstreams["example.org."]; len(list) != 1 {
+		t.Errorf("expected 1 upstream reserved for example.org, got %v", list)
+	}
+
+	for _, bad := range []string{"", "1.1.1.1#timeout=", "1.1.1.1#timeout=-1s", "1.1.1.1#timeout=soon"} {
+		if upstreamCfg, err := parseUpstream(bad, 0); err == nil {
+			upstreamCfg.Close()
+			t.Errorf("bad upstream %q accepted", bad)
+		}
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var queries atomic.Int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		// Drop first query, so it times out.
+		if queries.Add(1) == 1 {
+			return
+		}
+		w.WriteMsg(new(dns.Msg).SetReply(req))
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen UDP: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	d, err := New(&Config{
+		ListenAddr:           netip.MustParseAddrPort("127.0.0.1:0"),
+		Upstream:             pc.LocalAddr().String(),
+		UpstreamTimeout:      200 * time.Millisecond,
+		UpstreamRetries:      1,
+		UpstreamRetryBackoff: time.Millisecond,
+		Mapper:               new(countingMapper),
+		TTL:                  60,
+	})
+	if err != nil {
+		t.Fatalf("can't create proxy: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("can't start proxy: %v", err)
+	}
+	defer d.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeMX)
+	client := &dns.Client{Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(req, d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("query wasn't retried: got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, expected 2", n)
+	}
+}
+
+func TestUpstreamRetryInterrupted(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen UDP: %v", err)
+	}
+	defer pc.Close()
+
+	d, err := New(&Config{
+		ListenAddr:           netip.MustParseAddrPort("127.0.0.1:0"),
+		Upstream:             pc.LocalAddr().String(),
+		UpstreamTimeout:      50 * time.Millisecond,
+		UpstreamRetries:      1,
+		UpstreamRetryBackoff: time.Hour,
+		Mapper:               new(countingMapper),
+		TTL:                  60,
+	})
+	if err != nil {
+		t.Fatalf("can't create proxy: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("can't start proxy: %v", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeMX)
+	done := make(chan error, 1)
+	go func() {
+		done <- d.resolve(d.proxy, &proxy.DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	d.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("query without upstream response succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry backoff wasn't interrupted by Close")
+	}
+}
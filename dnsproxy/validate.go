@@ -0,0 +1,139 @@
+package dnsproxy
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Lengths of COOKIE option data (RFC 7873, section 4).
+const (
+	clientCookieLen    = 8
+	minServerCookie    = 8
+	maxServerCookie    = 32
+	cookieOptionMaxLen = clientCookieLen + maxServerCookie
+)
+
+// validateRequest is a [proxy.BeforeRequestHandler] implementation. It
+// answers queries request handler can't serve with proper error, so the
+// handler always gets a query with single question. Cookies of valid queries
+// are removed: dns44 doesn't implement server cookies, and client cookies
+// mustn't be passed to upstreams (RFC 7873, section 5.4).
+func (d *DNSProxy) validateRequest(p *proxy.Proxy, ctx *proxy.DNSContext) (bool, error) {
+	rcode, reason := checkRequest(ctx.Req)
+	if rcode == dns.RcodeSuccess {
+		stripCookies(ctx.Req)
+		return true, nil
+	}
+	ctx.Res = errorResponse(ctx.Req, rcode)
+	if len(ctx.Req.Question) != 1 {
+		// Proxy answers anything without single question with SERVFAIL,
+		// replacing our response, so it gets placeholder question instead.
+		ctx.Req = &dns.Msg{
+			MsgHdr:   ctx.Req.MsgHdr,
+			Question: []dns.Question{{Name: ".", Qtype: dns.TypeNone, Qclass: dns.ClassINET}},
+		}
+	}
+	d.queryLog.Printf("DNS %s malformed query => %s (%s)", ctx.Addr, dns.RcodeToString[rcode], reason)
+	return true, nil
+}
+
+// checkRequest returns error code query has to be answered with and its
+// reason. Code is RcodeSuccess if query is fine.
+func checkRequest(req *dns.Msg) (int, string) {
+	if req.Opcode != dns.OpcodeQuery {
+		return dns.RcodeNotImplemented, fmt.Sprintf("opcode %s", opcodeString(req.Opcode))
+	}
+	if len(req.Question) != 1 {
+		return dns.RcodeFormatError, fmt.Sprintf("%d questions", len(req.Question))
+	}
+	var opt *dns.OPT
+	for _, rr := range req.Extra {
+		if o, ok := rr.(*dns.OPT); ok {
+			if opt != nil {
+				return dns.RcodeFormatError, "multiple OPT records"
+			}
+			opt = o
+		}
+	}
+	if opt == nil {
+		return dns.RcodeSuccess, ""
+	}
+	if opt.Hdr.Name != "." {
+		return dns.RcodeFormatError, "OPT record owner isn't root"
+	}
+	if opt.Version() != 0 {
+		return dns.RcodeBadVers, fmt.Sprintf("EDNS version %d", opt.Version())
+	}
+	cookies := 0
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		if cookies++; cookies > 1 {
+			return dns.RcodeFormatError, "multiple cookies"
+		}
+		if !validCookie(cookie) {
+			return dns.RcodeFormatError, "malformed cookie"
+		}
+	}
+	return dns.RcodeSuccess, ""
+}
+
+// validCookie reports whether COOKIE option is either sole client cookie or
+// client cookie followed by server cookie of allowed length.
+func validCookie(cookie *dns.EDNS0_COOKIE) bool {
+	// Option keeps data hex-encoded.
+	size := len(cookie.Cookie) / 2
+	if len(cookie.Cookie)%2 != 0 {
+		return false
+	}
+	return size == clientCookieLen ||
+		size >= clientCookieLen+minServerCookie && size <= cookieOptionMaxLen
+}
+
+// errorResponse makes response with error code to query. It carries OPT
+// record if query has valid one, as required to signal BADVERS.
+func errorResponse(req *dns.Msg, rcode int) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	if len(req.Question) != 1 {
+		resp.Question = nil
+	}
+	opts := 0
+	for _, rr := range req.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			opts++
+		}
+	}
+	if opt := req.IsEdns0(); opts == 1 && opt != nil && opt.Hdr.Name == "." {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return resp
+}
+
+// stripCookies removes COOKIE options from message.
+func stripCookies(msg *dns.Msg) {
+	for _, rr := range msg.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		kept := opt.Option[:0]
+		for _, o := range opt.Option {
+			if o.Option() != dns.EDNS0COOKIE {
+				kept = append(kept, o)
+			}
+		}
+		opt.Option = kept
+	}
+}
+
+func opcodeString(opcode int) string {
+	if s, ok := dns.OpcodeToString[opcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("%d", opcode)
+}
@@ -0,0 +1,185 @@
+package dnsproxy
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+func withCookie(req *dns.Msg, cookie string) *dns.Msg {
+	if req.IsEdns0() == nil {
+		req.SetEdns0(1232, false)
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return req
+}
+
+func TestCheckRequest(t *testing.T) {
+	query := func() *dns.Msg {
+		return new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	}
+	clientCookie := "0102030405060708"
+	for _, tc := range []struct {
+		name  string
+		req   *dns.Msg
+		rcode int
+	}{
+		{"plain", query(), dns.RcodeSuccess},
+		{"EDNS", query().SetEdns0(1232, true), dns.RcodeSuccess},
+		{"no question", &dns.Msg{}, dns.RcodeFormatError},
+		{"two questions", func() *dns.Msg {
+			req := query()
+			req.Question = append(req.Question, req.Question[0])
+			return req
+		}(), dns.RcodeFormatError},
+		{"two OPT", func() *dns.Msg {
+			req := query().SetEdns0(1232, false)
+			req.Extra = append(req.Extra, req.Extra[0])
+			return req
+		}(), dns.RcodeFormatError},
+		{"EDNS version 1", func() *dns.Msg {
+			req := query().SetEdns0(1232, false)
+			req.IsEdns0().SetVersion(1)
+			return req
+		}(), dns.RcodeBadVers},
+		{"client cookie", withCookie(query(), clientCookie), dns.RcodeSuccess},
+		{"server cookie", withCookie(query(), clientCookie+strings.Repeat("ab", 16)), dns.RcodeSuccess},
+		{"short cookie", withCookie(query(), "0102"), dns.RcodeFormatError},
+		{"short server cookie", withCookie(query(), clientCookie+"0102"), dns.RcodeFormatError},
+		{"long server cookie", withCookie(query(), clientCookie+strings.Repeat("ab", 33)), dns.RcodeFormatError},
+		{"two cookies", withCookie(withCookie(query(), clientCookie), clientCookie), dns.RcodeFormatError},
+		{"notify", func() *dns.Msg {
+			req := query()
+			req.Opcode = dns.OpcodeNotify
+			return req
+		}(), dns.RcodeNotImplemented},
+	} {
+		if rcode, reason := checkRequest(tc.req); rcode != tc.rcode {
+			t.Errorf("%s: got %s (%s), expected %s", tc.name,
+				dns.RcodeToString[rcode], reason, dns.RcodeToString[tc.rcode])
+		}
+	}
+}
+
+func TestCookieStripped(t *testing.T) {
+	d := startProxy(t, &Config{Mapper: new(countingMapper)}, new(atomic.Int32))
+	ctx := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Req:   withCookie(new(dns.Msg).SetQuestion("example.com.", dns.TypeMX), "0102030405060708"),
+		Addr:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53},
+	}
+	if ok, err := d.validateRequest(d.proxy, ctx); !ok || err != nil || ctx.Res != nil {
+		t.Fatalf("valid query rejected: %v %v %v", ok, err, ctx.Res)
+	}
+	if hasOption(ctx.Req.IsEdns0(), dns.EDNS0COOKIE) {
+		t.Error("cookie is kept in forwarded query")
+	}
+}
+
+// exchangeRaw sends packet to proxy over UDP and returns unpacked response.
+func exchangeRaw(t testing.TB, d *DNSProxy, packet []byte) (*dns.Msg, error) {
+	conn, err := net.Dial("udp", d.proxy.Addr(proxy.ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("can't dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	return resp, resp.Unpack(buf[:n])
+}
+
+func TestMalformedQueries(t *testing.T) {
+	d := startProxy(t, &Config{Mapper: new(countingMapper)}, new(atomic.Int32))
+	for _, tc := range []struct {
+		name  string
+		req   *dns.Msg
+		rcode int
+	}{
+		{"no question", &dns.Msg{MsgHdr: dns.MsgHdr{Id: 1}}, dns.RcodeFormatError},
+		{"two questions", &dns.Msg{
+			MsgHdr: dns.MsgHdr{Id: 2},
+			Question: []dns.Question{
+				{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+		}, dns.RcodeFormatError},
+		{"EDNS version 1", func() *dns.Msg {
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).SetEdns0(1232, false)
+			req.IsEdns0().SetVersion(1)
+			return req
+		}(), dns.RcodeBadVers},
+	} {
+		packet, err := tc.req.Pack()
+		if err != nil {
+			t.Fatalf("%s: can't pack query: %v", tc.name, err)
+		}
+		resp, err := exchangeRaw(t, d, packet)
+		if err != nil {
+			t.Fatalf("%s: exchange failed: %v", tc.name, err)
+		}
+		if resp.Id != tc.req.Id || resp.Rcode != tc.rcode {
+			t.Errorf("%s: got %s with id %d, expected %s with id %d", tc.name,
+				dns.RcodeToString[resp.Rcode], resp.Id, dns.RcodeToString[tc.rcode], tc.req.Id)
+		}
+		if tc.rcode == dns.RcodeBadVers && (resp.IsEdns0() == nil || resp.IsEdns0().Version() != 0) {
+			t.Errorf("%s: BADVERS without OPT of version 0", tc.name)
+		}
+	}
+}
+
+func FuzzRequestHandler(f *testing.F) {
+	for _, req := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeMX).SetEdns0(1232, true),
+		withCookie(new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA), "0102030405060708"),
+		withCookie(new(dns.Msg).SetQuestion("example.com.", dns.TypeA), "01"),
+		{Question: []dns.Question{
+			{Name: "a.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "b.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		}},
+		{},
+	} {
+		packet, err := req.Pack()
+		if err != nil {
+			f.Fatalf("can't pack seed: %v", err)
+		}
+		f.Add(packet)
+	}
+	d := startProxy(f, &Config{Mapper: new(countingMapper)}, new(atomic.Int32))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		req := new(dns.Msg)
+		if req.Unpack(packet) != nil || req.Response {
+			// Proxy drops these.
+			return
+		}
+		resp, err := exchangeRaw(t, d, packet)
+		if err != nil {
+			t.Fatalf("no valid response to %v: %v", req, err)
+		}
+		if resp.Id != req.Id {
+			t.Errorf("response id %d, expected %d", resp.Id, req.Id)
+		}
+		if len(req.Question) != 1 && resp.Rcode != dns.RcodeFormatError &&
+			resp.Rcode != dns.RcodeNotImplemented {
+			t.Errorf("got %s to query with %d questions", dns.RcodeToString[resp.Rcode], len(req.Question))
+		}
+		if opt := resp.IsEdns0(); opt != nil && hasOption(opt, dns.EDNS0COOKIE) {
+			t.Error("response carries cookie")
+		}
+	})
+}
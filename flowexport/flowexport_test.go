@@ -0,0 +1,121 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFlow = Flow{
+	Network:     "tcp",
+	Source:      netip.MustParseAddrPort("10.0.0.1:40000"),
+	Destination: netip.MustParseAddrPort("172.24.0.1:443"),
+	Host:        "example.org",
+}
+
+func TestTable(t *testing.T) {
+	table := NewTable()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	table.now = func() time.Time { return now }
+	var ended []Record
+	table.sink = func(rec Record) { ended = append(ended, rec) }
+
+	id := new(int)
+	table.AddTraffic(id, testFlow, 100, 0)
+	table.AddTraffic(id, testFlow, 0, 5000)
+	var buf strings.Builder
+	table.WriteConntrack(&buf)
+	expected := "tcp      6 0 src=10.0.0.1 dst=172.24.0.1 sport=40000 dport=443 bytes=100 src=172.24.0.1 dst=10.0.0.1 sport=443 dport=40000 bytes=5000 host=example.org\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected conntrack output:\n%s", buf.String())
+	}
+
+	if recs := table.Expire(time.Minute); len(recs) != 0 {
+		t.Errorf("flow must not expire yet, got %+v", recs)
+	}
+	now = now.Add(time.Minute)
+	recs := table.Expire(time.Minute)
+	if len(recs) != 1 || recs[0].Sent != 100 || recs[0].Received != 5000 || recs[0].Ended {
+		t.Fatalf("unexpected active records %+v", recs)
+	}
+	table.AddTraffic(id, testFlow, 7, 0)
+	now = now.Add(time.Second)
+	table.End(id)
+	table.End(id)
+	if len(ended) != 1 || ended[0].Sent != 7 || ended[0].Received != 0 || !ended[0].Ended || ended[0].End.Sub(ended[0].Start) != time.Second {
+		t.Errorf("unexpected final records %+v", ended)
+	}
+
+	var nilTable *Table
+	nilTable.AddTraffic(id, testFlow, 1, 1)
+	nilTable.End(id)
+}
+
+func TestExporter(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	table := NewTable()
+	exporter, err := NewExporter(table, collector.LocalAddr().String(), 7, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := new(int)
+	table.AddTraffic(id, testFlow, 100, 5000)
+	table.End(id)
+	v6 := testFlow
+	v6.Destination = netip.MustParseAddrPort("[fd44::1]:443")
+	table.AddTraffic(&v6, v6, 1, 2)
+	table.End(&v6)
+	exporter.Close()
+
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := make([]byte, 65535)
+	n, _, err := collector.ReadFrom(msg)
+	if err != nil {
+		t.Fatalf("no IPFIX message received: %v", err)
+	}
+	msg = msg[:n]
+	if binary.BigEndian.Uint16(msg) != ipfixVersion || int(binary.BigEndian.Uint16(msg[2:])) != n ||
+		binary.BigEndian.Uint32(msg[8:]) != 0 || binary.BigEndian.Uint32(msg[12:]) != 7 {
+		t.Fatalf("bad message header %x", msg[:16])
+	}
+	sets := make(map[uint16][]byte)
+	for rest := msg[16:]; len(rest) > 0; {
+		id, length := binary.BigEndian.Uint16(rest), int(binary.BigEndian.Uint16(rest[2:]))
+		if length < 4 || length > len(rest) {
+			t.Fatalf("bad set length %d", length)
+		}
+		sets[id] = rest[4:length]
+		rest = rest[length:]
+	}
+	if _, ok := sets[templateSetID]; !ok {
+		t.Error("templates missing")
+	}
+	v4 := sets[templateIPv4]
+	if len(v4) != 2*templateLength(ipv4Fields) {
+		t.Fatalf("expected 2 IPv4 records, got %d bytes", len(v4))
+	}
+	if src := netip.AddrFrom4([4]byte(v4[0:4])); src != testFlow.Source.Addr() {
+		t.Errorf("unexpected source address %s", src)
+	}
+	if octets := binary.BigEndian.Uint64(v4[13:]); octets != 100 {
+		t.Errorf("unexpected forward octets %d", octets)
+	}
+	reverse := v4[templateLength(ipv4Fields):]
+	if src := netip.AddrFrom4([4]byte(reverse[0:4])); src != testFlow.Destination.Addr() {
+		t.Errorf("unexpected reverse source address %s", src)
+	}
+	if octets := binary.BigEndian.Uint64(reverse[13:]); octets != 5000 {
+		t.Errorf("unexpected reverse octets %d", octets)
+	}
+	if len(sets[templateIPv6]) != 2*templateLength(ipv6Fields) {
+		t.Errorf("expected 2 IPv6 records, got %d bytes", len(sets[templateIPv6]))
+	}
+}
@@ -0,0 +1,260 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultActiveTimeout is the default interval of records for
+	// long-lived flows.
+	DefaultActiveTimeout = time.Minute
+	// templateRefresh is the interval templates are resent at, so
+	// collectors which restarted learn them again.
+	templateRefresh = 5 * time.Minute
+	// maxMessageSize keeps IPFIX messages within typical MTU.
+	maxMessageSize = 1400
+	// flushInterval is how long records wait for batching.
+	flushInterval = time.Second
+
+	ipfixVersion      = 10
+	templateSetID     = 2
+	templateIPv4      = 256
+	templateIPv6      = 257
+	endReasonActive   = 2
+	endReasonFinished = 3
+)
+
+// IPFIX information elements of records, with their lengths.
+var (
+	ipv4Fields = [][2]uint16{
+		{8, 4},  // sourceIPv4Address
+		{12, 4}, // destinationIPv4Address
+	}
+	ipv6Fields = [][2]uint16{
+		{27, 16}, // sourceIPv6Address
+		{28, 16}, // destinationIPv6Address
+	}
+	commonFields = [][2]uint16{
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{1, 8},   // octetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+		{136, 1}, // flowEndReason
+	}
+)
+
+// Exporter sends records of flows from Table to IPFIX collector over UDP.
+// Each flow makes two unidirectional records: from client to destination
+// it connected to and back.
+type Exporter struct {
+	table         *Table
+	conn          net.Conn
+	domainID      uint32
+	activeTimeout time.Duration
+	queue         chan Record
+
+	// fields below are owned by run goroutine. sequence counts data
+	// records sent before current message.
+	sequence     uint32
+	records      uint32
+	templateSent time.Time
+	buf          []byte
+	setStart     int
+	setID        uint16
+
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// NewExporter starts exporting flows of table to collector address.
+// Zero activeTimeout means DefaultActiveTimeout.
+func NewExporter(table *Table, collector string, domainID uint32, activeTimeout time.Duration) (*Exporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	if activeTimeout <= 0 {
+		activeTimeout = DefaultActiveTimeout
+	}
+	e := &Exporter{
+		table:         table,
+		conn:          conn,
+		domainID:      domainID,
+		activeTimeout: activeTimeout,
+		queue:         make(chan Record, 1024),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	table.mux.Lock()
+	table.sink = e.enqueue
+	table.mux.Unlock()
+	go e.run()
+	return e, nil
+}
+
+func (e *Exporter) enqueue(rec Record) {
+	select {
+	case e.queue <- rec:
+	default:
+		log.Printf("IPFIX export queue is full, flow record dropped")
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.stopped)
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	expire := time.NewTicker(e.activeTimeout / 2)
+	defer expire.Stop()
+	for {
+		select {
+		case rec := <-e.queue:
+			e.add(rec)
+		case <-flush.C:
+			e.flush()
+		case <-expire.C:
+			for _, rec := range e.table.Expire(e.activeTimeout) {
+				e.add(rec)
+			}
+		case <-e.done:
+			for {
+				select {
+				case rec := <-e.queue:
+					e.add(rec)
+				default:
+					e.flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func templateLength(addrFields [][2]uint16) int {
+	n := 0
+	for _, f := range append(append([][2]uint16(nil), addrFields...), commonFields...) {
+		n += int(f[1])
+	}
+	return n
+}
+
+func (e *Exporter) add(rec Record) {
+	src, dst := rec.Source, rec.Destination
+	templateID := uint16(templateIPv4)
+	addrFields := ipv4Fields
+	if !src.Addr().Unmap().Is4() || !dst.Addr().Unmap().Is4() {
+		templateID, addrFields = templateIPv6, ipv6Fields
+	}
+	reason := byte(endReasonActive)
+	if rec.Ended {
+		reason = endReasonFinished
+	}
+	e.addRecord(templateID, addrFields, src, dst, rec, rec.Sent, reason)
+	e.addRecord(templateID, addrFields, dst, src, rec, rec.Received, reason)
+}
+
+func (e *Exporter) addRecord(templateID uint16, addrFields [][2]uint16, src, dst netip.AddrPort, rec Record, bytes uint64, reason byte) {
+	if len(e.buf) > 0 && len(e.buf)+templateLength(addrFields) > maxMessageSize {
+		e.flush()
+	}
+	if len(e.buf) == 0 {
+		e.startMessage()
+	}
+	if e.setID != templateID {
+		e.startSet(templateID)
+	}
+	if templateID == templateIPv4 {
+		a, b := src.Addr().Unmap().As4(), dst.Addr().Unmap().As4()
+		e.buf = append(append(e.buf, a[:]...), b[:]...)
+	} else {
+		a, b := src.Addr().As16(), dst.Addr().As16()
+		e.buf = append(append(e.buf, a[:]...), b[:]...)
+	}
+	e.buf = binary.BigEndian.AppendUint16(e.buf, src.Port())
+	e.buf = binary.BigEndian.AppendUint16(e.buf, dst.Port())
+	e.buf = append(e.buf, byte(protocolNumbers[rec.Network]))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, bytes)
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(rec.Start.UnixMilli()))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(rec.End.UnixMilli()))
+	e.buf = append(e.buf, reason)
+	e.records++
+}
+
+// startMessage begins IPFIX message, with templates if they are due.
+func (e *Exporter) startMessage() {
+	e.buf = append(e.buf[:0], make([]byte, 16)...)
+	e.setID = 0
+	if time.Since(e.templateSent) < templateRefresh {
+		return
+	}
+	e.templateSent = time.Now()
+	e.startSet(templateSetID)
+	for _, t := range []struct {
+		id     uint16
+		fields [][2]uint16
+	}{{templateIPv4, ipv4Fields}, {templateIPv6, ipv6Fields}} {
+		fields := append(append([][2]uint16(nil), t.fields...), commonFields...)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, t.id)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(len(fields)))
+		for _, f := range fields {
+			e.buf = binary.BigEndian.AppendUint16(e.buf, f[0])
+			e.buf = binary.BigEndian.AppendUint16(e.buf, f[1])
+		}
+	}
+}
+
+func (e *Exporter) startSet(id uint16) {
+	e.endSet()
+	e.setID = id
+	e.setStart = len(e.buf)
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(e.buf[e.setStart:], id)
+}
+
+func (e *Exporter) endSet() {
+	if e.setID != 0 {
+		binary.BigEndian.PutUint16(e.buf[e.setStart+2:], uint16(len(e.buf)-e.setStart))
+	}
+}
+
+func (e *Exporter) flush() {
+	if len(e.buf) == 0 {
+		return
+	}
+	e.endSet()
+	binary.BigEndian.PutUint16(e.buf[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(e.buf[2:], uint16(len(e.buf)))
+	binary.BigEndian.PutUint32(e.buf[4:], uint32(time.Now().Unix()))
+	binary.BigEndian.PutUint32(e.buf[8:], e.sequence)
+	e.sequence += e.records
+	e.records = 0
+	binary.BigEndian.PutUint32(e.buf[12:], e.domainID)
+	if _, err := e.conn.Write(e.buf); err != nil {
+		log.Printf("IPFIX export failed: %v", err)
+	}
+	e.buf = e.buf[:0]
+	e.setID = 0
+}
+
+// Close sends pending records and stops exporter.
+func (e *Exporter) Close() error {
+	if e == nil {
+		return nil
+	}
+	e.closeOnce.Do(func() {
+		close(e.done)
+		<-e.stopped
+		e.table.mux.Lock()
+		e.table.sink = nil
+		e.table.mux.Unlock()
+	})
+	return e.conn.Close()
+}
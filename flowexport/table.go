@@ -0,0 +1,169 @@
+// Package flowexport tracks proxied flows and exports flow records to IPFIX
+// collectors and in conntrack-like text form.
+package flowexport
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flow describes proxied connection or UDP session.
+type Flow struct {
+	// Network is "tcp" or "udp".
+	Network     string
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+	// Host is the upstream host flow is forwarded to.
+	Host string
+}
+
+type activeFlow struct {
+	Flow
+	start    time.Time
+	sent     atomic.Uint64
+	received atomic.Uint64
+
+	// exported counters are guarded by Table mutex.
+	exportedSent     uint64
+	exportedReceived uint64
+	exportedAt       time.Time
+}
+
+// Record is flow statistics for a time interval.
+type Record struct {
+	Flow
+	Start, End time.Time
+	// Sent and Received are numbers of bytes relayed within interval.
+	Sent, Received uint64
+	// Ended reports whether flow is closed. Records of active flows are
+	// made when active timeout expires.
+	Ended bool
+}
+
+// Table keeps active flows. Flows are identified by arbitrary comparable
+// IDs, such as pointers to connection descriptors. Nil Table tracks
+// nothing.
+type Table struct {
+	now func() time.Time
+	// sink receives records of ended flows.
+	sink func(Record)
+
+	mux   sync.Mutex
+	flows map[interface{}]*activeFlow
+}
+
+func NewTable() *Table {
+	return &Table{
+		now:   time.Now,
+		flows: make(map[interface{}]*activeFlow),
+	}
+}
+
+// AddTraffic counts bytes relayed by flow. Flow is registered on first
+// call, so flows which failed to connect upstream don't linger in table.
+func (t *Table) AddTraffic(id interface{}, flow Flow, sent, received int) {
+	if t == nil {
+		return
+	}
+	t.mux.Lock()
+	f, ok := t.flows[id]
+	if !ok {
+		now := t.now()
+		f = &activeFlow{Flow: flow, start: now, exportedAt: now}
+		t.flows[id] = f
+	}
+	t.mux.Unlock()
+	f.sent.Add(uint64(sent))
+	f.received.Add(uint64(received))
+}
+
+// End removes flow, producing its final record.
+func (t *Table) End(id interface{}) {
+	if t == nil {
+		return
+	}
+	now := t.now()
+	t.mux.Lock()
+	f, ok := t.flows[id]
+	if !ok {
+		t.mux.Unlock()
+		return
+	}
+	delete(t.flows, id)
+	rec := t.recordLocked(f, now)
+	sink := t.sink
+	t.mux.Unlock()
+	rec.Ended = true
+	if sink != nil {
+		sink(rec)
+	}
+}
+
+// Expire returns records of flows which were active for timeout since
+// their last record.
+func (t *Table) Expire(timeout time.Duration) []Record {
+	now := t.now()
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var res []Record
+	for _, f := range t.flows {
+		if now.Sub(f.exportedAt) >= timeout {
+			res = append(res, t.recordLocked(f, now))
+		}
+	}
+	return res
+}
+
+func (t *Table) recordLocked(f *activeFlow, now time.Time) Record {
+	sent, received := f.sent.Load(), f.received.Load()
+	rec := Record{
+		Flow:     f.Flow,
+		Start:    f.exportedAt,
+		End:      now,
+		Sent:     sent - f.exportedSent,
+		Received: received - f.exportedReceived,
+	}
+	f.exportedSent, f.exportedReceived, f.exportedAt = sent, received, now
+	return rec
+}
+
+var protocolNumbers = map[string]int{
+	"tcp": 6,
+	"udp": 17,
+}
+
+// WriteConntrack writes active flows in the format of "conntrack -L"
+// output, with original direction being client to destination it
+// connected to.
+func (t *Table) WriteConntrack(w io.Writer) error {
+	now := t.now()
+	type line struct {
+		start time.Time
+		text  string
+	}
+	t.mux.Lock()
+	lines := make([]line, 0, len(t.flows))
+	for _, f := range t.flows {
+		src, dst := f.Source, f.Destination
+		lines = append(lines, line{f.start, fmt.Sprintf(
+			"%-8s %d %d src=%s dst=%s sport=%d dport=%d bytes=%d src=%s dst=%s sport=%d dport=%d bytes=%d host=%s",
+			f.Network, protocolNumbers[f.Network], int(now.Sub(f.start).Seconds()),
+			src.Addr(), dst.Addr(), src.Port(), dst.Port(), f.sent.Load(),
+			dst.Addr(), src.Addr(), dst.Port(), src.Port(), f.received.Load(),
+			f.Host,
+		)})
+	}
+	t.mux.Unlock()
+	sort.Slice(lines, func(i, j int) bool { return lines[i].start.Before(lines[j].start) })
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,7 +5,10 @@ go 1.20
 require (
 	github.com/AdguardTeam/dnsproxy v0.54.0
 	github.com/AdguardTeam/golibs v0.15.0
+	github.com/BurntSushi/toml v1.3.2
 	github.com/miekg/dns v1.1.55
+	golang.org/x/sys v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
 	modernc.org/sqlite v1.25.0
 )
 
@@ -33,7 +36,6 @@ require (
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63 // indirect
 	golang.org/x/mod v0.12.0 // indirect
 	golang.org/x/net v0.14.0 // indirect
-	golang.org/x/sys v0.11.0 // indirect
 	golang.org/x/text v0.12.0 // indirect
 	golang.org/x/tools v0.12.1-0.20230815132531-74c255bcf846 // indirect
 	lukechampine.com/uint128 v1.3.0 // indirect
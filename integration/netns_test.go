@@ -0,0 +1,253 @@
+//go:build integration && linux
+
+// Package integration exercises the whole DNS => mapping => TPROXY =>
+// upstream flow inside throwaway network namespaces. It needs root
+// privileges, iproute2 and nftables, so it's excluded from regular test runs:
+//
+//	sudo go test -tags integration ./integration/
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	routerNS    = "dns44-it-router"
+	clientNS    = "dns44-it-client"
+	routerAddr  = "10.244.0.1"
+	clientAddr  = "10.244.0.2"
+	fakeRange   = "172.24.0.0/16"
+	dnsAddr     = routerAddr + ":53"
+	proxyAddr   = "127.0.0.1:4480"
+	echoPort    = "7777"
+	echoName    = "echo.test."
+	tproxyMark  = "44"
+	tproxyTable = "144"
+
+	helperEnv = "DNS44_IT_HELPER"
+)
+
+var nftRuleset = `
+table ip dns44_it {
+	chain prerouting {
+		type filter hook prerouting priority mangle; policy accept;
+		ip daddr ` + fakeRange + ` meta l4proto { tcp, udp } tproxy to ` + proxyAddr + ` meta mark set ` + tproxyMark + ` accept
+	}
+}
+`
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "echo":
+		os.Exit(runEcho())
+	case "client":
+		os.Exit(runClient())
+	}
+	os.Exit(m.Run())
+}
+
+func TestEndToEnd(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("integration test requires root privileges")
+	}
+	for _, tool := range []string{"ip", "nft"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("integration test requires %q: %v", tool, err)
+		}
+	}
+
+	setupNamespaces(t)
+	bin := buildDaemon(t)
+
+	startInNS(t, routerNS, nil, bin,
+		"-dns-bind-address", dnsAddr,
+		"-proxy-bind-address", proxyAddr,
+		"-db-path", t.TempDir(),
+		"-mapping-backend", "memory",
+		// Single-label names aren't mapped, so the echo gets a
+		// multi-label name mapped to localhost of router namespace.
+		"-static-host", echoName+"=map:localhost",
+	)
+	startInNS(t, routerNS, []string{helperEnv + "=echo"}, os.Args[0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ip", "netns", "exec", clientNS, os.Args[0])
+	cmd.Env = append(os.Environ(), helperEnv+"=client")
+	out, err := cmd.CombinedOutput()
+	t.Logf("client output:\n%s", out)
+	if err != nil {
+		t.Fatalf("client check failed: %v", err)
+	}
+}
+
+func setupNamespaces(t *testing.T) {
+	t.Cleanup(func() {
+		exec.Command("ip", "netns", "del", clientNS).Run()
+		exec.Command("ip", "netns", "del", routerNS).Run()
+	})
+	commands := [][]string{
+		{"ip", "netns", "add", routerNS},
+		{"ip", "netns", "add", clientNS},
+		{"ip", "-n", routerNS, "link", "add", "it-r", "type", "veth", "peer", "name", "it-c", "netns", clientNS},
+		{"ip", "-n", routerNS, "link", "set", "lo", "up"},
+		{"ip", "-n", routerNS, "addr", "add", routerAddr + "/24", "dev", "it-r"},
+		{"ip", "-n", routerNS, "link", "set", "it-r", "up"},
+		{"ip", "-n", clientNS, "link", "set", "lo", "up"},
+		{"ip", "-n", clientNS, "addr", "add", clientAddr + "/24", "dev", "it-c"},
+		{"ip", "-n", clientNS, "link", "set", "it-c", "up"},
+		{"ip", "-n", clientNS, "route", "add", "default", "via", routerAddr},
+		{"ip", "-n", routerNS, "rule", "add", "fwmark", tproxyMark, "lookup", tproxyTable},
+		{"ip", "-n", routerNS, "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", tproxyTable},
+	}
+	for _, args := range commands {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	nft := exec.Command("ip", "netns", "exec", routerNS, "nft", "-f", "-")
+	nft.Stdin = strings.NewReader(nftRuleset)
+	if out, err := nft.CombinedOutput(); err != nil {
+		t.Fatalf("nft ruleset load failed: %v\n%s", err, out)
+	}
+}
+
+func buildDaemon(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "dns44")
+	out, err := exec.Command("go", "build", "-o", bin, "github.com/Snawoot/dns44/cmd/dns44").CombinedOutput()
+	if err != nil {
+		t.Fatalf("build failed: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func startInNS(t *testing.T, ns string, env []string, bin string, args ...string) {
+	var output bytes.Buffer
+	cmd := exec.Command("ip", append([]string{"netns", "exec", ns, bin}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("can't start %s: %v", bin, err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("%s output:\n%s", filepath.Base(bin), output.String())
+		}
+	})
+}
+
+// runEcho serves TCP and UDP echo on all addresses of router namespace.
+// Proxy dials "localhost" as backend of echoName, so the echo must be
+// reachable at both loopbacks.
+func runEcho() int {
+	tcpListener, err := net.Listen("tcp", ":"+echoPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "echo: TCP listen failed: %v\n", err)
+		return 1
+	}
+	udpConn, err := net.ListenPacket("udp", ":"+echoPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "echo: UDP listen failed: %v\n", err)
+		return 1
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpConn.WriteTo(buf[:n], addr)
+		}
+	}()
+	for {
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			return 1
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// runClient resolves echoName via dns44 and checks the mapped
+// address carries both TCP and UDP traffic to the real destination.
+func runClient() int {
+	fail := func(format string, args ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "client: "+format+"\n", args...)
+		return 1
+	}
+
+	var (
+		resp *dns.Msg
+		err  error
+	)
+	client := &dns.Client{Timeout: time.Second}
+	req := new(dns.Msg)
+	req.SetQuestion(echoName, dns.TypeA)
+	for i := 0; i < 20; i++ {
+		resp, _, err = client.Exchange(req, dnsAddr)
+		if err == nil {
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if err != nil {
+		return fail("DNS query failed: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		return fail("unexpected answer: %v", resp.Answer)
+	}
+	a, ok := resp.Answer[0].(*dns.A)
+	if !ok {
+		return fail("unexpected RR type in answer: %v", resp.Answer[0])
+	}
+	mapped, _ := netip.AddrFromSlice(a.A.To4())
+	if !netip.MustParsePrefix(fakeRange).Contains(mapped) {
+		return fail("mapped address %s is outside of fake range %s", mapped, fakeRange)
+	}
+	fmt.Printf("%s mapped to %s\n", echoName, mapped)
+
+	target := net.JoinHostPort(mapped.String(), echoPort)
+	for _, network := range []string{"tcp", "udp"} {
+		payload := []byte("hello via " + network)
+		conn, err := net.DialTimeout(network, target, 5*time.Second)
+		if err != nil {
+			return fail("%s dial to %s failed: %v", network, target, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(payload); err != nil {
+			conn.Close()
+			return fail("%s write failed: %v", network, err)
+		}
+		reply := make([]byte, len(payload))
+		_, err = io.ReadFull(conn, reply)
+		conn.Close()
+		if err != nil {
+			return fail("%s read failed: %v", network, err)
+		}
+		if !bytes.Equal(reply, payload) {
+			return fail("%s echo mismatch: %q != %q", network, reply, payload)
+		}
+		fmt.Printf("%s echo via proxy ok\n", network)
+	}
+	return 0
+}
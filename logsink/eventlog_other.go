@@ -0,0 +1,24 @@
+//go:build !windows
+
+package logsink
+
+import "errors"
+
+// EventLog is unsupported outside of Windows.
+type EventLog struct{}
+
+func NewEventLog(source string) (*EventLog, error) {
+	return nil, errors.New("event log is supported on Windows only")
+}
+
+func (e *EventLog) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (e *EventLog) Close() error {
+	return nil
+}
+
+func IsWindowsService() bool {
+	return false
+}
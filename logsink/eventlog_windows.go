@@ -0,0 +1,51 @@
+package logsink
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventID is the ID of all reported events.
+const eventID = 1
+
+// EventLog sends log lines to Windows Event Log as information events,
+// matching LineSeverity.
+type EventLog struct {
+	log *eventlog.Log
+}
+
+// NewEventLog opens event log for source, registering source if needed.
+// Registration requires administrator rights, which services usually
+// have.
+func NewEventLog(source string) (*EventLog, error) {
+	// Error means source is registered already or can't be, either
+	// way events are still logged.
+	eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLog{log: l}, nil
+}
+
+func (e *EventLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		line = logHeader.ReplaceAllString(line, "")
+		if err := e.log.Info(eventID, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (e *EventLog) Close() error {
+	return e.log.Close()
+}
+
+// IsWindowsService reports whether process runs as Windows service.
+func IsWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
@@ -0,0 +1,58 @@
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// journalPriority returns journal PRIORITY value of severity. Journal
+// priorities are syslog severities.
+func journalPriority(s Severity) string {
+	return strconv.Itoa(int(s))
+}
+
+// codeLocation matches file and line added by standard logger with
+// Lshortfile flag.
+var codeLocation = regexp.MustCompile(`^([\w.-]+\.go):(\d+): `)
+
+// journalFields makes journal entry fields of log line.
+func journalFields(identifier, kind, line string) map[string]string {
+	line = logHeader.ReplaceAllString(line, "")
+	fields := map[string]string{
+		"PRIORITY":          journalPriority(LineSeverity),
+		"SYSLOG_IDENTIFIER": identifier,
+	}
+	if m := codeLocation.FindStringSubmatch(line); m != nil {
+		fields["CODE_FILE"] = m[1]
+		fields["CODE_LINE"] = m[2]
+		line = line[len(m[0]):]
+	}
+	fields["MESSAGE"] = line
+	if kind != "" {
+		fields[strings.ToUpper(identifier)+"_LOG"] = kind
+	}
+	return fields
+}
+
+// encodeJournalEntry encodes fields in journal native protocol format.
+func encodeJournalEntry(fields map[string]string) []byte {
+	var buf bytes.Buffer
+	for key, value := range fields {
+		if strings.ContainsRune(value, '\n') {
+			buf.WriteString(key)
+			buf.WriteByte('\n')
+			binary.Write(&buf, binary.LittleEndian, uint64(len(value)))
+			buf.WriteString(value)
+			buf.WriteByte('\n')
+			continue
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
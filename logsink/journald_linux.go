@@ -0,0 +1,72 @@
+package logsink
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// journalSocket is the socket of journal native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// Journald sends log lines to systemd journal with structured fields:
+// LineSeverity priority, code location and log kind.
+type Journald struct {
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+	identifier string
+	kind       string
+}
+
+// NewJournald connects to journal. Identifier becomes SYSLOG_IDENTIFIER of
+// entries.
+func NewJournald(identifier string) (*Journald, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("can't open journal socket: %w", err)
+	}
+	return &Journald{
+		conn:       conn,
+		addr:       &net.UnixAddr{Name: journalSocket, Net: "unixgram"},
+		identifier: identifier,
+	}, nil
+}
+
+// WithKind returns sink sharing socket with j, which marks entries with
+// IDENTIFIER_LOG=kind field, e.g. to tell query logs from other messages.
+func (j *Journald) WithKind(kind string) *Journald {
+	res := *j
+	res.kind = kind
+	return &res
+}
+
+func (j *Journald) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		entry := encodeJournalEntry(journalFields(j.identifier, j.kind, line))
+		if _, err := j.conn.WriteToUnix(entry, j.addr); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (j *Journald) Close() error {
+	return j.conn.Close()
+}
+
+// JournaldConnected reports whether stderr is connected to journal, i.e.
+// process runs as systemd service logging to journal.
+func JournaldConnected() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
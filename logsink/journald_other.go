@@ -0,0 +1,28 @@
+//go:build !linux
+
+package logsink
+
+import "errors"
+
+// Journald is unsupported outside of Linux.
+type Journald struct{}
+
+func NewJournald(identifier string) (*Journald, error) {
+	return nil, errors.New("journald is supported on Linux only")
+}
+
+func (j *Journald) WithKind(kind string) *Journald {
+	return j
+}
+
+func (j *Journald) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (j *Journald) Close() error {
+	return nil
+}
+
+func JournaldConnected() bool {
+	return false
+}
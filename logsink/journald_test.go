@@ -0,0 +1,39 @@
+package logsink
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJournalFields(t *testing.T) {
+	fields := journalFields("dns44", "query", "DNS44: 2024/05/01 12:00:00.123456 dnsproxy.go:273: DNS 10.0.0.1:5353 ?A example.org. => 172.24.0.1")
+	expected := map[string]string{
+		"PRIORITY":          "6",
+		"SYSLOG_IDENTIFIER": "dns44",
+		"CODE_FILE":         "dnsproxy.go",
+		"CODE_LINE":         "273",
+		"MESSAGE":           "DNS 10.0.0.1:5353 ?A example.org. => 172.24.0.1",
+		"DNS44_LOG":         "query",
+	}
+	if len(fields) != len(expected) {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("field %s = %q, expected %q", key, fields[key], value)
+		}
+	}
+	if fields := journalFields("dns44", "", "remote dial failed: refused"); fields["PRIORITY"] != "6" || fields["CODE_FILE"] != "" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestEncodeJournalEntry(t *testing.T) {
+	if entry := encodeJournalEntry(map[string]string{"MESSAGE": "hello"}); string(entry) != "MESSAGE=hello\n" {
+		t.Errorf("unexpected entry %q", entry)
+	}
+	entry := encodeJournalEntry(map[string]string{"MESSAGE": "a\nb"})
+	if !bytes.Equal(entry, []byte("MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n")) {
+		t.Errorf("unexpected entry %q", entry)
+	}
+}
@@ -0,0 +1,285 @@
+// Package logsink delivers log output to system and remote log services.
+package logsink
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Severity is syslog message severity.
+type Severity int
+
+const (
+	SeverityEmergency Severity = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseFacility returns code of syslog facility name, like "daemon" or
+// "local0".
+func ParseFacility(name string) (int, error) {
+	code, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return code, nil
+}
+
+// logHeader matches prefix, date and time added by standard logger.
+var logHeader = regexp.MustCompile(`^(?:[^ ]*: )?\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)? `)
+
+// LineSeverity is the severity of lines written to sinks. Standard logger
+// has no levels, so all its lines get the same severity, and other
+// severities are given explicitly with Log.
+const LineSeverity = SeverityInfo
+
+// Syslog sends log lines to syslog server as RFC 5424 messages. Messages
+// sent over TCP and TLS are framed with octet counting (RFC 6587).
+// Messages are queued and sent in background, so slow or unreachable
+// server never blocks logging: messages which don't fit the queue are
+// dropped and counted.
+type Syslog struct {
+	msgID  string
+	client *syslogClient
+}
+
+// syslogClient is connection to server shared by sinks with different
+// message IDs.
+type syslogClient struct {
+	network  string
+	addr     string
+	tls      *tls.Config
+	facility int
+	hostname string
+	appName  string
+	pid      int
+
+	queue     chan syslogMessage
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Uint64
+
+	// Fields below are owned by send loop.
+	conn net.Conn
+	// retryAt holds off reconnection after failed dial, so unreachable
+	// server doesn't hold up queue.
+	retryAt time.Time
+}
+
+type syslogMessage struct {
+	severity Severity
+	msgID    string
+	time     time.Time
+	text     string
+}
+
+const (
+	// syslogQueueSize is the number of messages waiting to be sent.
+	syslogQueueSize = 1024
+	// syslogRetryDelay is how long messages are dropped after failed dial.
+	syslogRetryDelay = 10 * time.Second
+	// syslogTimeout limits dial and each write to server.
+	syslogTimeout = 5 * time.Second
+	// syslogDrainTimeout limits sending of queued messages on Close.
+	syslogDrainTimeout = 2 * time.Second
+)
+
+var (
+	// errSyslogQueueFull is returned by Log for dropped messages.
+	errSyslogQueueFull = errors.New("syslog queue is full, message dropped")
+	errSyslogClosed    = errors.New("syslog sink is closed")
+)
+
+// NewSyslog makes sink for server given by URL udp://HOST[:PORT],
+// tcp://HOST[:PORT] or tls://HOST[:PORT]. Connection is made lazily.
+func NewSyslog(serverURL string, facility int, appName string) (*Syslog, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad syslog server URL: %w", err)
+	}
+	c := &syslogClient{
+		facility: facility,
+		appName:  appName,
+		pid:      os.Getpid(),
+		queue:    make(chan syslogMessage, syslogQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	port := "514"
+	switch u.Scheme {
+	case "udp", "tcp":
+		c.network = u.Scheme
+	case "tls":
+		c.network = "tcp"
+		port = "6514"
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("bad syslog server URL %q: scheme must be udp, tcp or tls", serverURL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("bad syslog server URL %q: no host", serverURL)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	c.addr = net.JoinHostPort(u.Hostname(), port)
+	if c.hostname, err = os.Hostname(); err != nil || c.hostname == "" {
+		c.hostname = "-"
+	}
+	go c.sendLoop()
+	return &Syslog{msgID: "-", client: c}, nil
+}
+
+// WithMsgID returns sink sharing connection with s, which marks messages
+// with msgID, e.g. to tell query logs from other messages.
+func (s *Syslog) WithMsgID(msgID string) *Syslog {
+	res := *s
+	res.msgID = msgID
+	return &res
+}
+
+// Write sends each log line as a message with LineSeverity, with standard
+// logger header removed.
+func (s *Syslog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		// Dropped lines are counted and reported to server later,
+		// failing the write would only make logger lose them anyway.
+		s.Log(LineSeverity, logHeader.ReplaceAllString(line, ""))
+	}
+	return len(p), nil
+}
+
+// Log queues message with given severity. Message is dropped if queue is
+// full.
+func (s *Syslog) Log(severity Severity, msg string) error {
+	c := s.client
+	select {
+	case <-c.stop:
+		return errSyslogClosed
+	case c.queue <- syslogMessage{severity: severity, msgID: s.msgID, time: time.Now(), text: msg}:
+		return nil
+	default:
+		c.dropped.Add(1)
+		return errSyslogQueueFull
+	}
+}
+
+// Dropped returns the number of messages dropped since start because
+// queue was full.
+func (s *Syslog) Dropped() uint64 {
+	return s.client.dropped.Load()
+}
+
+// Close sends queued messages, waiting for them for limited time, and
+// closes connection to server.
+func (s *Syslog) Close() error {
+	c := s.client
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+	select {
+	case <-c.done:
+	case <-time.After(syslogDrainTimeout):
+	}
+	return nil
+}
+
+// sendLoop sends queued messages until sink is closed, and then messages
+// left in queue. Drops are reported to server once it accepts messages
+// again.
+func (c *syslogClient) sendLoop() {
+	defer close(c.done)
+	defer func() {
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	}()
+	var reported uint64
+	for {
+		var msg syslogMessage
+		select {
+		case msg = <-c.queue:
+		case <-c.stop:
+			for {
+				select {
+				case msg = <-c.queue:
+					c.send(msg)
+				default:
+					return
+				}
+			}
+		}
+		if c.send(msg) != nil {
+			continue
+		}
+		if dropped := c.dropped.Load(); dropped > reported {
+			c.send(syslogMessage{
+				severity: SeverityWarning,
+				msgID:    "-",
+				time:     time.Now(),
+				text:     fmt.Sprintf("%d log messages were dropped as syslog server was too slow", dropped-reported),
+			})
+			reported = dropped
+		}
+	}
+}
+
+// send writes message to server, connecting if needed.
+func (c *syslogClient) send(msg syslogMessage) error {
+	packet := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		c.facility*8+int(msg.severity), msg.time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		c.hostname, c.appName, c.pid, msg.msgID, msg.text)
+	if c.network == "tcp" {
+		packet = fmt.Sprintf("%d %s", len(packet), packet)
+	}
+	// Retry once, as stream connection may have been closed by server.
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.conn == nil {
+			if time.Now().Before(c.retryAt) {
+				return fmt.Errorf("syslog server %s is unavailable", c.addr)
+			}
+			if c.conn, err = c.dial(); err != nil {
+				c.retryAt = time.Now().Add(syslogRetryDelay)
+				return err
+			}
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err = c.conn.Write([]byte(packet)); err == nil {
+			return nil
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+func (c *syslogClient) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	if c.tls != nil {
+		return tls.DialWithDialer(dialer, c.network, c.addr, c.tls)
+	}
+	return dialer.Dial(c.network, c.addr)
+}
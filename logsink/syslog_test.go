@@ -0,0 +1,136 @@
+package logsink
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	facility, err := ParseFacility("local3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewSyslog("udp://"+server.LocalAddr().String(), facility, "dns44")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Write([]byte("DNS44: 2024/05/01 12:00:00.123456 main.go:10: unable to start DNS server: oops\n"))
+	sink.WithMsgID("query").Write([]byte("DNS44: 2024/05/01 12:00:00.123456 dnsproxy.go:273: DNS 10.0.0.1:5353 ?A example.org. => 172.24.0.1\n"))
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`^<158>1 \S+ \S+ dns44 \d+ - - main\.go:10: unable to start DNS server: oops$`),
+		regexp.MustCompile(`^<158>1 \S+ \S+ dns44 \d+ query - dnsproxy\.go:273: DNS 10\.0\.0\.1:5353 \?A example\.org\. => 172\.24\.0\.1$`),
+	}
+	buf := make([]byte, 2048)
+	for _, re := range expected {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no syslog message: %v", err)
+		}
+		if !re.Match(buf[:n]) {
+			t.Errorf("message %q doesn't match %s", buf[:n], re)
+		}
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		length, _ := r.ReadString(' ')
+		n, _ := strconv.Atoi(strings.TrimSpace(length))
+		frame := make([]byte, n)
+		io.ReadFull(r, frame)
+		received <- string(frame)
+	}()
+	sink, err := NewSyslog("tcp://"+ln.Addr().String(), 3, "dns44")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Log(SeverityWarning, "hello"); err != nil {
+		t.Fatalf("Log failed: %v", err)
+	}
+	if frame := <-received; !strings.HasPrefix(frame, "<28>1 ") || !strings.HasSuffix(frame, " - - hello") {
+		t.Errorf("unexpected frame %q", frame)
+	}
+}
+
+func TestSyslogConfig(t *testing.T) {
+	for _, s := range []string{"http://host", "udp://", "tls//host"} {
+		if _, err := NewSyslog(s, 3, "dns44"); err == nil {
+			t.Errorf("NewSyslog(%q) succeeded, expected error", s)
+		}
+	}
+	if _, err := ParseFacility("bogus"); err == nil {
+		t.Error("unknown facility must be rejected")
+	}
+}
+
+func TestSyslogStalledServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// Server accepts connection and never reads from it.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		default:
+		}
+	}()
+	sink, err := NewSyslog("tcp://"+ln.Addr().String(), 3, "dns44")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	msg := strings.Repeat("x", 4096)
+	start := time.Now()
+	for i := 0; i < 5000; i++ {
+		sink.Log(SeverityInfo, msg)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("writes to stalled server took %v", elapsed)
+	}
+	if sink.Dropped() == 0 {
+		t.Error("no messages dropped by stalled server")
+	}
+	if err := sink.Log(SeverityError, "hello"); err != errSyslogQueueFull {
+		t.Errorf("Log to full queue returned %v", err)
+	}
+}
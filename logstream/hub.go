@@ -0,0 +1,139 @@
+// Package logstream streams structured events of DNS queries and proxied
+// connections to live subscribers, such as companion apps connected over
+// WebSocket.
+package logstream
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subscriberQueue is the number of events buffered for each subscriber.
+// Events beyond it are dropped for slow subscribers.
+const subscriberQueue = 256
+
+// Event kinds.
+const (
+	KindDNS     = "dns"
+	KindConnect = "connect"
+	KindClose   = "close"
+)
+
+// Event is a log record of DNS query or proxied connection.
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Client is client address and port.
+	Client netip.AddrPort `json:"client"`
+	Device string         `json:"device,omitempty"`
+	Domain string         `json:"domain,omitempty"`
+
+	// Type, Result and Decision describe DNS query and its answer. Rule
+	// names policy rule which decided on query.
+	Type     string `json:"type,omitempty"`
+	Result   string `json:"result,omitempty"`
+	Decision string `json:"decision,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+
+	// Network, Destination, Sent and Received describe connection.
+	Network     string `json:"network,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Sent        int64  `json:"sent,omitempty"`
+	Received    int64  `json:"received,omitempty"`
+}
+
+// Filter selects events for subscriber. Empty fields match all events.
+type Filter struct {
+	Device string
+	// Domain matches domain and its subdomains.
+	Domain string
+	// Client matches client addresses within prefix.
+	Client netip.Prefix
+	Kinds  []string
+}
+
+func (f *Filter) match(ev *Event) bool {
+	if f.Device != "" && ev.Device != f.Device {
+		return false
+	}
+	if f.Domain != "" && ev.Domain != f.Domain && !strings.HasSuffix(ev.Domain, "."+f.Domain) {
+		return false
+	}
+	if f.Client.IsValid() && !f.Client.Contains(ev.Client.Addr().Unmap()) {
+		return false
+	}
+	if len(f.Kinds) == 0 {
+		return true
+	}
+	for _, kind := range f.Kinds {
+		if kind == ev.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+type subscriber struct {
+	filter Filter
+	events chan Event
+}
+
+// Hub fans events out to subscribers. Nil Hub drops events.
+type Hub struct {
+	active atomic.Int32
+
+	mux  sync.RWMutex
+	subs map[*subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*subscriber]struct{})}
+}
+
+// Publish sends event to matching subscribers without waiting for them.
+func (h *Hub) Publish(ev Event) {
+	if h == nil || h.active.Load() == 0 {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	for s := range h.subs {
+		if !s.filter.match(&ev) {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+		}
+	}
+}
+
+// Active reports whether hub has subscribers, so callers may skip
+// building events nobody receives.
+func (h *Hub) Active() bool {
+	return h != nil && h.active.Load() > 0
+}
+
+// Subscribe registers subscriber receiving events matched by filter.
+// Returned function unregisters it.
+func (h *Hub) Subscribe(filter Filter) (<-chan Event, func()) {
+	s := &subscriber{filter: filter, events: make(chan Event, subscriberQueue)}
+	h.mux.Lock()
+	h.subs[s] = struct{}{}
+	h.active.Add(1)
+	h.mux.Unlock()
+	return s.events, func() {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		if _, ok := h.subs[s]; ok {
+			delete(h.subs, s)
+			h.active.Add(-1)
+		}
+	}
+}
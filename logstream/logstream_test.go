@@ -0,0 +1,130 @@
+package logstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	ev := Event{
+		Kind:   KindDNS,
+		Client: netip.MustParseAddrPort("192.168.1.10:5353"),
+		Device: "tablet",
+		Domain: "www.example.com",
+	}
+	for _, tc := range []struct {
+		filter Filter
+		match  bool
+	}{
+		{Filter{}, true},
+		{Filter{Device: "tablet"}, true},
+		{Filter{Device: "laptop"}, false},
+		{Filter{Domain: "example.com"}, true},
+		{Filter{Domain: "ample.com"}, false},
+		{Filter{Client: netip.MustParsePrefix("192.168.1.0/24")}, true},
+		{Filter{Client: netip.MustParsePrefix("10.0.0.0/8")}, false},
+		{Filter{Kinds: []string{KindConnect, KindDNS}}, true},
+		{Filter{Kinds: []string{KindClose}}, false},
+	} {
+		if m := tc.filter.match(&ev); m != tc.match {
+			t.Errorf("filter %+v: got %v, expected %v", tc.filter, m, tc.match)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	hub := NewHub()
+	srv := httptest.NewServer(Handler(hub))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /?domain=example.com HTTP/1.1\r\n"+
+		"Host: dns44\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad handshake response: %s %v", resp.Status, resp.Header)
+	}
+
+	for !hub.Active() {
+		time.Sleep(time.Millisecond)
+	}
+	hub.Publish(Event{Kind: KindDNS, Domain: "other.org"})
+	hub.Publish(Event{Kind: KindDNS, Domain: "www.example.com", Result: "172.24.0.1"})
+
+	var header [2]byte
+	if _, err := io.ReadFull(rd, header[:]); err != nil {
+		t.Fatalf("can't read frame: %v", err)
+	}
+	if header[0] != 0x80|opText {
+		t.Fatalf("unexpected frame header %x", header[0])
+	}
+	payload := make([]byte, header[1])
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		t.Fatalf("can't read frame: %v", err)
+	}
+	var ev Event
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		t.Fatalf("bad event %q: %v", payload, err)
+	}
+	if ev.Domain != "www.example.com" || ev.Result != "172.24.0.1" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	// Masked close frame ends stream.
+	conn.Write([]byte{0x80 | opClose, 0x80, 0, 0, 0, 0})
+	if _, err := io.ReadFull(rd, header[:]); err != nil || header[0] != 0x80|opClose {
+		t.Errorf("close frame not echoed: %x %v", header, err)
+	}
+	for hub.Active() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBadFilter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler(NewHub()).ServeHTTP(rec, httptest.NewRequest("GET", "/?client=bogus", strings.NewReader("")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCrossOriginWebSocket(t *testing.T) {
+	for origin, expected := range map[string]int{
+		"http://evil.example": http.StatusForbidden,
+		"http://dns44":        http.StatusInternalServerError,
+	} {
+		req := httptest.NewRequest("GET", "http://dns44/", nil)
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		Handler(NewHub()).ServeHTTP(rec, req)
+		// Recorder can't be hijacked, so allowed upgrade fails later.
+		if rec.Code != expected {
+			t.Errorf("origin %s: got status %d, expected %d", origin, rec.Code, expected)
+		}
+	}
+}
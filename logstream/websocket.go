@@ -0,0 +1,235 @@
+package logstream
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the magic value of WebSocket handshake (RFC 6455).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// writeTimeout bounds time spent sending one frame to subscriber.
+const writeTimeout = 10 * time.Second
+
+// maxControlPayload is the maximum payload size of frames read from
+// client. Clients only send control frames to stream.
+const maxControlPayload = 125
+
+// WebSocket opcodes.
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+// Handler streams events of hub as WebSocket text messages, one JSON
+// object per message. Query parameters device, domain, client (address or
+// prefix) and kind (comma-separated) filter events. Requests which aren't
+// WebSocket upgrades get events as newline-delimited JSON. Upgrades
+// requested by web pages of other origins are rejected, as browsers let any
+// page open WebSocket connections.
+func Handler(hub *Hub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			streamNDJSON(w, r, hub, filter)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin WebSocket requests are not allowed", http.StatusForbidden)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported WebSocket handshake", http.StatusBadRequest)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sum := sha1.Sum([]byte(key + websocketGUID))
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			return
+		}
+		streamWebSocket(conn, rw.Reader, hub, filter)
+	})
+}
+
+// sameOrigin reports whether request comes from page served by the same
+// host, or from client other than browser, which sends no Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func parseFilter(r *http.Request) (Filter, error) {
+	q := r.URL.Query()
+	filter := Filter{
+		Device: q.Get("device"),
+		Domain: strings.TrimSuffix(strings.ToLower(q.Get("domain")), "."),
+	}
+	if client := q.Get("client"); client != "" {
+		prefix, err := netip.ParsePrefix(client)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(client)
+			if addrErr != nil {
+				return filter, errors.New("client has to be address or prefix")
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		filter.Client = prefix.Masked()
+	}
+	if kinds := q.Get("kind"); kinds != "" {
+		filter.Kinds = strings.Split(kinds, ",")
+	}
+	return filter, nil
+}
+
+func streamNDJSON(w http.ResponseWriter, r *http.Request, hub *Hub, filter Filter) {
+	events, cancel := hub.Subscribe(filter)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func streamWebSocket(conn net.Conn, rd *bufio.Reader, hub *Hub, filter Filter) {
+	events, cancel := hub.Subscribe(filter)
+	defer cancel()
+
+	var wmux sync.Mutex
+	write := func(opcode byte, payload []byte) error {
+		wmux.Lock()
+		defer wmux.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := conn.Write(frame(opcode, payload))
+		return err
+	}
+
+	// Reader answers pings and stops stream once client closes it.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := readFrame(rd)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case opPing:
+				if write(opPong, payload) != nil {
+					return
+				}
+			case opClose:
+				write(opClose, payload)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-events:
+			msg, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			if write(opText, msg) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// frame builds unmasked final frame, as sent by server.
+func frame(opcode byte, payload []byte) []byte {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	return append(header, payload...)
+}
+
+// readFrame reads masked client frame. Only small frames are accepted.
+func readFrame(rd *bufio.Reader) (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(rd, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	n := int(header[1] & 0x7f)
+	if n > maxControlPayload {
+		return 0, nil, errors.New("client frame is too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(rd, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
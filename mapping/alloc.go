@@ -0,0 +1,85 @@
+package mapping
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// collisionWarnInterval limits rate of warnings about allocations which
+// barely found free address.
+const collisionWarnInterval = time.Minute
+
+// AllocStats describes address allocation since start.
+type AllocStats struct {
+	// Allocations is the number of successful allocations. SQLite backend
+	// counts lease renewals as well.
+	Allocations uint64
+	// Collisions is the number of random candidates which turned out to
+	// be taken.
+	Collisions uint64
+	// Failures is the number of allocations given up with
+	// ErrTooManyAttempts.
+	Failures uint64
+	// AllocTime is the total time spent in allocations.
+	AllocTime time.Duration
+}
+
+// CollisionRate returns average number of collisions per allocation
+// attempt, which grows with pool occupancy well before allocations fail.
+func (s AllocStats) CollisionRate() float64 {
+	if s.Allocations+s.Failures == 0 {
+		return 0
+	}
+	return float64(s.Collisions) / float64(s.Allocations+s.Failures)
+}
+
+// AvgAllocTime returns average duration of allocation.
+func (s AllocStats) AvgAllocTime() time.Duration {
+	if s.Allocations+s.Failures == 0 {
+		return 0
+	}
+	return s.AllocTime / time.Duration(s.Allocations+s.Failures)
+}
+
+// allocCounter collects AllocStats.
+type allocCounter struct {
+	allocations atomic.Uint64
+	collisions  atomic.Uint64
+	failures    atomic.Uint64
+	allocTime   atomic.Int64
+	lastWarn    atomic.Int64
+}
+
+// record accounts allocation started at start, which met given number
+// of collisions. Allocations which used up half of retries are logged, as
+// they signal pool close to exhaustion.
+func (c *allocCounter) record(start time.Duration, collisions int, failed bool) {
+	now := monoNow()
+	c.allocTime.Add(int64(now - start))
+	c.collisions.Add(uint64(collisions))
+	if failed {
+		c.failures.Add(1)
+	} else {
+		c.allocations.Add(1)
+	}
+	if collisions < insertRetries/2 {
+		return
+	}
+	last := c.lastWarn.Load()
+	if last != 0 && now-time.Duration(last) < collisionWarnInterval {
+		return
+	}
+	if c.lastWarn.CompareAndSwap(last, int64(now)) {
+		log.Printf("WARNING: address allocation met %d collisions in %d attempts, address pool is close to exhaustion", collisions, insertRetries)
+	}
+}
+
+func (c *allocCounter) snapshot() AllocStats {
+	return AllocStats{
+		Allocations: c.allocations.Load(),
+		Collisions:  c.collisions.Load(),
+		Failures:    c.failures.Load(),
+		AllocTime:   time.Duration(c.allocTime.Load()),
+	}
+}
@@ -0,0 +1,54 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestAllocStats(t *testing.T) {
+	m, err := NewMemory(t.TempDir(), smallPool{rand.New(rand.NewSource(1))}, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	defer m.Close()
+
+	// Pool has 16 addresses, so some allocation eventually fails.
+	var failures uint64
+	for i := 0; i < 32; i++ {
+		_, err := m.EnsureMapping(testKey("127.0.0.1"), fmt.Sprintf("d%d.example.org", i), time.Minute)
+		if errors.Is(err, ErrTooManyAttempts) {
+			failures++
+		} else if err != nil {
+			t.Fatalf("EnsureMapping failed: %v", err)
+		}
+	}
+	// Renewal doesn't allocate.
+	if _, err := m.EnsureMapping(testKey("127.0.0.1"), "d0.example.org", time.Minute); err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+
+	stats, err := m.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	alloc := stats.Alloc
+	if alloc.Allocations != uint64(stats.Mappings) {
+		t.Errorf("%d allocations counted for %d mappings", alloc.Allocations, stats.Mappings)
+	}
+	if failures == 0 || alloc.Failures != failures {
+		t.Errorf("%d failures counted, expected %d", alloc.Failures, failures)
+	}
+	if alloc.Collisions < failures*insertRetries {
+		t.Errorf("%d collisions counted, expected at least %d", alloc.Collisions, failures*insertRetries)
+	}
+	if rate := alloc.CollisionRate(); rate <= 1 {
+		t.Errorf("collision rate %v is too low for full pool", rate)
+	}
+
+	if (AllocStats{}).CollisionRate() != 0 || (AllocStats{}).AvgAllocTime() != 0 {
+		t.Error("empty stats have nonzero averages")
+	}
+}
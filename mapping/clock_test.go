@@ -0,0 +1,84 @@
+package mapping
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestStepDetector(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	clock.install(t)
+	var d stepDetector
+	if step := d.observe(); step != 0 {
+		t.Fatalf("first observation reported step %v", step)
+	}
+	clock.now = clock.now.Add(time.Hour)
+	if step := d.observe(); step != 0 {
+		t.Errorf("smooth clock reported step %v", step)
+	}
+	clock.step(time.Second)
+	if step := d.observe(); step != 0 {
+		t.Errorf("small step %v is reported", step)
+	}
+	clock.step(-24 * time.Hour)
+	if step := d.observe(); step != -24*time.Hour {
+		t.Errorf("unexpected step %v", step)
+	}
+}
+
+func TestClockStep(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	clock.install(t)
+	backends := map[string]func(dir string) (mapperUnderTest, error){
+		"memory": func(dir string) (mapperUnderTest, error) {
+			return NewMemory(dir, smallPool{rand.New(rand.NewSource(1))}, time.Hour)
+		},
+	}
+	if openSQLite != nil {
+		backends["sqlite"] = func(dir string) (mapperUnderTest, error) {
+			return openSQLite(dir, smallPool{rand.New(rand.NewSource(1))})
+		}
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			m, err := open(dir)
+			if err != nil {
+				t.Fatalf("can't open mapping: %v", err)
+			}
+			addr, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+
+			// Forward step must not expire live mapping.
+			clock.now = clock.now.Add(2 * time.Second)
+			clock.step(time.Hour)
+			if _, err := m.EnsureMapping(testKey("10.0.0.1"), "example.com", time.Minute); err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if domainName, ok, _ := m.ReverseLookup(testKey("10.0.0.1"), addr); !ok || domainName != "example.org" {
+				t.Fatalf("mapping was lost after clock step: (%q, %v)", domainName, ok)
+			}
+
+			// Backward step across restart must not make mapping immortal.
+			if err := m.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			clock.step(-24 * time.Hour)
+			m, err = open(dir)
+			if err != nil {
+				t.Fatalf("can't reopen mapping: %v", err)
+			}
+			defer m.Close()
+			clock.now = clock.now.Add(2 * time.Minute)
+			if _, err := m.EnsureMapping(testKey("10.0.0.2"), "example.com", time.Minute); err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if _, ok, _ := m.ReverseLookup(testKey("10.0.0.1"), addr); ok {
+				t.Errorf("mapping outlived its TTL after clock went backwards")
+			}
+		})
+	}
+}
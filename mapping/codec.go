@@ -0,0 +1,84 @@
+package mapping
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	errEncryptedState = errors.New("state is encrypted, but no key is given")
+	errDecrypt        = errors.New("can't decrypt state record, wrong key?")
+)
+
+// recordCodec converts records of memory backend state to lines of
+// snapshot and journal files. With AEAD set, lines are base64-encoded
+// AES-GCM ciphertexts of JSON records, otherwise JSON records as is.
+type recordCodec struct {
+	aead cipher.AEAD
+}
+
+// newRecordCodec returns codec encrypting records with key derived from
+// secret. Empty secret disables encryption.
+func newRecordCodec(secret []byte) (recordCodec, error) {
+	if len(secret) == 0 {
+		return recordCodec{}, nil
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return recordCodec{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return recordCodec{}, err
+	}
+	return recordCodec{aead}, nil
+}
+
+func (c recordCodec) encode(rec record) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	if c.aead != nil {
+		nonce := make([]byte, c.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("can't generate nonce: %w", err)
+		}
+		sealed := c.aead.Seal(nonce, nonce, data, nil)
+		data = make([]byte, base64.RawStdEncoding.EncodedLen(len(sealed)))
+		base64.RawStdEncoding.Encode(data, sealed)
+	}
+	return append(data, '\n'), nil
+}
+
+// decode parses line of state file. Plaintext records are accepted even
+// with encryption enabled, so existing state survives switch to encryption.
+func (c recordCodec) decode(line []byte) (record, error) {
+	var rec record
+	data := bytes.TrimSpace(line)
+	if !bytes.HasPrefix(data, []byte("{")) {
+		if c.aead == nil {
+			return rec, errEncryptedState
+		}
+		sealed := make([]byte, base64.RawStdEncoding.DecodedLen(len(data)))
+		n, err := base64.RawStdEncoding.Decode(sealed, data)
+		if err != nil || n < c.aead.NonceSize() {
+			return rec, errDecrypt
+		}
+		nonceSize := c.aead.NonceSize()
+		data, err = c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:n], nil)
+		if err != nil {
+			return rec, errDecrypt
+		}
+	}
+	err := json.Unmarshal(data, &rec)
+	return rec, err
+}
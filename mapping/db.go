@@ -1,3 +1,5 @@
+//go:build !nosqlite
+
 package mapping
 
 import (
@@ -5,26 +7,29 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net/netip"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
-	_ "modernc.org/sqlite"
-)
-
-const (
-	insertRetries           = 20
-	cleanupDebounceInterval = 1 * time.Second
+	"github.com/Snawoot/dns44/clientkey"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 var (
 	initQueries = []string{
 		`PRAGMA journal_mode=WAL`,
 		`PRAGMA synchronous=NORMAL`,
-		`CREATE TABLE IF NOT EXISTS mapping (
+	}
+
+	// migrations[i] upgrades schema from version i to version i+1.
+	migrations = [][]string{
+		{
+			`CREATE TABLE IF NOT EXISTS mapping (
   client_key TEXT NOT NULL,
   domain_name TEXT NOT NULL,
   mapped_addr TEXT NOT NULL,
@@ -32,27 +37,105 @@ var (
   PRIMARY KEY (client_key, domain_name),
   UNIQUE (client_key, mapped_addr)
  ) STRICT`,
-		`CREATE INDEX IF NOT EXISTS mapping_expire_idx ON mapping (expire ASC) WHERE expire IS NOT NULL`,
+			`CREATE INDEX IF NOT EXISTS mapping_expire_idx ON mapping (expire ASC) WHERE expire IS NOT NULL`,
+		},
+		{
+			`CREATE TABLE mapping_new (
+  namespace TEXT NOT NULL DEFAULT '',
+  client_key TEXT NOT NULL,
+  domain_name TEXT NOT NULL,
+  mapped_addr TEXT NOT NULL,
+  expire INTEGER,
+  PRIMARY KEY (namespace, client_key, domain_name),
+  UNIQUE (namespace, client_key, mapped_addr)
+ ) STRICT`,
+			`INSERT INTO mapping_new (client_key, domain_name, mapped_addr, expire)
+  SELECT client_key, domain_name, mapped_addr, expire FROM mapping`,
+			`DROP TABLE mapping`,
+			`ALTER TABLE mapping_new RENAME TO mapping`,
+			`CREATE INDEX IF NOT EXISTS mapping_expire_idx ON mapping (expire ASC) WHERE expire IS NOT NULL`,
+		},
+		{
+			`CREATE INDEX IF NOT EXISTS mapping_addr_idx ON mapping (namespace, mapped_addr)`,
+		},
+		{
+			`CREATE TABLE mapping_new (
+  namespace TEXT NOT NULL DEFAULT '',
+  client_key TEXT NOT NULL,
+  domain_name TEXT NOT NULL,
+  slot INTEGER NOT NULL DEFAULT 0,
+  mapped_addr TEXT NOT NULL,
+  expire INTEGER,
+  PRIMARY KEY (namespace, client_key, domain_name, slot),
+  UNIQUE (namespace, client_key, mapped_addr)
+ ) STRICT`,
+			`INSERT INTO mapping_new (namespace, client_key, domain_name, mapped_addr, expire)
+  SELECT namespace, client_key, domain_name, mapped_addr, expire FROM mapping`,
+			`DROP TABLE mapping`,
+			`ALTER TABLE mapping_new RENAME TO mapping`,
+			`CREATE INDEX IF NOT EXISTS mapping_expire_idx ON mapping (expire ASC) WHERE expire IS NOT NULL`,
+			`CREATE INDEX IF NOT EXISTS mapping_addr_idx ON mapping (namespace, mapped_addr)`,
+		},
+		{
+			`CREATE TABLE IF NOT EXISTS resolved (
+  domain_name TEXT NOT NULL PRIMARY KEY,
+  addrs TEXT NOT NULL,
+  expire INTEGER NOT NULL
+ ) STRICT`,
+		},
+		{
+			`ALTER TABLE mapping ADD COLUMN ttl INTEGER NOT NULL DEFAULT 0`,
+		},
+		{
+			`ALTER TABLE mapping ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0`,
+		},
 	}
-
-	ErrTooManyAttempts = errors.New("too many failed attempts")
 )
 
-type AddrPool interface {
-	GetRandom() netip.Addr
-}
+const dbFileName = "mapping.db"
 
 type SQLiteMapping struct {
 	db          *sql.DB
 	addrPool    AddrPool
-	lastCleanup time.Time
+	lastCleanup time.Duration
+	clock       stepDetector
 	cleanupMux  sync.RWMutex
+	alloc       allocCounter
 }
 
 func New(dbPath string, addrPool AddrPool) (*SQLiteMapping, error) {
+	path := filepath.Join(dbPath, dbFileName)
+	db, err := openDB(path)
+	if err != nil && isCorruption(err) {
+		// Power loss on flash storage often leaves database damaged. Losing
+		// mappings is better than failing every query, so damaged file is
+		// put aside and database is created anew.
+		backup, backupErr := backupCorrupted(path)
+		if backupErr != nil {
+			return nil, fmt.Errorf("%w; backup of damaged database failed: %v", err, backupErr)
+		}
+		log.Printf("mapping database is damaged (%v), moved it to %q and starting with empty one", err, backup)
+		db, err = openDB(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SQLiteMapping{
+		db:       db,
+		addrPool: addrPool,
+	}
+	if err := m.clampExpiry(); err != nil {
+		return nil, fmt.Errorf("expiration reconciliation failed: %w", err)
+	}
+	m.clock.observe()
+	return m, nil
+}
+
+func openDB(path string) (*sql.DB, error) {
 	dbURL := url.URL{
 		Scheme:   "file",
-		Path:     filepath.Join(dbPath, "mapping.db"),
+		Path:     path,
 		OmitHost: true,
 	}
 	db, err := sql.Open("sqlite", dbURL.String())
@@ -62,34 +145,194 @@ func New(dbPath string, addrPool AddrPool) (*SQLiteMapping, error) {
 
 	db.SetMaxOpenConns(1)
 
+	if err := setupDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func setupDB(db *sql.DB) error {
 	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("DB ping failed: %w", err)
+		return fmt.Errorf("DB ping failed: %w", err)
+	}
+
+	if err := checkIntegrity(db); err != nil {
+		return err
 	}
 
 	for _, query := range initQueries {
-		if _, err = db.Exec(query); err != nil {
-			return nil, fmt.Errorf("setup command (%q) error: %w", query, err)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("setup command (%q) error: %w", query, err)
 		}
 	}
 
-	return &SQLiteMapping{
-		db:       db,
-		addrPool: addrPool,
-	}, nil
+	if err := migrate(db); err != nil {
+		return fmt.Errorf("schema migration failed: %w", err)
+	}
+	return nil
+}
+
+// CheckSQLite verifies integrity of SQLite mapping database in dbPath
+// without modifying it, so it's safe to run along with the service. Error
+// wraps os.ErrNotExist if there is no database yet.
+func CheckSQLite(dbPath string) error {
+	path := filepath.Join(dbPath, dbFileName)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	dbURL := url.URL{
+		Scheme:   "file",
+		Path:     path,
+		OmitHost: true,
+		RawQuery: "mode=ro",
+	}
+	db, err := sql.Open("sqlite", dbURL.String())
+	if err != nil {
+		return fmt.Errorf("can't open database: %w", err)
+	}
+	defer db.Close()
+	return checkIntegrity(db)
+}
+
+// BackupSQLite writes consistent copy of SQLite mapping database in dbPath
+// to destDir, which becomes a valid dbPath itself. It's safe to run along
+// with the service. Error wraps os.ErrNotExist if there is no database.
+func BackupSQLite(dbPath, destDir string) error {
+	path := filepath.Join(dbPath, dbFileName)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	dbURL := url.URL{
+		Scheme:   "file",
+		Path:     path,
+		OmitHost: true,
+		RawQuery: "mode=ro",
+	}
+	db, err := sql.Open("sqlite", dbURL.String())
+	if err != nil {
+		return fmt.Errorf("can't open database: %w", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`VACUUM INTO ?`, filepath.Join(destDir, dbFileName)); err != nil {
+		return fmt.Errorf("database copy failed: %w", err)
+	}
+	return nil
 }
 
-func (m *SQLiteMapping) EnsureMapping(clientKey, domainName string, ttl time.Duration) (netip.Addr, error) {
+// errIntegrity reports damage found by integrity check.
+var errIntegrity = errors.New("integrity check failed")
+
+func checkIntegrity(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return fmt.Errorf("integrity check error: %w", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem); err != nil {
+			return fmt.Errorf("integrity check error: %w", err)
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("integrity check error: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errIntegrity, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isCorruption reports whether err is caused by damaged database file, as
+// opposed to e.g. missing permissions.
+func isCorruption(err error) bool {
+	if errors.Is(err, errIntegrity) {
+		return true
+	}
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// Extended result codes keep primary code in lower byte.
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB:
+		return true
+	}
+	return false
+}
+
+// backupCorrupted moves damaged database file and its WAL aside and
+// returns new path of database file.
+func backupCorrupted(path string) (string, error) {
+	backup := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(path+suffix, backup+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return backup, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("can't get schema version: %w", err)
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("can't start transaction: %w", err)
+		}
+		for _, query := range migrations[version] {
+			if _, err := tx.Exec(query); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration to version %d (%q) failed: %w", version+1, query, err)
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("can't set schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration to version %d commit failed: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+func (m *SQLiteMapping) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	return m.ensureMapping("", clientKey.String(), domainName, 0, ttl, m.poolFor(domainName))
+}
+
+// EnsureMappings returns count distinct addresses mapped to domainName.
+func (m *SQLiteMapping) EnsureMappings(clientKey clientkey.Key, domainName string, count int, ttl time.Duration) ([]netip.Addr, error) {
+	return ensureMappings(m, m.poolFor(domainName), "", clientKey.String(), domainName, count, ttl)
+}
+
+func (m *SQLiteMapping) poolFor(domainName string) AddrPool {
+	return selectPool(m.addrPool, domainName)
+}
+
+func (m *SQLiteMapping) ensureMapping(namespace, clientKey, domainName string, slot int, ttl time.Duration, addrPool AddrPool) (netip.Addr, error) {
 	m.cleanup()
 
+	start := monoNow()
 	for i := 0; i < insertRetries; i++ {
-		addrCandidate := m.addrPool.GetRandom()
-		expire := time.Now().Unix() + int64(math.Round(ttl.Seconds()))
+		addrCandidate := addrPool.GetRandom()
+		ttlSec := ttlSeconds(ttl)
+		expire := timeNow().Unix() + ttlSec
 		row := m.db.QueryRow(
-			`INSERT INTO mapping (client_key, domain_name, mapped_addr, expire)
-			VALUES (?, ?, ?, ?)
-			ON CONFLICT (client_key, domain_name) DO UPDATE SET expire = ?
-			ON CONFLICT (client_key, mapped_addr) DO NOTHING RETURNING mapped_addr`,
-			clientKey, domainName, addrCandidate.String(), expire, expire,
+			`INSERT INTO mapping (namespace, client_key, domain_name, slot, mapped_addr, expire, ttl)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (namespace, client_key, domain_name, slot) DO UPDATE SET expire = ?, ttl = ?
+			ON CONFLICT (namespace, client_key, mapped_addr) DO NOTHING RETURNING mapped_addr`,
+			namespace, clientKey, domainName, slot, addrCandidate.String(), expire, ttlSec, expire, ttlSec,
 		)
 		var ipStr string
 		if err := row.Scan(&ipStr); err != nil {
@@ -103,8 +346,10 @@ func (m *SQLiteMapping) EnsureMapping(clientKey, domainName string, ttl time.Dur
 			return netip.Addr{}, fmt.Errorf("can't parse IP address %q from DB: %w", ipStr, err)
 		}
 
+		m.alloc.record(start, i, false)
 		return res, nil
 	}
+	m.alloc.record(start, insertRetries, true)
 	return netip.Addr{}, ErrTooManyAttempts
 }
 
@@ -113,28 +358,105 @@ func (m *SQLiteMapping) cleanup() {
 	lastCleanup := m.lastCleanup
 	m.cleanupMux.RUnlock()
 
-	if time.Now().Sub(lastCleanup) > cleanupDebounceInterval {
+	if monoNow()-lastCleanup > cleanupDebounceInterval {
 		m.cleanupMux.Lock()
 		defer m.cleanupMux.Unlock()
+		if step := m.clock.observe(); step != 0 {
+			log.Printf("wall clock stepped by %v, shifting mapping expiration", step)
+			if err := m.shiftExpiry(int64(step.Round(time.Second) / time.Second)); err != nil {
+				log.Printf("DB expiration shift failed: %v", err)
+			}
+		}
 		if err := m.purgeExpired(); err != nil {
 			log.Printf("DB cleanup failed: %v", err)
 		}
-		m.lastCleanup = time.Now()
+		m.lastCleanup = monoNow()
+	}
+}
+
+// shiftExpiry moves expiration times by delta seconds, so leases keep
+// their remaining duration across wall clock step.
+func (m *SQLiteMapping) shiftExpiry(delta int64) error {
+	if _, err := m.db.Exec("UPDATE mapping SET expire = expire + ?", delta); err != nil {
+		return err
 	}
+	_, err := m.db.Exec("UPDATE resolved SET expire = expire + ?", delta)
+	return err
+}
+
+// clampExpiry limits expiration times to lease duration from now. Rows
+// expiring later were stored while wall clock was ahead.
+func (m *SQLiteMapping) clampExpiry() error {
+	now := timeNow().Unix()
+	_, err := m.db.Exec("UPDATE mapping SET expire = ? + ttl WHERE ttl > 0 AND expire > ? + ttl", now, now)
+	return err
 }
 
 func (m *SQLiteMapping) purgeExpired() error {
-	_, err := m.db.Exec("DELETE FROM mapping WHERE expire < ?", time.Now().Unix())
+	now := timeNow().Unix()
+	if _, err := m.db.Exec("DELETE FROM mapping WHERE expire < ? AND pinned = 0", now); err != nil {
+		return err
+	}
+	_, err := m.db.Exec("DELETE FROM resolved WHERE expire < ?", now)
 	return err
 }
 
+// LookupResolved returns real addresses of domain stored by StoreResolved,
+// unless they are expired.
+func (m *SQLiteMapping) LookupResolved(domainName string) (addrs []netip.Addr, ok bool, err error) {
+	row := m.db.QueryRow("SELECT addrs FROM resolved WHERE domain_name = ? AND expire >= ?",
+		domainName, timeNow().Unix())
+	var res string
+	if err := row.Scan(&res); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("resolved lookup query returned error: %w", err)
+	}
+	addrs, err = parseAddrList(res)
+	if err != nil {
+		return nil, false, fmt.Errorf("bad resolved addresses in DB: %w", err)
+	}
+	return addrs, true, nil
+}
+
+// StoreResolved saves real addresses of domain for ttl.
+func (m *SQLiteMapping) StoreResolved(domainName string, addrs []netip.Addr, ttl time.Duration) error {
+	expire := timeNow().Unix() + ttlSeconds(ttl)
+	_, err := m.db.Exec(`INSERT INTO resolved (domain_name, addrs, expire) VALUES (?, ?, ?)
+		ON CONFLICT (domain_name) DO UPDATE SET addrs = excluded.addrs, expire = excluded.expire`,
+		domainName, formatAddrList(addrs), expire)
+	if err != nil {
+		return fmt.Errorf("resolved upsert query error: %w", err)
+	}
+	return nil
+}
+
+// Stats returns snapshot of mapping state.
+func (m *SQLiteMapping) Stats() (Stats, error) {
+	var stats Stats
+	row := m.db.QueryRow(`SELECT (SELECT COUNT(*) FROM mapping),
+		(SELECT COUNT(*) FROM (SELECT DISTINCT namespace, mapped_addr FROM mapping))`)
+	if err := row.Scan(&stats.Mappings, &stats.Addresses); err != nil {
+		return Stats{}, fmt.Errorf("stats query returned error: %w", err)
+	}
+	dbStats := m.db.Stats()
+	stats.DB = &dbStats
+	stats.Alloc = m.alloc.snapshot()
+	return stats, nil
+}
+
 func (m *SQLiteMapping) Close() error {
 	return m.db.Close()
 }
 
-func (m *SQLiteMapping) ReverseLookup(clientKey string, addr netip.Addr) (domainName string, ok bool, err error) {
-	row := m.db.QueryRow("SELECT domain_name FROM mapping WHERE client_key = ? AND mapped_addr = ? LIMIT 1",
-		clientKey, addr.String())
+func (m *SQLiteMapping) ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (domainName string, ok bool, err error) {
+	return m.reverseLookup("", clientKey.String(), addr)
+}
+
+func (m *SQLiteMapping) reverseLookup(namespace, clientKey string, addr netip.Addr) (domainName string, ok bool, err error) {
+	row := m.db.QueryRow("SELECT domain_name FROM mapping WHERE namespace = ? AND client_key = ? AND mapped_addr = ? LIMIT 1",
+		namespace, clientKey, addr.Unmap().String())
 	var res string
 	if err := row.Scan(&res); err != nil {
 		if err == sql.ErrNoRows {
@@ -145,3 +467,141 @@ func (m *SQLiteMapping) ReverseLookup(clientKey string, addr netip.Addr) (domain
 
 	return res, true, nil
 }
+
+// ReverseLookupAnyClient finds domain mapped to addr for any client. If
+// several clients have this address mapped, most recently refreshed mapping
+// wins.
+func (m *SQLiteMapping) ReverseLookupAnyClient(addr netip.Addr) (domainName string, ok bool, err error) {
+	return m.reverseLookupAnyClient("", addr)
+}
+
+func (m *SQLiteMapping) reverseLookupAnyClient(namespace string, addr netip.Addr) (domainName string, ok bool, err error) {
+	row := m.db.QueryRow("SELECT domain_name FROM mapping WHERE namespace = ? AND mapped_addr = ? ORDER BY expire DESC LIMIT 1",
+		namespace, addr.Unmap().String())
+	var res string
+	if err := row.Scan(&res); err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("rev lookup query returned error: %w", err)
+	}
+
+	return res, true, nil
+}
+
+// WalkMappings calls fn for each live mapping.
+func (m *SQLiteMapping) WalkMappings(fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error {
+	return m.walkMappings("", fn)
+}
+
+func (m *SQLiteMapping) walkMappings(namespace string, fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error {
+	rows, err := m.db.Query("SELECT client_key, domain_name, mapped_addr, expire FROM mapping WHERE namespace = ? AND (expire >= ? OR pinned != 0)",
+		namespace, timeNow().Unix())
+	if err != nil {
+		return fmt.Errorf("mapping list query returned error: %w", err)
+	}
+	// Database has single connection, so fn is called only after rows are
+	// read and connection is released.
+	var records []record
+	for rows.Next() {
+		var (
+			rec  record
+			addr string
+		)
+		if err := rows.Scan(&rec.ClientKey, &rec.DomainName, &addr, &rec.Expire); err != nil {
+			rows.Close()
+			return fmt.Errorf("mapping list scan failed: %w", err)
+		}
+		if rec.MappedAddr, err = netip.ParseAddr(addr); err != nil {
+			rows.Close()
+			return fmt.Errorf("bad address %q in mapping: %w", addr, err)
+		}
+		records = append(records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("mapping list query failed: %w", err)
+	}
+	rows.Close()
+	for _, rec := range records {
+		fn(rec.ClientKey, rec.DomainName, rec.MappedAddr, time.Unix(rec.Expire, 0))
+	}
+	return nil
+}
+
+// Pin makes mapping of addr for client permanent. ok is false if there is
+// no such mapping.
+func (m *SQLiteMapping) Pin(clientKey clientkey.Key, addr netip.Addr) (res Mapping, ok bool, err error) {
+	return m.setPinned("", clientKey.String(), addr, true)
+}
+
+// Unpin makes pinned mapping expire as usual. It's kept at least for its
+// lease duration.
+func (m *SQLiteMapping) Unpin(clientKey clientkey.Key, addr netip.Addr) (res Mapping, ok bool, err error) {
+	return m.setPinned("", clientKey.String(), addr, false)
+}
+
+func (m *SQLiteMapping) setPinned(namespace, clientKey string, addr netip.Addr, pinned bool) (Mapping, bool, error) {
+	row := m.db.QueryRow(`UPDATE mapping SET pinned = ?,
+		expire = CASE WHEN ? THEN expire ELSE MAX(expire, ? + ttl) END
+		WHERE namespace = ? AND client_key = ? AND mapped_addr = ?
+		RETURNING domain_name, expire`,
+		pinned, pinned, timeNow().Unix(), namespace, clientKey, addr.Unmap().String())
+	res := Mapping{
+		ClientKey: clientKey,
+		Addr:      addr.Unmap(),
+		Pinned:    pinned,
+	}
+	var expire int64
+	if err := row.Scan(&res.DomainName, &expire); err != nil {
+		if err == sql.ErrNoRows {
+			return Mapping{}, false, nil
+		}
+		return Mapping{}, false, fmt.Errorf("pin query returned error: %w", err)
+	}
+	res.Expire = time.Unix(expire, 0)
+	return res, true, nil
+}
+
+// WalkPinned calls fn for each pinned mapping.
+func (m *SQLiteMapping) WalkPinned(fn func(Mapping)) error {
+	return m.walkPinned("", fn)
+}
+
+func (m *SQLiteMapping) walkPinned(namespace string, fn func(Mapping)) error {
+	rows, err := m.db.Query("SELECT client_key, domain_name, mapped_addr, expire FROM mapping WHERE namespace = ? AND pinned != 0",
+		namespace)
+	if err != nil {
+		return fmt.Errorf("pinned list query returned error: %w", err)
+	}
+	var res []Mapping
+	for rows.Next() {
+		var (
+			item   Mapping
+			addr   string
+			expire int64
+		)
+		if err := rows.Scan(&item.ClientKey, &item.DomainName, &addr, &expire); err != nil {
+			rows.Close()
+			return fmt.Errorf("pinned list scan failed: %w", err)
+		}
+		if item.Addr, err = netip.ParseAddr(addr); err != nil {
+			rows.Close()
+			return fmt.Errorf("bad address %q in mapping: %w", addr, err)
+		}
+		item.Expire, item.Pinned = time.Unix(expire, 0), true
+		res = append(res, item)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("pinned list query failed: %w", err)
+	}
+	rows.Close()
+	for _, item := range res {
+		fn(item)
+	}
+	return nil
+}
+
+// Namespace returns view of mapping confined to namespace ns.
+func (m *SQLiteMapping) Namespace(ns string) *NamespacedMapping {
+	return &NamespacedMapping{backend: m, namespace: ns}
+}
@@ -0,0 +1,108 @@
+//go:build !nosqlite
+
+package mapping
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	openSQLite = func(dir string, addrPool AddrPool) (mapperUnderTest, error) {
+		m, err := New(dir, addrPool)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+func TestCorruptedDBRecovery(t *testing.T) {
+	dir := t.TempDir()
+	garbage := bytes.Repeat([]byte("not a database "), 1024)
+	if err := os.WriteFile(filepath.Join(dir, dbFileName), garbage, 0600); err != nil {
+		t.Fatalf("can't write damaged database: %v", err)
+	}
+
+	m, err := New(dir, smallPool{rand.New(rand.NewSource(1))})
+	if err != nil {
+		t.Fatalf("damaged database wasn't recreated: %v", err)
+	}
+	defer m.Close()
+	if _, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute); err != nil {
+		t.Errorf("EnsureMapping failed on recreated database: %v", err)
+	}
+
+	backups, err := filepath.Glob(filepath.Join(dir, dbFileName+".corrupt-*"))
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("expected one backup of damaged database, got %v (%v)", backups, err)
+	}
+	if content, err := os.ReadFile(backups[0]); err != nil || !bytes.Equal(content, garbage) {
+		t.Errorf("backup doesn't hold damaged database")
+	}
+}
+
+func TestCheckSQLite(t *testing.T) {
+	dir := t.TempDir()
+	if err := CheckSQLite(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CheckSQLite without database = %v", err)
+	}
+
+	m, err := New(dir, smallPool{rand.New(rand.NewSource(1))})
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	if _, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute); err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	if err := CheckSQLite(dir); err != nil {
+		t.Errorf("CheckSQLite of open database failed: %v", err)
+	}
+	m.Close()
+
+	garbage := bytes.Repeat([]byte("not a database "), 1024)
+	if err := os.WriteFile(filepath.Join(dir, dbFileName), garbage, 0600); err != nil {
+		t.Fatalf("can't write damaged database: %v", err)
+	}
+	if err := CheckSQLite(dir); err == nil {
+		t.Error("CheckSQLite accepted damaged database")
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, dbFileName)); err != nil || !bytes.Equal(content, garbage) {
+		t.Error("CheckSQLite modified database")
+	}
+}
+
+func TestBackupSQLite(t *testing.T) {
+	dir, dest := t.TempDir(), t.TempDir()
+	if err := BackupSQLite(dir, dest); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("BackupSQLite without database = %v", err)
+	}
+
+	p := smallPool{rand.New(rand.NewSource(1))}
+	m, err := New(dir, p)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	defer m.Close()
+	addr, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+	if err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	if err := BackupSQLite(dir, dest); err != nil {
+		t.Fatalf("BackupSQLite of open database failed: %v", err)
+	}
+
+	restored, err := New(dest, p)
+	if err != nil {
+		t.Fatalf("can't open database copy: %v", err)
+	}
+	defer restored.Close()
+	if domainName, ok, err := restored.ReverseLookup(testKey("10.0.0.1"), addr); err != nil || !ok || domainName != "example.org" {
+		t.Errorf("mapping missing in copy: (%q, %v, %v)", domainName, ok, err)
+	}
+}
@@ -0,0 +1,109 @@
+package mapping
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type modelEntry struct {
+	addr   netip.Addr
+	expire int64
+}
+
+// checkInvariants interprets ops as a sequence of mapper operations and
+// verifies allocation invariants against a simple model after every step.
+func checkInvariants(t *testing.T, m mapperUnderTest, clock *fakeClock, ops []byte) {
+	model := make(map[clientDomain]modelEntry)
+	for len(ops) >= 2 {
+		op, arg := ops[0]%3, ops[1]
+		ops = ops[2:]
+		clientKey := fmt.Sprintf("10.0.0.%d", arg%2)
+		now := clock.now.Unix()
+		switch op {
+		case 0:
+			domainName := fmt.Sprintf("d%d.example.org", (arg>>1)%8)
+			ttl := time.Duration(1+(arg>>4)%4) * time.Second
+			addr, err := m.EnsureMapping(testKey(clientKey), domainName, ttl)
+			if err == ErrTooManyAttempts {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("EnsureMapping(%q, %q) failed: %v", clientKey, domainName, err)
+			}
+			key := clientDomain{"", clientKey, domainName, 0}
+			if prev, ok := model[key]; ok && prev.expire >= now && prev.addr != addr {
+				t.Fatalf("%s for %s changed address before expiry: %s -> %s",
+					domainName, clientKey, prev.addr, addr)
+			}
+			for other, entry := range model {
+				if other == key || other.clientKey != clientKey || entry.addr != addr {
+					continue
+				}
+				if entry.expire >= now {
+					t.Fatalf("address %s of client %s maps to both %s and %s",
+						addr, clientKey, other.domainName, domainName)
+				}
+				delete(model, other)
+			}
+			model[key] = modelEntry{addr, now + int64(ttl/time.Second)}
+		case 1:
+			for key, entry := range model {
+				if key.clientKey != clientKey || entry.expire < now {
+					continue
+				}
+				domainName, ok, err := m.ReverseLookup(testKey(clientKey), entry.addr)
+				if err != nil {
+					t.Fatalf("ReverseLookup failed: %v", err)
+				}
+				if !ok || domainName != key.domainName {
+					t.Fatalf("reverse lookup of live %s for %s returned (%q, %v), expected %q",
+						entry.addr, clientKey, domainName, ok, key.domainName)
+				}
+			}
+		case 2:
+			clock.now = clock.now.Add(time.Duration(arg%4) * time.Second)
+		}
+	}
+}
+
+func FuzzMappingInvariants(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 2, 1, 0, 2, 3, 0, 4, 1, 0})
+	f.Add([]byte{0, 17, 0, 33, 2, 3, 2, 3, 0, 49, 1, 1, 0, 2})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		if len(ops) > 512 {
+			ops = ops[:512]
+		}
+		clock := &fakeClock{now: time.Unix(1700000000, 0)}
+		clock.install(t)
+		var seed int64
+		if len(ops) >= 8 {
+			seed = int64(binary.LittleEndian.Uint64(ops))
+		}
+		for name, m := range openMappers(t, seed) {
+			t.Run(name, func(t *testing.T) {
+				defer m.Close()
+				checkInvariants(t, m, clock, ops)
+			})
+		}
+	})
+}
+
+func TestMappingInvariantsRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		ops := make([]byte, 256)
+		rng.Read(ops)
+		clock := &fakeClock{now: time.Unix(1700000000, 0)}
+		clock.install(t)
+		for name, m := range openMappers(t, int64(i)) {
+			t.Run(name, func(t *testing.T) {
+				defer m.Close()
+				checkInvariants(t, m, clock, ops)
+			})
+		}
+	}
+}
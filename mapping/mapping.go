@@ -0,0 +1,127 @@
+package mapping
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/Snawoot/dns44/pool"
+)
+
+const (
+	insertRetries           = 20
+	cleanupDebounceInterval = 1 * time.Second
+	// clockStepThreshold is the smallest wall clock step which gets
+	// reconciled. NTP slews smaller offsets anyway.
+	clockStepThreshold = 10 * time.Second
+)
+
+var (
+	ErrTooManyAttempts = errors.New("too many failed attempts")
+
+	// timeNow is the clock used for expiration. Overridden in tests.
+	timeNow = time.Now
+
+	monoStart = time.Now()
+	// monoNow is the monotonic clock, which isn't affected by wall clock
+	// steps. Overridden in tests.
+	monoNow = func() time.Duration { return time.Since(monoStart) }
+)
+
+// stepDetector detects wall clock steps by comparing it with monotonic
+// clock. Such steps happen e.g. on devices without RTC, which boot with
+// bogus time and fix it on NTP sync.
+type stepDetector struct {
+	wall time.Time
+	mono time.Duration
+}
+
+// observe returns wall clock step since previous call, or zero if clock
+// went smoothly.
+func (s *stepDetector) observe() time.Duration {
+	wall, mono := timeNow().Round(0), monoNow()
+	prevWall, prevMono := s.wall, s.mono
+	s.wall, s.mono = wall, mono
+	if prevWall.IsZero() {
+		return 0
+	}
+	step := wall.Sub(prevWall) - (mono - prevMono)
+	if step > -clockStepThreshold && step < clockStepThreshold {
+		return 0
+	}
+	return step
+}
+
+// ttlSeconds converts mapping TTL to whole seconds.
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64(math.Round(ttl.Seconds()))
+}
+
+type AddrPool interface {
+	GetRandom() netip.Addr
+}
+
+// PoolSelector is implemented by address pools which choose pool for new
+// mappings by domain name, such as [pool.Selector]. Existing mappings keep
+// their addresses until they expire.
+type PoolSelector interface {
+	PoolFor(domainName string) pool.AddressPool
+}
+
+// selectPool returns pool for new mappings of domainName.
+func selectPool(p AddrPool, domainName string) AddrPool {
+	if s, ok := p.(PoolSelector); ok {
+		return s.PoolFor(domainName)
+	}
+	return p
+}
+
+// Stats is a snapshot of mapping state for diagnostics.
+type Stats struct {
+	// Mappings is the number of stored mappings, including expired ones
+	// which are not purged yet.
+	Mappings int
+	// Addresses is the number of distinct addresses in use, counted
+	// separately for each namespace.
+	Addresses int
+	// DB holds database connection pool statistics. It's nil for backends
+	// without database.
+	DB *sql.DBStats
+	// Alloc describes address allocations.
+	Alloc AllocStats
+}
+
+// Mapping describes stored mapping. Pinned mappings never expire, so
+// Expire of them is meaningless.
+type Mapping struct {
+	ClientKey  string
+	DomainName string
+	Addr       netip.Addr
+	Expire     time.Time
+	Pinned     bool
+}
+
+// formatAddrList encodes addresses for storage.
+func formatAddrList(addrs []netip.Addr) string {
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return strings.Join(strs, " ")
+}
+
+func parseAddrList(s string) ([]netip.Addr, error) {
+	fields := strings.Fields(s)
+	res := make([]netip.Addr, 0, len(fields))
+	for _, field := range fields {
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, addr.Unmap())
+	}
+	return res, nil
+}
@@ -0,0 +1,79 @@
+package mapping
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+type mapperUnderTest interface {
+	EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error)
+	ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (domainName string, ok bool, err error)
+	Close() error
+}
+
+type namespacer interface {
+	Namespace(ns string) *NamespacedMapping
+	Close() error
+}
+
+// testKey returns client key of address s.
+func testKey(s string) clientkey.Key {
+	return clientkey.FromAddr(netip.MustParseAddr(s))
+}
+
+// smallPool is a deterministic pool with few addresses to provoke collisions.
+type smallPool struct {
+	rng *rand.Rand
+}
+
+func (p smallPool) GetRandom() netip.Addr {
+	return netip.AddrFrom4([4]byte{172, 24, 0, byte(p.rng.Intn(16))})
+}
+
+type fakeClock struct {
+	now time.Time
+	// stepped is the sum of wall clock steps, which monotonic clock
+	// doesn't follow.
+	stepped time.Duration
+}
+
+func (c *fakeClock) install(t testing.TB) {
+	origWall, origMono := timeNow, monoNow
+	base := c.now
+	timeNow = func() time.Time { return c.now }
+	monoNow = func() time.Duration { return c.now.Sub(base) - c.stepped }
+	t.Cleanup(func() { timeNow, monoNow = origWall, origMono })
+}
+
+// step moves wall clock without monotonic clock.
+func (c *fakeClock) step(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.stepped += d
+}
+
+// openSQLite opens SQLite backend. It's nil in builds without SQLite, and
+// tests then cover other backends only.
+var openSQLite func(dir string, addrPool AddrPool) (mapperUnderTest, error)
+
+// openMappers opens all backends with the same pool.
+func openMappers(t *testing.T, seed int64) map[string]mapperUnderTest {
+	p := smallPool{rand.New(rand.NewSource(seed))}
+	mappers := make(map[string]mapperUnderTest)
+	if openSQLite != nil {
+		sqlite, err := openSQLite(t.TempDir(), p)
+		if err != nil {
+			t.Fatalf("can't create SQLite mapping: %v", err)
+		}
+		mappers["sqlite"] = sqlite
+	}
+	memory, err := NewMemory(t.TempDir(), p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create memory mapping: %v", err)
+	}
+	mappers["memory"] = memory
+	return mappers
+}
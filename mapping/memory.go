@@ -0,0 +1,716 @@
+package mapping
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+const (
+	snapshotFileName        = "mapping.snapshot"
+	journalFileName         = "mapping.journal"
+	journalQueueSize        = 4096
+	journalFlushInterval    = 1 * time.Second
+	journalDropThreshold    = 256
+	DefaultSnapshotInterval = 5 * time.Minute
+)
+
+// InMemory is database path making memory mapping ephemeral: state is
+// neither recovered nor persisted.
+const InMemory = ":memory:"
+
+type record struct {
+	Namespace  string     `json:"n,omitempty"`
+	ClientKey  string     `json:"c"`
+	DomainName string     `json:"d"`
+	Slot       int        `json:"s,omitempty"`
+	MappedAddr netip.Addr `json:"a"`
+	Expire     int64      `json:"e"`
+	// TTL is the lease duration in seconds. It bounds expiration time
+	// after wall clock went backwards.
+	TTL int64 `json:"t,omitempty"`
+	// Pinned mapping never expires.
+	Pinned bool `json:"p,omitempty"`
+}
+
+type clientDomain struct {
+	namespace  string
+	clientKey  string
+	domainName string
+	slot       int
+}
+
+type clientAddr struct {
+	namespace string
+	clientKey string
+	addr      netip.Addr
+}
+
+type namespacedAddr struct {
+	namespace string
+	addr      netip.Addr
+}
+
+func (r *record) domainKey() clientDomain {
+	return clientDomain{r.Namespace, r.ClientKey, r.DomainName, r.Slot}
+}
+
+func (r *record) addrKey() clientAddr {
+	return clientAddr{r.Namespace, r.ClientKey, r.MappedAddr}
+}
+
+func (r *record) mapping() Mapping {
+	return Mapping{
+		ClientKey:  r.ClientKey,
+		DomainName: r.DomainName,
+		Addr:       r.MappedAddr,
+		Expire:     time.Unix(r.Expire, 0),
+		Pinned:     r.Pinned,
+	}
+}
+
+// MemoryMapping serves all lookups from RAM. Changes are journaled to disk
+// asynchronously and compacted into periodic snapshots, so state survives
+// restarts without putting disk I/O on the DNS hot path.
+//
+// Changes made while journal queue is full are not journaled. They are
+// persisted by snapshot taken at the next journal flush, or right away once
+// journalDropThreshold changes are dropped. Crash before that snapshot is
+// written loses them.
+type MemoryMapping struct {
+	addrPool    AddrPool
+	mux         sync.RWMutex
+	byDomain    map[clientDomain]*record
+	byAddr      map[clientAddr]*record
+	byAnyAddr   map[namespacedAddr]map[*record]struct{}
+	resolved    map[string]resolvedAddrs
+	lastCleanup time.Duration
+	clock       stepDetector
+	alloc       allocCounter
+
+	dir              string
+	snapshotInterval time.Duration
+	codec            recordCodec
+	journal          *os.File
+	journalCh        chan record
+	journalDropped   atomic.Int64
+	compactCh        chan struct{}
+	done             chan struct{}
+	persisterDone    chan struct{}
+	closeOnce        sync.Once
+}
+
+// NewMemory creates memory mapping persisting its state in dbPath
+// directory, unless dbPath is InMemory.
+func NewMemory(dbPath string, addrPool AddrPool, snapshotInterval time.Duration) (*MemoryMapping, error) {
+	return NewEncryptedMemory(dbPath, addrPool, snapshotInterval, nil)
+}
+
+// NewEncryptedMemory creates memory mapping which encrypts its snapshot and
+// journal with key derived from secret. Unencrypted state is read as well
+// and gets encrypted on the first snapshot.
+func NewEncryptedMemory(dbPath string, addrPool AddrPool, snapshotInterval time.Duration, secret []byte) (*MemoryMapping, error) {
+	codec, err := newRecordCodec(secret)
+	if err != nil {
+		return nil, fmt.Errorf("can't set up encryption: %w", err)
+	}
+	if snapshotInterval <= 0 {
+		snapshotInterval = DefaultSnapshotInterval
+	}
+	m := &MemoryMapping{
+		addrPool:         addrPool,
+		byDomain:         make(map[clientDomain]*record),
+		byAddr:           make(map[clientAddr]*record),
+		byAnyAddr:        make(map[namespacedAddr]map[*record]struct{}),
+		resolved:         make(map[string]resolvedAddrs),
+		dir:              dbPath,
+		snapshotInterval: snapshotInterval,
+		codec:            codec,
+		done:             make(chan struct{}),
+		persisterDone:    make(chan struct{}),
+	}
+	if dbPath == InMemory {
+		m.clock.observe()
+		close(m.persisterDone)
+		return m, nil
+	}
+	m.journalCh = make(chan record, journalQueueSize)
+	m.compactCh = make(chan struct{}, 1)
+
+	if err := m.recover(); err != nil {
+		return nil, fmt.Errorf("state recovery failed: %w", err)
+	}
+
+	// Compact recovered state right away so journal starts empty.
+	if err := m.writeSnapshot(m.copyRecords()); err != nil {
+		return nil, fmt.Errorf("initial snapshot failed: %w", err)
+	}
+
+	journal, err := os.OpenFile(m.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open journal: %w", err)
+	}
+	m.journal = journal
+	m.clock.observe()
+
+	go m.persister()
+
+	return m, nil
+}
+
+func (m *MemoryMapping) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	return m.ensureMapping("", clientKey.String(), domainName, 0, ttl, m.poolFor(domainName))
+}
+
+// EnsureMappings returns count distinct addresses mapped to domainName.
+func (m *MemoryMapping) EnsureMappings(clientKey clientkey.Key, domainName string, count int, ttl time.Duration) ([]netip.Addr, error) {
+	return ensureMappings(m, m.poolFor(domainName), "", clientKey.String(), domainName, count, ttl)
+}
+
+func (m *MemoryMapping) poolFor(domainName string) AddrPool {
+	return selectPool(m.addrPool, domainName)
+}
+
+func (m *MemoryMapping) ensureMapping(namespace, clientKey, domainName string, slot int, ttl time.Duration, addrPool AddrPool) (netip.Addr, error) {
+	m.cleanup()
+
+	ttlSec := ttlSeconds(ttl)
+	expire := timeNow().Unix() + ttlSec
+	dKey := clientDomain{namespace, clientKey, domainName, slot}
+
+	m.mux.Lock()
+	if rec, ok := m.byDomain[dKey]; ok {
+		rec.Expire = expire
+		rec.TTL = ttlSec
+		res := *rec
+		m.persist(res)
+		m.mux.Unlock()
+		return res.MappedAddr, nil
+	}
+
+	start := monoNow()
+	for i := 0; i < insertRetries; i++ {
+		addrCandidate := addrPool.GetRandom()
+		aKey := clientAddr{namespace, clientKey, addrCandidate}
+		if _, taken := m.byAddr[aKey]; taken {
+			continue
+		}
+		rec := &record{
+			Namespace:  namespace,
+			ClientKey:  clientKey,
+			DomainName: domainName,
+			Slot:       slot,
+			MappedAddr: addrCandidate,
+			Expire:     expire,
+			TTL:        ttlSec,
+		}
+		m.link(rec)
+		res := *rec
+		m.persist(res)
+		m.mux.Unlock()
+		m.alloc.record(start, i, false)
+		return res.MappedAddr, nil
+	}
+	m.mux.Unlock()
+	m.alloc.record(start, insertRetries, true)
+	return netip.Addr{}, ErrTooManyAttempts
+}
+
+func (m *MemoryMapping) ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (domainName string, ok bool, err error) {
+	return m.reverseLookup("", clientKey.String(), addr)
+}
+
+func (m *MemoryMapping) reverseLookup(namespace, clientKey string, addr netip.Addr) (domainName string, ok bool, err error) {
+	addr = addr.Unmap()
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	rec, ok := m.byAddr[clientAddr{namespace, clientKey, addr}]
+	if !ok {
+		return "", false, nil
+	}
+	return rec.DomainName, true, nil
+}
+
+// ReverseLookupAnyClient finds domain mapped to addr for any client. If
+// several clients have this address mapped, most recently refreshed mapping
+// wins.
+func (m *MemoryMapping) ReverseLookupAnyClient(addr netip.Addr) (domainName string, ok bool, err error) {
+	return m.reverseLookupAnyClient("", addr)
+}
+
+func (m *MemoryMapping) reverseLookupAnyClient(namespace string, addr netip.Addr) (domainName string, ok bool, err error) {
+	addr = addr.Unmap()
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	var best *record
+	for rec := range m.byAnyAddr[namespacedAddr{namespace, addr}] {
+		if best == nil || rec.Expire > best.Expire {
+			best = rec
+		}
+	}
+	if best == nil {
+		return "", false, nil
+	}
+	return best.DomainName, true, nil
+}
+
+// WalkMappings calls fn for each live mapping.
+func (m *MemoryMapping) WalkMappings(fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error {
+	return m.walkMappings("", fn)
+}
+
+func (m *MemoryMapping) walkMappings(namespace string, fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error {
+	now := timeNow().Unix()
+	var records []record
+	m.mux.RLock()
+	for _, rec := range m.byDomain {
+		if rec.Namespace == namespace && (rec.Expire >= now || rec.Pinned) {
+			records = append(records, *rec)
+		}
+	}
+	m.mux.RUnlock()
+	for _, rec := range records {
+		fn(rec.ClientKey, rec.DomainName, rec.MappedAddr, time.Unix(rec.Expire, 0))
+	}
+	return nil
+}
+
+// Pin makes mapping of addr for client permanent. ok is false if there is
+// no such mapping.
+func (m *MemoryMapping) Pin(clientKey clientkey.Key, addr netip.Addr) (res Mapping, ok bool, err error) {
+	return m.setPinned("", clientKey.String(), addr, true)
+}
+
+// Unpin makes pinned mapping expire as usual. It's kept at least for its
+// lease duration.
+func (m *MemoryMapping) Unpin(clientKey clientkey.Key, addr netip.Addr) (res Mapping, ok bool, err error) {
+	return m.setPinned("", clientKey.String(), addr, false)
+}
+
+func (m *MemoryMapping) setPinned(namespace, clientKey string, addr netip.Addr, pinned bool) (Mapping, bool, error) {
+	m.mux.Lock()
+	rec, ok := m.byAddr[clientAddr{namespace, clientKey, addr.Unmap()}]
+	if !ok {
+		m.mux.Unlock()
+		return Mapping{}, false, nil
+	}
+	rec.Pinned = pinned
+	if expire := timeNow().Unix() + rec.TTL; !pinned && rec.Expire < expire {
+		rec.Expire = expire
+	}
+	res := *rec
+	m.persist(res)
+	m.mux.Unlock()
+	return res.mapping(), true, nil
+}
+
+// WalkPinned calls fn for each pinned mapping.
+func (m *MemoryMapping) WalkPinned(fn func(Mapping)) error {
+	return m.walkPinned("", fn)
+}
+
+func (m *MemoryMapping) walkPinned(namespace string, fn func(Mapping)) error {
+	var res []Mapping
+	m.mux.RLock()
+	for _, rec := range m.byDomain {
+		if rec.Namespace == namespace && rec.Pinned {
+			res = append(res, rec.mapping())
+		}
+	}
+	m.mux.RUnlock()
+	for _, item := range res {
+		fn(item)
+	}
+	return nil
+}
+
+// Namespace returns view of mapping confined to namespace ns.
+func (m *MemoryMapping) Namespace(ns string) *NamespacedMapping {
+	return &NamespacedMapping{backend: m, namespace: ns}
+}
+
+// Stats returns snapshot of mapping state.
+func (m *MemoryMapping) Stats() (Stats, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return Stats{
+		Mappings:  len(m.byDomain),
+		Addresses: len(m.byAnyAddr),
+		Alloc:     m.alloc.snapshot(),
+	}, nil
+}
+
+func (m *MemoryMapping) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		<-m.persisterDone
+	})
+	return nil
+}
+
+func (m *MemoryMapping) cleanup() {
+	m.mux.RLock()
+	lastCleanup := m.lastCleanup
+	m.mux.RUnlock()
+
+	if monoNow()-lastCleanup > cleanupDebounceInterval {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		if step := m.clock.observe(); step != 0 {
+			log.Printf("wall clock stepped by %v, shifting mapping expiration", step)
+			m.shiftExpiry(int64(step.Round(time.Second) / time.Second))
+		}
+		m.purgeExpired(timeNow().Unix())
+		m.lastCleanup = monoNow()
+	}
+}
+
+// shiftExpiry moves expiration times by delta seconds, so leases keep
+// their remaining duration across wall clock step. Must be called with
+// write lock held.
+func (m *MemoryMapping) shiftExpiry(delta int64) {
+	for _, rec := range m.byDomain {
+		rec.Expire += delta
+	}
+	for domainName, entry := range m.resolved {
+		entry.expire += delta
+		m.resolved[domainName] = entry
+	}
+}
+
+// clampExpiry limits expiration times to lease duration from now. Records
+// expiring later were stored while wall clock was ahead. Must be called
+// with write lock held.
+func (m *MemoryMapping) clampExpiry(now int64) {
+	for _, rec := range m.byDomain {
+		if rec.TTL > 0 && rec.Expire > now+rec.TTL {
+			rec.Expire = now + rec.TTL
+		}
+	}
+}
+
+// purgeExpired must be called with write lock held.
+func (m *MemoryMapping) purgeExpired(now int64) {
+	for _, rec := range m.byDomain {
+		if rec.Expire < now && !rec.Pinned {
+			m.unlink(rec)
+		}
+	}
+	for domainName, entry := range m.resolved {
+		if entry.expire < now {
+			delete(m.resolved, domainName)
+		}
+	}
+}
+
+type resolvedAddrs struct {
+	addrs  []netip.Addr
+	expire int64
+}
+
+// LookupResolved returns real addresses of domain stored by StoreResolved,
+// unless they are expired.
+func (m *MemoryMapping) LookupResolved(domainName string) (addrs []netip.Addr, ok bool, err error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	entry, ok := m.resolved[domainName]
+	if !ok || entry.expire < timeNow().Unix() {
+		return nil, false, nil
+	}
+	return entry.addrs, true, nil
+}
+
+// StoreResolved saves real addresses of domain for ttl. Unlike mappings,
+// they are not persisted.
+func (m *MemoryMapping) StoreResolved(domainName string, addrs []netip.Addr, ttl time.Duration) error {
+	m.cleanup()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.resolved[domainName] = resolvedAddrs{
+		addrs:  append([]netip.Addr(nil), addrs...),
+		expire: timeNow().Unix() + ttlSeconds(ttl),
+	}
+	return nil
+}
+
+// insertRecovered applies record read from disk. Journal entries may come
+// out of order, so the latest expiration wins on any conflict. Of records
+// expiring at the same time the later one wins, as pinning doesn't change
+// expiration.
+func (m *MemoryMapping) insertRecovered(rec record) {
+	dKey := rec.domainKey()
+	aKey := rec.addrKey()
+	if old, ok := m.byDomain[dKey]; ok {
+		if old.Expire > rec.Expire {
+			return
+		}
+		m.unlink(old)
+	}
+	if old, ok := m.byAddr[aKey]; ok {
+		if old.Expire > rec.Expire {
+			return
+		}
+		m.unlink(old)
+	}
+	stored := rec
+	m.link(&stored)
+}
+
+// link adds record to all indexes. Must be called with write lock held.
+func (m *MemoryMapping) link(rec *record) {
+	m.byDomain[rec.domainKey()] = rec
+	m.byAddr[rec.addrKey()] = rec
+	nsAddr := namespacedAddr{rec.Namespace, rec.MappedAddr}
+	set, ok := m.byAnyAddr[nsAddr]
+	if !ok {
+		set = make(map[*record]struct{})
+		m.byAnyAddr[nsAddr] = set
+	}
+	set[rec] = struct{}{}
+}
+
+// unlink removes record from all indexes. Must be called with write lock
+// held.
+func (m *MemoryMapping) unlink(rec *record) {
+	delete(m.byDomain, rec.domainKey())
+	delete(m.byAddr, rec.addrKey())
+	nsAddr := namespacedAddr{rec.Namespace, rec.MappedAddr}
+	if set, ok := m.byAnyAddr[nsAddr]; ok {
+		delete(set, rec)
+		if len(set) == 0 {
+			delete(m.byAnyAddr, nsAddr)
+		}
+	}
+}
+
+func (m *MemoryMapping) recover() error {
+	for _, path := range []string{m.snapshotPath(), m.journalPath()} {
+		if err := m.loadFile(path); err != nil {
+			return err
+		}
+	}
+	now := timeNow().Unix()
+	m.clampExpiry(now)
+	m.purgeExpired(now)
+	return nil
+}
+
+// CheckMemory reads state of memory mapping in dbPath without modifying
+// it, so it's safe to run along with the service. It returns the number of
+// live mappings. secret is the encryption secret of state, if any.
+func CheckMemory(dbPath string, secret []byte) (int, error) {
+	codec, err := newRecordCodec(secret)
+	if err != nil {
+		return 0, fmt.Errorf("can't set up encryption: %w", err)
+	}
+	m := &MemoryMapping{
+		byDomain:  make(map[clientDomain]*record),
+		byAddr:    make(map[clientAddr]*record),
+		byAnyAddr: make(map[namespacedAddr]map[*record]struct{}),
+		dir:       dbPath,
+		codec:     codec,
+	}
+	for _, path := range []string{m.snapshotPath(), m.journalPath()} {
+		if err := m.loadFile(path); err != nil {
+			return 0, err
+		}
+	}
+	m.purgeExpired(timeNow().Unix())
+	return len(m.byDomain), nil
+}
+
+func (m *MemoryMapping) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("can't open %q: %w", path, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err != io.EOF {
+				return fmt.Errorf("can't read %q: %w", path, err)
+			}
+			return nil
+		}
+		rec, decodeErr := m.codec.decode(line)
+		if decodeErr != nil {
+			// Tail of the file may be torn by crash, but records which
+			// can't be decrypted aren't readable anywhere else either.
+			if errors.Is(decodeErr, errEncryptedState) || (errors.Is(decodeErr, errDecrypt) && err == nil) {
+				return fmt.Errorf("can't read %q: %w", path, decodeErr)
+			}
+			log.Printf("stopped reading %q on bad record: %v", path, decodeErr)
+			return nil
+		}
+		m.insertRecovered(rec)
+	}
+}
+
+func (m *MemoryMapping) copyRecords() []record {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	res := make([]record, 0, len(m.byDomain))
+	for _, rec := range m.byDomain {
+		res = append(res, *rec)
+	}
+	return res
+}
+
+func (m *MemoryMapping) writeSnapshot(records []record) error {
+	tmpPath := m.snapshotPath() + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("can't create snapshot file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	wr := bufio.NewWriter(f)
+	for _, rec := range records {
+		line, err := m.codec.encode(rec)
+		if err == nil {
+			_, err = wr.Write(line)
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("snapshot write failed: %w", err)
+		}
+	}
+	if err := wr.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("snapshot write failed: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("snapshot sync failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("snapshot close failed: %w", err)
+	}
+	if err := os.Rename(tmpPath, m.snapshotPath()); err != nil {
+		return fmt.Errorf("snapshot rename failed: %w", err)
+	}
+	return nil
+}
+
+// persist queues record for journal of persistent mapping. It's called with
+// m.mux held, so records of the same mapping are journaled in order of
+// changes. It never blocks, as persister needs m.mux to take snapshot: if
+// persister falls behind, record is dropped and next snapshot covers it.
+// Persister is asked to take that snapshot without waiting for journal
+// flush once journalDropThreshold records are dropped.
+func (m *MemoryMapping) persist(rec record) {
+	if m.journalCh == nil {
+		return
+	}
+	select {
+	case m.journalCh <- rec:
+	case <-m.done:
+	default:
+		if m.journalDropped.Add(1) == journalDropThreshold {
+			select {
+			case m.compactCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// persister is the only writer of journal and snapshot files. Records
+// queued after a snapshot copy is taken get appended to the fresh journal,
+// so nothing is lost between compactions.
+func (m *MemoryMapping) persister() {
+	defer close(m.persisterDone)
+	defer m.journal.Close()
+
+	wr := bufio.NewWriter(m.journal)
+	flushTicker := time.NewTicker(journalFlushInterval)
+	defer flushTicker.Stop()
+	snapshotTicker := time.NewTicker(m.snapshotInterval)
+	defer snapshotTicker.Stop()
+
+	appendRecord := func(rec record) {
+		line, err := m.codec.encode(rec)
+		if err == nil {
+			_, err = wr.Write(line)
+		}
+		if err != nil {
+			log.Printf("journal write failed: %v", err)
+		}
+	}
+	compact := func() {
+		// Queued records predate the copy, so they go to journal being
+		// replaced. Otherwise they would be replayed over newer state of
+		// records dropped after them.
+		for n := len(m.journalCh); n > 0; n-- {
+			appendRecord(<-m.journalCh)
+		}
+		if err := m.writeSnapshot(m.copyRecords()); err != nil {
+			log.Printf("mapping snapshot failed: %v", err)
+			return
+		}
+		wr.Reset(m.journal)
+		if err := m.journal.Truncate(0); err != nil {
+			log.Printf("journal truncate failed: %v", err)
+		}
+		if _, err := m.journal.Seek(0, io.SeekStart); err != nil {
+			log.Printf("journal seek failed: %v", err)
+		}
+	}
+	compactDropped := func() {
+		if dropped := m.journalDropped.Swap(0); dropped > 0 {
+			log.Printf("journal queue overflowed, %d records dropped, taking snapshot", dropped)
+			compact()
+		}
+	}
+
+	for {
+		select {
+		case rec := <-m.journalCh:
+			appendRecord(rec)
+		case <-flushTicker.C:
+			if err := wr.Flush(); err != nil {
+				log.Printf("journal flush failed: %v", err)
+			}
+			compactDropped()
+		case <-m.compactCh:
+			compactDropped()
+		case <-snapshotTicker.C:
+			compact()
+		case <-m.done:
+			for {
+				select {
+				case rec := <-m.journalCh:
+					appendRecord(rec)
+				default:
+					wr.Flush()
+					compact()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (m *MemoryMapping) snapshotPath() string {
+	return filepath.Join(m.dir, snapshotFileName)
+}
+
+func (m *MemoryMapping) journalPath() string {
+	return filepath.Join(m.dir, journalFileName)
+}
@@ -0,0 +1,255 @@
+package mapping
+
+import (
+	"bytes"
+	"math/rand"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/pool"
+)
+
+func TestMemoryRecovery(t *testing.T) {
+	dir := t.TempDir()
+	p, err := pool.New([]pool.Range{pool.PrefixRange(netip.MustParsePrefix("172.24.0.0/16"))})
+	if err != nil {
+		t.Fatalf("can't create IP pool: %v", err)
+	}
+
+	m, err := NewMemory(dir, p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	addr, err := m.EnsureMapping(testKey("127.0.0.1"), "example.org", time.Minute)
+	if err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	again, err := m.EnsureMapping(testKey("127.0.0.1"), "example.org", time.Minute)
+	if err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	if addr != again {
+		t.Fatalf("mapping changed address: %s != %s", addr, again)
+	}
+	m.Close()
+
+	m, err = NewMemory(dir, p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't reopen mapping: %v", err)
+	}
+	defer m.Close()
+	domainName, ok, err := m.ReverseLookup(testKey("127.0.0.1"), addr)
+	if err != nil {
+		t.Fatalf("ReverseLookup failed: %v", err)
+	}
+	if !ok || domainName != "example.org" {
+		t.Fatalf("mapping was not recovered: ok=%v domainName=%q", ok, domainName)
+	}
+}
+
+func TestEphemeralMemory(t *testing.T) {
+	p, err := pool.New([]pool.Range{pool.PrefixRange(netip.MustParsePrefix("172.24.0.0/16"))})
+	if err != nil {
+		t.Fatalf("can't create IP pool: %v", err)
+	}
+	m, err := NewMemory(InMemory, p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	addr, err := m.EnsureMapping(testKey("127.0.0.1"), "example.org", time.Minute)
+	if err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	if domainName, ok, err := m.ReverseLookup(testKey("127.0.0.1"), addr); err != nil || !ok || domainName != "example.org" {
+		t.Fatalf("ReverseLookup returned (%q, %v, %v)", domainName, ok, err)
+	}
+	if _, ok, _ := m.ReverseLookup(testKey("127.0.0.2"), addr); ok {
+		t.Error("mapping found for another client")
+	}
+	m.Close()
+	if _, err := os.Stat(InMemory); err == nil {
+		t.Errorf("ephemeral mapping created %s", InMemory)
+	}
+}
+
+func TestMemoryEncryption(t *testing.T) {
+	dir := t.TempDir()
+	p := smallPool{rand.New(rand.NewSource(1))}
+	secret := []byte("correct horse battery staple")
+
+	// Unencrypted state is taken over and encrypted.
+	m, err := NewMemory(dir, p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	addr, err := m.EnsureMapping(testKey("127.0.0.1"), "example.org", time.Minute)
+	if err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	m.Close()
+	m, err = NewEncryptedMemory(dir, p, time.Hour, secret)
+	if err != nil {
+		t.Fatalf("can't open mapping with encryption: %v", err)
+	}
+	if _, err := m.EnsureMapping(testKey("127.0.0.1"), "example.com", time.Minute); err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	m.Close()
+
+	for _, name := range []string{snapshotFileName, journalFileName} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("can't read %s: %v", name, err)
+		}
+		if bytes.Contains(content, []byte("example")) {
+			t.Errorf("%s holds domain names in plaintext", name)
+		}
+	}
+
+	if m, err := NewMemory(dir, p, time.Hour); err == nil {
+		m.Close()
+		t.Errorf("encrypted state was opened without key")
+	}
+	if m, err := NewEncryptedMemory(dir, p, time.Hour, []byte("wrong")); err == nil {
+		m.Close()
+		t.Errorf("encrypted state was opened with wrong key")
+	}
+
+	m, err = NewEncryptedMemory(dir, p, time.Hour, secret)
+	if err != nil {
+		t.Fatalf("can't reopen encrypted mapping: %v", err)
+	}
+	defer m.Close()
+	if domainName, ok, err := m.ReverseLookup(testKey("127.0.0.1"), addr); err != nil || !ok || domainName != "example.org" {
+		t.Errorf("mapping was not recovered: (%q, %v, %v)", domainName, ok, err)
+	}
+}
+
+func TestMemoryJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	p := smallPool{rand.New(rand.NewSource(1))}
+	m, err := NewMemory(dir, p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	defer m.Close()
+	addr, err := m.EnsureMapping(testKey("127.0.0.1"), "example.org", time.Minute)
+	if err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+
+	// Refreshes race with pin changes, the last change has to win.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			m.EnsureMapping(testKey("127.0.0.1"), "example.org", time.Minute)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		m.Pin(testKey("127.0.0.1"), addr)
+		m.Unpin(testKey("127.0.0.1"), addr)
+	}
+	<-done
+
+	// Copy state before Close compacts it, as if process crashed.
+	time.Sleep(2 * journalFlushInterval)
+	crashDir := t.TempDir()
+	for _, name := range []string{snapshotFileName, journalFileName} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("can't read %s: %v", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(crashDir, name), content, 0600); err != nil {
+			t.Fatalf("can't write %s: %v", name, err)
+		}
+	}
+	recovered, err := NewMemory(crashDir, p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't recover mapping: %v", err)
+	}
+	defer recovered.Close()
+	recovered.WalkPinned(func(mapping Mapping) {
+		t.Errorf("mapping %s => %s recovered pinned after unpin", mapping.DomainName, mapping.Addr)
+	})
+}
+
+func TestMemoryPersistAfterClose(t *testing.T) {
+	m, err := NewMemory(t.TempDir(), smallPool{rand.New(rand.NewSource(1))}, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	m.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*journalQueueSize; i++ {
+			m.EnsureMapping(testKey("127.0.0.1"), "example.org", time.Minute)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("EnsureMapping blocked after Close")
+	}
+}
+
+func TestCheckMemory(t *testing.T) {
+	dir := t.TempDir()
+	secret := []byte("secret")
+	m, err := NewEncryptedMemory(dir, smallPool{rand.New(rand.NewSource(1))}, time.Hour, secret)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	for _, name := range []string{"example.org", "example.com"} {
+		if _, err := m.EnsureMapping(testKey("127.0.0.1"), name, time.Minute); err != nil {
+			t.Fatalf("EnsureMapping failed: %v", err)
+		}
+	}
+	m.Close()
+	snapshot, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		t.Fatalf("can't read snapshot: %v", err)
+	}
+
+	if n, err := CheckMemory(dir, secret); err != nil || n != 2 {
+		t.Errorf("CheckMemory = %d, %v; expected 2 mappings", n, err)
+	}
+	if _, err := CheckMemory(dir, []byte("wrong")); err == nil {
+		t.Error("CheckMemory read state with wrong key")
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, snapshotFileName)); err != nil || !bytes.Equal(content, snapshot) {
+		t.Error("CheckMemory modified snapshot")
+	}
+}
+
+func TestMemoryPersistOverflow(t *testing.T) {
+	m := &MemoryMapping{
+		journalCh: make(chan record, 1),
+		compactCh: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	m.persist(record{})
+	for i := 1; i < journalDropThreshold; i++ {
+		m.persist(record{})
+	}
+	select {
+	case <-m.compactCh:
+		t.Fatal("snapshot requested before drop threshold")
+	default:
+	}
+	m.persist(record{})
+	m.persist(record{})
+	select {
+	case <-m.compactCh:
+	default:
+		t.Fatal("snapshot wasn't requested at drop threshold")
+	}
+	if dropped := m.journalDropped.Load(); dropped != journalDropThreshold+1 {
+		t.Errorf("counted %d dropped records, expected %d", dropped, journalDropThreshold+1)
+	}
+}
@@ -0,0 +1,82 @@
+package mapping
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+func TestEnsureMappings(t *testing.T) {
+	for name, m := range openMappers(t, 1) {
+		t.Run(name, func(t *testing.T) {
+			defer m.Close()
+			multi := m.(interface {
+				EnsureMappings(clientKey clientkey.Key, domainName string, count int, ttl time.Duration) ([]netip.Addr, error)
+			})
+			addrs, err := multi.EnsureMappings(testKey("10.0.0.1"), "example.org", 3, time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMappings failed: %v", err)
+			}
+			seen := make(map[netip.Addr]bool)
+			for _, addr := range addrs {
+				if seen[addr] {
+					t.Fatalf("address %s is returned twice: %v", addr, addrs)
+				}
+				seen[addr] = true
+				domainName, ok, err := m.ReverseLookup(testKey("10.0.0.1"), addr)
+				if err != nil || !ok || domainName != "example.org" {
+					t.Fatalf("unexpected reverse lookup result for %s: (%q, %v, %v)", addr, domainName, ok, err)
+				}
+			}
+			again, err := multi.EnsureMappings(testKey("10.0.0.1"), "example.org", 3, time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMappings failed: %v", err)
+			}
+			for i := range addrs {
+				if again[i] != addrs[i] {
+					t.Fatalf("mappings changed on refresh: %v -> %v", addrs, again)
+				}
+			}
+			first, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil || first != addrs[0] {
+				t.Fatalf("EnsureMapping returned (%s, %v), expected first slot %s", first, err, addrs[0])
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	for name, m := range openMappers(t, 1) {
+		t.Run(name, func(t *testing.T) {
+			defer m.Close()
+			ns, ok := m.(namespacer)
+			if !ok {
+				t.Fatal("mapper doesn't support namespaces")
+			}
+			if _, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute); err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if _, err := m.EnsureMapping(testKey("10.0.0.2"), "example.org", time.Minute); err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if _, err := ns.Namespace("a").EnsureMapping(testKey("10.0.0.1"), "example.com", time.Minute); err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			stats, err := m.(interface{ Stats() (Stats, error) }).Stats()
+			if err != nil {
+				t.Fatalf("Stats failed: %v", err)
+			}
+			if stats.Mappings != 3 {
+				t.Fatalf("got %d mappings, expected 3", stats.Mappings)
+			}
+			if stats.Addresses < 2 || stats.Addresses > 3 {
+				t.Fatalf("got %d addresses, expected 2 or 3", stats.Addresses)
+			}
+			if (name == "sqlite") != (stats.DB != nil) {
+				t.Fatalf("unexpected DB stats presence: %v", stats.DB)
+			}
+		})
+	}
+}
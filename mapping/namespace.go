@@ -0,0 +1,107 @@
+package mapping
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+type namespacedBackend interface {
+	ensureMapping(namespace, clientKey, domainName string, slot int, ttl time.Duration, addrPool AddrPool) (netip.Addr, error)
+	poolFor(domainName string) AddrPool
+	reverseLookup(namespace, clientKey string, addr netip.Addr) (domainName string, ok bool, err error)
+	reverseLookupAnyClient(namespace string, addr netip.Addr) (domainName string, ok bool, err error)
+	walkMappings(namespace string, fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error
+	setPinned(namespace, clientKey string, addr netip.Addr, pinned bool) (Mapping, bool, error)
+	walkPinned(namespace string, fn func(Mapping)) error
+	LookupResolved(domainName string) (addrs []netip.Addr, ok bool, err error)
+	StoreResolved(domainName string, addrs []netip.Addr, ttl time.Duration) error
+}
+
+// NamespacedMapping is a view of mapping storage confined to a namespace.
+// Several namespaces share the same storage, but their domains and mapped
+// addresses are independent, so they may overlap without conflicts.
+type NamespacedMapping struct {
+	backend   namespacedBackend
+	namespace string
+	addrPool  AddrPool
+}
+
+// WithPool returns view of the same namespace which allocates addresses
+// of new mappings from p, regardless of domain names.
+func (n *NamespacedMapping) WithPool(p AddrPool) *NamespacedMapping {
+	return &NamespacedMapping{
+		backend:   n.backend,
+		namespace: n.namespace,
+		addrPool:  p,
+	}
+}
+
+func (n *NamespacedMapping) poolFor(domainName string) AddrPool {
+	if n.addrPool != nil {
+		return n.addrPool
+	}
+	return n.backend.poolFor(domainName)
+}
+
+func (n *NamespacedMapping) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	return n.backend.ensureMapping(n.namespace, clientKey.String(), domainName, 0, ttl, n.poolFor(domainName))
+}
+
+func (n *NamespacedMapping) EnsureMappings(clientKey clientkey.Key, domainName string, count int, ttl time.Duration) ([]netip.Addr, error) {
+	return ensureMappings(n.backend, n.poolFor(domainName), n.namespace, clientKey.String(), domainName, count, ttl)
+}
+
+func (n *NamespacedMapping) ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (domainName string, ok bool, err error) {
+	return n.backend.reverseLookup(n.namespace, clientKey.String(), addr)
+}
+
+func (n *NamespacedMapping) ReverseLookupAnyClient(addr netip.Addr) (domainName string, ok bool, err error) {
+	return n.backend.reverseLookupAnyClient(n.namespace, addr)
+}
+
+// WalkMappings calls fn for each live mapping of namespace.
+func (n *NamespacedMapping) WalkMappings(fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error {
+	return n.backend.walkMappings(n.namespace, fn)
+}
+
+// Pin makes mapping of addr for client permanent. ok is false if there is
+// no such mapping in namespace.
+func (n *NamespacedMapping) Pin(clientKey clientkey.Key, addr netip.Addr) (res Mapping, ok bool, err error) {
+	return n.backend.setPinned(n.namespace, clientKey.String(), addr, true)
+}
+
+// Unpin makes pinned mapping expire as usual.
+func (n *NamespacedMapping) Unpin(clientKey clientkey.Key, addr netip.Addr) (res Mapping, ok bool, err error) {
+	return n.backend.setPinned(n.namespace, clientKey.String(), addr, false)
+}
+
+// WalkPinned calls fn for each pinned mapping of namespace.
+func (n *NamespacedMapping) WalkPinned(fn func(Mapping)) error {
+	return n.backend.walkPinned(n.namespace, fn)
+}
+
+// LookupResolved returns real addresses of domain. They are shared between
+// namespaces.
+func (n *NamespacedMapping) LookupResolved(domainName string) (addrs []netip.Addr, ok bool, err error) {
+	return n.backend.LookupResolved(domainName)
+}
+
+func (n *NamespacedMapping) StoreResolved(domainName string, addrs []netip.Addr, ttl time.Duration) error {
+	return n.backend.StoreResolved(domainName, addrs, ttl)
+}
+
+// ensureMappings maps domain to slots 0..count-1, each slot holding its own
+// address.
+func ensureMappings(b namespacedBackend, addrPool AddrPool, namespace, clientKey, domainName string, count int, ttl time.Duration) ([]netip.Addr, error) {
+	res := make([]netip.Addr, 0, count)
+	for slot := 0; slot < count; slot++ {
+		addr, err := b.ensureMapping(namespace, clientKey, domainName, slot, ttl, addrPool)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, addr)
+	}
+	return res, nil
+}
@@ -0,0 +1,272 @@
+//go:build !nosqlite
+
+package mapping
+
+import (
+	"database/sql"
+	"math/rand"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+func TestNamespaceIsolation(t *testing.T) {
+	p := smallPool{rand.New(rand.NewSource(1))}
+	sqlite, err := New(t.TempDir(), p)
+	if err != nil {
+		t.Fatalf("can't create SQLite mapping: %v", err)
+	}
+	memory, err := NewMemory(t.TempDir(), p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create memory mapping: %v", err)
+	}
+	for name, m := range map[string]namespacer{"sqlite": sqlite, "memory": memory} {
+		t.Run(name, func(t *testing.T) {
+			defer m.Close()
+			a, b := m.Namespace("a"), m.Namespace("b")
+			addr, err := a.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if _, ok, _ := b.ReverseLookup(testKey("10.0.0.1"), addr); ok {
+				t.Fatalf("mapping from namespace a leaked into namespace b")
+			}
+			domainName, ok, err := a.ReverseLookup(testKey("10.0.0.1"), addr)
+			if err != nil || !ok || domainName != "example.org" {
+				t.Fatalf("unexpected reverse lookup result: (%q, %v, %v)", domainName, ok, err)
+			}
+		})
+	}
+}
+
+func TestReverseLookupAnyClient(t *testing.T) {
+	for name, m := range openMappers(t, 1) {
+		t.Run(name, func(t *testing.T) {
+			defer m.Close()
+			addr, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if _, ok, _ := m.ReverseLookup(testKey("10.0.0.2"), addr); ok {
+				t.Fatalf("exact lookup matched foreign client")
+			}
+			anyClient := m.(interface {
+				ReverseLookupAnyClient(netip.Addr) (string, bool, error)
+			})
+			domainName, ok, err := anyClient.ReverseLookupAnyClient(addr)
+			if err != nil || !ok || domainName != "example.org" {
+				t.Fatalf("unexpected any-client lookup result: (%q, %v, %v)", domainName, ok, err)
+			}
+		})
+	}
+}
+
+func TestReverseLookupMappedAddr(t *testing.T) {
+	for name, m := range openMappers(t, 1) {
+		t.Run(name, func(t *testing.T) {
+			defer m.Close()
+			addr, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			mapped := netip.AddrFrom16(addr.As16())
+			domainName, ok, err := m.ReverseLookup(testKey("10.0.0.1"), mapped)
+			if err != nil || !ok || domainName != "example.org" {
+				t.Fatalf("unexpected reverse lookup result for %s: (%q, %v, %v)", mapped, domainName, ok, err)
+			}
+			anyClient := m.(interface {
+				ReverseLookupAnyClient(netip.Addr) (string, bool, error)
+			})
+			domainName, ok, err = anyClient.ReverseLookupAnyClient(mapped)
+			if err != nil || !ok || domainName != "example.org" {
+				t.Fatalf("unexpected any-client lookup result for %s: (%q, %v, %v)", mapped, domainName, ok, err)
+			}
+		})
+	}
+}
+
+func TestLegacySchemaMigration(t *testing.T) {
+	dir := t.TempDir()
+	dbURL := url.URL{
+		Scheme:   "file",
+		Path:     filepath.Join(dir, "mapping.db"),
+		OmitHost: true,
+	}
+	db, err := sql.Open("sqlite", dbURL.String())
+	if err != nil {
+		t.Fatalf("can't open database: %v", err)
+	}
+	for _, query := range append(migrations[0],
+		`INSERT INTO mapping VALUES ('10.0.0.1', 'example.org', '172.24.0.1', 4000000000)`) {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("legacy setup failed: %v", err)
+		}
+	}
+	db.Close()
+
+	m, err := New(dir, smallPool{rand.New(rand.NewSource(1))})
+	if err != nil {
+		t.Fatalf("can't open legacy database: %v", err)
+	}
+	defer m.Close()
+	addr, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+	if err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	if addr.String() != "172.24.0.1" {
+		t.Fatalf("legacy mapping was not preserved: got %s", addr)
+	}
+}
+
+func TestResolvedCache(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	clock.install(t)
+	p := smallPool{rand.New(rand.NewSource(1))}
+	sqlite, err := New(t.TempDir(), p)
+	if err != nil {
+		t.Fatalf("can't create SQLite mapping: %v", err)
+	}
+	memory, err := NewMemory(t.TempDir(), p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create memory mapping: %v", err)
+	}
+	for name, m := range map[string]namespacer{"sqlite": sqlite, "memory": memory} {
+		t.Run(name, func(t *testing.T) {
+			defer m.Close()
+			a, b := m.Namespace("a"), m.Namespace("b")
+			if _, ok, err := a.LookupResolved("example.org"); ok || err != nil {
+				t.Fatalf("unexpected lookup result for unknown domain: (%v, %v)", ok, err)
+			}
+			addrs := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+			if err := a.StoreResolved("example.org", addrs, time.Minute); err != nil {
+				t.Fatalf("StoreResolved failed: %v", err)
+			}
+			got, ok, err := b.LookupResolved("example.org")
+			if err != nil || !ok || len(got) != 2 || got[0] != addrs[0] || got[1] != addrs[1] {
+				t.Fatalf("unexpected lookup result: (%v, %v, %v)", got, ok, err)
+			}
+
+			clock.now = clock.now.Add(2 * time.Minute)
+			if _, ok, _ := a.LookupResolved("example.org"); ok {
+				t.Errorf("expired addresses are returned")
+			}
+			clock.now = clock.now.Add(-2 * time.Minute)
+		})
+	}
+}
+
+func TestWalkMappings(t *testing.T) {
+	for name, m := range openMappers(t, 1) {
+		t.Run(name, func(t *testing.T) {
+			defer m.Close()
+			addr, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			ns := m.(namespacer).Namespace("a")
+			if _, err := ns.EnsureMapping(testKey("10.0.0.1"), "example.com", time.Minute); err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			walker := m.(interface {
+				WalkMappings(func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error
+			})
+			var seen []string
+			err = walker.WalkMappings(func(clientKey, domainName string, a netip.Addr, expire time.Time) {
+				seen = append(seen, domainName)
+				if clientKey != testKey("10.0.0.1").String() || a != addr || expire.Before(time.Now()) {
+					t.Errorf("unexpected mapping (%q, %q, %s, %v)", clientKey, domainName, a, expire)
+				}
+			})
+			if err != nil || len(seen) != 1 || seen[0] != "example.org" {
+				t.Errorf("WalkMappings saw %v, %v; expected example.org only", seen, err)
+			}
+			seen = nil
+			ns.WalkMappings(func(clientKey, domainName string, a netip.Addr, expire time.Time) {
+				seen = append(seen, domainName)
+			})
+			if len(seen) != 1 || seen[0] != "example.com" {
+				t.Errorf("WalkMappings of namespace saw %v", seen)
+			}
+		})
+	}
+}
+
+type pinner interface {
+	Pin(clientKey clientkey.Key, addr netip.Addr) (Mapping, bool, error)
+	Unpin(clientKey clientkey.Key, addr netip.Addr) (Mapping, bool, error)
+	WalkPinned(fn func(Mapping)) error
+}
+
+func TestPin(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	clock.install(t)
+	for name, open := range map[string]func(dir string) (mapperUnderTest, error){
+		"sqlite": func(dir string) (mapperUnderTest, error) {
+			return New(dir, smallPool{rand.New(rand.NewSource(1))})
+		},
+		"memory": func(dir string) (mapperUnderTest, error) {
+			return NewMemory(dir, smallPool{rand.New(rand.NewSource(1))}, time.Hour)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			m, err := open(dir)
+			if err != nil {
+				t.Fatalf("can't open mapping: %v", err)
+			}
+			addr, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if _, ok, err := m.(pinner).Pin(testKey("10.0.0.2"), addr); ok || err != nil {
+				t.Fatalf("mapping of other client pinned: %v, %v", ok, err)
+			}
+			res, ok, err := m.(pinner).Pin(testKey("10.0.0.1"), addr)
+			if !ok || err != nil || res.DomainName != "example.org" || !res.Pinned {
+				t.Fatalf("Pin returned %+v, %v, %v", res, ok, err)
+			}
+
+			// Pinned mapping outlives its TTL and restart.
+			clock.now = clock.now.Add(time.Hour)
+			if err := m.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if m, err = open(dir); err != nil {
+				t.Fatalf("can't reopen mapping: %v", err)
+			}
+			defer func() { m.Close() }()
+			if _, err := m.EnsureMapping(testKey("10.0.0.2"), "example.com", time.Minute); err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if domainName, ok, _ := m.ReverseLookup(testKey("10.0.0.1"), addr); !ok || domainName != "example.org" {
+				t.Fatalf("pinned mapping was lost: (%q, %v)", domainName, ok)
+			}
+			var pinned []string
+			m.(pinner).WalkPinned(func(item Mapping) {
+				pinned = append(pinned, item.ClientKey+" "+item.DomainName+" "+item.Addr.String())
+			})
+			if expected := "10.0.0.1 example.org " + addr.String(); len(pinned) != 1 || pinned[0] != expected {
+				t.Errorf("WalkPinned saw %q, expected %q", pinned, expected)
+			}
+
+			// Unpinned mapping lives for its lease duration.
+			if _, ok, err := m.(pinner).Unpin(testKey("10.0.0.1"), addr); !ok || err != nil {
+				t.Fatalf("Unpin failed: %v, %v", ok, err)
+			}
+			clock.now = clock.now.Add(30 * time.Second)
+			m.EnsureMapping(testKey("10.0.0.2"), "example.com", time.Minute)
+			if _, ok, _ := m.ReverseLookup(testKey("10.0.0.1"), addr); !ok {
+				t.Fatalf("unpinned mapping expired before its TTL")
+			}
+			clock.now = clock.now.Add(time.Minute)
+			m.EnsureMapping(testKey("10.0.0.2"), "example.com", time.Minute)
+			if _, ok, _ := m.ReverseLookup(testKey("10.0.0.1"), addr); ok {
+				t.Errorf("unpinned mapping outlived its TTL")
+			}
+		})
+	}
+}
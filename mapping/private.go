@@ -0,0 +1,218 @@
+package mapping
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// hashedNamePrefix marks domain names replaced with their hashes.
+const hashedNamePrefix = "h-"
+
+// Backend is mapping storage which PrivateMapping can wrap.
+type Backend interface {
+	namespacedBackend
+	Stats() (Stats, error)
+	Close() error
+}
+
+// NameHasher replaces domain names with their keyed hashes.
+type NameHasher struct {
+	key []byte
+}
+
+func NewNameHasher(secret []byte) *NameHasher {
+	return &NameHasher{key: append([]byte(nil), secret...)}
+}
+
+// Hash returns HMAC-SHA256 of domain name truncated to 128 bits.
+func (h *NameHasher) Hash(domainName string) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(domainName))
+	return hashedNamePrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// pinnedName is expiration of plain names of pinned mappings.
+const pinnedName = math.MaxInt64
+
+type privateName struct {
+	domainName string
+	expire     int64
+}
+
+// PrivateMapping keeps only hashes of domain names in backend storage.
+// Plain names live in RAM for lifetime of their mappings, which is enough
+// for reverse lookups of active mappings. Mappings made before restart
+// can't be reverse looked up until their domains are queried again.
+type PrivateMapping struct {
+	backend Backend
+	hasher  *NameHasher
+
+	mux         sync.RWMutex
+	names       map[string]privateName
+	lastCleanup time.Duration
+}
+
+func NewPrivate(backend Backend, hasher *NameHasher) *PrivateMapping {
+	return &PrivateMapping{
+		backend: backend,
+		hasher:  hasher,
+		names:   make(map[string]privateName),
+	}
+}
+
+func (p *PrivateMapping) EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error) {
+	return p.ensureMapping("", clientKey.String(), domainName, 0, ttl, p.poolFor(domainName))
+}
+
+// EnsureMappings returns count distinct addresses mapped to domainName.
+func (p *PrivateMapping) EnsureMappings(clientKey clientkey.Key, domainName string, count int, ttl time.Duration) ([]netip.Addr, error) {
+	return ensureMappings(p, p.poolFor(domainName), "", clientKey.String(), domainName, count, ttl)
+}
+
+// poolFor selects pool by plain domain name, which backend never sees.
+func (p *PrivateMapping) poolFor(domainName string) AddrPool {
+	return p.backend.poolFor(domainName)
+}
+
+func (p *PrivateMapping) ensureMapping(namespace, clientKey, domainName string, slot int, ttl time.Duration, addrPool AddrPool) (netip.Addr, error) {
+	hash := p.hasher.Hash(domainName)
+	p.remember(hash, domainName, ttl)
+	return p.backend.ensureMapping(namespace, clientKey, hash, slot, ttl, addrPool)
+}
+
+// remember keeps plain name of hash at least for ttl.
+func (p *PrivateMapping) remember(hash, domainName string, ttl time.Duration) {
+	now := timeNow().Unix()
+	expire := now + ttlSeconds(ttl)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if monoNow()-p.lastCleanup > cleanupDebounceInterval {
+		for h, entry := range p.names {
+			if entry.expire < now {
+				delete(p.names, h)
+			}
+		}
+		p.lastCleanup = monoNow()
+	}
+	if entry, ok := p.names[hash]; !ok || entry.expire < expire {
+		p.names[hash] = privateName{domainName, expire}
+	}
+}
+
+// name returns plain domain name of hash, if it's known.
+func (p *PrivateMapping) name(hash string, ok bool, err error) (string, bool, error) {
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	entry, ok := p.names[hash]
+	return entry.domainName, ok, nil
+}
+
+func (p *PrivateMapping) ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (domainName string, ok bool, err error) {
+	return p.reverseLookup("", clientKey.String(), addr)
+}
+
+func (p *PrivateMapping) reverseLookup(namespace, clientKey string, addr netip.Addr) (domainName string, ok bool, err error) {
+	return p.name(p.backend.reverseLookup(namespace, clientKey, addr))
+}
+
+func (p *PrivateMapping) ReverseLookupAnyClient(addr netip.Addr) (domainName string, ok bool, err error) {
+	return p.reverseLookupAnyClient("", addr)
+}
+
+func (p *PrivateMapping) reverseLookupAnyClient(namespace string, addr netip.Addr) (domainName string, ok bool, err error) {
+	return p.name(p.backend.reverseLookupAnyClient(namespace, addr))
+}
+
+func (p *PrivateMapping) LookupResolved(domainName string) (addrs []netip.Addr, ok bool, err error) {
+	return p.backend.LookupResolved(p.hasher.Hash(domainName))
+}
+
+func (p *PrivateMapping) StoreResolved(domainName string, addrs []netip.Addr, ttl time.Duration) error {
+	return p.backend.StoreResolved(p.hasher.Hash(domainName), addrs, ttl)
+}
+
+// WalkMappings calls fn for each live mapping. Domains with unknown plain
+// names are reported by their hashes.
+func (p *PrivateMapping) WalkMappings(fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error {
+	return p.walkMappings("", fn)
+}
+
+func (p *PrivateMapping) walkMappings(namespace string, fn func(clientKey, domainName string, addr netip.Addr, expire time.Time)) error {
+	return p.backend.walkMappings(namespace, func(clientKey, hash string, addr netip.Addr, expire time.Time) {
+		domainName, ok, _ := p.name(hash, true, nil)
+		if !ok {
+			domainName = hash
+		}
+		fn(clientKey, domainName, addr, expire)
+	})
+}
+
+// Pin makes mapping of addr for client permanent. Plain name of its
+// domain is kept in RAM while it's pinned.
+func (p *PrivateMapping) Pin(clientKey clientkey.Key, addr netip.Addr) (res Mapping, ok bool, err error) {
+	return p.setPinned("", clientKey.String(), addr, true)
+}
+
+// Unpin makes pinned mapping expire as usual.
+func (p *PrivateMapping) Unpin(clientKey clientkey.Key, addr netip.Addr) (res Mapping, ok bool, err error) {
+	return p.setPinned("", clientKey.String(), addr, false)
+}
+
+func (p *PrivateMapping) setPinned(namespace, clientKey string, addr netip.Addr, pinned bool) (Mapping, bool, error) {
+	res, ok, err := p.backend.setPinned(namespace, clientKey, addr, pinned)
+	if !ok || err != nil {
+		return res, ok, err
+	}
+	hash := res.DomainName
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if entry, known := p.names[hash]; known {
+		res.DomainName = entry.domainName
+		if pinned {
+			entry.expire = pinnedName
+		} else {
+			entry.expire = res.Expire.Unix()
+		}
+		p.names[hash] = entry
+	}
+	return res, true, nil
+}
+
+// WalkPinned calls fn for each pinned mapping. Domains with unknown plain
+// names are reported by their hashes.
+func (p *PrivateMapping) WalkPinned(fn func(Mapping)) error {
+	return p.walkPinned("", fn)
+}
+
+func (p *PrivateMapping) walkPinned(namespace string, fn func(Mapping)) error {
+	return p.backend.walkPinned(namespace, func(item Mapping) {
+		if domainName, ok, _ := p.name(item.DomainName, true, nil); ok {
+			item.DomainName = domainName
+		}
+		fn(item)
+	})
+}
+
+// Namespace returns view of mapping confined to namespace ns.
+func (p *PrivateMapping) Namespace(ns string) *NamespacedMapping {
+	return &NamespacedMapping{backend: p, namespace: ns}
+}
+
+func (p *PrivateMapping) Stats() (Stats, error) {
+	return p.backend.Stats()
+}
+
+func (p *PrivateMapping) Close() error {
+	return p.backend.Close()
+}
@@ -0,0 +1,62 @@
+package mapping
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrivateMapping(t *testing.T) {
+	dir := t.TempDir()
+	p := smallPool{rand.New(rand.NewSource(1))}
+	hasher := NewNameHasher([]byte("secret"))
+	if hasher.Hash("example.org") == NewNameHasher([]byte("other")).Hash("example.org") {
+		t.Fatalf("hash doesn't depend on key")
+	}
+
+	backend, err := NewMemory(dir, p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create mapping: %v", err)
+	}
+	m := NewPrivate(backend, hasher)
+	addr, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+	if err != nil {
+		t.Fatalf("EnsureMapping failed: %v", err)
+	}
+	if domainName, ok, err := m.Namespace("").ReverseLookup(testKey("10.0.0.1"), addr); err != nil || !ok || domainName != "example.org" {
+		t.Fatalf("unexpected reverse lookup result: (%q, %v, %v)", domainName, ok, err)
+	}
+	if domainName, _, _ := backend.ReverseLookup(testKey("10.0.0.1"), addr); domainName != hasher.Hash("example.org") {
+		t.Errorf("backend stores %q instead of hash", domainName)
+	}
+	m.Close()
+
+	content, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		t.Fatalf("can't read snapshot: %v", err)
+	}
+	if bytes.Contains(content, []byte("example")) {
+		t.Errorf("snapshot holds domain name in plaintext")
+	}
+
+	// Plain names don't survive restart, but mappings do.
+	backend, err = NewMemory(dir, p, time.Hour)
+	if err != nil {
+		t.Fatalf("can't reopen mapping: %v", err)
+	}
+	m = NewPrivate(backend, hasher)
+	defer m.Close()
+	if _, ok, err := m.ReverseLookup(testKey("10.0.0.1"), addr); ok || err != nil {
+		t.Errorf("name of mapping made before restart is known: (%v, %v)", ok, err)
+	}
+	again, err := m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+	if err != nil || again != addr {
+		t.Fatalf("mapping changed after restart: %s -> %s (%v)", addr, again, err)
+	}
+	if domainName, ok, _ := m.ReverseLookup(testKey("10.0.0.1"), addr); !ok || domainName != "example.org" {
+		t.Errorf("name wasn't learned again: (%q, %v)", domainName, ok)
+	}
+}
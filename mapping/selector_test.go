@@ -0,0 +1,82 @@
+//go:build !nosqlite
+
+package mapping
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/pool"
+)
+
+func TestPoolSelection(t *testing.T) {
+	def, err := pool.New([]pool.Range{pool.PrefixRange(netip.MustParsePrefix("172.24.0.0/16"))})
+	if err != nil {
+		t.Fatalf("can't create IP pool: %v", err)
+	}
+	video, err := pool.New([]pool.Range{pool.PrefixRange(netip.MustParsePrefix("172.25.0.0/16"))})
+	if err != nil {
+		t.Fatalf("can't create IP pool: %v", err)
+	}
+	selector := pool.NewSelector(def)
+	selector.Add("video.example", video)
+	videoRange := netip.MustParsePrefix("172.25.0.0/16")
+
+	sqlite, err := New(t.TempDir(), selector)
+	if err != nil {
+		t.Fatalf("can't create SQLite mapping: %v", err)
+	}
+	memory, err := NewMemory(t.TempDir(), selector, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create memory mapping: %v", err)
+	}
+	private, err := NewMemory(t.TempDir(), selector, time.Hour)
+	if err != nil {
+		t.Fatalf("can't create memory mapping: %v", err)
+	}
+	for name, m := range map[string]interface {
+		EnsureMapping(clientKey clientkey.Key, domainName string, ttl time.Duration) (netip.Addr, error)
+		Namespace(ns string) *NamespacedMapping
+		Close() error
+	}{
+		"sqlite":  sqlite,
+		"memory":  memory,
+		"private": NewPrivate(private, NewNameHasher([]byte("secret"))),
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer m.Close()
+			for _, domainName := range []string{"video.example", "www.video.example"} {
+				addr, err := m.EnsureMapping(testKey("10.0.0.1"), domainName, time.Minute)
+				if err != nil {
+					t.Fatalf("EnsureMapping failed: %v", err)
+				}
+				if !videoRange.Contains(addr) {
+					t.Errorf("%s is mapped to %s outside of its pool", domainName, addr)
+				}
+			}
+			addr, err := m.Namespace("tenant").EnsureMapping(testKey("10.0.0.1"), "video.example", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if !videoRange.Contains(addr) {
+				t.Errorf("namespaced mapping got %s outside of its pool", addr)
+			}
+			addr, err = m.EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if videoRange.Contains(addr) {
+				t.Errorf("domain without rule is mapped to %s", addr)
+			}
+			addr, err = m.Namespace("blocked").WithPool(video).EnsureMapping(testKey("10.0.0.1"), "example.org", time.Minute)
+			if err != nil {
+				t.Fatalf("EnsureMapping failed: %v", err)
+			}
+			if !videoRange.Contains(addr) {
+				t.Errorf("view with pool override mapped domain to %s", addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+// Package mqtt implements minimal MQTT 3.1.1 client, which publishes and
+// receives messages with QoS 0.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Packet types and flags.
+const (
+	packetConnect    = 0x10
+	packetConnAck    = 0x20
+	packetPublish    = 0x30
+	packetSubscribe  = 0x82
+	packetPingReq    = 0xC0
+	packetDisconnect = 0xE0
+
+	flagRetain       = 0x01
+	flagCleanSession = 0x02
+	flagWill         = 0x04
+	flagWillRetain   = 0x20
+	flagPassword     = 0x40
+	flagUsername     = 0x80
+
+	protocolLevel = 4
+	maxRemaining  = 268435455
+	// maxIncoming limits size of packets from broker. Client only gets
+	// acknowledgements and short command messages, so larger packets
+	// are rejected instead of allocating whatever broker announces.
+	maxIncoming = 64 << 10
+)
+
+// DefaultKeepAlive is the default interval of keepalive pings.
+const DefaultKeepAlive = 60 * time.Second
+
+// Options configure connection to broker.
+type Options struct {
+	// Addr is the broker address in HOST:PORT form.
+	Addr string
+	// TLS, if set, makes connection use TLS.
+	TLS      *tls.Config
+	Username string
+	Password string
+	// ClientID defaults to random one.
+	ClientID string
+	// KeepAlive defaults to DefaultKeepAlive.
+	KeepAlive time.Duration
+
+	// WillTopic, if set, is where broker publishes WillPayload when client
+	// disconnects without DISCONNECT packet.
+	WillTopic   string
+	WillPayload []byte
+	WillRetain  bool
+
+	// OnMessage is called for messages of subscribed topics. It's called
+	// from the client read loop, so it must not block.
+	OnMessage func(topic string, payload []byte)
+}
+
+// ParseURL parses mqtt://[USER:PASSWORD@]HOST[:PORT]/TOPIC URL, or mqtts://
+// one for TLS connection, into options and topic.
+func ParseURL(s string) (Options, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Options{}, "", fmt.Errorf("bad MQTT URL: %w", err)
+	}
+	var opts Options
+	port := "1883"
+	switch u.Scheme {
+	case "mqtt":
+	case "mqtts":
+		port = "8883"
+		opts.TLS = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return Options{}, "", fmt.Errorf("bad MQTT URL %q: scheme must be mqtt or mqtts", u.Redacted())
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if u.Hostname() == "" || topic == "" {
+		return Options{}, "", fmt.Errorf("bad MQTT URL %q: expected %s://[USER:PASSWORD@]HOST[:PORT]/TOPIC", u.Redacted(), u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	opts.Addr = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	return opts, topic, nil
+}
+
+// Client is a connection to MQTT broker.
+type Client struct {
+	conn      net.Conn
+	onMessage func(topic string, payload []byte)
+	keepAlive time.Duration
+
+	wmux     sync.Mutex
+	packetID uint16
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// Dial connects to broker.
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = DefaultKeepAlive
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = randomClientID()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to MQTT broker: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if opts.TLS != nil {
+		tlsConn := tls.Client(conn, opts.TLS)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("MQTT TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	r := bufio.NewReader(conn)
+	if err := handshake(conn, r, &opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Client{
+		conn:      conn,
+		onMessage: opts.OnMessage,
+		keepAlive: opts.KeepAlive,
+		done:      make(chan struct{}),
+	}
+	go c.readLoop(r)
+	go c.pingLoop()
+	return c, nil
+}
+
+func handshake(conn net.Conn, r *bufio.Reader, opts *Options) error {
+	var body []byte
+	body = appendString(body, "MQTT")
+	flags := byte(flagCleanSession)
+	if opts.WillTopic != "" {
+		flags |= flagWill
+		if opts.WillRetain {
+			flags |= flagWillRetain
+		}
+	}
+	if opts.Username != "" {
+		flags |= flagUsername
+		if opts.Password != "" {
+			flags |= flagPassword
+		}
+	}
+	keepAlive := int(opts.KeepAlive / time.Second)
+	body = append(body, protocolLevel, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendString(body, opts.ClientID)
+	if flags&flagWill != 0 {
+		body = appendString(body, opts.WillTopic)
+		body = appendString(body, string(opts.WillPayload))
+	}
+	if flags&flagUsername != 0 {
+		body = appendString(body, opts.Username)
+	}
+	if flags&flagPassword != 0 {
+		body = appendString(body, opts.Password)
+	}
+	if err := writePacket(conn, packetConnect, body); err != nil {
+		return fmt.Errorf("MQTT connect failed: %w", err)
+	}
+
+	header, ack, err := readPacket(r)
+	if err != nil {
+		return fmt.Errorf("MQTT connect failed: %w", err)
+	}
+	if header != packetConnAck || len(ack) != 2 {
+		return errors.New("MQTT connect failed: unexpected response from broker")
+	}
+	if ack[1] != 0 {
+		return fmt.Errorf("MQTT broker refused connection with code %d", ack[1])
+	}
+	return nil
+}
+
+func randomClientID() string {
+	var b [6]byte
+	rand.Read(b[:])
+	return "dns44-" + hex.EncodeToString(b[:])
+}
+
+// Publish sends message to topic.
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(packetPublish)
+	if retain {
+		header |= flagRetain
+	}
+	return c.write(header, append(appendString(nil, topic), payload...))
+}
+
+// Subscribe subscribes to topic filters. Messages are delivered to
+// OnMessage.
+func (c *Client) Subscribe(filters ...string) error {
+	c.wmux.Lock()
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID++
+	}
+	body := []byte{byte(c.packetID >> 8), byte(c.packetID)}
+	c.wmux.Unlock()
+	for _, filter := range filters {
+		body = append(appendString(body, filter), 0)
+	}
+	return c.write(packetSubscribe, body)
+}
+
+func (c *Client) write(header byte, body []byte) error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.keepAlive))
+	if err := writePacket(c.conn, header, body); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		header, body, err := readPacket(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if header&0xF0 == packetPublish {
+			if err := c.handlePublish(header, body); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) handlePublish(header byte, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("malformed MQTT PUBLISH packet")
+	}
+	n := int(body[0])<<8 | int(body[1])
+	if len(body) < 2+n {
+		return errors.New("malformed MQTT PUBLISH packet")
+	}
+	topic, payload := string(body[2:2+n]), body[2+n:]
+	if qos := header >> 1 & 3; qos > 0 {
+		// Subscriptions are made with QoS 0, but skip packet ID anyway.
+		if len(payload) < 2 {
+			return errors.New("malformed MQTT PUBLISH packet")
+		}
+		payload = payload[2:]
+	}
+	if c.onMessage != nil {
+		c.onMessage(topic, payload)
+	}
+	return nil
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.write(packetPingReq, nil) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// Done is closed once connection is lost or closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason connection was lost.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close disconnects from broker gracefully, so will message isn't sent.
+func (c *Client) Close() error {
+	c.write(packetDisconnect, nil)
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func writePacket(w io.Writer, header byte, body []byte) error {
+	if len(body) > maxRemaining {
+		return errors.New("MQTT packet is too large")
+	}
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	header, err = r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errors.New("malformed MQTT packet length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxIncoming {
+		return 0, nil, fmt.Errorf("MQTT packet of %d bytes is too large", length)
+	}
+	body = make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
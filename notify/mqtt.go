@@ -0,0 +1,39 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Snawoot/dns44/mqtt"
+)
+
+// MQTT publishes events as JSON messages to broker topic. It connects to
+// broker for each event, as events are rare.
+type MQTT struct {
+	opts  mqtt.Options
+	topic string
+}
+
+func NewMQTT(opts mqtt.Options, topic string) *MQTT {
+	return &MQTT{
+		opts:  opts,
+		topic: topic,
+	}
+}
+
+func (m *MQTT) Send(ctx context.Context, e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	client, err := mqtt.Dial(ctx, m.opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Publish(m.topic, payload, false); err != nil {
+		return fmt.Errorf("MQTT publish failed: %w", err)
+	}
+	return nil
+}
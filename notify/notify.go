@@ -0,0 +1,174 @@
+// Package notify delivers notifications about significant events, such as
+// exhausted address pool or unavailable upstream, to external sinks.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event kinds.
+const (
+	EventPoolFull     = "pool_full"
+	EventUpstreamDown = "upstream_down"
+	EventUpstreamUp   = "upstream_up"
+	EventMappingError = "mapping_error"
+	EventBlocked      = "blocked"
+	EventFailOpen     = "fail_open"
+	EventFailOpenEnd  = "fail_open_end"
+	EventThreat       = "threat"
+)
+
+// Events lists all event kinds.
+var Events = []string{
+	EventPoolFull,
+	EventUpstreamDown,
+	EventUpstreamUp,
+	EventMappingError,
+	EventBlocked,
+	EventFailOpen,
+	EventFailOpenEnd,
+	EventThreat,
+}
+
+const (
+	// DefaultCooldown is the minimal interval between notifications of
+	// one kind.
+	DefaultCooldown = 10 * time.Minute
+	// sendTimeout limits delivery of notification to one sink.
+	sendTimeout = 10 * time.Second
+	// queueSize is the number of pending notifications. Notifications are
+	// dropped when queue is full.
+	queueSize = 64
+)
+
+// Event is a notification about something operator should know about.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("dns44 %s: %s", e.Kind, e.Message)
+}
+
+// Sink delivers events to their destination.
+type Sink interface {
+	Send(ctx context.Context, e Event) error
+}
+
+// Notifier dispatches events to sinks in background. Events of one kind
+// are sent at most once per cooldown period, others are counted and
+// mentioned in the next notification of that kind. Nil Notifier discards
+// all events.
+type Notifier struct {
+	sinks    []Sink
+	kinds    map[string]bool
+	cooldown time.Duration
+	queue    chan Event
+	done     chan struct{}
+
+	mux        sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+	closed     bool
+}
+
+// New returns notifier sending events of listed kinds to sinks. Empty
+// kinds list enables all kinds, zero cooldown means DefaultCooldown.
+func New(sinks []Sink, kinds []string, cooldown time.Duration) (*Notifier, error) {
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	enabled := make(map[string]bool)
+	if len(kinds) == 0 {
+		kinds = Events
+	}
+	for _, kind := range kinds {
+		if !knownEvent(kind) {
+			return nil, fmt.Errorf("unknown event kind %q, expected one of %s", kind, strings.Join(Events, ", "))
+		}
+		enabled[kind] = true
+	}
+	n := &Notifier{
+		sinks:      sinks,
+		kinds:      enabled,
+		cooldown:   cooldown,
+		queue:      make(chan Event, queueSize),
+		done:       make(chan struct{}),
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	go n.run()
+	return n, nil
+}
+
+func knownEvent(kind string) bool {
+	for _, k := range Events {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify queues event of given kind with formatted message.
+func (n *Notifier) Notify(kind, format string, args ...interface{}) {
+	if n == nil || !n.kinds[kind] {
+		return
+	}
+	now := time.Now()
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.closed {
+		return
+	}
+	if last, ok := n.last[kind]; ok && now.Sub(last) < n.cooldown {
+		n.suppressed[kind]++
+		return
+	}
+	e := Event{Time: now, Kind: kind, Message: fmt.Sprintf(format, args...)}
+	if suppressed := n.suppressed[kind]; suppressed > 0 {
+		e.Message += fmt.Sprintf(" (%d similar event(s) suppressed)", suppressed)
+	}
+	select {
+	case n.queue <- e:
+		n.last[kind] = now
+		n.suppressed[kind] = 0
+	default:
+		log.Printf("notification queue is full, %s event dropped", kind)
+	}
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for e := range n.queue {
+		for _, sink := range n.sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+			if err := sink.Send(ctx, e); err != nil {
+				log.Printf("can't send %s notification: %v", e.Kind, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Close sends queued events and stops notifier.
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	n.mux.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mux.Unlock()
+	<-n.done
+	return nil
+}
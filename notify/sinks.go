@@ -0,0 +1,127 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Snawoot/dns44/mqtt"
+)
+
+// ParseSink makes sink from URL:
+//
+//	http://HOST/PATH, https://HOST/PATH        webhook
+//	telegram://BOT_TOKEN@CHAT_ID               Telegram bot message
+//	mqtt://[USER:PASSWORD@]HOST[:PORT]/TOPIC   MQTT publication
+//	mqtts://[USER:PASSWORD@]HOST[:PORT]/TOPIC  MQTT over TLS
+func ParseSink(spec string) (Sink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("bad notification sink URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewWebhook(spec), nil
+	case "telegram":
+		token, _ := u.User.Password()
+		if u.User == nil || u.Host == "" || token == "" {
+			return nil, fmt.Errorf("bad Telegram sink %q: expected telegram://BOT_TOKEN@CHAT_ID", u.Redacted())
+		}
+		return NewTelegram(u.User.Username()+":"+token, u.Host), nil
+	case "mqtt", "mqtts":
+		opts, topic, err := mqtt.ParseURL(spec)
+		if err != nil {
+			return nil, err
+		}
+		return NewMQTT(opts, topic), nil
+	}
+	return nil, fmt.Errorf("unsupported notification sink scheme %q", u.Scheme)
+}
+
+// Webhook posts events as JSON objects with time, kind and message fields.
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		url:    url,
+		client: &http.Client{},
+	}
+}
+
+func (w *Webhook) Send(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRequest(w.client, req)
+}
+
+// telegramAPI is the Telegram Bot API endpoint.
+const telegramAPI = "https://api.telegram.org"
+
+// Telegram sends events as messages of Telegram bot to chat.
+type Telegram struct {
+	api    string
+	token  string
+	chatID string
+	client *http.Client
+}
+
+func NewTelegram(token, chatID string) *Telegram {
+	return &Telegram{
+		api:    telegramAPI,
+		token:  token,
+		chatID: chatID,
+		client: &http.Client{},
+	}
+}
+
+func (t *Telegram) Send(ctx context.Context, e Event) error {
+	form := url.Values{
+		"chat_id": {t.chatID},
+		"text":    {e.String()},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.api+"/bot"+t.token+"/sendMessage", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := doRequest(t.client, req); err != nil {
+		// Request errors include URL, which holds bot token.
+		return fmt.Errorf("Telegram request failed: %w", stripURLError(err))
+	}
+	return nil
+}
+
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sink responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+func stripURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package pool
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var ErrBadPairPrefix = errors.New("paired prefix has to be IPv6 prefix of /96 or shorter")
+
+// Pair6 pairs IPv4 addresses with IPv6 addresses by embedding them into
+// the last 32 bits of IPv6 prefix, e.g. /96 or ULA /64. Bits between prefix
+// and embedded address are zero. Mapping of IPv4 address thus yields IPv6
+// address reversing to the same domain name.
+type Pair6 struct {
+	prefix netip.Prefix
+}
+
+func NewPair6(prefix netip.Prefix) (*Pair6, error) {
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() > 96 {
+		return nil, ErrBadPairPrefix
+	}
+	return &Pair6{
+		prefix: prefix.Masked(),
+	}, nil
+}
+
+// Prefix returns IPv6 prefix paired addresses belong to.
+func (p *Pair6) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// To6 returns IPv6 address paired with IPv4 address addr.
+func (p *Pair6) To6(addr netip.Addr) netip.Addr {
+	res := p.prefix.Addr().As16()
+	a4 := addr.Unmap().As4()
+	copy(res[12:], a4[:])
+	return netip.AddrFrom16(res)
+}
+
+// To4 returns IPv4 address paired with addr if addr is within paired
+// prefix and has zero bits between prefix and embedded address.
+func (p *Pair6) To4(addr netip.Addr) (netip.Addr, bool) {
+	if !p.prefix.Contains(addr) {
+		return netip.Addr{}, false
+	}
+	a16 := addr.As16()
+	addr4 := netip.AddrFrom4([4]byte(a16[12:]))
+	if p.To6(addr4) != addr {
+		return netip.Addr{}, false
+	}
+	return addr4, true
+}
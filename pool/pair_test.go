@@ -0,0 +1,45 @@
+package pool
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPair6(t *testing.T) {
+	p, err := NewPair6(netip.MustParsePrefix("fd44::/96"))
+	if err != nil {
+		t.Fatalf("NewPair6 failed: %v", err)
+	}
+	addr6 := p.To6(netip.MustParseAddr("172.24.1.2"))
+	if addr6.String() != "fd44::ac18:102" {
+		t.Errorf("To6 returned %s", addr6)
+	}
+	addr4, ok := p.To4(addr6)
+	if !ok || addr4.String() != "172.24.1.2" {
+		t.Errorf("To4(%s) = (%s, %v)", addr6, addr4, ok)
+	}
+	if _, ok := p.To4(netip.MustParseAddr("fd45::ac18:102")); ok {
+		t.Errorf("To4 accepted address outside of prefix")
+	}
+
+	p, err = NewPair6(netip.MustParsePrefix("fd44:0:0:44::/64"))
+	if err != nil {
+		t.Fatalf("NewPair6 failed for /64: %v", err)
+	}
+	addr6 = p.To6(netip.MustParseAddr("172.24.1.2"))
+	if addr6.String() != "fd44::44:0:0:ac18:102" {
+		t.Errorf("To6 returned %s for /64", addr6)
+	}
+	if addr4, ok := p.To4(addr6); !ok || addr4.String() != "172.24.1.2" {
+		t.Errorf("To4(%s) = (%s, %v)", addr6, addr4, ok)
+	}
+	if _, ok := p.To4(netip.MustParseAddr("fd44:0:0:44:1::ac18:102")); ok {
+		t.Errorf("To4 accepted address with bits between prefix and embedded address")
+	}
+
+	for _, prefix := range []string{"fd44::/112", "172.24.0.0/16", "::ffff:0:0/96"} {
+		if _, err := NewPair6(netip.MustParsePrefix(prefix)); err == nil {
+			t.Errorf("NewPair6 accepted %s", prefix)
+		}
+	}
+}
@@ -3,16 +3,42 @@ package pool
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net/netip"
 
 	"github.com/Snawoot/dns44/utils/random"
 )
 
-type addressPoolV4 struct {
+// Range is inclusive address range from Start to End.
+type Range struct {
+	Start netip.Addr
+	End   netip.Addr
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%s-%s", r.Start, r.End)
+}
+
+// Prefixes returns minimal list of prefixes exactly covering range.
+func (r Range) Prefixes() []netip.Prefix {
+	return RangeToPrefixes(r.Start, r.End)
+}
+
+// Overlaps reports whether ranges have addresses in common.
+func (r Range) Overlaps(o Range) bool {
+	return !r.End.Less(o.Start) && !o.End.Less(r.Start)
+}
+
+type rangeV4 struct {
 	base uint32
-	size uint32
-	rng  *rand.Rand
+	size uint64
+}
+
+type addressPoolV4 struct {
+	ranges []rangeV4
+	total  uint64
+	rng    *rand.Rand
 }
 
 type AddressPool interface {
@@ -22,26 +48,48 @@ type AddressPool interface {
 var (
 	ErrUnsupportedAddressFamily = errors.New("unsupported address family")
 	ErrBadOrder                 = errors.New("end of range is less than start of range")
+	ErrNoRanges                 = errors.New("no address ranges")
 )
 
-func New(start, end netip.Addr) (AddressPool, error) {
-	if !start.Is4() || !end.Is4() {
-		return nil, ErrUnsupportedAddressFamily
+// New returns pool yielding addresses of disjoint ranges. Each address is
+// equally likely, regardless of size of its range.
+func New(ranges []Range) (AddressPool, error) {
+	if len(ranges) == 0 {
+		return nil, ErrNoRanges
 	}
-	if end.Less(start) {
-		return nil, ErrBadOrder
+	p := &addressPoolV4{
+		rng: random.NewTimeSeededRand(),
 	}
-
-	base := binary.BigEndian.Uint32(start.AsSlice())
-	return &addressPoolV4{
-		base: base,
-		size: binary.BigEndian.Uint32(end.AsSlice()) - base + 1,
-		rng:  random.NewTimeSeededRand(),
-	}, nil
+	for i, r := range ranges {
+		if !r.Start.Is4() || !r.End.Is4() {
+			return nil, ErrUnsupportedAddressFamily
+		}
+		if r.End.Less(r.Start) {
+			return nil, ErrBadOrder
+		}
+		for _, prev := range ranges[:i] {
+			if r.Overlaps(prev) {
+				return nil, fmt.Errorf("address ranges %s and %s overlap", prev, r)
+			}
+		}
+		base := binary.BigEndian.Uint32(r.Start.AsSlice())
+		size := uint64(binary.BigEndian.Uint32(r.End.AsSlice())-base) + 1
+		p.ranges = append(p.ranges, rangeV4{base, size})
+		p.total += size
+	}
+	return p, nil
 }
 
 func (p *addressPoolV4) GetRandom() netip.Addr {
-	ip := p.base + uint32(p.rng.Intn(int(p.size)))
+	n := uint64(p.rng.Int63n(int64(p.total)))
+	var ip uint32
+	for _, r := range p.ranges {
+		if n < r.size {
+			ip = r.base + uint32(n)
+			break
+		}
+		n -= r.size
+	}
 	ipSlice := make([]byte, 4)
 	binary.BigEndian.PutUint32(ipSlice, ip)
 	res, ok := netip.AddrFromSlice(ipSlice)
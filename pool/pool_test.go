@@ -8,7 +8,7 @@ import (
 func TestComplex(t *testing.T) {
 	start := netip.MustParseAddr("172.24.0.0")
 	end := netip.MustParseAddr("172.24.255.255")
-	p, err := New(start, end)
+	p, err := New([]Range{{start, end}})
 	if err != nil {
 		t.Fatalf("can't create IP pool: %v", err)
 	}
@@ -27,3 +27,44 @@ func TestComplex(t *testing.T) {
 		t.Fatalf("too few different addresses returned: %d", len(ips))
 	}
 }
+
+func TestMultiRange(t *testing.T) {
+	ranges := []Range{
+		{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")},
+		PrefixRange(netip.MustParsePrefix("192.168.44.0/30")),
+	}
+	p, err := New(ranges)
+	if err != nil {
+		t.Fatalf("can't create IP pool: %v", err)
+	}
+	seen := make(map[netip.Addr]int)
+	for i := 0; i < 6000; i++ {
+		ip := p.GetRandom()
+		if !(ranges[0].Overlaps(Range{ip, ip}) || ranges[1].Overlaps(Range{ip, ip})) {
+			t.Fatalf("IP %s is outside pool ranges %v", ip, ranges)
+		}
+		seen[ip]++
+	}
+	if len(seen) != 6 {
+		t.Fatalf("got %d different addresses, expected 6", len(seen))
+	}
+	// Addresses are equally likely, regardless of size of their ranges.
+	for ip, n := range seen {
+		if n < 700 || n > 1300 {
+			t.Errorf("address %s returned %d times out of 6000", ip, n)
+		}
+	}
+}
+
+func TestBadRanges(t *testing.T) {
+	for _, ranges := range [][]Range{
+		nil,
+		{{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1")}},
+		{PrefixRange(netip.MustParsePrefix("fd00::/64"))},
+		{PrefixRange(netip.MustParsePrefix("10.0.0.0/24")), PrefixRange(netip.MustParsePrefix("10.0.0.128/25"))},
+	} {
+		if _, err := New(ranges); err == nil {
+			t.Errorf("ranges %v accepted", ranges)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package pool
+
+import (
+	"net/netip"
+)
+
+// RangeToPrefixes returns minimal list of prefixes exactly covering
+// inclusive address range from start to end.
+func RangeToPrefixes(start, end netip.Addr) []netip.Prefix {
+	var res []netip.Prefix
+	if start.BitLen() != end.BitLen() {
+		return nil
+	}
+	for start.Compare(end) <= 0 {
+		bits := start.BitLen()
+		for bits > 0 {
+			wider, _ := start.Prefix(bits - 1)
+			if wider.Addr() != start || lastAddr(wider).Compare(end) > 0 {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(start, bits)
+		res = append(res, prefix)
+		start = lastAddr(prefix).Next()
+		if !start.IsValid() {
+			break
+		}
+	}
+	return res
+}
+
+// PrefixRange returns range of all addresses of prefix.
+func PrefixRange(prefix netip.Prefix) Range {
+	prefix = prefix.Masked()
+	return Range{Start: prefix.Addr(), End: lastAddr(prefix)}
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr()
+	bytes := addr.AsSlice()
+	for i := prefix.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 0x80 >> (i % 8)
+	}
+	res, _ := netip.AddrFromSlice(bytes)
+	return res
+}
@@ -0,0 +1,26 @@
+package pool
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestRangeToPrefixes(t *testing.T) {
+	testCases := []struct {
+		start, end string
+		expected   string
+	}{
+		{"172.24.0.0", "172.24.255.255", "[172.24.0.0/16]"},
+		{"10.0.0.1", "10.0.0.1", "[10.0.0.1/32]"},
+		{"10.0.0.1", "10.0.0.6", "[10.0.0.1/32 10.0.0.2/31 10.0.0.4/31 10.0.0.6/32]"},
+		{"0.0.0.0", "255.255.255.255", "[0.0.0.0/0]"},
+		{"fd00::", "fd00::ffff", "[fd00::/112]"},
+	}
+	for _, tc := range testCases {
+		got := fmt.Sprint(RangeToPrefixes(netip.MustParseAddr(tc.start), netip.MustParseAddr(tc.end)))
+		if got != tc.expected {
+			t.Errorf("RangeToPrefixes(%s, %s) = %s, expected %s", tc.start, tc.end, got, tc.expected)
+		}
+	}
+}
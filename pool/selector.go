@@ -0,0 +1,46 @@
+package pool
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Selector picks address pool by domain name. It's AddressPool itself,
+// yielding addresses of the default pool.
+type Selector struct {
+	def   AddressPool
+	rules map[string]AddressPool
+}
+
+// NewSelector returns Selector using def for domains without rule.
+func NewSelector(def AddressPool) *Selector {
+	return &Selector{
+		def:   def,
+		rules: make(map[string]AddressPool),
+	}
+}
+
+// Add makes domain and its subdomains get addresses from p. Domain "."
+// covers all domains.
+func (s *Selector) Add(domain string, p AddressPool) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	s.rules[domain] = p
+}
+
+func (s *Selector) GetRandom() netip.Addr {
+	return s.def.GetRandom()
+}
+
+// PoolFor returns pool of the most specific rule covering domainName, or
+// the default pool.
+func (s *Selector) PoolFor(domainName string) AddressPool {
+	for name := domainName; ; {
+		if p, ok := s.rules[name]; ok {
+			return p
+		}
+		if name == "" {
+			return s.def
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
@@ -0,0 +1,44 @@
+package pool
+
+import (
+	"net/netip"
+	"testing"
+)
+
+type fixedPool netip.Addr
+
+func (p fixedPool) GetRandom() netip.Addr {
+	return netip.Addr(p)
+}
+
+func TestSelector(t *testing.T) {
+	def := fixedPool(netip.MustParseAddr("172.24.0.1"))
+	video := fixedPool(netip.MustParseAddr("172.25.0.1"))
+	corp := fixedPool(netip.MustParseAddr("172.26.0.1"))
+	s := NewSelector(def)
+	s.Add("Video.Example.", video)
+	s.Add("corp.example", corp)
+	s.Add("cdn.corp.example", def)
+
+	for name, want := range map[string]AddressPool{
+		"example.org":             def,
+		"video.example":           video,
+		"www.video.example":       video,
+		"xvideo.example":          def,
+		"corp.example":            corp,
+		"cdn.corp.example":        def,
+		"static.cdn.corp.example": def,
+	} {
+		if got := s.PoolFor(name); got != want {
+			t.Errorf("PoolFor(%q) = %v, expected %v", name, got, want)
+		}
+	}
+	if addr := s.GetRandom(); addr != netip.Addr(def) {
+		t.Errorf("GetRandom() = %s, expected default pool address", addr)
+	}
+
+	s.Add(".", corp)
+	if got := s.PoolFor("example.org"); got != corp {
+		t.Errorf("catch-all rule isn't applied: got %v", got)
+	}
+}
@@ -0,0 +1,105 @@
+package tproxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+)
+
+func quietLog(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func BenchmarkUDPProxyDatagram(b *testing.B) {
+	quietLog(b)
+	_, udpEcho := startEcho(b)
+	proxy, err := NewUDPProxy(context.Background(), fakeConfig(udpEcho.Port()))
+	if err != nil {
+		b.Fatalf("can't start UDP proxy: %v", err)
+	}
+	defer proxy.Wait()
+	defer proxy.Close()
+
+	conn, err := net.Dial("udp", proxy.Addr().String())
+	if err != nil {
+		b.Fatalf("can't connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	msg := make([]byte, 1200)
+	reply := make([]byte, UDPBufSize)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			b.Fatalf("write failed: %v", err)
+		}
+		if _, err := conn.Read(reply); err != nil {
+			b.Fatalf("read failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkUDPProxySession(b *testing.B) {
+	quietLog(b)
+	_, udpEcho := startEcho(b)
+	proxy, err := NewUDPProxy(context.Background(), fakeConfig(udpEcho.Port()))
+	if err != nil {
+		b.Fatalf("can't start UDP proxy: %v", err)
+	}
+	defer proxy.Wait()
+	defer proxy.Close()
+
+	msg := make([]byte, 1200)
+	reply := make([]byte, UDPBufSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("udp", proxy.Addr().String())
+		if err != nil {
+			b.Fatalf("can't connect to proxy: %v", err)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			b.Fatalf("write failed: %v", err)
+		}
+		if _, err := conn.Read(reply); err != nil {
+			b.Fatalf("read failed: %v", err)
+		}
+		conn.Close()
+	}
+}
+
+func BenchmarkTCPProxyConn(b *testing.B) {
+	quietLog(b)
+	tcpEcho, _ := startEcho(b)
+	proxy, err := NewTCPProxy(context.Background(), fakeConfig(tcpEcho.Port()))
+	if err != nil {
+		b.Fatalf("can't start TCP proxy: %v", err)
+	}
+	defer proxy.Wait()
+	defer proxy.Close()
+
+	msg := make([]byte, 16*1024)
+	reply := make([]byte, len(msg))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			b.Fatalf("can't connect to proxy: %v", err)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			b.Fatalf("write failed: %v", err)
+		}
+		conn.(*net.TCPConn).CloseWrite()
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			b.Fatalf("read failed: %v", err)
+		}
+		conn.Close()
+	}
+}
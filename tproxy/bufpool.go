@@ -0,0 +1,71 @@
+package tproxy
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultCopyBufSize is the default size of buffers used to relay
+	// streams.
+	DefaultCopyBufSize = 32 * 1024
+	// datagramBufSize is the capacity of pooled buffers for queued
+	// datagrams. Larger datagrams get buffers allocated for them, which
+	// aren't returned to pool.
+	datagramBufSize = 2048
+)
+
+var (
+	udpBufPool      = newBufPool(UDPBufSize)
+	datagramBufPool = sync.Pool{
+		New: func() any {
+			buf := make([]byte, 0, datagramBufSize)
+			return &buf
+		},
+	}
+)
+
+// bufPool keeps buffers of fixed size.
+type bufPool struct {
+	pool sync.Pool
+}
+
+func newBufPool(size int) *bufPool {
+	return &bufPool{
+		pool: sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		},
+	}
+}
+
+func (p *bufPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// copy is io.Copy which takes buffer from pool.
+func (p *bufPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := p.get()
+	defer p.put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// getDatagramBuf returns pooled buffer holding copy of b.
+func getDatagramBuf(b []byte) *[]byte {
+	buf := datagramBufPool.Get().(*[]byte)
+	*buf = append((*buf)[:0], b...)
+	return buf
+}
+
+func putDatagramBuf(buf *[]byte) {
+	if cap(*buf) > datagramBufSize {
+		return
+	}
+	datagramBufPool.Put(buf)
+}
@@ -0,0 +1,36 @@
+package tproxy
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// Flow describes proxied connection for client key computation.
+type Flow struct {
+	// Network is either "tcp" or "udp".
+	Network     string
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+
+	// Conn is accepted client connection. It's nil for UDP flows. Extractor
+	// may consume data from it (e.g. PROXY protocol header) and replace it
+	// with connection which will be proxied instead.
+	Conn net.Conn
+}
+
+// ClientKeyExtractor computes mapping client key for proxied flow. Embedders
+// may implement it to identify clients by means other than source address.
+type ClientKeyExtractor interface {
+	FlowClientKey(flow *Flow) (clientkey.Key, error)
+}
+
+// SourceClientKey derives client key from flow source address.
+type SourceClientKey struct {
+	Masker clientkey.Masker
+}
+
+func (k SourceClientKey) FlowClientKey(flow *Flow) (clientkey.Key, error) {
+	return k.Masker.Key(flow.Source.Addr()), nil
+}
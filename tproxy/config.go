@@ -1,9 +1,16 @@
 package tproxy
 
 import (
+	"errors"
+	"log"
 	"net"
 	"net/netip"
+	"runtime"
+	"sync"
 	"time"
+
+	"github.com/Snawoot/dns44/notify"
+	"github.com/Snawoot/dns44/pool"
 )
 
 const (
@@ -15,13 +22,264 @@ type Config struct {
 	Mapper      Mapper
 	DialTimeout time.Duration
 	Dialer      Dialer
+
+	// UDPListenAddr, if set, is listened by UDP proxy instead of
+	// ListenAddr.
+	UDPListenAddr netip.AddrPort
+
+	// Transparent provides sockets receiving intercepted traffic. Defaults
+	// to platform implementation.
+	Transparent Transparent
+
+	// AnyClientFallback enables reverse lookup ignoring client key when
+	// exact lookup misses. It helps with asymmetric paths, where proxy sees
+	// different source address than DNS server did. Mapper has to implement
+	// AnyClientMapper.
+	AnyClientFallback bool
+
+	// ClientKey computes mapping client key for proxied flows. Defaults to
+	// SourceClientKey with no masking.
+	ClientKey ClientKeyExtractor
+
+	// LoopProtectRanges lists address ranges proxy must never dial, such
+	// as range where DNS requests are mapped.
+	LoopProtectRanges []netip.Prefix
+
+	// LoopProtectListeners lists dns44 own listening addresses which proxy
+	// must never dial.
+	LoopProtectListeners []netip.AddrPort
+
+	// InterceptRanges lists real address ranges which proxy accepts
+	// connections to without prior DNS query. Such connections are
+	// forwarded to their original destination via Dialer.
+	InterceptRanges []netip.Prefix
+
+	// BlockedRanges hold addresses of domains blocked by DNS policy. Flows
+	// to them are rejected ahead of CIDRRules, unless blocking is paused
+	// for the client.
+	BlockedRanges []netip.Prefix
+
+	// BlockedMapper finds domains of addresses in BlockedRanges for logs
+	// and paused clients. Flows of paused clients are rejected without
+	// it.
+	BlockedMapper Mapper
+
+	// BlockPage, if set, serves TCP connections to addresses of blocked
+	// domains found by BlockedMapper.
+	BlockPage BlockPage
+
+	// CIDRRules route flows by their destination address regardless of
+	// DNS. First matching rule wins. Rules take precedence over
+	// InterceptRanges.
+	CIDRRules []CIDRRule
+
+	// Pair6 resolves destinations within paired IPv6 prefix via mappings
+	// of IPv4 addresses they are paired with.
+	Pair6 *pool.Pair6
+
+	// LooseUDPRules list destination ports of UDP sessions to domains,
+	// which are tracked by client IP and destination address only. Such
+	// sessions keep upstream socket when client changes its source port.
+	// Most specific rule applies, like with PortRules.
+	LooseUDPRules []PortRule
+
+	// UDPTimeout is idle timeout of UDP sessions. Sessions of DNS and NTP
+	// use UDPShortTimeout, sessions which look like QUIC or WireGuard use
+	// UDPLongTimeout instead.
+	UDPTimeout      time.Duration
+	UDPShortTimeout time.Duration
+	UDPLongTimeout  time.Duration
+
+	// UDPWorkers is the number of goroutines forwarding UDP datagrams.
+	// Conntrack table is sharded between them. Defaults to number of CPUs.
+	UDPWorkers int
+
+	// CopyBufSize is the size of buffers relaying TCP streams. Larger
+	// buffers trade memory for throughput. Streams between plain TCP
+	// sockets may bypass buffers using splice on Linux.
+	CopyBufSize int
+
+	// MaxPendingConns limits number of TCP connections being set up at
+	// once, i.e. accepted but not yet connected to upstream. MaxAcceptRate
+	// limits accepted TCP connections per second. Connections beyond
+	// limits are closed right away. Zero disables respective limit.
+	MaxPendingConns int
+	MaxAcceptRate   float64
+
+	// ResolvedCacheTTL enables caching of real addresses of mapped domains
+	// in Mapper, which has to implement ResolvedCache. Proxy dials cached
+	// addresses directly instead of resolving domain for each connection.
+	// Cache is used only with direct egress, i.e. when Dialer is
+	// *net.Dialer. Zero disables cache.
+	ResolvedCacheTTL time.Duration
+
+	// Resolver resolves domains missing in cache. Defaults to
+	// net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// RedactName replaces domain names in logs, e.g. with their hashes.
+	RedactName func(name string) string
+
+	// ConnLog receives log lines of connections and UDP sessions being
+	// opened and closed. Defaults to standard logger.
+	ConnLog *log.Logger
+
+	// ForbiddenRanges lists ranges connections to mapped domains must not
+	// go to, such as DefaultForbiddenRanges. Domains are checked by
+	// addresses they resolve to at dial time, addresses routed by
+	// CIDRRules or InterceptRanges are not checked. It requires Dialer to
+	// be *net.Dialer.
+	ForbiddenRanges []netip.Prefix
+
+	// PortRules limit destination ports of flows to mapped domains. Flows
+	// to other ports are blocked.
+	PortRules []PortRule
+
+	// DialerMiddlewares wrap upstream dialer, first of them being the
+	// outermost. They get dials of domain names before resolution, after
+	// built-in protections are set up.
+	DialerMiddlewares []DialerMiddleware
+
+	// OnConnect is called for new TCP connection or UDP session once its
+	// upstream host is known, before upstream is dialed. Error rejects
+	// connection.
+	OnConnect func(info *ConnInfo) error
+
+	// OnData is called for each chunk of n bytes before it's relayed,
+	// either to upstream or from it. Error terminates connection. Setting
+	// OnData, or Quotas applying to connection, disables splice of TCP
+	// streams.
+	OnData func(info *ConnInfo, toUpstream bool, n int) error
+
+	// OnClose is called once upstream connection is closed, with total
+	// bytes sent to upstream and received from it.
+	OnClose func(info *ConnInfo, sent, received int64)
+
+	// Quotas limit daily traffic of each client to mapped domains.
+	// Connections are refused and terminated once quota is used up. Usage
+	// isn't persisted and starts over at local midnight.
+	Quotas []QuotaRule
+
+	// Notifier receives events about flows blocked by rules and failed
+	// reverse lookups.
+	Notifier *notify.Notifier
+
+	// Devices, if set, counts flows blocked by CIDRRules and PortRules.
+	// Clients it reports as paused are not blocked: their flows to
+	// blocked ranges go to original destination.
+	Devices DeviceTracker
+
+	// ClientNames, if set, names clients in connection log.
+	ClientNames ClientNames
+
+	quotaOnce sync.Once
+	quota     *quotaTracker
+}
+
+func (cfg *Config) validate() error {
+	if cfg.AnyClientFallback {
+		if _, ok := cfg.Mapper.(AnyClientMapper); !ok {
+			return errors.New("mapper doesn't support lookups regardless of client")
+		}
+	}
+	if cfg.ResolvedCacheTTL > 0 {
+		if _, ok := cfg.Mapper.(ResolvedCache); !ok {
+			return errors.New("mapper doesn't support resolved addresses cache")
+		}
+	}
+	if len(cfg.ForbiddenRanges) > 0 {
+		if _, ok := cfg.Dialer.(*net.Dialer); !ok {
+			return errors.New("forbidden ranges require direct dialer")
+		}
+	}
+	return nil
 }
 
 func (cfg *Config) populateDefaults() {
 	if cfg.DialTimeout == 0 {
 		cfg.DialTimeout = DefaultDialTimeout
 	}
+	if cfg.UDPTimeout == 0 {
+		cfg.UDPTimeout = UDPConnTrackTimeout
+	}
+	if cfg.UDPShortTimeout == 0 {
+		cfg.UDPShortTimeout = DefaultUDPShortTimeout
+	}
+	if cfg.UDPLongTimeout == 0 {
+		cfg.UDPLongTimeout = DefaultUDPLongTimeout
+	}
+	if cfg.UDPWorkers <= 0 {
+		cfg.UDPWorkers = runtime.NumCPU()
+	}
+	if cfg.CopyBufSize <= 0 {
+		cfg.CopyBufSize = DefaultCopyBufSize
+	}
+	if cfg.Transparent == nil {
+		cfg.Transparent = defaultTransparent()
+	}
 	if cfg.Dialer == nil {
 		cfg.Dialer = new(net.Dialer)
 	}
+	if cfg.ClientKey == nil {
+		cfg.ClientKey = SourceClientKey{}
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+}
+
+// udpListenAddr returns address UDP proxy listens.
+func (cfg *Config) udpListenAddr() netip.AddrPort {
+	if cfg.UDPListenAddr.IsValid() {
+		return cfg.UDPListenAddr
+	}
+	return cfg.ListenAddr
+}
+
+// dialer returns configured dialer wrapped with loop protection, rebinding
+// protection, resolved addresses cache and middlewares.
+func (cfg *Config) dialer() Dialer {
+	guard := &loopGuard{
+		prefixes:  cfg.LoopProtectRanges,
+		listeners: append([]netip.AddrPort{cfg.ListenAddr, cfg.udpListenAddr()}, cfg.LoopProtectListeners...),
+	}
+	dialer := guard.wrap(cfg.Dialer)
+	var rebind *rebindGuard
+	if len(cfg.ForbiddenRanges) > 0 {
+		rebind = &rebindGuard{forbidden: cfg.ForbiddenRanges}
+		dialer = rebind.wrap(dialer.(*net.Dialer))
+	}
+	if _, direct := cfg.Dialer.(*net.Dialer); direct && cfg.ResolvedCacheTTL > 0 {
+		dialer = &cachingDialer{
+			dialer:   dialer,
+			cache:    cfg.Mapper.(ResolvedCache),
+			resolver: cfg.Resolver,
+			ttl:      cfg.ResolvedCacheTTL,
+			redact:   cfg.RedactName,
+		}
+	}
+	if rebind != nil {
+		dialer = &namedDialer{dialer}
+	}
+	dialer = chainDialer(dialer, cfg.DialerMiddlewares)
+	if cfg.RedactName != nil {
+		dialer = &redactingDialer{dialer, cfg.RedactName}
+	}
+	return dialer
+}
+
+// sharedQuota returns traffic counters of Quotas shared by all proxies
+// started with cfg, so TCP and UDP traffic count against the same quota.
+func (cfg *Config) sharedQuota() *quotaTracker {
+	cfg.quotaOnce.Do(func() {
+		cfg.quota = newQuotaTracker(cfg.Quotas)
+	})
+	return cfg.quota
+}
+
+func (cfg *Config) connLog() *log.Logger {
+	if cfg.ConnLog != nil {
+		return cfg.ConnLog
+	}
+	return log.Default()
 }
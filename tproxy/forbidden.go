@@ -0,0 +1,89 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+var ErrForbiddenDestination = errors.New("destination is forbidden")
+
+// DefaultForbiddenRanges are private, loopback and link-local ranges,
+// where internal services usually live.
+var DefaultForbiddenRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// namedDialKey marks context of dial to domain name, as opposed to dial
+// to address chosen by client.
+type namedDialKey struct{}
+
+// rebindGuard refuses connections to domains which resolve into forbidden
+// ranges, so mapped external domains can't be pointed at internal
+// services. Check happens right before connect, after resolution, so
+// rebinding between checks isn't possible. Dials to addresses are allowed.
+type rebindGuard struct {
+	forbidden []netip.Prefix
+}
+
+func (g *rebindGuard) check(addr netip.AddrPort) error {
+	ip := addr.Addr().Unmap()
+	for _, prefix := range g.forbidden {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%w: domain resolved to %s within %s", ErrForbiddenDestination, ip, prefix)
+		}
+	}
+	return nil
+}
+
+// wrap returns copy of dialer checking connections to domain names, which
+// are marked by namedDialer.
+func (g *rebindGuard) wrap(dialer *net.Dialer) *net.Dialer {
+	guarded := *dialer
+	origControl, origControlContext := dialer.Control, dialer.ControlContext
+	guarded.Control = nil
+	guarded.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		if named, _ := ctx.Value(namedDialKey{}).(bool); named {
+			if addr, err := netip.ParseAddrPort(address); err == nil {
+				if err := g.check(addr); err != nil {
+					return err
+				}
+			}
+		}
+		switch {
+		case origControlContext != nil:
+			return origControlContext(ctx, network, address, c)
+		case origControl != nil:
+			return origControl(network, address, c)
+		}
+		return nil
+	}
+	return &guarded
+}
+
+// namedDialer marks dials to domain names for rebindGuard check.
+type namedDialer struct {
+	dialer Dialer
+}
+
+func (d *namedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		if _, err := netip.ParseAddr(host); err != nil {
+			ctx = context.WithValue(ctx, namedDialKey{}, true)
+		}
+	}
+	return d.dialer.DialContext(ctx, network, address)
+}
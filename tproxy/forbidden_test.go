@@ -0,0 +1,34 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestRebindGuard(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	guard := &rebindGuard{forbidden: []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}}
+	dialer := &namedDialer{guard.wrap(new(net.Dialer))}
+
+	_, err = dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if !errors.Is(err, ErrForbiddenDestination) {
+		t.Errorf("domain resolved to forbidden range was dialed: %v", err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("dial to address failed: %v", err)
+	}
+	conn.Close()
+}
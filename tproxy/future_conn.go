@@ -38,6 +38,9 @@ func newFutureConn(dial func() (net.Conn, error), backlog int) *futureConn {
 
 func (c *futureConn) Read(b []byte) (n int, err error) {
 	c.WaitResolve()
+	if c.connErr != nil {
+		return 0, fmt.Errorf("postponed error: %w", c.connErr)
+	}
 	return c.conn.Read(b)
 }
 
@@ -114,12 +117,14 @@ func (c *futureConn) Write(b []byte) (int, error) {
 }
 
 func (c *futureConn) bgDial(dial func() (net.Conn, error)) {
-	c.conn, c.connErr = dial()
+	if err := runRecovered("bgDial", func() { c.conn, c.connErr = dial() }); err != nil {
+		c.conn, c.connErr = nil, err
+	}
+	close(c.connCh)
 	if c.connErr != nil {
 		log.Printf("bgDial: dial failed: %v", c.connErr)
 		return
 	}
-	close(c.connCh)
 
 	c.backlogMux.Lock()
 	defer c.backlogMux.Unlock()
@@ -0,0 +1,142 @@
+package tproxy
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// ConnInfo describes proxied TCP connection or UDP session to hooks.
+type ConnInfo struct {
+	// Network is either "tcp" or "udp".
+	Network     string
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+	// Host is the upstream host: mapped domain name or address.
+	Host      string
+	ClientKey clientkey.Key
+}
+
+// hooks are connection lifecycle callbacks from Config, along with traffic
+// quotas which are enforced the same way.
+type hooks struct {
+	quota     *quotaTracker
+	onConnect func(info *ConnInfo) error
+	onData    func(info *ConnInfo, toUpstream bool, n int) error
+	onClose   func(info *ConnInfo, sent, received int64)
+}
+
+func newHooks(cfg *Config) hooks {
+	return hooks{
+		quota:     cfg.sharedQuota(),
+		onConnect: cfg.OnConnect,
+		onData:    cfg.OnData,
+		onClose:   cfg.OnClose,
+	}
+}
+
+func (h hooks) connect(info *ConnInfo) error {
+	if err := h.quota.add(info, 0); err != nil {
+		return err
+	}
+	if h.onConnect == nil {
+		return nil
+	}
+	return h.onConnect(info)
+}
+
+// wrap returns upstream connection which reports data and close to hooks.
+// Connection is returned as is when there are no such hooks, and only
+// counts traffic for OnClose when chunks needn't be seen, so splice
+// remains possible.
+func (h hooks) wrap(info *ConnInfo, conn net.Conn) net.Conn {
+	_, _, quota := h.quota.match(info)
+	switch {
+	case quota || h.onData != nil:
+		return &hookedConn{Conn: conn, info: info, hooks: h}
+	case h.onClose != nil:
+		return countedConn{&hookedConn{Conn: conn, info: info, hooks: h}}
+	}
+	return conn
+}
+
+// hookedConn is upstream connection observed by hooks.
+type hookedConn struct {
+	net.Conn
+	info      *ConnInfo
+	hooks     hooks
+	sent      atomic.Int64
+	received  atomic.Int64
+	closeOnce sync.Once
+}
+
+// Read passes data received from upstream to OnData before it's relayed
+// to client. Data rejected by hook is dropped and connection is closed.
+func (c *hookedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.received.Add(int64(n))
+		if hookErr := c.data(false, n); hookErr != nil {
+			return 0, hookErr
+		}
+	}
+	return n, err
+}
+
+// Write passes data from client to OnData before it's sent upstream.
+func (c *hookedConn) Write(b []byte) (int, error) {
+	if hookErr := c.data(true, len(b)); hookErr != nil {
+		return 0, hookErr
+	}
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+func (c *hookedConn) data(toUpstream bool, n int) error {
+	err := c.hooks.quota.add(c.info, n)
+	if err == nil && c.hooks.onData != nil {
+		err = c.hooks.onData(c.info, toUpstream, n)
+	}
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+func (c *hookedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.hooks.onClose != nil {
+			c.hooks.onClose(c.info, c.sent.Load(), c.received.Load())
+		}
+	})
+	return err
+}
+
+func (c *hookedConn) Raw() net.Conn {
+	return c.Conn
+}
+
+// countedConn is upstream connection which only counts traffic for
+// OnClose. Copies to and from it use ReadFrom and WriteTo of underlying
+// connection, so TCP streams are still spliced.
+type countedConn struct {
+	*hookedConn
+}
+
+func (c countedConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.Conn, r)
+	c.sent.Add(n)
+	return n, err
+}
+
+func (c countedConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, c.Conn)
+	c.received.Add(n)
+	return n, err
+}
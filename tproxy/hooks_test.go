@@ -0,0 +1,112 @@
+package tproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPProxyHooks(t *testing.T) {
+	tcpEcho, _ := startEcho(t)
+	cfg := fakeConfig(tcpEcho.Port())
+	connected := make(chan ConnInfo, 1)
+	closed := make(chan [2]int64, 1)
+	cfg.OnConnect = func(info *ConnInfo) error {
+		connected <- *info
+		return nil
+	}
+	cfg.OnClose = func(info *ConnInfo, sent, received int64) {
+		closed <- [2]int64{sent, received}
+	}
+	proxy, err := NewTCPProxy(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("can't start TCP proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect to proxy: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello")
+	conn.Write(msg)
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, msg) {
+		t.Fatalf("unexpected echo: %q, %v", reply, err)
+	}
+	conn.Close()
+
+	if info := <-connected; info.Network != "tcp" || info.Host != "127.0.0.1" || info.Destination.Port() != tcpEcho.Port() {
+		t.Errorf("unexpected connection info: %+v", info)
+	}
+	select {
+	case counts := <-closed:
+		if counts != [2]int64{5, 5} {
+			t.Errorf("OnClose got sent, received = %v, expected 5, 5", counts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose wasn't called")
+	}
+}
+
+func TestTCPProxyHooksReject(t *testing.T) {
+	tcpEcho, _ := startEcho(t)
+	errQuota := errors.New("quota exceeded")
+	for name, setup := range map[string]func(*Config){
+		"connect": func(cfg *Config) {
+			cfg.OnConnect = func(*ConnInfo) error { return errQuota }
+		},
+		"data": func(cfg *Config) {
+			cfg.OnData = func(info *ConnInfo, toUpstream bool, n int) error {
+				if toUpstream {
+					return errQuota
+				}
+				return nil
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := fakeConfig(tcpEcho.Port())
+			setup(cfg)
+			proxy, err := NewTCPProxy(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("can't start TCP proxy: %v", err)
+			}
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Addr().String())
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte("hello"))
+			if n, err := conn.Read(make([]byte, 5)); err == nil {
+				t.Fatalf("rejected connection relayed %d bytes", n)
+			}
+		})
+	}
+}
+
+func TestHooksWrap(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	info := &ConnInfo{Host: "example.com"}
+	if wrapped := newHooks(new(Config)).wrap(info, conn); wrapped != conn {
+		t.Errorf("connection is wrapped without hooks: %T", wrapped)
+	}
+	cfg := &Config{OnClose: func(*ConnInfo, int64, int64) {}}
+	wrapped := newHooks(cfg).wrap(info, conn)
+	if _, ok := wrapped.(io.ReaderFrom); !ok {
+		t.Errorf("connection counted for OnClose can't be spliced: %T", wrapped)
+	}
+	cfg.OnData = func(*ConnInfo, bool, int) error { return nil }
+	if _, ok := newHooks(cfg).wrap(info, conn).(*hookedConn); !ok {
+		t.Error("connection isn't observed by OnData")
+	}
+}
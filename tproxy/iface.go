@@ -4,10 +4,45 @@ import (
 	"context"
 	"net"
 	"net/netip"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
 )
 
 type Mapper interface {
-	ReverseLookup(clientKey string, addr netip.Addr) (domainName string, ok bool, err error)
+	ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (domainName string, ok bool, err error)
+}
+
+// AnyClientMapper is implemented by mappers which are able to find mapping
+// of address regardless of client key.
+type AnyClientMapper interface {
+	ReverseLookupAnyClient(addr netip.Addr) (domainName string, ok bool, err error)
+}
+
+// ResolvedCache is implemented by mappers able to store real addresses of
+// domains, so proxy doesn't have to resolve them for each connection.
+type ResolvedCache interface {
+	LookupResolved(domainName string) (addrs []netip.Addr, ok bool, err error)
+	StoreResolved(domainName string, addrs []netip.Addr, ttl time.Duration) error
+}
+
+// BlockPage explains blocks to clients. It gets TCP connections to
+// addresses of blocked domains instead of having them closed.
+type BlockPage interface {
+	ServeBlocked(conn net.Conn, clientKey clientkey.Key, domainName string, port uint16)
+}
+
+// DeviceTracker counts blocked flows of clients and may pause blocking for
+// them.
+type DeviceTracker interface {
+	Blocked(clientKey clientkey.Key)
+	BlockingPaused(clientKey clientkey.Key) bool
+}
+
+// ClientNames gives friendly names to clients. Empty name means client
+// isn't named.
+type ClientNames interface {
+	ClientName(clientKey clientkey.Key) (name, group string)
 }
 
 type Dialer interface {
@@ -0,0 +1,90 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+type nullMapper struct{}
+
+func (nullMapper) ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (string, bool, error) {
+	return "", false, nil
+}
+
+func skipIfNotPermitted(t *testing.T, err error) {
+	if errors.Is(err, os.ErrPermission) {
+		t.Skipf("transparent sockets are not permitted: %v", err)
+	}
+}
+
+func waitDone(t *testing.T, done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy didn't stop in time")
+	}
+}
+
+func TestTCPProxyLifecycle(t *testing.T) {
+	cfg := &Config{
+		ListenAddr: netip.MustParseAddrPort("127.0.0.1:0"),
+		Mapper:     nullMapper{},
+	}
+	proxy, err := NewTCPProxy(context.Background(), cfg)
+	if err != nil {
+		skipIfNotPermitted(t, err)
+		t.Fatalf("can't start TCP proxy: %v", err)
+	}
+	if proxy.Addr().(*net.TCPAddr).Port == 0 {
+		t.Fatalf("ephemeral port was not reported: %s", proxy.Addr())
+	}
+	if err := proxy.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	waitDone(t, proxy.Done())
+	proxy.Wait()
+}
+
+func TestUDPProxyContextCancel(t *testing.T) {
+	cfg := &Config{
+		ListenAddr: netip.MustParseAddrPort("127.0.0.1:0"),
+		Mapper:     nullMapper{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy, err := NewUDPProxy(ctx, cfg)
+	if err != nil {
+		cancel()
+		skipIfNotPermitted(t, err)
+		t.Fatalf("can't start UDP proxy: %v", err)
+	}
+	if proxy.Addr().(*net.UDPAddr).Port == 0 {
+		t.Fatalf("ephemeral port was not reported: %s", proxy.Addr())
+	}
+	cancel()
+	waitDone(t, proxy.Done())
+	proxy.Wait()
+}
+
+func TestUDPProxyListenAddr(t *testing.T) {
+	cfg := &Config{
+		ListenAddr:    netip.MustParseAddrPort("[::1]:0"),
+		UDPListenAddr: netip.MustParseAddrPort("127.0.0.1:0"),
+		Mapper:        nullMapper{},
+	}
+	proxy, err := NewUDPProxy(context.Background(), cfg)
+	if err != nil {
+		skipIfNotPermitted(t, err)
+		t.Fatalf("can't start UDP proxy: %v", err)
+	}
+	defer proxy.Close()
+	if addr := proxy.Addr().(*net.UDPAddr); !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("UDP proxy listens %s instead of UDPListenAddr", addr)
+	}
+}
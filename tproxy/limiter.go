@@ -0,0 +1,96 @@
+package tproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// shedLogInterval limits how often shed connections are reported.
+const shedLogInterval = time.Second
+
+// acceptLimiter sheds incoming connections when too many of them are being
+// set up at once or when they arrive faster than allowed rate. Zero limits
+// disable respective checks.
+type acceptLimiter struct {
+	pending chan struct{}
+	rate    float64
+	burst   float64
+
+	mux     sync.Mutex
+	tokens  float64
+	last    time.Time
+	shed    uint64
+	lastLog time.Time
+}
+
+func newAcceptLimiter(maxPending int, rate float64) *acceptLimiter {
+	l := &acceptLimiter{
+		rate:  rate,
+		burst: rate,
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.tokens = l.burst
+	if maxPending > 0 {
+		l.pending = make(chan struct{}, maxPending)
+	}
+	return l
+}
+
+// acquire reserves setup slot for new connection. It returns false if
+// connection has to be shed. Setup slot is reserved before rate token is
+// taken, so connections shed for lack of slots don't use up the rate.
+func (l *acceptLimiter) acquire(now time.Time) bool {
+	if l.pending != nil {
+		select {
+		case l.pending <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if l.rate > 0 && !l.take(now) {
+		l.release()
+		return false
+	}
+	return true
+}
+
+// release frees setup slot reserved by successful acquire.
+func (l *acceptLimiter) release() {
+	if l.pending != nil {
+		<-l.pending
+	}
+}
+
+func (l *acceptLimiter) take(now time.Time) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// recordShed counts shed connection. It returns number of connections shed
+// since last report if it's time to report them.
+func (l *acceptLimiter) recordShed(now time.Time) (uint64, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.shed++
+	if now.Sub(l.lastLog) < shedLogInterval {
+		return 0, false
+	}
+	shed := l.shed
+	l.shed = 0
+	l.lastLog = now
+	return shed, true
+}
@@ -0,0 +1,75 @@
+package tproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcceptLimiterPending(t *testing.T) {
+	l := newAcceptLimiter(2, 0)
+	now := time.Now()
+	if !l.acquire(now) || !l.acquire(now) {
+		t.Fatal("connections within limit were shed")
+	}
+	if l.acquire(now) {
+		t.Fatal("connection beyond pending limit was accepted")
+	}
+	l.release()
+	if !l.acquire(now) {
+		t.Fatal("released slot wasn't reused")
+	}
+}
+
+func TestAcceptLimiterRate(t *testing.T) {
+	l := newAcceptLimiter(0, 10)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if !l.acquire(now) {
+			t.Fatalf("connection %d within burst was shed", i)
+		}
+	}
+	if l.acquire(now) {
+		t.Fatal("connection beyond burst was accepted")
+	}
+	if !l.acquire(now.Add(100 * time.Millisecond)) {
+		t.Fatal("token wasn't replenished")
+	}
+	if l.acquire(now.Add(100 * time.Millisecond)) {
+		t.Fatal("replenished more tokens than rate allows")
+	}
+}
+
+func TestAcceptLimiterCombined(t *testing.T) {
+	l := newAcceptLimiter(1, 2)
+	now := time.Now()
+	if !l.acquire(now) {
+		t.Fatal("first connection was shed")
+	}
+	if l.acquire(now) {
+		t.Fatal("connection beyond pending limit was accepted")
+	}
+	l.release()
+	if !l.acquire(now) {
+		t.Fatal("connection shed for pending limit used up rate token")
+	}
+	l.release()
+	if l.acquire(now) {
+		t.Fatal("connection beyond burst was accepted")
+	}
+	if !l.acquire(now.Add(500 * time.Millisecond)) {
+		t.Fatal("connection shed for rate kept setup slot")
+	}
+}
+
+func TestAcceptLimiterShedReport(t *testing.T) {
+	l := newAcceptLimiter(0, 0)
+	now := time.Now()
+	if shed, report := l.recordShed(now); !report || shed != 1 {
+		t.Fatalf("unexpected first report: %d, %v", shed, report)
+	}
+	l.recordShed(now.Add(time.Millisecond))
+	l.recordShed(now.Add(2 * time.Millisecond))
+	if shed, report := l.recordShed(now.Add(shedLogInterval)); !report || shed != 3 {
+		t.Fatalf("unexpected report: %d, %v", shed, report)
+	}
+}
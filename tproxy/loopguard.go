@@ -0,0 +1,112 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+var ErrForwardingLoop = errors.New("forwarding loop detected")
+
+// loopGuard rejects outbound connections which would come back to dns44
+// itself: to the fake address range or to its own listeners. This happens
+// when egress resolution accidentally goes through dns44 DNS server.
+type loopGuard struct {
+	prefixes  []netip.Prefix
+	listeners []netip.AddrPort
+}
+
+func (g *loopGuard) empty() bool {
+	return len(g.prefixes) == 0 && len(g.listeners) == 0
+}
+
+func (g *loopGuard) check(addr netip.AddrPort) error {
+	ip := addr.Addr().Unmap()
+	for _, prefix := range g.prefixes {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%w: destination %s is within mapped range %s", ErrForwardingLoop, addr, prefix)
+		}
+	}
+	for _, listener := range g.listeners {
+		if listener.Port() != addr.Port() {
+			continue
+		}
+		if listener.Addr().Unmap() == ip || listener.Addr().IsUnspecified() && (ip.IsLoopback() || isLocalAddr(ip)) {
+			return fmt.Errorf("%w: destination %s is dns44 own listener", ErrForwardingLoop, addr)
+		}
+	}
+	return nil
+}
+
+func (g *loopGuard) control(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil
+	}
+	return g.check(addr)
+}
+
+// wrap returns dialer which refuses looped connections. Standard dialer
+// gets checks before connect, arbitrary dialers are checked by remote
+// address of established connection.
+func (g *loopGuard) wrap(dialer Dialer) Dialer {
+	if g.empty() {
+		return dialer
+	}
+	if netDialer, ok := dialer.(*net.Dialer); ok {
+		guarded := *netDialer
+		origControl := netDialer.Control
+		guarded.Control = func(network, address string, c syscall.RawConn) error {
+			if err := g.control(network, address, c); err != nil {
+				return err
+			}
+			if origControl != nil {
+				return origControl(network, address, c)
+			}
+			return nil
+		}
+		return &guarded
+	}
+	return &guardedDialer{dialer, g}
+}
+
+type guardedDialer struct {
+	dialer Dialer
+	guard  *loopGuard
+}
+
+func (d *guardedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn, nil
+	}
+	if err := d.guard.check(remote); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func isLocalAddr(ip netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if local, ok := netip.AddrFromSlice(ipNet.IP); ok && local.Unmap() == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package tproxy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestLoopGuardCheck(t *testing.T) {
+	g := &loopGuard{
+		prefixes:  []netip.Prefix{netip.MustParsePrefix("172.24.0.0/16")},
+		listeners: []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:4453")},
+	}
+	testCases := []struct {
+		addr   string
+		looped bool
+	}{
+		{"172.24.1.1:443", true},
+		{"[::ffff:172.24.1.1]:443", true},
+		{"127.0.0.1:4453", true},
+		{"127.0.0.1:4454", false},
+		{"1.1.1.1:53", false},
+	}
+	for _, tc := range testCases {
+		err := g.check(netip.MustParseAddrPort(tc.addr))
+		if looped := errors.Is(err, ErrForwardingLoop); looped != tc.looped {
+			t.Errorf("check(%s) = %v, expected loop detection: %v", tc.addr, err, tc.looped)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package tproxy
+
+import (
+	"context"
+	"net"
+)
+
+// DialerFunc adapts function to Dialer.
+type DialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f DialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// DialerMiddleware wraps upstream dialer with extra behaviour, such as
+// accounting, rate limiting or proxy chaining.
+type DialerMiddleware interface {
+	WrapDialer(next Dialer) Dialer
+}
+
+// DialerMiddlewareFunc adapts function to DialerMiddleware.
+type DialerMiddlewareFunc func(next Dialer) Dialer
+
+func (f DialerMiddlewareFunc) WrapDialer(next Dialer) Dialer {
+	return f(next)
+}
+
+// chainDialer wraps dialer with middlewares, so first of them sees dials
+// first.
+func chainDialer(dialer Dialer, middlewares []DialerMiddleware) Dialer {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		dialer = middlewares[i].WrapDialer(dialer)
+	}
+	return dialer
+}
@@ -0,0 +1,39 @@
+package tproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestDialerMiddlewares(t *testing.T) {
+	var layers []string
+	layer := func(name string) DialerMiddleware {
+		return DialerMiddlewareFunc(func(next Dialer) Dialer {
+			return DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+				layers = append(layers, name+" "+address)
+				return next.DialContext(ctx, network, address)
+			})
+		})
+	}
+	base := new(recordingDialer)
+	cfg := &Config{
+		ListenAddr:        netip.MustParseAddrPort("127.0.0.1:8443"),
+		Dialer:            base,
+		DialerMiddlewares: []DialerMiddleware{layer("outer"), layer("inner")},
+	}
+	conn, err := cfg.dialer().DialContext(context.Background(), "tcp", "example.org:443")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+	expected := []string{"outer example.org:443", "inner example.org:443"}
+	if !reflect.DeepEqual(layers, expected) {
+		t.Errorf("layers = %q, expected %q", layers, expected)
+	}
+	if !reflect.DeepEqual(base.addresses, []string{"example.org:443"}) {
+		t.Errorf("base dialer got %q", base.addresses)
+	}
+}
@@ -0,0 +1,136 @@
+package tproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To uint16
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(int(r.From))
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// PortRule limits destination ports of flows to Domain and its
+// subdomains. Domain "." matches all domains.
+type PortRule struct {
+	Domain string
+	Ports  []PortRange
+}
+
+func (r PortRule) String() string {
+	ports := make([]string, 0, len(r.Ports))
+	for _, p := range r.Ports {
+		ports = append(ports, p.String())
+	}
+	return r.Domain + "=" + strings.Join(ports, ",")
+}
+
+// ParsePortRule parses rule in "DOMAIN=PORT[-PORT][,...]" format.
+func ParsePortRule(s string) (PortRule, error) {
+	domain, ports, ok := strings.Cut(s, "=")
+	if !ok {
+		return PortRule{}, fmt.Errorf("port rule %q has no ports", s)
+	}
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain != "." {
+		domain = strings.TrimSuffix(domain, ".")
+	}
+	if domain == "" {
+		return PortRule{}, fmt.Errorf("port rule %q has no domain", s)
+	}
+	rule := PortRule{Domain: domain}
+	for _, spec := range strings.Split(ports, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+		if !isRange {
+			to = from
+		}
+		fromPort, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return PortRule{}, fmt.Errorf("bad port %q in rule %q", from, s)
+		}
+		toPort, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || toPort < fromPort {
+			return PortRule{}, fmt.Errorf("bad port range %q in rule %q", spec, s)
+		}
+		rule.Ports = append(rule.Ports, PortRange{uint16(fromPort), uint16(toPort)})
+	}
+	return rule, nil
+}
+
+// portRules maps domains to allowed port ranges.
+type portRules map[string][]PortRange
+
+func newPortRules(rules []PortRule) portRules {
+	if len(rules) == 0 {
+		return nil
+	}
+	res := make(portRules, len(rules))
+	for _, rule := range rules {
+		domain := ruleDomain(rule.Domain)
+		res[domain] = append(res[domain], rule.Ports...)
+	}
+	return res
+}
+
+// allowed reports whether port may be proxied for domain. Most specific
+// rule applies, domains without rules are not limited.
+func (r portRules) allowed(domainName string, port uint16) bool {
+	_, ranges, ok := matchDomain(r, domainName)
+	if !ok {
+		return true
+	}
+	for _, pr := range ranges {
+		if port >= pr.From && port <= pr.To {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether port is listed for domain by the most specific
+// rule covering it. Domains without rules have no ports listed.
+func (r portRules) contains(domainName string, port uint16) bool {
+	_, ranges, ok := matchDomain(r, domainName)
+	if !ok {
+		return false
+	}
+	for _, pr := range ranges {
+		if port >= pr.From && port <= pr.To {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleDomain returns key of rule domain in maps searched by matchDomain.
+func ruleDomain(domain string) string {
+	if domain == "." {
+		return ""
+	}
+	return domain
+}
+
+// matchDomain finds value of the most specific rule domain covering
+// domainName. Empty rule domain covers all domains.
+func matchDomain[V any](rules map[string]V, domainName string) (domain string, value V, ok bool) {
+	if len(rules) == 0 {
+		return "", value, false
+	}
+	for name := domainName; ; {
+		if value, ok := rules[name]; ok {
+			return name, value, true
+		}
+		if name == "" {
+			return "", value, false
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
@@ -0,0 +1,69 @@
+package tproxy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePortRule(t *testing.T) {
+	rule, err := ParsePortRule("Example.ORG.=80, 443,8000-8100")
+	if err != nil {
+		t.Fatalf("ParsePortRule failed: %v", err)
+	}
+	if s := rule.String(); s != "example.org=80,443,8000-8100" {
+		t.Errorf("rule = %q", s)
+	}
+	for _, bad := range []string{"example.org", "=443", "example.org=", "example.org=70000", "example.org=443-80", "example.org=x"} {
+		if _, err := ParsePortRule(bad); err == nil {
+			t.Errorf("ParsePortRule(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRouterPortRules(t *testing.T) {
+	var rules []PortRule
+	for _, s := range []string{".=80,443", "example.org=443", "git.example.org=22,443"} {
+		rule, err := ParsePortRule(s)
+		if err != nil {
+			t.Fatalf("ParsePortRule(%q) failed: %v", s, err)
+		}
+		rules = append(rules, rule)
+	}
+	r := newRouter(&Config{
+		Mapper: staticMapper{
+			netip.MustParseAddr("172.24.0.1"): "example.org",
+			netip.MustParseAddr("172.24.0.2"): "www.example.org",
+			netip.MustParseAddr("172.24.0.3"): "git.example.org",
+			netip.MustParseAddr("172.24.0.4"): "example.com",
+		},
+		ClientKey: SourceClientKey{},
+		PortRules: rules,
+	})
+	testCases := []struct {
+		dst string
+		ok  bool
+	}{
+		{"172.24.0.1:443", true},
+		{"172.24.0.1:80", false},
+		{"172.24.0.2:443", true},
+		{"172.24.0.2:80", false},
+		{"172.24.0.3:22", true},
+		{"172.24.0.3:80", false},
+		{"172.24.0.4:80", true},
+		{"172.24.0.4:22", false},
+	}
+	for _, tc := range testCases {
+		_, _, err := r.route(&Flow{
+			Network:     "tcp",
+			Source:      netip.MustParseAddrPort("10.0.0.1:40000"),
+			Destination: netip.MustParseAddrPort(tc.dst),
+		})
+		if (err == nil) != tc.ok {
+			t.Errorf("route(%s) error = %v, expected ok=%v", tc.dst, err, tc.ok)
+		}
+		if err != nil && !errors.Is(err, ErrBlocked) {
+			t.Errorf("route(%s) error = %v, expected ErrBlocked", tc.dst, err)
+		}
+	}
+}
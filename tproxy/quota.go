@@ -0,0 +1,138 @@
+package tproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+// ErrQuotaExceeded is returned for connections of client which used up its
+// traffic quota.
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// QuotaRule limits daily traffic of each client to Domain and its
+// subdomains. Domain "." matches all domains.
+type QuotaRule struct {
+	Domain string
+	Bytes  int64
+}
+
+var sizeSuffixes = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+func (r QuotaRule) String() string {
+	size := strconv.FormatInt(r.Bytes, 10)
+	for _, suffix := range []byte("TGMK") {
+		if unit := sizeSuffixes[suffix]; r.Bytes >= unit && r.Bytes%unit == 0 {
+			size = strconv.FormatInt(r.Bytes/unit, 10) + string(suffix)
+			break
+		}
+	}
+	return r.Domain + "=" + size
+}
+
+// ParseQuotaRule parses rule in "DOMAIN=SIZE" format, where SIZE is number
+// of bytes, optionally with K, M, G or T binary suffix.
+func ParseQuotaRule(s string) (QuotaRule, error) {
+	domain, size, ok := strings.Cut(s, "=")
+	if !ok {
+		return QuotaRule{}, fmt.Errorf("quota rule %q has no size", s)
+	}
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain != "." {
+		domain = strings.TrimSuffix(domain, ".")
+	}
+	if domain == "" {
+		return QuotaRule{}, fmt.Errorf("quota rule %q has no domain", s)
+	}
+	size = strings.ToUpper(strings.TrimSpace(size))
+	unit := int64(1)
+	if size != "" {
+		if u, ok := sizeSuffixes[size[len(size)-1]]; ok {
+			unit = u
+			size = size[:len(size)-1]
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/unit {
+		return QuotaRule{}, fmt.Errorf("bad size in quota rule %q", s)
+	}
+	return QuotaRule{Domain: domain, Bytes: n * unit}, nil
+}
+
+type quotaKey struct {
+	client clientkey.Key
+	domain string
+}
+
+// quotaTracker counts traffic of clients to domains with quota. Counters
+// are reset at local midnight.
+type quotaTracker struct {
+	limits map[string]int64
+	now    func() time.Time
+
+	mux   sync.Mutex
+	day   int
+	usage map[quotaKey]int64
+}
+
+func newQuotaTracker(rules []QuotaRule) *quotaTracker {
+	if len(rules) == 0 {
+		return nil
+	}
+	limits := make(map[string]int64, len(rules))
+	for _, rule := range rules {
+		limits[ruleDomain(rule.Domain)] = rule.Bytes
+	}
+	return &quotaTracker{
+		limits: limits,
+		now:    time.Now,
+		usage:  make(map[quotaKey]int64),
+	}
+}
+
+// match finds quota applicable to connection. Connections to addresses
+// rather than domains have no quota.
+func (q *quotaTracker) match(info *ConnInfo) (quotaKey, int64, bool) {
+	if q == nil {
+		return quotaKey{}, 0, false
+	}
+	if _, err := netip.ParseAddr(info.Host); err == nil {
+		return quotaKey{}, 0, false
+	}
+	domain, limit, ok := matchDomain(q.limits, info.Host)
+	return quotaKey{info.ClientKey, domain}, limit, ok
+}
+
+// add accounts n bytes of connection traffic. It returns ErrQuotaExceeded
+// once usage is over quota, which happens with n equal to zero for
+// connections made after quota ran out.
+func (q *quotaTracker) add(info *ConnInfo, n int) error {
+	key, limit, ok := q.match(info)
+	if !ok {
+		return nil
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	now := q.now()
+	if day := now.Year()*1000 + now.YearDay(); day != q.day {
+		q.day = day
+		q.usage = make(map[quotaKey]int64)
+	}
+	usage := q.usage[key]
+	if usage >= limit {
+		return ErrQuotaExceeded
+	}
+	q.usage[key] = usage + int64(n)
+	return nil
+}
@@ -0,0 +1,81 @@
+package tproxy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/dns44/clientkey"
+)
+
+func TestParseQuotaRule(t *testing.T) {
+	for s, expected := range map[string]QuotaRule{
+		"Example.COM.=100": {"example.com", 100},
+		".=2K":             {".", 2048},
+		"example.org=3g":   {"example.org", 3 << 30},
+	} {
+		rule, err := ParseQuotaRule(s)
+		if err != nil {
+			t.Errorf("ParseQuotaRule(%q) failed: %v", s, err)
+			continue
+		}
+		if rule != expected {
+			t.Errorf("ParseQuotaRule(%q) = %+v, expected %+v", s, rule, expected)
+		}
+	}
+	for _, s := range []string{"example.com", "=1M", "example.com=", "example.com=0", "example.com=1X", "example.com=-5"} {
+		if _, err := ParseQuotaRule(s); err == nil {
+			t.Errorf("ParseQuotaRule(%q) succeeded, expected error", s)
+		}
+	}
+	if s := (QuotaRule{"example.com", 5 << 20}).String(); s != "example.com=5M" {
+		t.Errorf("unexpected rule string %q", s)
+	}
+}
+
+func TestQuotaTracker(t *testing.T) {
+	q := newQuotaTracker([]QuotaRule{
+		{".", 1000},
+		{"example.com", 100},
+	})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	q.now = func() time.Time { return now }
+	alice := &ConnInfo{Host: "www.example.com", ClientKey: clientkey.FromAddr(netip.MustParseAddr("10.0.0.1"))}
+	bob := &ConnInfo{Host: "example.com", ClientKey: clientkey.FromAddr(netip.MustParseAddr("10.0.0.2"))}
+	other := &ConnInfo{Host: "example.org", ClientKey: alice.ClientKey}
+	direct := &ConnInfo{Host: "192.0.2.1", ClientKey: alice.ClientKey}
+
+	if err := q.add(alice, 150); err != nil {
+		t.Fatalf("first chunk over quota must pass: %v", err)
+	}
+	if err := q.add(alice, 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected quota to be exceeded, got %v", err)
+	}
+	if err := q.add(bob, 50); err != nil {
+		t.Errorf("other client must have own quota: %v", err)
+	}
+	if err := q.add(other, 500); err != nil {
+		t.Errorf("other domain must have own quota: %v", err)
+	}
+	if err := q.add(direct, 5000); err != nil || q.add(direct, 0) != nil {
+		t.Errorf("connections to addresses must not be limited")
+	}
+
+	now = now.Add(12 * time.Hour)
+	if err := q.add(alice, 0); err != nil {
+		t.Errorf("quota must be reset next day: %v", err)
+	}
+}
+
+func TestQuotaSharedByProxies(t *testing.T) {
+	cfg := &Config{Quotas: []QuotaRule{{"example.com", 100}}}
+	tcpHooks, udpHooks := newHooks(cfg), newHooks(cfg)
+	info := &ConnInfo{Host: "example.com", ClientKey: clientkey.FromAddr(netip.MustParseAddr("10.0.0.1"))}
+	if err := tcpHooks.quota.add(info, 150); err != nil {
+		t.Fatalf("first chunk over quota must pass: %v", err)
+	}
+	if err := udpHooks.connect(info); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("quota used up by TCP must apply to UDP, got %v", err)
+	}
+}
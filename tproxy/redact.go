@@ -0,0 +1,49 @@
+package tproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// redactor replaces domain names in logs. Nil redactor keeps them as is.
+type redactor func(name string) string
+
+func (r redactor) name(name string) string {
+	if r == nil {
+		return name
+	}
+	if _, err := netip.ParseAddr(name); err == nil {
+		return name
+	}
+	return r(name)
+}
+
+// redactedError hides domain name in message of wrapped error.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactingDialer hides dialed domain name in dial errors, as they end up
+// in logs.
+type redactingDialer struct {
+	dialer Dialer
+	redact redactor
+}
+
+func (d *redactingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		if host, _, splitErr := net.SplitHostPort(address); splitErr == nil {
+			if redacted := d.redact.name(host); redacted != host {
+				err = &redactedError{err, strings.ReplaceAll(err.Error(), host, redacted)}
+			}
+		}
+	}
+	return conn, err
+}
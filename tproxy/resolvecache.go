@@ -0,0 +1,71 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// cachingDialer resolves domain names using real addresses stored by
+// mapper and dials them directly. Cache misses are resolved with resolver
+// and stored.
+type cachingDialer struct {
+	dialer   Dialer
+	cache    ResolvedCache
+	resolver *net.Resolver
+	ttl      time.Duration
+	redact   redactor
+}
+
+func (d *cachingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("dial %s failed: %w", host, errors.Join(errs...))
+}
+
+func (d *cachingDialer) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs, ok, err := d.cache.LookupResolved(host)
+	if err != nil {
+		log.Printf("resolved addresses lookup for %s failed: %v", d.redact.name(host), err)
+	}
+	if ok && len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	addrs, err = d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	if err := d.cache.StoreResolved(host, addrs, d.ttl); err != nil {
+		log.Printf("can't store resolved addresses of %s: %v", d.redact.name(host), err)
+	}
+	return addrs, nil
+}
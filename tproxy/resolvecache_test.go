@@ -0,0 +1,96 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mapCache struct {
+	mux    sync.Mutex
+	addrs  map[string][]netip.Addr
+	stores int
+}
+
+func (c *mapCache) LookupResolved(domainName string) ([]netip.Addr, bool, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	addrs, ok := c.addrs[domainName]
+	return addrs, ok, nil
+}
+
+func (c *mapCache) StoreResolved(domainName string, addrs []netip.Addr, ttl time.Duration) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.addrs[domainName] = addrs
+	c.stores++
+	return nil
+}
+
+type recordingDialer struct {
+	mux       sync.Mutex
+	addresses []string
+	refuse    map[string]bool
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.addresses = append(d.addresses, address)
+	if d.refuse[address] {
+		return nil, errors.New("connection refused")
+	}
+	left, right := net.Pipe()
+	right.Close()
+	return left, nil
+}
+
+func TestCachingDialer(t *testing.T) {
+	cache := &mapCache{addrs: map[string][]netip.Addr{
+		"example.org": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")},
+	}}
+	dialer := &recordingDialer{refuse: map[string]bool{"192.0.2.1:443": true}}
+	d := &cachingDialer{
+		dialer:   dialer,
+		cache:    cache,
+		resolver: net.DefaultResolver,
+		ttl:      time.Minute,
+	}
+	ctx := context.Background()
+
+	conn, err := d.DialContext(ctx, "tcp", "example.org:443")
+	if err != nil {
+		t.Fatalf("dial via cached addresses failed: %v", err)
+	}
+	conn.Close()
+	if len(dialer.addresses) != 2 || dialer.addresses[1] != "192.0.2.2:443" {
+		t.Errorf("unexpected dialed addresses: %v", dialer.addresses)
+	}
+
+	dialer.addresses = nil
+	conn, err = d.DialContext(ctx, "tcp", "198.51.100.1:80")
+	if err != nil {
+		t.Fatalf("dial of IP address failed: %v", err)
+	}
+	conn.Close()
+	if len(dialer.addresses) != 1 || dialer.addresses[0] != "198.51.100.1:80" {
+		t.Errorf("IP address wasn't dialed as is: %v", dialer.addresses)
+	}
+
+	dialer.addresses = nil
+	conn, err = d.DialContext(ctx, "tcp", "localhost:80")
+	if err != nil {
+		t.Skipf("localhost can't be resolved: %v", err)
+	}
+	conn.Close()
+	if _, ok := cache.addrs["localhost"]; !ok || cache.stores != 1 {
+		t.Errorf("resolved addresses of localhost are not stored")
+	}
+	if _, err := netip.ParseAddrPort(dialer.addresses[0]); err != nil {
+		t.Errorf("domain wasn't dialed by address: %v", dialer.addresses)
+	}
+}
@@ -0,0 +1,62 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	minRetryDelay = 5 * time.Millisecond
+	maxRetryDelay = time.Second
+)
+
+// transientErrnos are socket errors which go away on their own, e.g. when
+// kernel buffers or file descriptors are freed.
+var transientErrnos = []syscall.Errno{
+	syscall.EINTR,
+	syscall.EAGAIN,
+	syscall.ENOBUFS,
+	syscall.ENOMEM,
+	syscall.EMFILE,
+	syscall.ENFILE,
+	syscall.ECONNABORTED,
+}
+
+func isTransient(err error) bool {
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// backoff is exponentially growing delay between retries.
+type backoff struct {
+	delay time.Duration
+}
+
+// wait sleeps for next delay. It returns false if ctx is done.
+func (b *backoff) wait(ctx context.Context) bool {
+	if b.delay == 0 {
+		b.delay = minRetryDelay
+	} else if b.delay *= 2; b.delay > maxRetryDelay {
+		b.delay = maxRetryDelay
+	}
+	t := time.NewTimer(b.delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (b *backoff) reset() {
+	b.delay = 0
+}
@@ -0,0 +1,82 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	for err, want := range map[error]bool{
+		&net.OpError{Op: "read", Err: os.NewSyscallError("recvmsg", syscall.ENOBUFS)}:  true,
+		fmt.Errorf("wrapped: %w", syscall.EINTR):                                       true,
+		&net.OpError{Op: "accept", Err: os.NewSyscallError("accept4", syscall.EMFILE)}: true,
+		&net.OpError{Op: "read", Err: os.NewSyscallError("recvmsg", syscall.EBADF)}:    false,
+		errors.New("boom"): false,
+	} {
+		if got := isTransient(err); got != want {
+			t.Errorf("isTransient(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
+
+// scriptedPacketConn fails reads with scripted errors.
+type scriptedPacketConn struct {
+	errs  []error
+	reads int
+}
+
+func (c *scriptedPacketConn) ReadFromOriginal(b []byte) (int, netip.AddrPort, netip.AddrPort, error) {
+	c.reads++
+	err := c.errs[0]
+	if len(c.errs) > 1 {
+		c.errs = c.errs[1:]
+	}
+	return 0, netip.AddrPort{}, netip.AddrPort{}, err
+}
+
+func (c *scriptedPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *scriptedPacketConn) Close() error {
+	return nil
+}
+
+type scriptedTransparent struct {
+	fakeTransparent
+	conn *scriptedPacketConn
+}
+
+func (s *scriptedTransparent) ListenTransparentUDP(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+	return s.conn, nil
+}
+
+func TestUDPProxyRetriesTransientErrors(t *testing.T) {
+	fatal := errors.New("fatal read error")
+	conn := &scriptedPacketConn{errs: []error{
+		syscall.ENOBUFS,
+		syscall.EINTR,
+		syscall.ENOBUFS,
+		fatal,
+	}}
+	cfg := fakeConfig(53)
+	cfg.Transparent = &scriptedTransparent{conn: conn}
+	proxy, err := NewUDPProxy(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("can't start UDP proxy: %v", err)
+	}
+	defer proxy.Close()
+	waitDone(t, proxy.Done())
+	if !errors.Is(proxy.Err(), fatal) {
+		t.Fatalf("unexpected proxy error: %v", proxy.Err())
+	}
+	if conn.reads != 4 {
+		t.Fatalf("proxy made %d reads, expected 4", conn.reads)
+	}
+}
@@ -0,0 +1,174 @@
+package tproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/notify"
+	"github.com/Snawoot/dns44/pool"
+)
+
+// router decides where flow has to be forwarded.
+type router struct {
+	mapper    Mapper
+	anyClient bool
+	clientKey ClientKeyExtractor
+	rules     []CIDRRule
+	pair6     *pool.Pair6
+	ports     portRules
+	notifier  *notify.Notifier
+	devices   DeviceTracker
+	blocked   []netip.Prefix
+	blockedBy Mapper
+	redact    redactor
+	names     ClientNames
+}
+
+func newRouter(cfg *Config) *router {
+	rules := append([]CIDRRule(nil), cfg.CIDRRules...)
+	for _, prefix := range cfg.InterceptRanges {
+		rules = append(rules, CIDRRule{prefix, ActionDirect})
+	}
+	return &router{
+		mapper:    cfg.Mapper,
+		anyClient: cfg.AnyClientFallback,
+		clientKey: cfg.ClientKey,
+		rules:     rules,
+		pair6:     cfg.Pair6,
+		ports:     newPortRules(cfg.PortRules),
+		notifier:  cfg.Notifier,
+		devices:   cfg.Devices,
+		blocked:   cfg.BlockedRanges,
+		blockedBy: cfg.BlockedMapper,
+		redact:    cfg.RedactName,
+		names:     cfg.ClientNames,
+	}
+}
+
+// route returns host which has to be dialed for the flow according to
+// routing rules, along with flow client key. Flows not matched by rules are
+// resolved back to domain name via mapper. It may replace flow.Conn, just
+// like ClientKeyExtractor does.
+func (r *router) route(flow *Flow) (host string, clientKey clientkey.Key, err error) {
+	defer func() {
+		if errors.Is(err, ErrBlocked) {
+			r.notifier.Notify(notify.EventBlocked, "%s %v", flow.Network, err)
+			if r.devices != nil {
+				r.devices.Blocked(clientKey)
+			}
+		}
+	}()
+	clientKey, err = r.clientKey.FlowClientKey(flow)
+	if err != nil {
+		return "", clientKey, fmt.Errorf("can't compute client key for %s: %w", flow.Source.String(), err)
+	}
+
+	// Dual-stack listeners report IPv4 destinations as IPv4-mapped IPv6
+	// ones, while rules and mappings hold plain IPv4 addresses.
+	dst := flow.Destination.Addr().Unmap()
+	lookupAddr := dst
+	if r.pair6 != nil {
+		if addr4, ok := r.pair6.To4(dst); ok {
+			lookupAddr = addr4
+		}
+	}
+
+	if r.isBlocked(lookupAddr) {
+		return r.routeBlocked(flow, clientKey, lookupAddr)
+	}
+	switch matchRules(r.rules, dst) {
+	case ActionDirect:
+		return dst.String(), clientKey, nil
+	case ActionBlock:
+		if r.paused(clientKey) {
+			return dst.String(), clientKey, nil
+		}
+		return "", clientKey, fmt.Errorf("%w (%s=>%s)", ErrBlocked, flow.Source.Addr().String(), dst.String())
+	}
+
+	domainName, ok, err := reverseLookup(r.mapper, r.anyClient, clientKey, lookupAddr)
+	if err != nil {
+		r.notifier.Notify(notify.EventMappingError, "reverse lookup of %s failed: %v", lookupAddr.String(), err)
+		return "", clientKey, fmt.Errorf("reverse lookup failed: %w", err)
+	}
+
+	if !ok {
+		return "", clientKey, fmt.Errorf("reverse mapping not found for address (%s=>%s)", flow.Source.Addr().String(), dst.String())
+	}
+
+	if domainName == "" {
+		return "", clientKey, fmt.Errorf("bad domain name for address (%s=>%s)", flow.Source.Addr().String(), dst.String())
+	}
+
+	if !r.ports.allowed(domainName, flow.Destination.Port()) && !r.paused(clientKey) {
+		return "", clientKey, fmt.Errorf("%w: port is not allowed for domain (%s=>%s)", ErrBlocked, flow.Source.Addr().String(), flow.Destination.String())
+	}
+
+	return domainName, clientKey, nil
+}
+
+func (r *router) isBlocked(addr netip.Addr) bool {
+	for _, prefix := range r.blocked {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sinkholedError is returned for flows to addresses of blocked domains.
+type sinkholedError struct {
+	domainName string
+	msg        string
+}
+
+func (e *sinkholedError) Error() string { return e.msg }
+func (e *sinkholedError) Unwrap() error { return ErrBlocked }
+
+// routeBlocked rejects flow to address of blocked domain. Flows of paused
+// clients go to the domain.
+func (r *router) routeBlocked(flow *Flow, clientKey clientkey.Key, addr netip.Addr) (string, clientkey.Key, error) {
+	var domainName string
+	if r.blockedBy != nil {
+		if name, ok, err := r.blockedBy.ReverseLookup(clientKey, addr); err == nil && ok {
+			domainName = name
+		}
+	}
+	if domainName != "" && r.paused(clientKey) {
+		return domainName, clientKey, nil
+	}
+	logName := "unknown domain"
+	if domainName != "" {
+		logName = r.redact.name(domainName)
+	}
+	return "", clientKey, &sinkholedError{
+		domainName: domainName,
+		msg:        fmt.Sprintf("%v: %s is blocked by DNS policy (%s=>%s)", ErrBlocked, logName, flow.Source.Addr().String(), flow.Destination.String()),
+	}
+}
+
+// clientLabel returns flow source address for logs, prefixed with client
+// name if it's known.
+func (r *router) clientLabel(clientKey clientkey.Key, source netip.AddrPort) string {
+	if r.names != nil {
+		if name, _ := r.names.ClientName(clientKey); name != "" {
+			return name + "(" + source.String() + ")"
+		}
+	}
+	return source.String()
+}
+
+// paused reports whether blocking is paused for client.
+func (r *router) paused(clientKey clientkey.Key) bool {
+	return r.devices != nil && r.devices.BlockingPaused(clientKey)
+}
+
+func reverseLookup(mapper Mapper, anyClientFallback bool, clientKey clientkey.Key, addr netip.Addr) (domainName string, ok bool, err error) {
+	domainName, ok, err = mapper.ReverseLookup(clientKey, addr)
+	if err != nil || ok || !anyClientFallback {
+		return domainName, ok, err
+	}
+	return mapper.(AnyClientMapper).ReverseLookupAnyClient(addr)
+}
@@ -0,0 +1,162 @@
+package tproxy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/Snawoot/dns44/clientkey"
+	"github.com/Snawoot/dns44/pool"
+)
+
+type staticMapper map[netip.Addr]string
+
+func (m staticMapper) ReverseLookup(clientKey clientkey.Key, addr netip.Addr) (string, bool, error) {
+	domainName, ok := m[addr]
+	return domainName, ok, nil
+}
+
+func TestRouterRoute(t *testing.T) {
+	r := newRouter(&Config{
+		Mapper:          staticMapper{netip.MustParseAddr("172.24.0.1"): "example.org"},
+		ClientKey:       SourceClientKey{},
+		InterceptRanges: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+		CIDRRules: []CIDRRule{
+			{netip.MustParsePrefix("203.0.113.128/25"), ActionBlock},
+			{netip.MustParsePrefix("10.0.0.0/8"), ActionDirect},
+			{netip.MustParsePrefix("0.0.0.0/8"), ActionBlock},
+		},
+	})
+	testCases := []struct {
+		dst  string
+		host string
+		ok   bool
+	}{
+		{"172.24.0.1:443", "example.org", true},
+		{"172.24.0.2:443", "", false},
+		{"203.0.113.7:443", "203.0.113.7", true},
+		{"198.51.100.1:443", "", false},
+		{"203.0.113.200:443", "", false},
+		{"10.1.2.3:22", "10.1.2.3", true},
+		{"0.1.2.3:80", "", false},
+		{"[::ffff:172.24.0.1]:443", "example.org", true},
+		{"[::ffff:203.0.113.200]:443", "", false},
+		{"[::ffff:10.1.2.3]:22", "10.1.2.3", true},
+	}
+	for _, tc := range testCases {
+		host, _, err := r.route(&Flow{
+			Network:     "tcp",
+			Source:      netip.MustParseAddrPort("10.0.0.1:40000"),
+			Destination: netip.MustParseAddrPort(tc.dst),
+		})
+		if (err == nil) != tc.ok || host != tc.host {
+			t.Errorf("route(%s) = (%q, %v), expected (%q, ok=%v)", tc.dst, host, err, tc.host, tc.ok)
+		}
+	}
+}
+
+func TestRouterPair6(t *testing.T) {
+	pair6, err := pool.NewPair6(netip.MustParsePrefix("fd44::/96"))
+	if err != nil {
+		t.Fatalf("NewPair6 failed: %v", err)
+	}
+	mapper := staticMapper{
+		netip.MustParseAddr("172.24.0.1"): "example.org",
+		netip.MustParseAddr("172.24.3.7"): "example.com",
+	}
+	r := newRouter(&Config{
+		Mapper:    mapper,
+		ClientKey: SourceClientKey{},
+		Pair6:     pair6,
+	})
+	for addr4, domainName := range mapper {
+		for _, dst := range []netip.Addr{addr4, pair6.To6(addr4)} {
+			host, _, err := r.route(&Flow{
+				Network:     "tcp",
+				Source:      netip.MustParseAddrPort("10.0.0.1:40000"),
+				Destination: netip.AddrPortFrom(dst, 443),
+			})
+			if err != nil || host != domainName {
+				t.Errorf("route(%s) = (%q, %v), expected %q", dst, host, err, domainName)
+			}
+		}
+	}
+}
+
+type pausedDevices struct {
+	paused  clientkey.Key
+	blocked int
+}
+
+func (d *pausedDevices) Blocked(clientkey.Key) { d.blocked++ }
+
+func (d *pausedDevices) BlockingPaused(key clientkey.Key) bool { return key == d.paused }
+
+func TestRouterBlockingPause(t *testing.T) {
+	devices := &pausedDevices{paused: clientkey.FromAddr(netip.MustParseAddr("10.0.0.2"))}
+	r := newRouter(&Config{
+		Mapper:    staticMapper{netip.MustParseAddr("172.24.0.1"): "example.org"},
+		ClientKey: SourceClientKey{},
+		CIDRRules: []CIDRRule{{netip.MustParsePrefix("203.0.113.0/24"), ActionBlock}},
+		PortRules: []PortRule{{Domain: ".", Ports: []PortRange{{443, 443}}}},
+		Devices:   devices,
+	})
+	for _, dst := range []string{"203.0.113.1:443", "172.24.0.1:80"} {
+		if _, _, err := r.route(&Flow{
+			Network:     "tcp",
+			Source:      netip.MustParseAddrPort("10.0.0.1:40000"),
+			Destination: netip.MustParseAddrPort(dst),
+		}); err == nil {
+			t.Errorf("flow to %s of client without pause must be blocked", dst)
+		}
+		if _, _, err := r.route(&Flow{
+			Network:     "tcp",
+			Source:      netip.MustParseAddrPort("10.0.0.2:40000"),
+			Destination: netip.MustParseAddrPort(dst),
+		}); err != nil {
+			t.Errorf("flow to %s of paused client must pass, got %v", dst, err)
+		}
+	}
+	if devices.blocked != 2 {
+		t.Errorf("%d blocked flows counted, expected 2", devices.blocked)
+	}
+}
+
+func TestRouterBlockedRanges(t *testing.T) {
+	devices := &pausedDevices{paused: clientkey.FromAddr(netip.MustParseAddr("10.0.0.2"))}
+	r := newRouter(&Config{
+		Mapper:        staticMapper{netip.MustParseAddr("172.24.0.1"): "example.org"},
+		ClientKey:     SourceClientKey{},
+		BlockedRanges: []netip.Prefix{netip.MustParsePrefix("172.31.255.0/24")},
+		BlockedMapper: staticMapper{netip.MustParseAddr("172.31.255.1"): "ads.example"},
+		CIDRRules:     []CIDRRule{{netip.MustParsePrefix("172.31.0.0/16"), ActionDirect}},
+		Devices:       devices,
+	})
+	route := func(src, dst string) (string, error) {
+		host, _, err := r.route(&Flow{
+			Network:     "tcp",
+			Source:      netip.MustParseAddrPort(src),
+			Destination: netip.MustParseAddrPort(dst),
+		})
+		return host, err
+	}
+	for dst, domainName := range map[string]string{"172.31.255.1:443": "ads.example", "172.31.255.2:443": ""} {
+		_, err := route("10.0.0.1:40000", dst)
+		if !errors.Is(err, ErrBlocked) {
+			t.Errorf("flow to %s must be blocked, got %v", dst, err)
+		}
+		var sinkholed *sinkholedError
+		if !errors.As(err, &sinkholed) || sinkholed.domainName != domainName {
+			t.Errorf("flow to %s: expected sinkholed error for %q, got %v", dst, domainName, err)
+		}
+	}
+	if host, err := route("10.0.0.2:40000", "172.31.255.1:443"); err != nil || host != "ads.example" {
+		t.Errorf("flow of paused client = (%q, %v), expected blocked domain", host, err)
+	}
+	if _, err := route("10.0.0.2:40000", "172.31.255.2:443"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("flow of paused client to unknown blocked address must be blocked, got %v", err)
+	}
+	if host, err := route("10.0.0.1:40000", "172.31.0.1:443"); err != nil || host != "172.31.0.1" {
+		t.Errorf("flow outside of blocked range = (%q, %v)", host, err)
+	}
+}
@@ -0,0 +1,62 @@
+package tproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// ErrBlocked is returned for flows rejected by routing rules.
+var ErrBlocked = errors.New("flow is blocked by rule")
+
+// Action is routing decision for flow.
+type Action int
+
+const (
+	// ActionMap resolves destination back to domain name via mapper.
+	ActionMap Action = iota
+	// ActionDirect forwards flow to its original destination.
+	ActionDirect
+	// ActionBlock rejects flow.
+	ActionBlock
+)
+
+var actionNames = map[Action]string{
+	ActionMap:    "map",
+	ActionDirect: "direct",
+	ActionBlock:  "block",
+}
+
+func (a Action) String() string {
+	if name, ok := actionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// ParseAction parses action name as returned by Action.String.
+func ParseAction(name string) (Action, error) {
+	for a, n := range actionNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q", name)
+}
+
+// CIDRRule applies Action to flows with destination within Prefix.
+type CIDRRule struct {
+	Prefix netip.Prefix
+	Action Action
+}
+
+// matchRules returns action of the first rule matching addr. Flows not
+// matched by any rule are mapped.
+func matchRules(rules []CIDRRule, addr netip.Addr) Action {
+	for _, rule := range rules {
+		if rule.Prefix.Contains(addr) {
+			return rule.Action
+		}
+	}
+	return ActionMap
+}
@@ -0,0 +1,39 @@
+package tproxy
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// superviseRestartDelay is the pause before loop restart after panic.
+var superviseRestartDelay = 100 * time.Millisecond
+
+// logPanic recovers from panic and logs it along with stack trace. It has
+// to be deferred directly.
+func logPanic(where string) {
+	if r := recover(); r != nil {
+		log.Printf("panic in %s: %v\n%s", where, r, debug.Stack())
+	}
+}
+
+// runRecovered runs f and returns error if it panicked.
+func runRecovered(where string, f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic in %s: %v\n%s", where, r, debug.Stack())
+			err = fmt.Errorf("panic in %s: %v", where, r)
+		}
+	}()
+	f()
+	return nil
+}
+
+// supervise runs loop until it returns, restarting it after panics.
+func supervise(where string, loop func()) {
+	for runRecovered(where, loop) != nil {
+		log.Printf("restarting %s", where)
+		time.Sleep(superviseRestartDelay)
+	}
+}
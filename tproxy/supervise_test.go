@@ -0,0 +1,50 @@
+package tproxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSuperviseRestart(t *testing.T) {
+	defer func(d time.Duration) { superviseRestartDelay = d }(superviseRestartDelay)
+	superviseRestartDelay = 0
+	runs := 0
+	supervise("test loop", func() {
+		runs++
+		if runs < 3 {
+			panic("boom")
+		}
+	})
+	if runs != 3 {
+		t.Fatalf("loop ran %d times, expected 3", runs)
+	}
+}
+
+func TestFutureConnDialFailure(t *testing.T) {
+	for name, dial := range map[string]func() (net.Conn, error){
+		"error": func() (net.Conn, error) { return nil, errors.New("dial failed") },
+		"panic": func() (net.Conn, error) { panic("boom") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := newFutureConn(dial, 0)
+			done := make(chan error, 1)
+			go func() {
+				_, err := conn.Read(make([]byte, 1))
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatal("read succeeded on failed connection")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("read on failed connection blocked")
+			}
+			if err := conn.Close(); err != nil {
+				t.Fatalf("close failed: %v", err)
+			}
+		})
+	}
+}
@@ -2,72 +2,193 @@ package tproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/netip"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type TCPProxy struct {
 	listener    net.Listener
-	mapper      Mapper
+	router      *router
+	transparent Transparent
 	baseCtx     context.Context
+	cancel      context.CancelFunc
 	dialer      Dialer
 	dialTimeout time.Duration
+	copyBufs    *bufPool
+	limiter     *acceptLimiter
+	redact      redactor
+	connLog     *log.Logger
+	hooks       hooks
+	blockPage   BlockPage
+	active      atomic.Int64
+	settingUp   atomic.Int64
+	err         error
+	handlers    sync.WaitGroup
+	done        chan struct{}
+	closeOnce   sync.Once
 }
 
+// NewTCPProxy starts TCP proxy listener. Proxy shuts down when ctx is
+// cancelled or Close is called.
 func NewTCPProxy(ctx context.Context, cfg *Config) (*TCPProxy, error) {
 	cfg.populateDefaults()
-
-	listenConfig := net.ListenConfig{
-		Control: transparentControlFunc,
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("bad config: %w", err)
 	}
 
-	listener, err := listenConfig.Listen(ctx, "tcp", cfg.ListenAddr.String())
+	listener, err := cfg.Transparent.ListenTransparentTCP(ctx, cfg.ListenAddr)
 	if err != nil {
 		return nil, fmt.Errorf("unable to start TCP proxy listener: %w", err)
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	proxy := &TCPProxy{
 		listener:    listener,
-		mapper:      cfg.Mapper,
+		router:      newRouter(cfg),
+		transparent: cfg.Transparent,
 		baseCtx:     ctx,
-		dialer:      cfg.Dialer,
+		cancel:      cancel,
+		dialer:      cfg.dialer(),
 		dialTimeout: cfg.DialTimeout,
+		copyBufs:    newBufPool(cfg.CopyBufSize),
+		limiter:     newAcceptLimiter(cfg.MaxPendingConns, cfg.MaxAcceptRate),
+		redact:      cfg.RedactName,
+		connLog:     cfg.connLog(),
+		hooks:       newHooks(cfg),
+		blockPage:   cfg.BlockPage,
+		done:        make(chan struct{}),
 	}
+	go func() {
+		<-ctx.Done()
+		proxy.Close()
+	}()
 	go proxy.listen()
 
 	return proxy, nil
 }
 
+// Addr returns address proxy listens on. It's useful to learn actual port
+// when proxy was bound to port 0.
+func (t *TCPProxy) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Close stops accepting new connections and terminates active ones.
+func (t *TCPProxy) Close() (err error) {
+	t.closeOnce.Do(func() {
+		t.cancel()
+		err = t.listener.Close()
+	})
+	return err
+}
+
+// Done returns a channel which is closed when proxy stops accepting
+// connections.
+func (t *TCPProxy) Done() <-chan struct{} {
+	return t.done
+}
+
+// TCPStats is a snapshot of TCP proxy state for diagnostics.
+type TCPStats struct {
+	// Conns is the number of connections being handled.
+	Conns int64
+	// SettingUp is the number of connections waiting for upstream
+	// connection.
+	SettingUp int64
+}
+
+// Stats returns snapshot of proxy state.
+func (t *TCPProxy) Stats() TCPStats {
+	return TCPStats{
+		Conns:     t.active.Load(),
+		SettingUp: t.settingUp.Load(),
+	}
+}
+
+// Err returns error which made proxy stop accepting connections. It's nil
+// if proxy is running or was closed.
+func (t *TCPProxy) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until proxy is stopped and all connection handlers are
+// finished.
+func (t *TCPProxy) Wait() {
+	<-t.done
+	t.handlers.Wait()
+}
+
 func (t *TCPProxy) listen() {
+	defer close(t.done)
+	supervise("TCP accept loop", t.acceptLoop)
+}
+
+func (t *TCPProxy) acceptLoop() {
+	var retry backoff
 	for {
 		conn, err := t.listener.Accept()
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				log.Printf("temporary error while accepting connection: %s", netErr)
-				time.Sleep(100 * time.Millisecond)
-				continue
+			if isTransient(err) {
+				log.Printf("temporary error while accepting connection: %s", err)
+				if retry.wait(t.baseCtx) {
+					continue
+				}
 			}
 
 			select {
 			case <-t.baseCtx.Done():
 			default:
 				log.Printf("unrecoverable error while accepting connection: %s", err)
+				t.err = err
 			}
 			return
 		}
+		retry.reset()
 
-		go t.handle(conn)
+		now := time.Now()
+		if !t.limiter.acquire(now) {
+			conn.Close()
+			if shed, report := t.limiter.recordShed(now); report {
+				log.Printf("TCP accept limit exceeded, %d connection(s) shed", shed)
+			}
+			continue
+		}
+
+		t.handlers.Add(1)
+		t.active.Add(1)
+		t.settingUp.Add(1)
+		go func() {
+			defer t.handlers.Done()
+			defer t.active.Add(-1)
+			defer logPanic("TCP handler")
+			var once sync.Once
+			t.handle(conn, func() {
+				once.Do(func() {
+					t.settingUp.Add(-1)
+					t.limiter.release()
+				})
+			})
+		}()
 	}
 }
 
-func (t *TCPProxy) handle(conn net.Conn) {
+// handle proxies connection. setupDone is called once connection to
+// upstream is established or failed.
+func (t *TCPProxy) handle(conn net.Conn, setupDone func()) {
 	defer conn.Close()
+	defer setupDone()
 
 	rAddr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
 	if err != nil {
@@ -75,64 +196,89 @@ func (t *TCPProxy) handle(conn net.Conn) {
 		return
 	}
 	rAddr = netip.AddrPortFrom(rAddr.Addr().Unmap(), rAddr.Port())
-	lAddr, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	lAddr, err := t.transparent.OriginalDst(conn)
 	if err != nil {
-		log.Printf("can't parse local address: %v", err)
+		log.Printf("can't get original destination: %v", err)
 		return
 	}
 	lAddr = netip.AddrPortFrom(lAddr.Addr().Unmap(), lAddr.Port())
 
-	domainName, ok, err := t.mapper.ReverseLookup(rAddr.Addr().String(), lAddr.Addr())
-	if err != nil {
-		log.Printf("reverse lookup in TCP handler failed: %v", err)
-		return
+	flow := &Flow{
+		Network:     "tcp",
+		Source:      rAddr,
+		Destination: lAddr,
+		Conn:        conn,
 	}
-
-	if !ok {
-		log.Printf("reverse mapping not found for address (%s=>%s)", rAddr.Addr().String(), lAddr.Addr().String())
+	host, clientKey, err := t.router.route(flow)
+	if flow.Conn != conn {
+		conn = flow.Conn
+		defer conn.Close()
+	}
+	if err != nil {
+		log.Printf("TCP handler: %v", err)
+		var sinkholed *sinkholedError
+		if t.blockPage != nil && errors.As(err, &sinkholed) && sinkholed.domainName != "" {
+			setupDone()
+			t.blockPage.ServeBlocked(conn, clientKey, sinkholed.domainName, lAddr.Port())
+		}
 		return
 	}
 
-	if domainName == "" {
-		log.Printf("bad domain name for address (%s=>%s)", rAddr.Addr().String(), lAddr.Addr().String())
+	info := &ConnInfo{Network: "tcp", Source: rAddr, Destination: lAddr, Host: host, ClientKey: clientKey}
+	client := t.router.clientLabel(clientKey, rAddr)
+	if err := t.hooks.connect(info); err != nil {
+		log.Printf("TCP handler: connection %s => %s rejected: %v", client, lAddr.String(), err)
 		return
 	}
 
-	log.Printf("[+] TCP %s <=> [%s(%s)]:%d", rAddr.String(), domainName, lAddr.Addr().String(), lAddr.Port())
+	t.connLog.Printf("[+] TCP %s <=> [%s(%s)]:%d", client, t.redact.name(host), lAddr.Addr().String(), lAddr.Port())
 
-	dialAddress := net.JoinHostPort(domainName, strconv.FormatUint(uint64(lAddr.Port()), 10))
+	dialAddress := net.JoinHostPort(host, strconv.FormatUint(uint64(lAddr.Port()), 10))
 	dialCtx, cancel := context.WithTimeout(t.baseCtx, t.dialTimeout)
 	defer cancel()
 
 	upstreamConn, err := t.dialer.DialContext(dialCtx, "tcp", dialAddress)
+	setupDone()
 	if err != nil {
 		log.Printf("remote dial failed: %v", err)
 		return
 	}
+	upstreamConn = t.hooks.wrap(info, upstreamConn)
 	defer upstreamConn.Close()
 
-	proxyStream(conn, upstreamConn)
-	log.Printf("[-] TCP %s <=> [%s(%s)]:%d", rAddr.String(), domainName, lAddr.Addr().String(), lAddr.Port())
+	proxyStream(t.baseCtx, t.copyBufs, conn, upstreamConn)
+	t.connLog.Printf("[-] TCP %s <=> [%s(%s)]:%d", client, t.redact.name(host), lAddr.Addr().String(), lAddr.Port())
 }
 
-func proxyStream(left, right net.Conn) {
+func proxyStream(ctx context.Context, bufs *bufPool, left, right net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			left.Close()
+			right.Close()
+		case <-finished:
+		}
+	}()
+
 	go func() {
 		defer wg.Done()
-		unidirForward(left, right)
+		unidirForward(bufs, left, right)
 	}()
 	go func() {
 		defer wg.Done()
-		unidirForward(right, left)
+		unidirForward(bufs, right, left)
 	}()
 
 	wg.Wait()
 }
 
-func unidirForward(from, to net.Conn) {
-	io.Copy(to, from)
+func unidirForward(bufs *bufPool, from, to net.Conn) {
+	bufs.copy(to, from)
 	shutdownWrite(to)
 }
 
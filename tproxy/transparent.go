@@ -0,0 +1,50 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var ErrTransparentUnsupported = errors.New("transparent sockets are not supported on this platform")
+
+// ErrRedirectUDP is returned by UDP listener of RedirectTransparent.
+var ErrRedirectUDP = errors.New("UDP can't be proxied in redirect mode")
+
+// Transparent is the platform layer which delivers intercepted traffic to
+// proxy and lets proxy answer on behalf of original destination.
+type Transparent interface {
+	// ListenTransparentTCP starts listener accepting connections
+	// addressed to any destination redirected to it.
+	ListenTransparentTCP(ctx context.Context, addr netip.AddrPort) (net.Listener, error)
+
+	// ListenTransparentUDP starts listener receiving datagrams addressed
+	// to any destination redirected to it.
+	ListenTransparentUDP(ctx context.Context, addr netip.AddrPort) (PacketConn, error)
+
+	// OriginalDst returns destination client has addressed connection
+	// accepted by transparent listener to.
+	OriginalDst(conn net.Conn) (netip.AddrPort, error)
+
+	// ReplyDial opens datagram connection to remote which is sourced from
+	// local, i.e. from original destination of client datagrams.
+	ReplyDial(local, remote netip.AddrPort) (net.Conn, error)
+}
+
+// RedirectTransparent returns Transparent for TCP connections redirected to
+// proxy by NAT, like iptables REDIRECT target does. It needs neither TPROXY
+// nor policy routing: original destination is queried from connection
+// tracking with SO_ORIGINAL_DST socket option. UDP isn't supported.
+func RedirectTransparent() Transparent {
+	return redirectTransparent()
+}
+
+// PacketConn is a transparent datagram listener.
+type PacketConn interface {
+	// ReadFromOriginal reads datagram into b and returns its source and
+	// original destination addresses.
+	ReadFromOriginal(b []byte) (n int, src, dst netip.AddrPort, err error)
+	LocalAddr() net.Addr
+	Close() error
+}
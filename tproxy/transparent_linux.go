@@ -1,48 +1,148 @@
 package tproxy
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"strconv"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
-var nativeEndian binary.ByteOrder
+// linuxTransparent implements Transparent with TPROXY sockets.
+type linuxTransparent struct{}
 
-func init() {
-	buf := [2]byte{}
-	*(*uint16)(unsafe.Pointer(&buf[0])) = uint16(0xABCD)
+func defaultTransparent() Transparent {
+	return linuxTransparent{}
+}
 
-	switch buf {
-	case [2]byte{0xCD, 0xAB}:
-		nativeEndian = binary.LittleEndian
-	case [2]byte{0xAB, 0xCD}:
-		nativeEndian = binary.BigEndian
-	default:
-		panic("Could not determine native endianness.")
+func (linuxTransparent) ListenTransparentTCP(ctx context.Context, addr netip.AddrPort) (net.Listener, error) {
+	listenConfig := net.ListenConfig{
+		Control: transparentControlFunc,
 	}
+	return listenConfig.Listen(ctx, "tcp", addr.String())
 }
 
-const (
-	IPV6_TRANSPARENT     = 75
-	IPV6_RECVORIGDSTADDR = 74
-)
+func (linuxTransparent) ListenTransparentUDP(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+	listenConfig := net.ListenConfig{
+		Control: transparentDgramControlFunc,
+	}
+	listener, err := listenConfig.ListenPacket(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	udpListener, ok := listener.(*net.UDPConn)
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("unable to assert listener type")
+	}
+	return linuxPacketConn{udpListener}, nil
+}
+
+// OriginalDst returns local address of connection, which TPROXY keeps
+// equal to original destination.
+func (linuxTransparent) OriginalDst(conn net.Conn) (netip.AddrPort, error) {
+	return netip.ParseAddrPort(conn.LocalAddr().String())
+}
+
+func (linuxTransparent) ReplyDial(local, remote netip.AddrPort) (net.Conn, error) {
+	return DialUDP("udp", net.UDPAddrFromAddrPort(local), net.UDPAddrFromAddrPort(remote))
+}
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+const ip6tSoOriginalDst = 80
+
+// linuxRedirect implements Transparent for connections redirected by NAT.
+type linuxRedirect struct{}
+
+func redirectTransparent() Transparent {
+	return linuxRedirect{}
+}
+
+func (linuxRedirect) ListenTransparentTCP(ctx context.Context, addr netip.AddrPort) (net.Listener, error) {
+	var listenConfig net.ListenConfig
+	return listenConfig.Listen(ctx, "tcp", addr.String())
+}
+
+func (linuxRedirect) ListenTransparentUDP(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+	return nil, ErrRedirectUDP
+}
+
+// OriginalDst returns destination of connection before NAT rewrote it.
+// Connections which reached listener directly have none.
+func (linuxRedirect) OriginalDst(conn net.Conn) (netip.AddrPort, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("connection of type %T has no socket", conn)
+	}
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var dst *net.UDPAddr
+	var operr error
+	if err := raw.Control(func(fd uintptr) {
+		// Socket options return sockaddr structures, which are read
+		// into structures of big enough size.
+		if local.Addr().Unmap().Is4() {
+			var mreq *unix.IPv6Mreq
+			mreq, operr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if operr == nil {
+				dst, operr = parseOrigDst(mreq.Multiaddr[:], unix.SizeofSockaddrInet4, 4, 4)
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		info, operr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+		if operr == nil {
+			data := unsafe.Slice((*byte)(unsafe.Pointer(&info.Addr)), unsafe.Sizeof(info.Addr))
+			dst, operr = parseOrigDst(data, unix.SizeofSockaddrInet6, 8, 16)
+		}
+	}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if operr != nil {
+		return netip.AddrPort{}, fmt.Errorf("SO_ORIGINAL_DST: %w", operr)
+	}
+	return dst.AddrPort(), nil
+}
+
+func (linuxRedirect) ReplyDial(local, remote netip.AddrPort) (net.Conn, error) {
+	return nil, ErrRedirectUDP
+}
+
+type linuxPacketConn struct {
+	*net.UDPConn
+}
+
+func (c linuxPacketConn) ReadFromOriginal(b []byte) (int, netip.AddrPort, netip.AddrPort, error) {
+	n, src, dst, err := ReadFromUDP(c.UDPConn, b)
+	if err != nil {
+		return 0, netip.AddrPort{}, netip.AddrPort{}, err
+	}
+	return n, src.AddrPort(), dst.AddrPort(), nil
+}
 
 func transparentControlFunc(network, address string, conn syscall.RawConn) error {
 	var operr error
 	if err := conn.Control(func(fd uintptr) {
-		level := syscall.SOL_IP
-		optname := syscall.IP_TRANSPARENT
+		level := unix.SOL_IP
+		optname := unix.IP_TRANSPARENT
 		switch network {
 		case "tcp6", "udp6", "ip6":
-			level = syscall.SOL_IPV6
-			optname = IPV6_TRANSPARENT
+			level = unix.SOL_IPV6
+			optname = unix.IPV6_TRANSPARENT
 		}
-		operr = syscall.SetsockoptInt(int(fd), level, optname, 1)
+		operr = unix.SetsockoptInt(int(fd), level, optname, 1)
 	}); err != nil {
 		return err
 	}
@@ -52,21 +152,29 @@ func transparentControlFunc(network, address string, conn syscall.RawConn) error
 func transparentDgramControlFunc(network, address string, conn syscall.RawConn) error {
 	var operr error
 	if err := conn.Control(func(fd uintptr) {
-		level := syscall.SOL_IP
-		transOptName := syscall.IP_TRANSPARENT
-		origDstOptName := syscall.IP_RECVORIGDSTADDR
+		level := unix.SOL_IP
+		transOptName := unix.IP_TRANSPARENT
+		origDstOptName := unix.IP_RECVORIGDSTADDR
 		switch network {
 		case "tcp6", "udp6", "ip6":
-			level = syscall.SOL_IPV6
-			transOptName = IPV6_TRANSPARENT
-			origDstOptName = IPV6_RECVORIGDSTADDR
+			level = unix.SOL_IPV6
+			transOptName = unix.IPV6_TRANSPARENT
+			origDstOptName = unix.IPV6_RECVORIGDSTADDR
 		}
 
-		operr = syscall.SetsockoptInt(int(fd), level, transOptName, 1)
+		operr = unix.SetsockoptInt(int(fd), level, transOptName, 1)
 		if operr != nil {
 			return
 		}
-		operr = syscall.SetsockoptInt(int(fd), level, origDstOptName, 1)
+		operr = unix.SetsockoptInt(int(fd), level, origDstOptName, 1)
+		if operr != nil || level == unix.SOL_IP {
+			return
+		}
+		// Dual-stack socket reports original destination of IPv4
+		// datagrams only with IPv4 option, and without it replies can't
+		// be sent from address datagram arrived on. It fails harmlessly
+		// for IPv6-only sockets.
+		unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
 	}); err != nil {
 		return err
 	}
@@ -86,46 +194,49 @@ func ReadFromUDP(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr,
 		return 0, nil, nil, err
 	}
 
-	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
 	if err != nil {
 		return 0, nil, nil, fmt.Errorf("parsing socket control message: %s", err)
 	}
 
-	ntohs := func(n uint16) uint16 {
-		return (n >> 8) | (n << 8)
-	}
-
 	var originalDst *net.UDPAddr
 	for _, msg := range msgs {
-		if msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVORIGDSTADDR {
-			originalDstRaw := &syscall.RawSockaddrInet4{}
-			if err = binary.Read(bytes.NewReader(msg.Data), nativeEndian, originalDstRaw); err != nil {
-				return 0, nil, nil, fmt.Errorf("reading original destination address: %s", err)
-			}
-			originalDst = &net.UDPAddr{
-				IP:   net.IPv4(originalDstRaw.Addr[0], originalDstRaw.Addr[1], originalDstRaw.Addr[2], originalDstRaw.Addr[3]),
-				Port: int(ntohs(originalDstRaw.Port)),
-			}
-		} else if msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == IPV6_RECVORIGDSTADDR {
-			originalDstRaw := &syscall.RawSockaddrInet6{}
-			if err = binary.Read(bytes.NewReader(msg.Data), nativeEndian, originalDstRaw); err != nil {
-				return 0, nil, nil, fmt.Errorf("reading original destination address: %s", err)
-			}
-			originalDst = &net.UDPAddr{
-				IP:   originalDstRaw.Addr[:],
-				Port: int(ntohs(originalDstRaw.Port)),
-				Zone: strconv.Itoa(int(originalDstRaw.Scope_id)),
-			}
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_RECVORIGDSTADDR:
+			originalDst, err = parseOrigDst(msg.Data, unix.SizeofSockaddrInet4, 4, 4)
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_RECVORIGDSTADDR:
+			originalDst, err = parseOrigDst(msg.Data, unix.SizeofSockaddrInet6, 8, 16)
+		default:
+			continue
+		}
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("reading original destination address: %s", err)
 		}
 	}
 
 	if originalDst == nil {
-		return 0, nil, nil, fmt.Errorf("unable to obtain original destination: %s", err)
+		return 0, nil, nil, fmt.Errorf("unable to obtain original destination: no control message")
 	}
 
 	return n, addr, originalDst, nil
 }
 
+// parseOrigDst decodes sockaddr_in or sockaddr_in6 structure carried by
+// control message. Port and address fields are in network byte order, so
+// no knowledge of host endianness is needed. Scope ID is not used: original
+// destinations are never link-local.
+func parseOrigDst(data []byte, size, addrOffset, addrLen int) (*net.UDPAddr, error) {
+	if len(data) < size {
+		return nil, fmt.Errorf("short sockaddr: %d bytes", len(data))
+	}
+	ip := make(net.IP, addrLen)
+	copy(ip, data[addrOffset:addrOffset+addrLen])
+	return &net.UDPAddr{
+		IP:   ip,
+		Port: int(binary.BigEndian.Uint16(data[2:4])),
+	}, nil
+}
+
 // DialUDP connects to the remote address raddr on the network net,
 // which must be "udp", "udp4", or "udp6".  If laddr is not nil, it is
 // used as the local address for the connection.
@@ -140,35 +251,35 @@ func DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (*net.UDPCo
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("build local socket address: %s", err)}
 	}
 
-	fileDescriptor, err := syscall.Socket(udpAddrFamily(network, laddr, raddr), syscall.SOCK_DGRAM, 0)
+	fileDescriptor, err := unix.Socket(udpAddrFamily(network, laddr, raddr), unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
 	if err != nil {
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("socket open: %s", err)}
 	}
 
-	if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		syscall.Close(fileDescriptor)
+	if err = unix.SetsockoptInt(fileDescriptor, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		unix.Close(fileDescriptor)
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("set socket option: SO_REUSEADDR: %s", err)}
 	}
 
 	if laddr.IP.To4() != nil {
-		if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
-			syscall.Close(fileDescriptor)
+		if err = unix.SetsockoptInt(fileDescriptor, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+			unix.Close(fileDescriptor)
 			return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("set socket option: IP_TRANSPARENT: %s", err)}
 		}
 	} else {
-		if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_IPV6, IPV6_TRANSPARENT, 1); err != nil {
-			syscall.Close(fileDescriptor)
+		if err = unix.SetsockoptInt(fileDescriptor, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			unix.Close(fileDescriptor)
 			return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("set socket option: IPV6_TRANSPARENT: %s", err)}
 		}
 	}
 
-	if err = syscall.Bind(fileDescriptor, localSocketAddress); err != nil {
-		syscall.Close(fileDescriptor)
+	if err = unix.Bind(fileDescriptor, localSocketAddress); err != nil {
+		unix.Close(fileDescriptor)
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("socket bind: %s", err)}
 	}
 
-	if err = syscall.Connect(fileDescriptor, remoteSocketAddress); err != nil {
-		syscall.Close(fileDescriptor)
+	if err = unix.Connect(fileDescriptor, remoteSocketAddress); err != nil {
+		unix.Close(fileDescriptor)
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("socket connect: %s", err)}
 	}
 
@@ -177,7 +288,7 @@ func DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (*net.UDPCo
 
 	remoteConn, err := net.FileConn(fdFile)
 	if err != nil {
-		syscall.Close(fileDescriptor)
+		unix.Close(fileDescriptor)
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("convert file descriptor to connection: %s", err)}
 	}
 
@@ -187,13 +298,13 @@ func DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (*net.UDPCo
 // udpAddToSockerAddr will convert a UDPAddr
 // into a Sockaddr that may be used when
 // connecting and binding sockets
-func udpAddrToSocketAddr(addr *net.UDPAddr) (syscall.Sockaddr, error) {
+func udpAddrToSocketAddr(addr *net.UDPAddr) (unix.Sockaddr, error) {
 	switch {
 	case addr.IP.To4() != nil:
 		ip := [4]byte{}
 		copy(ip[:], addr.IP.To4())
 
-		return &syscall.SockaddrInet4{Addr: ip, Port: addr.Port}, nil
+		return &unix.SockaddrInet4{Addr: ip, Port: addr.Port}, nil
 
 	default:
 		ip := [16]byte{}
@@ -204,7 +315,7 @@ func udpAddrToSocketAddr(addr *net.UDPAddr) (syscall.Sockaddr, error) {
 			zoneID = 0
 		}
 
-		return &syscall.SockaddrInet6{Addr: ip, Port: addr.Port, ZoneId: uint32(zoneID)}, nil
+		return &unix.SockaddrInet6{Addr: ip, Port: addr.Port, ZoneId: uint32(zoneID)}, nil
 	}
 }
 
@@ -214,14 +325,14 @@ func udpAddrToSocketAddr(addr *net.UDPAddr) (syscall.Sockaddr, error) {
 func udpAddrFamily(net string, laddr, raddr *net.UDPAddr) int {
 	switch net[len(net)-1] {
 	case '4':
-		return syscall.AF_INET
+		return unix.AF_INET
 	case '6':
-		return syscall.AF_INET6
+		return unix.AF_INET6
 	}
 
 	if (laddr == nil || laddr.IP.To4() != nil) &&
-		(raddr == nil || laddr.IP.To4() != nil) {
-		return syscall.AF_INET
+		(raddr == nil || raddr.IP.To4() != nil) {
+		return unix.AF_INET
 	}
-	return syscall.AF_INET6
+	return unix.AF_INET6
 }
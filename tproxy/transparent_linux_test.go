@@ -0,0 +1,65 @@
+package tproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestDualStackOriginalDst(t *testing.T) {
+	listener, err := defaultTransparent().ListenTransparentUDP(context.Background(), netip.MustParseAddrPort("[::]:0"))
+	if err != nil {
+		t.Skipf("transparent sockets are unavailable: %v", err)
+	}
+	defer listener.Close()
+	port := netip.MustParseAddrPort(listener.LocalAddr().String()).Port()
+
+	buf := make([]byte, 16)
+	for _, addr := range []string{"127.0.0.2", "::1"} {
+		expected := netip.AddrPortFrom(netip.MustParseAddr(addr), port)
+		conn, err := net.Dial("udp", expected.String())
+		if err != nil {
+			t.Fatalf("can't dial %s: %v", expected, err)
+		}
+		conn.Write([]byte("ping"))
+		conn.Close()
+		_, _, dst, err := listener.ReadFromOriginal(buf)
+		if err != nil {
+			t.Fatalf("datagram to %s: %v", expected, err)
+		}
+		if unmapAddrPort(dst) != expected {
+			t.Errorf("got original destination %s, expected %s", dst, expected)
+		}
+	}
+}
+
+func TestRedirectOriginalDst(t *testing.T) {
+	redirect := RedirectTransparent()
+	if _, err := redirect.ListenTransparentUDP(context.Background(), netip.MustParseAddrPort("127.0.0.1:0")); err != ErrRedirectUDP {
+		t.Errorf("UDP listener in redirect mode returned %v", err)
+	}
+	listener, err := redirect.ListenTransparentTCP(context.Background(), netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("can't dial: %v", err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("can't accept: %v", err)
+	}
+	defer conn.Close()
+
+	// Connection which wasn't NATed has no original destination, unless
+	// conntrack tracks it, then it's listener address itself.
+	dst, err := redirect.OriginalDst(conn)
+	if err == nil && dst.String() != listener.Addr().String() {
+		t.Errorf("got original destination %s of direct connection to %s", dst, listener.Addr())
+	}
+}
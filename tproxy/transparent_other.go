@@ -0,0 +1,35 @@
+//go:build !linux
+
+package tproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+type unsupportedTransparent struct{}
+
+func defaultTransparent() Transparent {
+	return unsupportedTransparent{}
+}
+
+func redirectTransparent() Transparent {
+	return unsupportedTransparent{}
+}
+
+func (unsupportedTransparent) ListenTransparentTCP(ctx context.Context, addr netip.AddrPort) (net.Listener, error) {
+	return nil, ErrTransparentUnsupported
+}
+
+func (unsupportedTransparent) ListenTransparentUDP(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+	return nil, ErrTransparentUnsupported
+}
+
+func (unsupportedTransparent) OriginalDst(conn net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, ErrTransparentUnsupported
+}
+
+func (unsupportedTransparent) ReplyDial(local, remote netip.AddrPort) (net.Conn, error) {
+	return nil, ErrTransparentUnsupported
+}
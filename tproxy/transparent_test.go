@@ -0,0 +1,220 @@
+package tproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// fakeTransparent pretends every intercepted flow was addressed to dst.
+type fakeTransparent struct {
+	dst      netip.AddrPort
+	listener *net.UDPConn
+}
+
+func (f *fakeTransparent) ListenTransparentTCP(ctx context.Context, addr netip.AddrPort) (net.Listener, error) {
+	var lc net.ListenConfig
+	return lc.Listen(ctx, "tcp", addr.String())
+}
+
+func (f *fakeTransparent) ListenTransparentUDP(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return nil, err
+	}
+	f.listener = conn
+	return &fakePacketConn{conn, f.dst}, nil
+}
+
+func (f *fakeTransparent) OriginalDst(conn net.Conn) (netip.AddrPort, error) {
+	return f.dst, nil
+}
+
+// ReplyDial answers from listener socket, because fake listener can't
+// source datagrams from original destination.
+func (f *fakeTransparent) ReplyDial(local, remote netip.AddrPort) (net.Conn, error) {
+	return &fakeReplyConn{f.listener, remote, make(chan struct{})}, nil
+}
+
+type fakeReplyConn struct {
+	*net.UDPConn
+	remote netip.AddrPort
+	closed chan struct{}
+}
+
+func (c *fakeReplyConn) Write(b []byte) (int, error) {
+	return c.WriteToUDPAddrPort(b, c.remote)
+}
+
+func (c *fakeReplyConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *fakeReplyConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+type fakePacketConn struct {
+	*net.UDPConn
+	dst netip.AddrPort
+}
+
+func (c *fakePacketConn) ReadFromOriginal(b []byte) (int, netip.AddrPort, netip.AddrPort, error) {
+	n, src, err := c.ReadFromUDPAddrPort(b)
+	return n, src, c.dst, err
+}
+
+func startEcho(t testing.TB) (tcpAddr, udpAddr netip.AddrPort) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen TCP: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("can't listen UDP: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, UDPBufSize)
+		for {
+			n, addr, err := pc.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDPAddrPort(buf[:n], addr)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).AddrPort(), pc.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func fakeConfig(dstPort uint16) *Config {
+	fakeAddr := netip.MustParseAddr("172.24.0.1")
+	return &Config{
+		ListenAddr:  netip.MustParseAddrPort("127.0.0.1:0"),
+		Mapper:      staticMapper{fakeAddr: "127.0.0.1"},
+		Transparent: &fakeTransparent{dst: netip.AddrPortFrom(fakeAddr, dstPort)},
+	}
+}
+
+func TestTCPProxyFakeTransparent(t *testing.T) {
+	tcpEcho, _ := startEcho(t)
+	proxy, err := NewTCPProxy(context.Background(), fakeConfig(tcpEcho.Port()))
+	if err != nil {
+		t.Fatalf("can't start TCP proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, msg) {
+		t.Fatalf("unexpected echo: %q, %v", reply, err)
+	}
+	if stats := proxy.Stats(); stats != (TCPStats{Conns: 1}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestUDPProxyFakeTransparent(t *testing.T) {
+	_, udpEcho := startEcho(t)
+	proxy, err := NewUDPProxy(context.Background(), fakeConfig(udpEcho.Port()))
+	if err != nil {
+		t.Fatalf("can't start UDP proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("udp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	reply := make([]byte, UDPBufSize)
+	n, err := conn.Read(reply)
+	if err != nil || !bytes.Equal(reply[:n], msg) {
+		t.Fatalf("unexpected echo: %q, %v", reply[:n], err)
+	}
+	if stats := proxy.Stats(); stats != (UDPStats{Sessions: 1}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestUDPProxyManySessions(t *testing.T) {
+	_, udpEcho := startEcho(t)
+	cfg := fakeConfig(udpEcho.Port())
+	cfg.UDPWorkers = 2
+	proxy, err := NewUDPProxy(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("can't start UDP proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			conn, err := net.Dial("udp", proxy.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			reply := make([]byte, UDPBufSize)
+			for j := 0; j < 10; j++ {
+				msg := []byte(fmt.Sprintf("session %d message %d", i, j))
+				if _, err := conn.Write(msg); err != nil {
+					errs <- err
+					return
+				}
+				n, err := conn.Read(reply)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(reply[:n], msg) {
+					errs <- fmt.Errorf("unexpected echo: %q, want %q", reply[:n], msg)
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
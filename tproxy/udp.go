@@ -3,22 +3,27 @@ package tproxy
 import (
 	"context"
 	"fmt"
-	"io"
+	"hash/maphash"
 	"log"
 	"net"
 	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
-	// UDPConnTrackTimeout is the timeout used for UDP connection tracking
+	// UDPConnTrackTimeout is the default timeout used for UDP connection
+	// tracking
 	UDPConnTrackTimeout = 90 * time.Second
 	// UDPBufSize is the buffer size for the UDP proxy
 	UDPBufSize = 65507
+	// udpWorkerQueue is the number of datagrams queued for each UDP worker.
+	// Datagrams which don't fit are dropped.
+	udpWorkerQueue = 256
 )
 
 // A net.Addr where the IP is split into two fields so you can use it as a key
@@ -28,70 +33,192 @@ type connTrackKey struct {
 	to   netip.AddrPort
 }
 
+// loose returns key of session tracked regardless of client port.
+func (key connTrackKey) loose() connTrackKey {
+	return connTrackKey{netip.AddrPortFrom(key.from.Addr(), 0), key.to}
+}
+
 func (key connTrackKey) String() string {
 	return fmt.Sprintf("<%s,%s>", key.from.String(), key.to.String())
 }
 
-type connTrackMap map[connTrackKey]net.Conn
+// hash is computed for each datagram, so it must not allocate.
+func (key connTrackKey) hash(seed maphash.Seed) uint64 {
+	var h maphash.Hash
+	h.SetSeed(seed)
+	writeAddrPort(&h, key.from)
+	writeAddrPort(&h, key.to)
+	return h.Sum64()
+}
+
+func writeAddrPort(h *maphash.Hash, ap netip.AddrPort) {
+	addr := ap.Addr().As16()
+	h.Write(addr[:])
+	h.WriteByte(byte(ap.Port() >> 8))
+	h.WriteByte(byte(ap.Port()))
+}
+
+// connTrackEntry is a tracked UDP session. Client address may change
+// during session lifetime if session is tracked regardless of client port.
+type connTrackEntry struct {
+	conn    net.Conn
+	client  atomic.Pointer[netip.AddrPort]
+	timeout time.Duration
+}
+
+type connTrackMap map[connTrackKey]*connTrackEntry
+
+type udpDatagram struct {
+	data     *[]byte
+	from, to netip.AddrPort
+	key      connTrackKey
+}
+
+// udpShard is a part of conntrack table served by one worker. Datagrams
+// of each session are always handled by the same worker, so they are
+// forwarded in order.
+// udpShard tracks sessions of some clients. Loose sessions are listed
+// twice in table: under key of the client port which started them and
+// under loose key.
+type udpShard struct {
+	lock  sync.Mutex
+	table connTrackMap
+	loose int
+	queue chan udpDatagram
+}
 
 type UDPProxy struct {
-	listener       *net.UDPConn
-	mapper         Mapper
-	baseCtx        context.Context
-	dialer         Dialer
-	dialTimeout    time.Duration
-	connTrackTable connTrackMap
-	connTrackLock  sync.Mutex
+	listener     PacketConn
+	transparent  Transparent
+	router       *router
+	baseCtx      context.Context
+	cancel       context.CancelFunc
+	dialer       Dialer
+	dialTimeout  time.Duration
+	shards       []*udpShard
+	shardSeed    maphash.Seed
+	looseUDP     portRules
+	timeouts     udpTimeouts
+	pendingDials atomic.Int64
+	redact       redactor
+	connLog      *log.Logger
+	hooks        hooks
+	err          error
+	dropped      uint64
+	lastDropLog  time.Time
+	workers      sync.WaitGroup
+	replyLoops   sync.WaitGroup
+	done         chan struct{}
+	closeOnce    sync.Once
 }
 
+// NewUDPProxy starts UDP proxy listener. Proxy shuts down when ctx is
+// cancelled or Close is called.
 func NewUDPProxy(ctx context.Context, cfg *Config) (*UDPProxy, error) {
 	cfg.populateDefaults()
-
-	listenConfig := net.ListenConfig{
-		Control: transparentDgramControlFunc,
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("bad config: %w", err)
 	}
 
-	listener, err := listenConfig.ListenPacket(ctx, "udp", cfg.ListenAddr.String())
+	listener, err := cfg.Transparent.ListenTransparentUDP(ctx, cfg.udpListenAddr())
 	if err != nil {
 		return nil, fmt.Errorf("unable to start UDP proxy listener: %w", err)
 	}
-	udpListener, ok := listener.(*net.UDPConn)
-	if !ok {
-		return nil, fmt.Errorf("unable to assert listener type")
-	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	proxy := &UDPProxy{
-		listener:    udpListener,
-		mapper:      cfg.Mapper,
+		listener:    listener,
+		transparent: cfg.Transparent,
+		router:      newRouter(cfg),
 		baseCtx:     ctx,
-		dialer:      cfg.Dialer,
+		cancel:      cancel,
+		dialer:      cfg.dialer(),
 		dialTimeout: cfg.DialTimeout,
+		shards:      make([]*udpShard, cfg.UDPWorkers),
+		shardSeed:   maphash.MakeSeed(),
+		looseUDP:    newPortRules(cfg.LooseUDPRules),
+		timeouts: udpTimeouts{
+			short:  cfg.UDPShortTimeout,
+			normal: cfg.UDPTimeout,
+			long:   cfg.UDPLongTimeout,
+		},
+		redact:  cfg.RedactName,
+		connLog: cfg.connLog(),
+		hooks:   newHooks(cfg),
+		done:    make(chan struct{}),
+	}
+	for i := range proxy.shards {
+		shard := &udpShard{
+			table: make(connTrackMap),
+			queue: make(chan udpDatagram, udpWorkerQueue),
+		}
+		proxy.shards[i] = shard
+		proxy.workers.Add(1)
+		go proxy.worker(shard)
 	}
 
+	go func() {
+		<-ctx.Done()
+		proxy.Close()
+	}()
 	go proxy.listen()
 
 	return proxy, nil
 }
 
-func (proxy *UDPProxy) replyLoop(proxyConn net.Conn, clientAddr *net.UDPAddr, localAddr *net.UDPAddr, ctKey connTrackKey) {
+func (proxy *UDPProxy) replyLoop(shard *udpShard, entry *connTrackEntry, localAddr netip.AddrPort, ctKey connTrackKey) {
+	proxyConn := entry.conn
+	defer proxy.replyLoops.Done()
+	defer logPanic("UDP reply loop")
 	defer func() {
-		proxy.connTrackLock.Lock()
-		delete(proxy.connTrackTable, ctKey)
-		proxy.connTrackLock.Unlock()
+		shard.lock.Lock()
+		delete(shard.table, ctKey)
+		if looseKey := ctKey.loose(); shard.table[looseKey] == entry {
+			delete(shard.table, looseKey)
+			shard.loose--
+		}
+		shard.lock.Unlock()
 		proxyConn.Close()
-		log.Printf("[-] UDP %s <=> %s", ctKey.from.String(), ctKey.to.String())
+		proxy.connLog.Printf("[-] UDP %s <=> %s", ctKey.from.String(), ctKey.to.String())
 	}()
 
-	respConn, err := DialUDP("udp", localAddr, clientAddr)
-	if err != nil {
-		log.Printf("unable to open reply UDP connection: %v", err)
+	var (
+		respConn   net.Conn
+		respClient *netip.AddrPort
+	)
+	defer func() {
+		if respConn != nil {
+			respConn.Close()
+		}
+	}()
+	// dialResp (re)opens reply connection when client address changes.
+	dialResp := func() bool {
+		client := entry.client.Load()
+		if respConn != nil && client == respClient {
+			return true
+		}
+		if respConn != nil {
+			respConn.Close()
+		}
+		var err error
+		respConn, err = proxy.transparent.ReplyDial(localAddr, *client)
+		if err != nil {
+			log.Printf("unable to open reply UDP connection: %v", err)
+			return false
+		}
+		respClient = client
+		go udpBufPool.copy(proxyConn, respConn)
+		return true
+	}
+	if !dialResp() {
+		return
 	}
-	defer respConn.Close()
-	go io.Copy(proxyConn, respConn)
 
-	readBuf := make([]byte, UDPBufSize)
+	bufPtr := udpBufPool.get()
+	defer udpBufPool.put(bufPtr)
+	readBuf := *bufPtr
 	for {
-		proxyConn.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout))
+		proxyConn.SetReadDeadline(time.Now().Add(entry.timeout))
 	again:
 		read, err := proxyConn.Read(readBuf)
 		if err != nil {
@@ -99,13 +226,16 @@ func (proxy *UDPProxy) replyLoop(proxyConn net.Conn, clientAddr *net.UDPAddr, lo
 				// This will happen if the last write failed
 				// (e.g: nothing is actually listening on the
 				// proxied port on the container), ignore it
-				// and continue until UDPConnTrackTimeout
+				// and continue until session timeout
 				// expires:
 				goto again
 			}
 			log.Printf("reply loop (%s) stopped on read for reason: %v", ctKey.String(), err)
 			return
 		}
+		if !dialResp() {
+			return
+		}
 		_, err = respConn.Write(readBuf[:read])
 		if err != nil {
 			log.Printf("reply loop (%s) stopped on write for reason: %v", ctKey.String(), err)
@@ -114,62 +244,174 @@ func (proxy *UDPProxy) replyLoop(proxyConn net.Conn, clientAddr *net.UDPAddr, lo
 	}
 }
 
-// listen starts forwarding the traffic using UDP.
 func (proxy *UDPProxy) listen() {
-	proxy.connTrackTable = make(connTrackMap)
+	defer close(proxy.done)
+	defer proxy.workers.Wait()
+	defer func() {
+		for _, shard := range proxy.shards {
+			close(shard.queue)
+		}
+	}()
+	supervise("UDP listen loop", proxy.readLoop)
+}
+
+// readLoop reads datagrams and dispatches them to workers.
+func (proxy *UDPProxy) readLoop() {
 	readBuf := make([]byte, UDPBufSize)
+	var retry backoff
 	for {
-		read, from, to, err := ReadFromUDP(proxy.listener, readBuf)
+		read, from, to, err := proxy.listener.ReadFromOriginal(readBuf)
 		if err != nil {
 			// NOTE: Apparently ReadFrom doesn't return
 			// ECONNREFUSED like Read do (see comment in
 			// UDPProxy.replyLoop)
-			if !isClosedError(err) {
-				log.Printf("stopping proxy on udp: %v", err)
+			if isClosedError(err) {
+				break
 			}
+			if isTransient(err) {
+				log.Printf("temporary error while reading UDP datagram: %v", err)
+				if retry.wait(proxy.baseCtx) {
+					continue
+				}
+				break
+			}
+			log.Printf("stopping proxy on udp: %v", err)
+			proxy.err = err
 			break
 		}
-		from, to = unmapUDPAddr(from), unmapUDPAddr(to)
-
-		ctKey := connTrackKey{from.AddrPort(), to.AddrPort()}
-		proxy.connTrackLock.Lock()
-		proxyConn, hit := proxy.connTrackTable[ctKey]
-		if !hit {
-			proxyConn, err = proxy.makeOutboundConn(from.AddrPort(), to.AddrPort())
-			if err != nil {
-				log.Printf("can't proxy a datagram to udp: %v", err)
-				proxy.connTrackLock.Unlock()
-				continue
-			}
-			proxy.connTrackTable[ctKey] = proxyConn
-			go proxy.replyLoop(proxyConn, from, to, ctKey)
+		retry.reset()
+		from, to = unmapAddrPort(from), unmapAddrPort(to)
+
+		// Sessions are sharded regardless of client port, so loose
+		// session is found in the same shard when client port changes.
+		ctKey := connTrackKey{from, to}
+		shard := proxy.shards[ctKey.loose().hash(proxy.shardSeed)%uint64(len(proxy.shards))]
+		dgram := udpDatagram{
+			data: getDatagramBuf(readBuf[:read]),
+			from: from,
+			to:   to,
+			key:  ctKey,
 		}
-		proxy.connTrackLock.Unlock()
-		_, err = proxyConn.Write(readBuf[:read])
-		if err != nil {
-			log.Printf("can't proxy a datagram to udp: %v", err)
+		select {
+		case shard.queue <- dgram:
+		default:
+			putDatagramBuf(dgram.data)
+			if dropped, report := proxy.recordDrop(time.Now()); report {
+				log.Printf("UDP worker queue is full, %d datagram(s) dropped", dropped)
+			}
 		}
 	}
 }
 
-func (proxy *UDPProxy) makeOutboundConn(from, to netip.AddrPort) (net.Conn, error) {
-	futureConn := newFutureConn(func() (net.Conn, error) {
-		domainName, ok, err := proxy.mapper.ReverseLookup(from.Addr().String(), to.Addr())
-		if err != nil {
-			return nil, fmt.Errorf("reverse lookup in UDP handler failed: %w", err)
+// recordDrop counts datagram dropped by read loop. It returns number of
+// datagrams dropped since last report if it's time to report them.
+func (proxy *UDPProxy) recordDrop(now time.Time) (uint64, bool) {
+	proxy.dropped++
+	if now.Sub(proxy.lastDropLog) < shedLogInterval {
+		return 0, false
+	}
+	dropped := proxy.dropped
+	proxy.dropped = 0
+	proxy.lastDropLog = now
+	return dropped, true
+}
+
+func (proxy *UDPProxy) worker(shard *udpShard) {
+	defer proxy.workers.Done()
+	supervise("UDP worker", func() {
+		for dgram := range shard.queue {
+			if proxy.baseCtx.Err() == nil {
+				proxy.forward(shard, dgram)
+			}
+			// Otherwise drain queue without starting new sessions.
+			putDatagramBuf(dgram.data)
 		}
+	})
+}
+
+// forward sends datagram to upstream, starting new session if needed.
+func (proxy *UDPProxy) forward(shard *udpShard, dgram udpDatagram) {
+	entry, err := proxy.session(shard, dgram)
+	if err != nil {
+		log.Printf("can't proxy a datagram to udp: %v", err)
+		return
+	}
+	_, err = entry.conn.Write(*dgram.data)
+	if err != nil {
+		log.Printf("can't proxy a datagram to udp: %v", err)
+	}
+}
 
-		if !ok {
-			return nil, fmt.Errorf("reverse mapping not found for address (%s=>%s)", from.Addr().String(), to.Addr().String())
+// session returns tracked session for datagram, starting new one if needed.
+// Datagrams from new client port join loose session of the client, which
+// then replies to that port, like QUIC connection migration expects.
+func (proxy *UDPProxy) session(shard *udpShard, dgram udpDatagram) (*connTrackEntry, error) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, hit := shard.table[dgram.key]
+	if !hit && shard.loose > 0 {
+		entry, hit = shard.table[dgram.key.loose()]
+	}
+	if hit {
+		if *entry.client.Load() != dgram.from {
+			entry.client.Store(&dgram.from)
 		}
+		return entry, nil
+	}
+	entry = &connTrackEntry{
+		timeout: proxy.timeouts.sessionTimeout(dgram.to, *dgram.data),
+	}
+	proxyConn, err := proxy.makeOutboundConn(dgram.from, dgram.to, func() {
+		proxy.trackLoose(shard, dgram.key, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry.conn = proxyConn
+	entry.client.Store(&dgram.from)
+	shard.table[dgram.key] = entry
+	proxy.replyLoops.Add(1)
+	go proxy.replyLoop(shard, entry, dgram.to, dgram.key)
+	return entry, nil
+}
+
+// trackLoose lists session under loose key of its client, unless session
+// is over or client already has loose session to the same destination.
+func (proxy *UDPProxy) trackLoose(shard *udpShard, key connTrackKey, entry *connTrackEntry) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if shard.table[key] != entry {
+		return
+	}
+	if _, taken := shard.table[key.loose()]; !taken {
+		shard.table[key.loose()] = entry
+		shard.loose++
+	}
+}
 
-		if domainName == "" {
-			return nil, fmt.Errorf("bad domain name for address (%s=>%s)", from.Addr().String(), to.Addr().String())
+// makeOutboundConn dials upstream of flow in background. It calls loose
+// once flow is routed to domain and port listed by LooseUDPRules.
+func (proxy *UDPProxy) makeOutboundConn(from, to netip.AddrPort, loose func()) (net.Conn, error) {
+	proxy.pendingDials.Add(1)
+	futureConn := newFutureConn(func() (net.Conn, error) {
+		defer proxy.pendingDials.Add(-1)
+		host, clientKey, err := proxy.router.route(&Flow{
+			Network:     "udp",
+			Source:      from,
+			Destination: to,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("UDP handler: %w", err)
+		}
+		info := &ConnInfo{Network: "udp", Source: from, Destination: to, Host: host, ClientKey: clientKey}
+		client := proxy.router.clientLabel(clientKey, from)
+		if err := proxy.hooks.connect(info); err != nil {
+			return nil, fmt.Errorf("UDP handler: session %s => %s rejected: %w", client, to.String(), err)
 		}
 
-		log.Printf("[+] UDP %s <=> [%s(%s)]:%d", from.String(), domainName, to.Addr().String(), to.Port())
+		proxy.connLog.Printf("[+] UDP %s <=> [%s(%s)]:%d", client, proxy.redact.name(host), to.Addr().String(), to.Port())
 
-		dialAddress := net.JoinHostPort(domainName, strconv.FormatUint(uint64(to.Port()), 10))
+		dialAddress := net.JoinHostPort(host, strconv.FormatUint(uint64(to.Port()), 10))
 		dialCtx, cancel := context.WithTimeout(proxy.baseCtx, proxy.dialTimeout)
 		defer cancel()
 
@@ -177,21 +419,85 @@ func (proxy *UDPProxy) makeOutboundConn(from, to netip.AddrPort) (net.Conn, erro
 		if err != nil {
 			return nil, fmt.Errorf("remote dial failed: %w", err)
 		}
+		if proxy.looseUDP.contains(host, to.Port()) {
+			loose()
+		}
 
-		return conn, nil
+		return proxy.hooks.wrap(info, conn), nil
 	}, 0)
 
 	return futureConn, nil
 }
 
+// Addr returns address proxy listens on. It's useful to learn actual port
+// when proxy was bound to port 0.
+func (proxy *UDPProxy) Addr() net.Addr {
+	return proxy.listener.LocalAddr()
+}
+
 // Close stops forwarding the traffic.
-func (proxy *UDPProxy) Close() {
-	proxy.listener.Close()
-	proxy.connTrackLock.Lock()
-	defer proxy.connTrackLock.Unlock()
-	for _, conn := range proxy.connTrackTable {
-		conn.Close()
+func (proxy *UDPProxy) Close() (err error) {
+	proxy.closeOnce.Do(func() {
+		proxy.cancel()
+		err = proxy.listener.Close()
+		for _, shard := range proxy.shards {
+			shard.lock.Lock()
+			for key, entry := range shard.table {
+				if key.from.Port() != 0 {
+					entry.conn.Close()
+				}
+			}
+			shard.lock.Unlock()
+		}
+	})
+	return err
+}
+
+// Done returns a channel which is closed when proxy stops receiving
+// datagrams.
+func (proxy *UDPProxy) Done() <-chan struct{} {
+	return proxy.done
+}
+
+// UDPStats is a snapshot of UDP proxy state for diagnostics.
+type UDPStats struct {
+	// Sessions is the number of tracked sessions.
+	Sessions int
+	// PendingDials is the number of sessions waiting for upstream socket.
+	PendingDials int64
+	// Queued is the number of datagrams waiting for workers.
+	Queued int
+}
+
+// Stats returns snapshot of proxy state.
+func (proxy *UDPProxy) Stats() UDPStats {
+	stats := UDPStats{
+		PendingDials: proxy.pendingDials.Load(),
+	}
+	for _, shard := range proxy.shards {
+		shard.lock.Lock()
+		stats.Sessions += len(shard.table) - shard.loose
+		shard.lock.Unlock()
+		stats.Queued += len(shard.queue)
 	}
+	return stats
+}
+
+// Err returns error which made proxy stop receiving datagrams. It's nil if
+// proxy is running or was closed.
+func (proxy *UDPProxy) Err() error {
+	select {
+	case <-proxy.done:
+		return proxy.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until proxy is stopped and all reply loops are finished.
+func (proxy *UDPProxy) Wait() {
+	<-proxy.done
+	proxy.replyLoops.Wait()
 }
 
 func isClosedError(err error) bool {
@@ -204,8 +510,6 @@ func isClosedError(err error) bool {
 	return strings.HasSuffix(err.Error(), "use of closed network connection")
 }
 
-func unmapUDPAddr(a *net.UDPAddr) *net.UDPAddr {
-	ap := a.AddrPort()
-	apu := netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
-	return net.UDPAddrFromAddrPort(apu)
+func unmapAddrPort(a netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
 }
@@ -0,0 +1,120 @@
+package tproxy
+
+import (
+	"bytes"
+	"context"
+	"hash/maphash"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestUDPLooseSession(t *testing.T) {
+	_, udpEcho := startEcho(t)
+	for _, tc := range []struct {
+		name  string
+		rules []PortRule
+		loose bool
+	}{
+		{"no rules", nil, false},
+		{"other port", []PortRule{{Domain: ".", Ports: []PortRange{{443, 443}}}}, false},
+		{"other domain", []PortRule{{Domain: "example.com", Ports: []PortRange{{0, 65535}}}}, false},
+		{"all domains", []PortRule{{Domain: ".", Ports: []PortRange{{0, 65535}}}}, true},
+		{"domain", []PortRule{{Domain: "0.1", Ports: []PortRange{{udpEcho.Port(), udpEcho.Port()}}}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := fakeConfig(udpEcho.Port())
+			cfg.LooseUDPRules = tc.rules
+			proxy, err := NewUDPProxy(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("can't start UDP proxy: %v", err)
+			}
+			defer proxy.Close()
+
+			// Second socket stands for the client after its port
+			// changed.
+			reply := make([]byte, UDPBufSize)
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("udp", proxy.Addr().String())
+				if err != nil {
+					t.Fatalf("can't connect to proxy: %v", err)
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				msg := []byte("hello")
+				if _, err := conn.Write(msg); err != nil {
+					t.Fatalf("write failed: %v", err)
+				}
+				n, err := conn.Read(reply)
+				if err != nil || !bytes.Equal(reply[:n], msg) {
+					t.Fatalf("unexpected echo: %q, %v", reply[:n], err)
+				}
+			}
+			expected := 2
+			if tc.loose {
+				expected = 1
+			}
+			if stats := proxy.Stats(); stats.Sessions != expected {
+				t.Errorf("client port change made %d sessions, expected %d", stats.Sessions, expected)
+			}
+		})
+	}
+}
+
+func TestUDPTrackKeyHash(t *testing.T) {
+	seed := maphash.MakeSeed()
+	key := connTrackKey{
+		from: netip.MustParseAddrPort("10.0.0.1:1000"),
+		to:   netip.MustParseAddrPort("172.24.0.1:53"),
+	}
+	other := key
+	other.from = netip.MustParseAddrPort("10.0.0.1:1001")
+	if key.hash(seed) != key.hash(seed) {
+		t.Error("hash of the same key changed")
+	}
+	if key.hash(seed) == other.hash(seed) {
+		t.Error("keys differing in port got the same hash")
+	}
+	if allocs := testing.AllocsPerRun(100, func() { key.hash(seed) }); allocs != 0 {
+		t.Errorf("hash made %v allocations", allocs)
+	}
+}
+
+func TestUDPDropReport(t *testing.T) {
+	proxy := new(UDPProxy)
+	now := time.Now()
+	if dropped, report := proxy.recordDrop(now); !report || dropped != 1 {
+		t.Fatalf("unexpected first report: %d, %v", dropped, report)
+	}
+	proxy.recordDrop(now.Add(time.Millisecond))
+	proxy.recordDrop(now.Add(2 * time.Millisecond))
+	if dropped, report := proxy.recordDrop(now.Add(shedLogInterval)); !report || dropped != 3 {
+		t.Fatalf("unexpected report: %d, %v", dropped, report)
+	}
+}
+
+func TestUDPSessionTimeout(t *testing.T) {
+	timeouts := udpTimeouts{short: 1, normal: 2, long: 3}
+	quic := make([]byte, 1200)
+	quic[0] = 0xc3
+	wireguard := make([]byte, 148)
+	wireguard[0] = 1
+	testCases := []struct {
+		name     string
+		to       string
+		first    []byte
+		expected time.Duration
+	}{
+		{"dns", "172.24.0.1:53", []byte{0, 1}, 1},
+		{"quic", "172.24.0.1:443", quic, 3},
+		{"short quic-like", "172.24.0.1:443", quic[:100], 2},
+		{"wireguard", "172.24.0.1:51820", wireguard, 3},
+		{"other", "172.24.0.1:9999", []byte("hello"), 2},
+	}
+	for _, tc := range testCases {
+		if got := timeouts.sessionTimeout(netip.MustParseAddrPort(tc.to), tc.first); got != tc.expected {
+			t.Errorf("%s: sessionTimeout = %d, expected %d", tc.name, got, tc.expected)
+		}
+	}
+}
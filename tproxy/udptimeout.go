@@ -0,0 +1,50 @@
+package tproxy
+
+import (
+	"net/netip"
+	"time"
+)
+
+const (
+	// DefaultUDPShortTimeout is used for request-response protocols like
+	// DNS and NTP.
+	DefaultUDPShortTimeout = 10 * time.Second
+	// DefaultUDPLongTimeout is used for long-living sessions like QUIC and
+	// WireGuard tunnels.
+	DefaultUDPLongTimeout = 180 * time.Second
+
+	quicMinInitialSize     = 1200
+	wireguardInitiationLen = 148
+)
+
+// shortUDPPorts are destination ports of request-response protocols.
+var shortUDPPorts = map[uint16]struct{}{
+	53:  {},
+	123: {},
+}
+
+type udpTimeouts struct {
+	short, normal, long time.Duration
+}
+
+// sessionTimeout guesses protocol of UDP session by its destination and
+// first datagram and returns idle timeout suitable for it.
+func (t udpTimeouts) sessionTimeout(to netip.AddrPort, first []byte) time.Duration {
+	if _, ok := shortUDPPorts[to.Port()]; ok {
+		return t.short
+	}
+	if isQUICInitial(first) || isWireguardInitiation(first) {
+		return t.long
+	}
+	return t.normal
+}
+
+// isQUICInitial reports if datagram looks like QUIC packet with long
+// header. Client initial datagrams are padded to at least 1200 bytes.
+func isQUICInitial(b []byte) bool {
+	return len(b) >= quicMinInitialSize && b[0]&0xc0 == 0xc0
+}
+
+func isWireguardInitiation(b []byte) bool {
+	return len(b) == wireguardInitiationLen && b[0] == 1 && b[1] == 0 && b[2] == 0 && b[3] == 0
+}